@@ -7,29 +7,60 @@ import (
 	"os"
 
 	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/executable"
 )
 
 func main() {
 	log.SetFlags(0)
 	filename := flag.String("f", "", "file to process")
 	debug := flag.Bool("d", false, "debug mode")
+	entry := flag.String("entry", "", "label of the entry point of the executable (default: the first instruction)")
+	output := flag.String("o", "", "write an executable with symbol and line tables into the given file")
 	flag.Parse()
 	if *filename == "" {
-		log.Fatal("usage: asm -f <assmebly-code-file>")
+		log.Fatal("usage: asm [-d] [-entry <label>] [-o <executable-file>] -f <assmebly-code-file>")
 	}
 	fp, err := os.Open(*filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer fp.Close()
+	if *output != "" {
+		writeExecutable(fp, *entry, *output)
+		return
+	}
+	var addr int
 	for instr := range asm.StartAssembler(fp) {
 		if instr.Error != nil {
 			log.Fatal(instr.Error)
 		}
+		for ; addr < int(instr.Address); addr++ {
+			fmt.Println("0000") // gap left by .org
+		}
 		fmt.Printf("%04x", instr.Instruction)
 		if *debug {
 			fmt.Printf("  # %d", instr.Lineno)
 		}
 		fmt.Println("")
+		addr++
+	}
+}
+
+// writeExecutable assembles the source read from fp and writes
+// the corresponding executable into the given file.
+func writeExecutable(fp *os.File, entry, filename string) {
+	exe, err := asm.NewExecutable(fp, entry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := executable.Write(out, exe); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,108 @@
+// Command difftest runs differential tests comparing the VM with the
+// reference interpreter of the difftest package.
+//
+// Usage:
+//
+//	difftest [-fast] [-n <programs>] [-seed <n>] [-size <n>] [-steps <n>] [-o <file>]
+//	difftest [-fast] [-steps <n>] -f <machine-code-file>
+//
+// The first form generates random programs, while the second form checks
+// the given program. When the VM diverges from the reference interpreter,
+// difftest prints the first diverging step, writes the program into the
+// file given by -o, if any, and exits with status 1.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"github.com/bassosimone/risc16/pkg/difftest"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+func main() {
+	log.SetFlags(0)
+	fast := flag.Bool("fast", false, "run the VM using Step rather than Fetch and Execute")
+	filename := flag.String("f", "", "program to check")
+	count := flag.Int("n", 1000, "number of random programs to check")
+	output := flag.String("o", "", "write the diverging program into the given file")
+	seed := flag.Int64("seed", 1, "seed of the random programs")
+	size := flag.Int("size", 64, "approximate number of instructions of each random program")
+	steps := flag.Uint64("steps", difftest.DefaultMaxSteps, "maximum number of steps per program")
+	flag.Parse()
+	opts := difftest.Options{MaxSteps: *steps}
+	if *fast {
+		opts.Step = (*vm.VM).Step
+	}
+	if *filename != "" {
+		check(loadProgram(*filename), opts, "")
+		log.Printf("difftest: %s: ok", *filename)
+		return
+	}
+	rng := rand.New(rand.NewSource(*seed))
+	for idx := 0; idx < *count; idx++ {
+		check(difftest.Generate(rng, *size), opts, *output)
+	}
+	log.Printf("difftest: %d random programs: ok", *count)
+}
+
+// check compares the VM with the reference interpreter running program
+// and exits on divergence, writing the program into output if not empty.
+func check(program []uint16, opts difftest.Options, output string) {
+	d := difftest.Compare(program, opts)
+	if d == nil {
+		return
+	}
+	fmt.Fprint(os.Stderr, d.String())
+	if output != "" {
+		writeProgram(program, output)
+		log.Printf("difftest: program written into %s", output)
+	}
+	os.Exit(1)
+}
+
+// writeProgram writes program into the given file using the format
+// of the assembler (i.e., one hexadecimal word per line).
+func writeProgram(program []uint16, filename string) {
+	fp, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(fp)
+	for _, word := range program {
+		fmt.Fprintf(bw, "%04x\n", word)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadProgram loads the machine code in the given file.
+func loadProgram(filename string) []uint16 {
+	fp, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	var program []uint16
+	for scanner.Scan() {
+		value, err := strconv.ParseUint(scanner.Text(), 16, 16)
+		if err != nil {
+			log.Fatal(err)
+		}
+		program = append(program, uint16(value))
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return program
+}
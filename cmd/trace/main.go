@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+
+	"github.com/bassosimone/risc16/pkg/trace"
+)
+
+func main() {
+	log.SetFlags(0)
+	filename := flag.String("f", "", "trace to read")
+	other := flag.String("diff", "", "trace to compare with")
+	flag.Parse()
+	if *filename == "" {
+		log.Fatal("usage: trace [-diff <trace-file>] -f <trace-file>")
+	}
+	reader := openTrace(*filename)
+	if *other != "" {
+		diff(reader, openTrace(*other))
+		return
+	}
+	writer := trace.NewJSONWriter(os.Stdout)
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writer.Write(rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openTrace opens a trace in any of the supported formats.
+func openTrace(filename string) *trace.Reader {
+	fp, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reader, err := trace.NewReader(fp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return reader
+}
+
+// diff prints the first record where the two traces differ and
+// exits with a nonzero status if the traces differ.
+func diff(left, right *trace.Reader) {
+	for {
+		lrec, lerr := left.Next()
+		rrec, rerr := right.Next()
+		if lerr != nil && !errors.Is(lerr, io.EOF) {
+			log.Fatal(lerr)
+		}
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			log.Fatal(rerr)
+		}
+		switch {
+		case lerr != nil && rerr != nil:
+			return
+		case lerr != nil:
+			log.Fatalf("trace: first trace ends before step %d", rrec.Step)
+		case rerr != nil:
+			log.Fatalf("trace: second trace ends before step %d", lrec.Step)
+		case !reflect.DeepEqual(normalize(lrec), normalize(rrec)):
+			fmt.Printf("- %+v\n+ %+v\n", *lrec, *rrec)
+			os.Exit(1)
+		}
+	}
+}
+
+// normalize makes records comparable using reflect.DeepEqual.
+func normalize(rec *trace.Record) *trace.Record {
+	out := *rec
+	if len(out.Registers) == 0 {
+		out.Registers = nil
+	}
+	if len(out.Memory) == 0 {
+		out.Memory = nil
+	}
+	return &out
+}
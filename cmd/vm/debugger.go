@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/reverse"
+	"github.com/bassosimone/risc16/pkg/vm"
+	"github.com/bassosimone/risc16/pkg/watch"
+)
+
+// breakpoint is a debugger breakpoint.
+type breakpoint struct {
+	id        int
+	addr      uint16
+	temporary bool
+}
+
+// debugger is the interactive debugger. It drives the VM
+// using the step function, which executes one instruction, and
+// uses the undo log, if not nil, to execute backwards.
+type debugger struct {
+	breaks   map[uint16]*breakpoint
+	halted   bool
+	labels   map[string]int64
+	last     string
+	machine  *vm.VM
+	nextID   int
+	out      io.Writer
+	step     func() error
+	undo     *reverse.Log
+	watchIDs map[*watch.Watchpoint]int
+	watches  *watch.Set
+}
+
+// debuggerCommand is a command understood by the debugger. The
+// function returns true when the debugger should quit.
+type debuggerCommand func(d *debugger, args []string) (bool, error)
+
+// debuggerCommands maps each command name to its implementation.
+var debuggerCommands map[string]debuggerCommand
+
+func init() {
+	debuggerCommands = map[string]debuggerCommand{
+		"b":                (*debugger).cmdBreak,
+		"break":            (*debugger).cmdBreak,
+		"c":                (*debugger).cmdContinue,
+		"continue":         (*debugger).cmdContinue,
+		"d":                (*debugger).cmdDelete,
+		"delete":           (*debugger).cmdDelete,
+		"disas":            (*debugger).cmdDisas,
+		"finish":           (*debugger).cmdFinish,
+		"h":                (*debugger).cmdHelp,
+		"help":             (*debugger).cmdHelp,
+		"i":                (*debugger).cmdInfo,
+		"info":             (*debugger).cmdInfo,
+		"p":                (*debugger).cmdPrint,
+		"print":            (*debugger).cmdPrint,
+		"q":                (*debugger).cmdQuit,
+		"quit":             (*debugger).cmdQuit,
+		"rc":               (*debugger).cmdReverseContinue,
+		"reverse-continue": (*debugger).cmdReverseContinue,
+		"reverse-step":     (*debugger).cmdReverseStep,
+		"rs":               (*debugger).cmdReverseStep,
+		"s":                (*debugger).cmdStep,
+		"set":              (*debugger).cmdSet,
+		"step":             (*debugger).cmdStep,
+		"tbreak":           (*debugger).cmdTbreak,
+		"watch":            (*debugger).cmdWatch,
+		"x":                (*debugger).cmdExamine,
+	}
+}
+
+// repeatableCommands contains the commands that an empty line repeats.
+var repeatableCommands = map[string]bool{
+	"c": true, "continue": true, "s": true, "step": true, "x": true,
+}
+
+const debuggerHelp = `commands:
+  break|b LOC           set a breakpoint at LOC (address or label)
+  tbreak LOC            set a temporary breakpoint at LOC
+  watch SPEC            stop when LOC[:LEN][:r|w|rw][=VALUE] or rN[=VALUE]
+                        is accessed (e.g., 'watch buf:4:w', 'watch r3=0')
+  delete|d [ID...]      delete the given breakpoints and watchpoints (all
+                        if no ID)
+  step|s [N]            execute N instructions (default: 1)
+  continue|c            run until a breakpoint or halt
+  finish                run until the current subroutine returns
+  reverse-step|rs [N]   undo N instructions (default: 1)
+  reverse-continue|rc   run backwards until a breakpoint or a watched
+                        value changes
+  print|p [REG...]      print registers (r0-r7, pc; all if no REG)
+  x LOC [N]             examine N memory words starting at LOC
+  disas [LOC] [N]       disassemble N instructions starting at LOC
+  set REG VALUE         set register r0-r7 or pc to VALUE
+  set mem LOC VALUE     set memory word at LOC to VALUE
+  info|i breakpoints|registers|watchpoints
+  help|h                show this help
+  quit|q                exit the debugger
+an empty line repeats the last step, continue, or x command
+`
+
+// newDebugger creates a new debugger instance.
+func newDebugger(machine *vm.VM, labels map[string]int64, step func() error,
+	undo *reverse.Log, watches *watch.Set, out io.Writer) *debugger {
+	d := &debugger{
+		breaks:   make(map[uint16]*breakpoint),
+		labels:   labels,
+		machine:  machine,
+		nextID:   1,
+		out:      out,
+		step:     step,
+		undo:     undo,
+		watchIDs: make(map[*watch.Watchpoint]int),
+		watches:  watches,
+	}
+	watches.OnHit = d.watchpointHit
+	for _, w := range watches.Watchpoints() {
+		d.watchIDs[w] = d.nextID
+		d.nextID++
+	}
+	return d
+}
+
+// run runs the debugger command loop reading commands from r. The
+// program may read from r as well, e.g., using the console device.
+func (d *debugger) run(r *bufio.Reader) error {
+	d.where()
+	for {
+		fmt.Fprint(d.out, "(vm) ")
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			fmt.Fprintln(d.out, "")
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = d.last
+		}
+		args := strings.Fields(line)
+		if len(args) < 1 {
+			continue
+		}
+		d.last = ""
+		if repeatableCommands[args[0]] {
+			d.last = line
+		}
+		cmd := debuggerCommands[args[0]]
+		if cmd == nil {
+			fmt.Fprintf(d.out, "unknown command '%s'; try 'help'\n", args[0])
+			continue
+		}
+		quit, err := cmd(d, args[1:])
+		if err != nil {
+			fmt.Fprintf(d.out, "error: %s\n", err.Error())
+			continue
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// errDebuggerSyntax indicates that a command has the wrong syntax.
+var errDebuggerSyntax = errors.New("invalid syntax; try 'help'")
+
+// parseLocation parses an address or a label.
+func (d *debugger) parseLocation(s string) (uint16, error) {
+	if value, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return uint16(value), nil
+	}
+	if value, found := d.labels[s]; found {
+		return uint16(value), nil
+	}
+	return 0, fmt.Errorf("no such address or label: '%s'", s)
+}
+
+// parseValue parses a value that may be negative or a label.
+func (d *debugger) parseValue(s string) (uint16, error) {
+	if value, err := strconv.ParseInt(s, 0, 32); err == nil {
+		if value < -(1<<15) || value > (1<<16)-1 {
+			return 0, fmt.Errorf("value out of range: '%s'", s)
+		}
+		return uint16(value), nil
+	}
+	return d.parseLocation(s)
+}
+
+// parseCount parses an optional count argument.
+func parseCount(args []string, idx int) (int, error) {
+	if len(args) <= idx {
+		return 1, nil
+	}
+	count, err := strconv.Atoi(args[idx])
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid count: '%s'", args[idx])
+	}
+	return count, nil
+}
+
+// symbolize returns a description of addr based on the closest
+// label that precedes addr, if any, or the empty string.
+func (d *debugger) symbolize(addr uint16) string {
+	var (
+		best  string
+		found bool
+		where int64
+	)
+	for name, value := range d.labels {
+		if value > int64(addr) || (found && value < where) {
+			continue
+		}
+		if found && value == where && name > best {
+			continue // be deterministic with aliases
+		}
+		best, found, where = name, true, value
+	}
+	if !found {
+		return ""
+	}
+	if where == int64(addr) {
+		return fmt.Sprintf("<%s>", best)
+	}
+	return fmt.Sprintf("<%s+%d>", best, int64(addr)-where)
+}
+
+// describe describes the instruction at the given address.
+func (d *debugger) describe(addr uint16) string {
+	instr := d.machine.Memory()[addr]
+	return fmt.Sprintf("%5d %-12s %04x  %s", addr, d.symbolize(addr), instr,
+		vm.Disassemble(instr))
+}
+
+// where prints the next instruction to execute.
+func (d *debugger) where() {
+	fmt.Fprintf(d.out, "=> %s\n", d.describe(d.machine.PC))
+}
+
+// stepOnce executes a single instruction. It returns true when the
+// machine has halted or an exception has occurred.
+func (d *debugger) stepOnce() bool {
+	if d.halted {
+		return true
+	}
+	if err := d.step(); err != nil {
+		d.halted = true
+		if errors.Is(err, vm.ErrHalted) {
+			fmt.Fprintln(d.out, "program halted")
+			return true
+		}
+		fmt.Fprintf(d.out, "program stopped: %s\n", err.Error())
+		return true
+	}
+	return false
+}
+
+// breakpointHit returns true if there is a breakpoint at the current
+// PC. As a side effect, it removes temporary breakpoints.
+func (d *debugger) breakpointHit() bool {
+	bp := d.breaks[d.machine.PC]
+	if bp == nil {
+		return false
+	}
+	fmt.Fprintf(d.out, "breakpoint %d at %d %s\n", bp.id, bp.addr, d.symbolize(bp.addr))
+	if bp.temporary {
+		delete(d.breaks, bp.addr)
+	}
+	return true
+}
+
+// runUntil executes instructions until stop returns true, a breakpoint
+// is hit, or the machine halts. Before each instruction, runUntil invokes
+// stop passing it the instruction that is about to be executed.
+func (d *debugger) runUntil(stop func(instr uint16) bool) {
+	if d.halted {
+		fmt.Fprintln(d.out, "the program is not running")
+		return
+	}
+	// always make progress even if we're sitting on a breakpoint
+	for first := true; ; first = false {
+		if !first && d.breakpointHit() {
+			break
+		}
+		instr := d.machine.Memory()[d.machine.PC]
+		if stop(instr) {
+			break
+		}
+		if d.stepOnce() {
+			return
+		}
+		if d.watches.Triggered() {
+			break
+		}
+	}
+	d.where()
+}
+
+// watchpointHit reports a triggered watchpoint.
+func (d *debugger) watchpointHit(hit watch.Hit) {
+	fmt.Fprintf(d.out, "watchpoint %d: %s\n", d.watchIDs[hit.Watchpoint], hit)
+}
+
+// watchedValue is the value of a location watched for writes.
+type watchedValue struct {
+	id    int
+	where string
+	value uint16
+}
+
+// watchedValues returns the values of the locations watched for writes.
+func (d *debugger) watchedValues() []watchedValue {
+	var out []watchedValue
+	for _, w := range d.watches.Watchpoints() {
+		id := d.watchIDs[w]
+		if w.Register {
+			out = append(out, watchedValue{id, fmt.Sprintf("r%d", w.Addr), d.machine.GPR[w.Addr]})
+			continue
+		}
+		if w.Access&watch.Write == 0 {
+			continue
+		}
+		for off := uint32(0); off < uint32(w.Len) || off == 0; off++ {
+			addr := uint16(uint32(w.Addr) + off)
+			out = append(out, watchedValue{id, fmt.Sprintf("M[%d]", addr), d.machine.Memory()[addr]})
+		}
+	}
+	return out
+}
+
+func (d *debugger) addBreakpoint(args []string, temporary bool) (bool, error) {
+	if len(args) != 1 {
+		return false, errDebuggerSyntax
+	}
+	addr, err := d.parseLocation(args[0])
+	if err != nil {
+		return false, err
+	}
+	bp := &breakpoint{id: d.nextID, addr: addr, temporary: temporary}
+	d.nextID++
+	d.breaks[addr] = bp
+	fmt.Fprintf(d.out, "breakpoint %d at %d %s\n", bp.id, addr, d.symbolize(addr))
+	return false, nil
+}
+
+func (d *debugger) cmdBreak(args []string) (bool, error) {
+	return d.addBreakpoint(args, false)
+}
+
+func (d *debugger) cmdTbreak(args []string) (bool, error) {
+	return d.addBreakpoint(args, true)
+}
+
+func (d *debugger) cmdWatch(args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, errDebuggerSyntax
+	}
+	w, err := watch.Parse(args[0], func(name string) (uint16, bool) {
+		value, found := d.labels[name]
+		return uint16(value), found
+	})
+	if err != nil {
+		return false, err
+	}
+	d.watches.Add(w)
+	d.watchIDs[w] = d.nextID
+	fmt.Fprintf(d.out, "watchpoint %d: %s\n", d.nextID, w)
+	d.nextID++
+	return false, nil
+}
+
+func (d *debugger) cmdDelete(args []string) (bool, error) {
+	if len(args) < 1 {
+		d.breaks = make(map[uint16]*breakpoint)
+		for w := range d.watchIDs {
+			d.watches.Remove(w)
+		}
+		d.watchIDs = make(map[*watch.Watchpoint]int)
+		return false, nil
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return false, fmt.Errorf("invalid breakpoint ID: '%s'", arg)
+		}
+		var found bool
+		for addr, bp := range d.breaks {
+			if bp.id == id {
+				delete(d.breaks, addr)
+				found = true
+			}
+		}
+		for w, wid := range d.watchIDs {
+			if wid == id {
+				d.watches.Remove(w)
+				delete(d.watchIDs, w)
+				found = true
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("no such breakpoint: %d", id)
+		}
+	}
+	return false, nil
+}
+
+func (d *debugger) cmdStep(args []string) (bool, error) {
+	if len(args) > 1 {
+		return false, errDebuggerSyntax
+	}
+	count, err := parseCount(args, 0)
+	if err != nil {
+		return false, err
+	}
+	d.runUntil(func(instr uint16) bool {
+		count--
+		return count < 0
+	})
+	return false, nil
+}
+
+func (d *debugger) cmdContinue(args []string) (bool, error) {
+	if len(args) != 0 {
+		return false, errDebuggerSyntax
+	}
+	d.runUntil(func(instr uint16) bool {
+		return false
+	})
+	return false, nil
+}
+
+// errNoReverse indicates that reverse execution is disabled.
+var errNoReverse = errors.New("reverse execution is disabled")
+
+func (d *debugger) cmdReverseStep(args []string) (bool, error) {
+	if len(args) > 1 {
+		return false, errDebuggerSyntax
+	}
+	count, err := parseCount(args, 0)
+	if err != nil {
+		return false, err
+	}
+	if d.undo == nil {
+		return false, errNoReverse
+	}
+	undone := d.undo.StepBack(count)
+	if undone > 0 {
+		d.halted = false
+	}
+	if undone < count {
+		fmt.Fprintln(d.out, "reached the beginning of the history")
+	}
+	d.where()
+	return false, nil
+}
+
+func (d *debugger) cmdReverseContinue(args []string) (bool, error) {
+	if len(args) != 0 {
+		return false, errDebuggerSyntax
+	}
+	if d.undo == nil {
+		return false, errNoReverse
+	}
+	values := d.watchedValues()
+	undone, stopped := d.undo.ReverseContinue(func() bool {
+		current := d.watchedValues()
+		for idx := range current {
+			if current[idx].value != values[idx].value {
+				fmt.Fprintf(d.out, "watchpoint %d: %s changed from %d to %d at %d (%s)\n",
+					current[idx].id, current[idx].where, current[idx].value,
+					values[idx].value, d.machine.PC,
+					vm.Disassemble(d.machine.Memory()[d.machine.PC]))
+				return true
+			}
+		}
+		values = current
+		return d.breakpointHit()
+	})
+	if undone > 0 {
+		d.halted = false
+	}
+	if !stopped {
+		fmt.Fprintln(d.out, "reached the beginning of the history")
+	}
+	d.where()
+	return false, nil
+}
+
+// isCall returns true if instr is a JALR saving the return address.
+func isCall(instr uint16) bool {
+	ra := (instr >> 10) & 0b0111
+	return instr>>13 == vm.OpcodeJALR && ra != 0
+}
+
+// isReturn returns true if instr is a JALR not saving the return address
+// and which is not a special instruction (e.g., HALT).
+func isReturn(instr uint16) bool {
+	ra, rb := (instr>>10)&0b0111, (instr>>7)&0b0111
+	return instr>>13 == vm.OpcodeJALR && ra == 0 && rb != 0
+}
+
+func (d *debugger) cmdFinish(args []string) (bool, error) {
+	if len(args) != 0 {
+		return false, errDebuggerSyntax
+	}
+	var (
+		depth     int
+		returning bool
+	)
+	d.runUntil(func(instr uint16) bool {
+		if returning {
+			return true // we've executed the return
+		}
+		switch {
+		case isCall(instr):
+			depth++
+		case isReturn(instr):
+			depth--
+			returning = depth < 0
+		}
+		return false
+	})
+	return false, nil
+}
+
+func (d *debugger) printRegister(name string) error {
+	switch name {
+	case "pc":
+		fmt.Fprintf(d.out, "pc  %6d  0x%04x  %s\n", d.machine.PC, d.machine.PC,
+			d.symbolize(d.machine.PC))
+		return nil
+	case "r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7":
+		idx, _ := strconv.Atoi(name[1:])
+		value := d.machine.GPR[idx]
+		fmt.Fprintf(d.out, "%-3s %6d  0x%04x  %d\n", name, value, value, int16(value))
+		return nil
+	default:
+		return fmt.Errorf("no such register: '%s'", name)
+	}
+}
+
+func (d *debugger) cmdPrint(args []string) (bool, error) {
+	if len(args) < 1 {
+		args = []string{"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "pc"}
+	}
+	for _, arg := range args {
+		if err := d.printRegister(arg); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (d *debugger) cmdExamine(args []string) (bool, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return false, errDebuggerSyntax
+	}
+	addr, err := d.parseLocation(args[0])
+	if err != nil {
+		return false, err
+	}
+	count, err := parseCount(args, 1)
+	if err != nil {
+		return false, err
+	}
+	for ; count > 0; count-- {
+		value := d.machine.Memory()[addr]
+		fmt.Fprintf(d.out, "%5d %-12s %04x  %6d\n", addr, d.symbolize(addr),
+			value, int16(value))
+		addr++
+	}
+	return false, nil
+}
+
+func (d *debugger) cmdDisas(args []string) (bool, error) {
+	if len(args) > 2 {
+		return false, errDebuggerSyntax
+	}
+	addr := d.machine.PC
+	if len(args) > 0 {
+		var err error
+		if addr, err = d.parseLocation(args[0]); err != nil {
+			return false, err
+		}
+	}
+	count := 10
+	if len(args) > 1 {
+		var err error
+		if count, err = parseCount(args, 1); err != nil {
+			return false, err
+		}
+	}
+	for ; count > 0; count-- {
+		prefix := "  "
+		if addr == d.machine.PC {
+			prefix = "=>"
+		}
+		fmt.Fprintf(d.out, "%s %s\n", prefix, d.describe(addr))
+		addr++
+	}
+	return false, nil
+}
+
+// modify calls change, which modifies the machine state, recording
+// the change into the undo log, if any, so that it can be undone.
+func (d *debugger) modify(change func()) {
+	if d.undo == nil {
+		change()
+		return
+	}
+	d.undo.Record(func() error {
+		change()
+		return nil
+	})
+}
+
+func (d *debugger) cmdSet(args []string) (bool, error) {
+	if len(args) == 3 && args[0] == "mem" {
+		addr, err := d.parseLocation(args[1])
+		if err != nil {
+			return false, err
+		}
+		value, err := d.parseValue(args[2])
+		if err != nil {
+			return false, err
+		}
+		d.modify(func() {
+			d.machine.Store(addr, value)
+		})
+		return false, nil
+	}
+	if len(args) != 2 {
+		return false, errDebuggerSyntax
+	}
+	value, err := d.parseValue(args[1])
+	if err != nil {
+		return false, err
+	}
+	switch args[0] {
+	case "pc":
+		d.modify(func() {
+			d.machine.PC = value
+		})
+		d.where()
+		return false, nil
+	case "r1", "r2", "r3", "r4", "r5", "r6", "r7":
+		idx, _ := strconv.Atoi(args[0][1:])
+		d.modify(func() {
+			d.machine.GPR[idx] = value
+		})
+		return false, nil
+	case "r0":
+		return false, errors.New("r0 is always zero")
+	default:
+		return false, fmt.Errorf("no such register: '%s'", args[0])
+	}
+}
+
+func (d *debugger) cmdInfo(args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, errDebuggerSyntax
+	}
+	switch args[0] {
+	case "b", "breakpoints":
+		var bps []*breakpoint
+		for _, bp := range d.breaks {
+			bps = append(bps, bp)
+		}
+		sort.Slice(bps, func(i, j int) bool {
+			return bps[i].id < bps[j].id
+		})
+		for _, bp := range bps {
+			kind := "break"
+			if bp.temporary {
+				kind = "tbreak"
+			}
+			fmt.Fprintf(d.out, "%3d %-6s %5d %s\n", bp.id, kind, bp.addr,
+				d.symbolize(bp.addr))
+		}
+		return false, nil
+	case "r", "registers":
+		return d.cmdPrint(nil)
+	case "w", "watchpoints":
+		for _, w := range d.watches.Watchpoints() {
+			fmt.Fprintf(d.out, "%3d %-6s %s\n", d.watchIDs[w], "watch", w)
+		}
+		return false, nil
+	default:
+		return false, errDebuggerSyntax
+	}
+}
+
+func (d *debugger) cmdHelp(args []string) (bool, error) {
+	fmt.Fprint(d.out, debuggerHelp)
+	return false, nil
+}
+
+func (d *debugger) cmdQuit(args []string) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/reverse"
+	"github.com/bassosimone/risc16/pkg/vm"
+	"github.com/bassosimone/risc16/pkg/watch"
+)
+
+// runDebugger runs the debugger on machine with the given commands
+// and returns the debugger along with its output.
+func runDebugger(t *testing.T, machine *vm.VM, commands string) (*debugger, string) {
+	undo := reverse.New(machine, 100)
+	watches := watch.New(machine, nil)
+	var out strings.Builder
+	d := newDebugger(machine, map[string]int64{}, undo.Step, undo, watches, &out)
+	if err := d.run(bufio.NewReader(strings.NewReader(commands))); err != nil {
+		t.Fatal(err)
+	}
+	return d, out.String()
+}
+
+func TestDebuggerSetMemIsUndoable(t *testing.T) {
+	machine := new(vm.VM)
+	_, out := runDebugger(t, machine, "set mem 100 7\nx 100\nrs\nx 100\n")
+	if !strings.Contains(out, "  100              0007") {
+		t.Fatalf("set mem did not change the memory:\n%s", out)
+	}
+	if machine.M[100] != 0 {
+		t.Fatalf("reverse-step did not undo set mem:\n%s", out)
+	}
+}
+
+func TestDebuggerSetMemNotifiesWatchpoints(t *testing.T) {
+	machine := new(vm.VM)
+	_, out := runDebugger(t, machine, "watch 100:w\nset mem 100 7\n")
+	if !strings.Contains(out, "watchpoint") {
+		t.Fatalf("set mem did not trigger the watchpoint:\n%s", out)
+	}
+}
+
+func TestDebuggerEmptyLineRepeats(t *testing.T) {
+	machine := new(vm.VM) // executes NOPs
+	_, _ = runDebugger(t, machine, "s\n\n\n")
+	if machine.PC != 3 {
+		t.Fatalf("expected PC=3 after repeating step, got %d", machine.PC)
+	}
+	d, _ := runDebugger(t, new(vm.VM), "break 5\n\n")
+	if len(d.breaks) != 1 {
+		t.Fatalf("an empty line repeated break: %d breakpoints", len(d.breaks))
+	}
+	machine = new(vm.VM)
+	_, _ = runDebugger(t, machine, "set r1 3\n\nrs\n")
+	if machine.GPR[1] != 0 {
+		t.Fatalf("an empty line repeated set: r1=%d", machine.GPR[1])
+	}
+}
@@ -2,59 +2,692 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
-	"fmt"
+	"image"
+	"io"
 	"log"
+	"math/rand"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/bpred"
+	"github.com/bassosimone/risc16/pkg/cache"
+	"github.com/bassosimone/risc16/pkg/coverage"
+	"github.com/bassosimone/risc16/pkg/executable"
+	"github.com/bassosimone/risc16/pkg/framebuffer"
+	"github.com/bassosimone/risc16/pkg/gdbstub"
+	"github.com/bassosimone/risc16/pkg/multicore"
+	"github.com/bassosimone/risc16/pkg/pipeline"
+	"github.com/bassosimone/risc16/pkg/profile"
+	"github.com/bassosimone/risc16/pkg/reverse"
+	"github.com/bassosimone/risc16/pkg/trace"
 	"github.com/bassosimone/risc16/pkg/vm"
+	"github.com/bassosimone/risc16/pkg/watch"
 )
 
 func main() {
 	log.SetFlags(0)
+	os.Exit(run())
+}
+
+// run runs the program and returns the exit status. We return the status,
+// rather than calling os.Exit or log.Fatal, so that the deferred functions
+// (e.g., printing statistics or saving a snapshot) run on every path.
+func run() int {
+	bpredName := flag.String("bpred", "", "simulate the given branch predictor (static, btfn, 1bit, 2bit, or gshare)")
+	coverageFile := flag.String("coverage", "", "write the line and branch coverage of the -s source into the given LCOV file")
+	coverageListing := flag.String("coverage-listing", "", "write the -s source annotated with the coverage into the given file")
+	cores := flag.Int("cores", 1, "run the program on the given number of cores sharing the memory")
 	debug := flag.Bool("d", false, "enable debugging")
-	filename := flag.String("f", "", "file to run")
+	diskFile := flag.String("disk", "", "attach a disk backed by the given file")
+	filename := flag.String("f", "", "executable or machine code file to run")
+	fbPattern := flag.String("fb", "", "attach a framebuffer and write its frames into the given PNG or PPM files (e.g., out%03d.png)")
+	cacheSpec := flag.String("cache", "", "simulate the given cache hierarchy (e.g., i=64x1x4,d=32x2x4:lru:wb,l2=128x4x8)")
+	cacheTrace := flag.Bool("cache-trace", false, "log each cache access")
+	pipelined := flag.Bool("pipeline", false, "run on the pipeline model and verify it")
+	paging := flag.Bool("paging", false, "enable paged virtual memory in user mode")
+	gdb := flag.String("gdb", "", "serve GDB on the given TCP address (or '-' for stdio)")
+	quantum := flag.Int("quantum", multicore.DefaultQuantum, "number of instructions that each core executes before switching core")
+	seed := flag.Int64("seed", 0, "shuffle the order of the cores using the given seed (0 means round robin)")
+	profileFile := flag.String("profile", "", "profile the execution, print a report, and write a pprof profile into the given file")
+	restore := flag.String("restore", "", "restore the machine state from the given snapshot")
+	saveOnHalt := flag.String("save-on-halt", "", "save a snapshot of the machine state into the given file when the execution stops")
+	maxInstructions := flag.Uint64("max-instructions", 0, "stop after executing the given number of instructions")
+	source := flag.String("s", "", "assembly source from which to load labels")
+	traceFile := flag.String("trace", "", "write an execution trace into the given file")
+	traceFormat := flag.String("trace-format", "jsonl", "format of the execution trace (jsonl or bin)")
+	undoLimit := flag.Int("undo", 100000, "number of instructions that the debugger can undo (0 disables reverse execution)")
+	timeout := flag.Duration("timeout", 0, "stop after the given wall-clock time (e.g., 10s)")
 	verbose := flag.Bool("v", false, "be verbose")
+	var watchSpecs stringList
+	flag.Var(&watchSpecs, "watch", "report accesses to LOC[:LEN][:r|w|rw][=VALUE] or rN[=VALUE] (may be repeated)")
+	watchStop := flag.Bool("watch-stop", false, "stop when a watchpoint triggers")
 	flag.Parse()
-	if *filename == "" {
-		log.Fatal("usage: vm [-d] [-v] -f <machine-code-file>")
+	if (*filename == "") == (*restore == "") {
+		log.Print("usage: vm [-bpred <predictor>] [-cache <spec>] [-cache-trace] [-coverage <lcov-file>] [-coverage-listing <file>] [-cores <n> [-quantum <n>] [-seed <n>]] [-d] [-disk <file>] [-fb <pattern>] [-gdb <address>] [-max-instructions <n>] [-paging] [-pipeline] [-profile <pprof-file>] [-v] [-s <assembly-code-file>] [-save-on-halt <snapshot-file>] [-timeout <duration>] [-trace <file>] [-trace-format jsonl|bin] [-undo <n>] [-watch <spec>]... [-watch-stop] -f <machine-code-file>|-restore <snapshot-file>")
+		return 1
+	}
+	if *pipelined {
+		for _, name := range []string{"coverage", "coverage-listing", "profile", "trace", "watch"} {
+			if isFlagSet(name) {
+				log.Printf("vm: -%s is not supported with -pipeline", name)
+				return 1
+			}
+		}
+	}
+	if (*coverageFile != "" || *coverageListing != "") && *source == "" {
+		log.Print("vm: -coverage requires -s")
+		return 1
+	}
+	if *cores > 1 {
+		return runMulticore(*filename, *cores, *quantum, *seed, vm.RunOptions{
+			MaxInstructions: *maxInstructions,
+			Timeout:         *timeout,
+		})
+	}
+	// Set up the machine, without producing any output, so that we
+	// can bail out before deferring the functions writing the results.
+	machine := new(vm.VM)
+	var exe *executable.Executable
+	if *filename != "" {
+		var err error
+		if exe, err = readProgram(*filename); err == nil {
+			err = loadProgram(machine, exe, *pipelined || *restore != "")
+		}
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	var console *vm.Console
+	if *gdb == "-" {
+		// stdin and stdout carry the GDB protocol
+		console = vm.NewConsole(vm.ConsoleBase, strings.NewReader(""), os.Stderr)
+	} else {
+		console = vm.NewConsole(vm.ConsoleBase, stdin, os.Stdout)
+	}
+	if err := machine.Attach(console); err != nil {
+		log.Print(err)
+		return 1
+	}
+	registerSyscalls(machine, console)
+	defer console.Flush()
+	if *diskFile != "" {
+		closeDisk, err := attachDisk(machine, *diskFile)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer closeDisk()
+	}
+	var closeFramebuffer func()
+	if *fbPattern != "" {
+		var err error
+		if closeFramebuffer, err = attachFramebuffer(machine, *fbPattern); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if *restore != "" {
+		if err := restoreSnapshot(machine, *restore); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if *paging {
+		machine.Paging = true
+	}
+	var hierarchy *cache.Hierarchy
+	if *cacheSpec != "" {
+		var err error
+		if hierarchy, err = cache.ParseHierarchy(*cacheSpec); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	var tracker *bpred.Tracker
+	if *bpredName != "" {
+		predictor, err := bpred.New(*bpredName)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		tracker = bpred.NewTracker(predictor)
+	}
+	labels := make(map[string]int64)
+	if *source != "" {
+		var err error
+		if labels, err = loadLabels(*source); err != nil {
+			log.Print(err)
+			return 1
+		}
+	} else if exe != nil {
+		for name, addr := range exe.Symbols {
+			labels[name] = int64(addr)
+		}
+	}
+	var covered *coverage.Source
+	if *coverageFile != "" || *coverageListing != "" {
+		var err error
+		if covered, err = loadSource(*source, exe); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	watches := watch.New(machine, func(hit watch.Hit) {
+		log.Printf("watch: %s", hit)
+		if *watchStop {
+			machine.RequestStop()
+		}
+	})
+	for _, spec := range watchSpecs {
+		w, err := watch.Parse(spec, func(name string) (uint16, bool) {
+			value, found := labels[name]
+			return uint16(value), found
+		})
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		watches.Add(w)
+	}
+	// Start collecting and writing the results.
+	if closeFramebuffer != nil {
+		defer closeFramebuffer()
+	}
+	if *saveOnHalt != "" {
+		defer saveSnapshot(machine, *saveOnHalt)
+	}
+	if hierarchy != nil {
+		if *cacheTrace {
+			hierarchy.SetTrace(func(ev cache.Event) {
+				log.Printf("cache: %s", ev)
+			})
+		}
+		hierarchy.Attach(machine)
+		defer printCacheStats(hierarchy)
+	}
+	if tracker != nil {
+		defer printBranchStats(tracker)
+	}
+	if *traceFile != "" {
+		stopTrace, err := startTrace(machine, *traceFile, *traceFormat)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer stopTrace()
+	}
+	if *profileFile != "" {
+		var symbols *profile.Symbols
+		if len(labels) > 0 {
+			symbols = profile.NewSymbols(labels)
+		}
+		defer writeProfile(profile.New(machine, symbols), *profileFile, *source)
+	}
+	if covered != nil {
+		defer writeCoverage(coverage.New(machine, covered), *coverageFile, *coverageListing)
+	}
+	if *pipelined {
+		if err := runPipeline(machine, tracker, *verbose); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if *verbose {
+		machine.AddObserver(&verboseObserver{machine: machine})
+	}
+	if tracker != nil {
+		tracker.Attach(machine)
+	}
+	step := machine.Step
+	var undo *reverse.Log
+	if (*gdb != "" || *debug) && *undoLimit > 0 {
+		undo = reverse.New(machine, *undoLimit)
+		step = undo.Step
+	}
+	if *gdb != "" || *debug {
+		// make the program output immediately visible
+		runStep := step
+		step = func() error {
+			defer console.Flush()
+			return runStep()
+		}
+	}
+	if *gdb != "" {
+		if err := serveGDB(machine, step, undo, *gdb); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if *debug {
+		dbg := newDebugger(machine, labels, step, undo, watches, os.Stdout)
+		if err := dbg.run(stdin); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	result := machine.Run(ctx, vm.RunOptions{
+		MaxInstructions: *maxInstructions,
+		Timeout:         *timeout,
+	})
+	if result.Reason == vm.StopHalted {
+		return 0
+	}
+	console.Flush()
+	var exit exitError
+	if errors.As(result.Err, &exit) {
+		return exit.status
+	}
+	log.Printf("%s (after %d instructions)", result.Err, result.Instructions)
+	return 1
+}
+
+// isFlagSet returns whether the given flag was set on the command line.
+func isFlagSet(name string) (found bool) {
+	flag.Visit(func(f *flag.Flag) {
+		found = found || f.Name == name
+	})
+	return
+}
+
+// multicoreFlags contains the flags supported with -cores.
+var multicoreFlags = map[string]bool{
+	"cores": true, "f": true, "max-instructions": true, "quantum": true,
+	"seed": true, "timeout": true,
+}
+
+// runMulticore runs the program in the given file on a multi-core
+// system and returns the exit status.
+func runMulticore(filename string, cores, quantum int, seed int64, opts vm.RunOptions) int {
+	var unsupported []string
+	flag.Visit(func(f *flag.Flag) {
+		if !multicoreFlags[f.Name] {
+			unsupported = append(unsupported, f.Name)
+		}
+	})
+	if len(unsupported) > 0 {
+		log.Printf("vm: -%s is not supported with -cores", unsupported[0])
+		return 1
+	}
+	if filename == "" {
+		log.Print("vm: -cores requires -f")
+		return 1
+	}
+	system := multicore.New(cores)
+	system.Quantum = quantum
+	if seed != 0 {
+		system.Rand = rand.New(rand.NewSource(seed))
+	}
+	exe, err := readProgram(filename)
+	if err == nil {
+		err = loadProgram(system.Cores[0], exe, true)
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	for _, core := range system.Cores {
+		core.PC = system.Cores[0].PC
+	}
+	console := vm.NewConsole(vm.ConsoleBase, bufio.NewReader(os.Stdin), os.Stdout)
+	defer console.Flush()
+	for _, core := range system.Cores {
+		if err := core.Attach(console); err != nil {
+			log.Print(err)
+			return 1
+		}
+		registerSyscalls(core, console)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	result := system.Run(ctx, opts)
+	if result.Reason == vm.StopHalted {
+		return 0
+	}
+	console.Flush()
+	var exit exitError
+	if errors.As(result.Err, &exit) {
+		return exit.status
+	}
+	if result.Core >= 0 {
+		log.Printf("core %d: %s (after %d instructions)", result.Core, result.Err, result.Instructions)
+	} else {
+		log.Printf("%s (after %d instructions)", result.Err, result.Instructions)
+	}
+	return 1
+}
+
+// stringList is a flag.Value collecting repeated string flags.
+type stringList []string
+
+// String implements flag.Value.String.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value.Set.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// verboseObserver logs the state of the VM before each instruction.
+type verboseObserver struct {
+	vm.NopObserver
+	machine *vm.VM
+}
+
+// BeforeInstruction implements vm.Observer.BeforeInstruction.
+func (o *verboseObserver) BeforeInstruction(pc, instr uint16) {
+	log.Printf("vm: %s\n", o.machine)
+	log.Printf("vm: %#016b %s\n", instr, vm.Disassemble(instr))
+}
+
+// startTrace starts writing an execution trace into the given file and
+// returns a function to call for finishing writing the trace.
+func startTrace(machine *vm.VM, filename, format string) (func(), error) {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := trace.NewWriter(format, fp)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	recorder := trace.NewRecorder(writer)
+	machine.AddObserver(recorder)
+	return func() {
+		if err := recorder.Err(); err != nil {
+			log.Printf("vm: cannot write trace: %s", err.Error())
+		}
+		if err := writer.Flush(); err != nil {
+			log.Printf("vm: cannot write trace: %s", err.Error())
+		}
+		if err := fp.Close(); err != nil {
+			log.Printf("vm: cannot write trace: %s", err.Error())
+		}
+	}, nil
+}
+
+// writeProfile prints the profile report and writes the pprof
+// profile into the given file.
+func writeProfile(profiler *profile.Profiler, filename, source string) {
+	if err := profiler.WriteReport(os.Stderr); err != nil {
+		log.Printf("vm: cannot write profile report: %s", err.Error())
 	}
-	fp, err := os.Open(*filename)
+	fp, err := os.Create(filename)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("vm: cannot write profile: %s", err.Error())
+		return
+	}
+	if err := profiler.WritePprof(fp, source); err != nil {
+		log.Printf("vm: cannot write profile: %s", err.Error())
+	}
+	if err := fp.Close(); err != nil {
+		log.Printf("vm: cannot write profile: %s", err.Error())
+	}
+}
+
+// loadSource loads the given source for measuring the coverage, using
+// the line table of the executable, if exe is not nil and has one, or
+// assembling the source otherwise.
+func loadSource(filename string, exe *executable.Executable) (*coverage.Source, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
 	defer fp.Close()
-	machine := new(vm.VM)
-	scanner := bufio.NewScanner(fp)
-	var addr uint16
+	if exe != nil && len(exe.Lines) > 0 {
+		return coverage.NewExecutableSource(filename, fp, exe)
+	}
+	return coverage.NewSource(filename, fp)
+}
+
+// writeCoverage prints the coverage statistics and writes the LCOV
+// file and the annotated listing, when their filenames are not empty.
+func writeCoverage(cov *coverage.Coverage, lcovFile, listingFile string) {
+	log.Printf("coverage: %s", cov.Stats())
+	write := func(filename string, writeFunc func(io.Writer) error) {
+		if filename == "" {
+			return
+		}
+		fp, err := os.Create(filename)
+		if err != nil {
+			log.Printf("vm: cannot write coverage: %s", err.Error())
+			return
+		}
+		if err := writeFunc(fp); err != nil {
+			log.Printf("vm: cannot write coverage: %s", err.Error())
+		}
+		if err := fp.Close(); err != nil {
+			log.Printf("vm: cannot write coverage: %s", err.Error())
+		}
+	}
+	write(lcovFile, cov.WriteLCOV)
+	write(listingFile, cov.WriteListing)
+}
+
+// readProgram reads the program in the given file. The file contains
+// either an executable, which may also contain symbols and the line
+// table, or the machine code to load at address zero, which we return
+// as an executable with a single segment and the entry point at zero.
+func readProgram(filename string) (*executable.Executable, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	br := bufio.NewReader(fp)
+	if magic, _ := br.Peek(len(executable.Magic)); string(magic) == executable.Magic {
+		return executable.Read(br)
+	}
+	scanner := bufio.NewScanner(br)
+	var words []uint16
 	for scanner.Scan() {
 		value, err := strconv.ParseUint(scanner.Text(), 16, 16)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		machine.M[addr] = uint16(value)
-		addr++
+		words = append(words, uint16(value))
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	return &executable.Executable{Segments: []vm.Segment{{Words: words}}}, nil
+}
+
+// loadProgram loads exe into machine. By default, we boot exe through the
+// boot ROM (see vm.VM.Boot). When direct is true, we copy the segments and
+// set the PC instead, which we do when the boot ROM cannot run (e.g., on
+// the pipeline model, which does not implement devices and rfe).
+func loadProgram(machine *vm.VM, exe *executable.Executable, direct bool) error {
+	if direct {
+		return machine.LoadSegments(exe.Entry, exe.Segments)
+	}
+	return machine.Boot(exe.Entry, exe.Segments)
+}
+
+// attachDisk attaches a disk backed by the given file and returns
+// a function to call for closing the file.
+func attachDisk(machine *vm.VM, filename string) (func(), error) {
+	fp, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
 	}
-	for {
-		machine.Fetch()
-		if *verbose {
-			log.Printf("vm: %s\n", machine)
-			log.Printf("vm: %#016b %s\n", machine.CI, vm.Disassemble(machine.CI))
+	disk := vm.NewDisk(machine, vm.DiskBase, fp, info.Size())
+	if err := machine.Attach(disk); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return func() {
+		if err := disk.Err(); err != nil {
+			log.Printf("disk: %s", err)
 		}
-		if *debug {
-			log.Printf("vm: paused...")
-			fmt.Scanln()
+		if err := fp.Close(); err != nil {
+			log.Printf("disk: %s", err)
 		}
-		if err := machine.Execute(); err != nil {
-			if errors.Is(err, vm.ErrHalted) {
-				break
-			}
-			log.Fatal(err)
+	}, nil
+}
+
+// attachFramebuffer attaches a framebuffer writing the presented frames
+// into files named after pattern, and returns a function to call for
+// writing the last frame when the execution stops. When writing a frame
+// fails, we stop the machine and the returned function reports the error.
+func attachFramebuffer(machine *vm.VM, pattern string) (func(), error) {
+	frames, err := framebuffer.NewFrameWriter(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var writeErr error
+	writeFrame := func(img *image.Paletted) {
+		if writeErr != nil {
+			return
 		}
+		if writeErr = frames.WriteFrame(img); writeErr != nil {
+			machine.RequestStop()
+		}
+	}
+	fb := framebuffer.New(framebuffer.DefaultBase, writeFrame)
+	if err := machine.Attach(fb); err != nil {
+		return nil, err
+	}
+	return func() {
+		fb.Flush()
+		if writeErr != nil {
+			log.Printf("framebuffer: %s", writeErr)
+		}
+		log.Printf("framebuffer: %d frames written", frames.Count())
+	}, nil
+}
+
+// restoreSnapshot restores the machine state from the given snapshot.
+func restoreSnapshot(machine *vm.VM, filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return machine.Restore(bufio.NewReader(fp))
+}
+
+// saveSnapshot saves the machine state into the given snapshot.
+func saveSnapshot(machine *vm.VM, filename string) {
+	fp, err := os.Create(filename)
+	if err != nil {
+		log.Printf("vm: cannot save snapshot: %s", err.Error())
+		return
+	}
+	if err := machine.Save(fp); err != nil {
+		log.Printf("vm: cannot save snapshot: %s", err.Error())
+	}
+	if err := fp.Close(); err != nil {
+		log.Printf("vm: cannot save snapshot: %s", err.Error())
+	}
+}
+
+// loadLabels loads the labels defined by the given assembly source.
+func loadLabels(filename string) (map[string]int64, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return asm.CollectLabels(fp)
+}
+
+// serveGDB serves the GDB remote serial protocol on the given address.
+func serveGDB(machine *vm.VM, step func() error, undo *reverse.Log, address string) error {
+	stub := gdbstub.NewStub(machine)
+	stub.Step = step
+	if undo != nil {
+		stub.StepBack = func() bool {
+			return undo.StepBack(1) == 1
+		}
+		stub.Modify = func(change func()) {
+			undo.Record(func() error {
+				change()
+				return nil
+			})
+		}
+	}
+	var err error
+	if address == "-" {
+		err = stub.Serve(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout})
+	} else {
+		log.Printf("vm: waiting for GDB on %s", address)
+		err = stub.ListenAndServe(address)
+	}
+	if errors.Is(err, gdbstub.ErrKilled) {
+		return nil
+	}
+	return err
+}
+
+// maxPipelineCycles is the maximum number of cycles for which we
+// run the pipeline model.
+const maxPipelineCycles = 1 << 32
+
+// runPipeline runs the program on the pipeline model, verifies the result
+// using the functional VM, and prints statistics.
+func runPipeline(machine *vm.VM, tracker *bpred.Tracker, verbose bool) error {
+	var trace func(pipeline.Occupancy)
+	if verbose {
+		trace = func(occupancy pipeline.Occupancy) {
+			log.Printf("pipeline: %s", occupancy)
+		}
+	}
+	p := pipeline.New(machine)
+	p.Branches = tracker
+	stats, err := p.Verify(maxPipelineCycles, trace)
+	log.Printf("pipeline: %s", stats)
+	return err
+}
+
+// printCacheStats prints the statistics of each cache.
+func printCacheStats(hierarchy *cache.Hierarchy) {
+	for _, c := range hierarchy.All {
+		log.Printf("cache: %s %s", c.Config().Name, c.Stats())
+	}
+}
+
+// printBranchStats prints the statistics of each branch and the
+// overall misprediction rate.
+func printBranchStats(tracker *bpred.Tracker) {
+	for _, stats := range tracker.Branches() {
+		log.Printf("bpred: %d: %-20s %s", stats.PC, vm.Disassemble(stats.Instr), stats)
 	}
+	log.Printf("bpred: %s %s", tracker.Predictor.Name(), tracker.Total())
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/executable"
+	"github.com/bassosimone/risc16/pkg/framebuffer"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+func TestAttachFramebufferWriteError(t *testing.T) {
+	machine := new(vm.VM)
+	pattern := filepath.Join(t.TempDir(), "missing", "out%03d.ppm")
+	closeFramebuffer, err := attachFramebuffer(machine, pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sw r0 r1 0 with r1 pointing to the present register, then loop
+	machine.GPR[1] = framebuffer.DefaultBase + framebuffer.Present
+	machine.M[0] = vm.OpcodeSW<<13 | 1<<7
+	machine.M[1] = vm.OpcodeBEQ<<13 | 0x7f
+	result := machine.Run(context.Background(), vm.RunOptions{MaxInstructions: 1000})
+	if result.Reason != vm.StopRequested {
+		t.Fatalf("expected StopRequested, got %s", result.Reason)
+	}
+	closeFramebuffer() // must not panic or exit
+}
+
+func TestReadProgram(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "prog.hex")
+	if err := os.WriteFile(filename, []byte("0001\nffff\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	exe, err := readProgram(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe.Entry != 0 || len(exe.Segments) != 1 || exe.Segments[0].Addr != 0 ||
+		!reflect.DeepEqual(exe.Segments[0].Words, []uint16{1, 0xffff}) {
+		t.Fatalf("unexpected executable: %+v", exe)
+	}
+	if err := os.WriteFile(filename, []byte("bogus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProgram(filename); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := readProgram(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestLoadProgram(t *testing.T) {
+	halt := uint16(vm.OpcodeJALR<<13 | vm.ExceptionTypeEXCEPTION | vm.ExceptionValueHALT)
+	exe := &executable.Executable{
+		Entry:    0x100,
+		Segments: []vm.Segment{{Addr: 0x100, Words: []uint16{halt}}},
+	}
+	machine := new(vm.VM)
+	if err := loadProgram(machine, exe, false); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC != vm.BootROMBase || machine.M[0x100] != 0 {
+		t.Fatalf("expected the boot ROM to load the program, got PC %#04x", machine.PC)
+	}
+	result := machine.Run(context.Background(), vm.RunOptions{MaxInstructions: 1000})
+	if result.Reason != vm.StopHalted || result.PC != 0x101 {
+		t.Fatalf("expected StopHalted at 0x101, got %+v", result)
+	}
+	machine = new(vm.VM)
+	if err := loadProgram(machine, exe, true); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC != 0x100 || machine.M[0x100] != halt {
+		t.Fatalf("unexpected machine %s", machine)
+	}
+}
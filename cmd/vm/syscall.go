@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// The following constants define the system calls implemented by
+// this command. Arguments are passed in r1 and r2 and the result is
+// returned in r1. Characters are transferred through the console.
+const (
+	// SyscallExit terminates the program with exit status r1.
+	SyscallExit = iota
+
+	// SyscallPutchar prints the low byte of r1.
+	SyscallPutchar
+
+	// SyscallGetchar reads a byte into r1, or 0xffff on end of input.
+	SyscallGetchar
+
+	// SyscallWrite prints the low bytes of the r2 words starting at
+	// address r1, and returns into r1 the number of printed bytes.
+	SyscallWrite
+
+	// SyscallRead reads up to r2 bytes into the words starting at address
+	// r1, stopping after a newline or at end of input, and returns into r1
+	// the number of bytes read.
+	SyscallRead
+)
+
+// The buffers of SyscallWrite and SyscallRead are virtual addresses,
+// which we translate like LW and SW do. When the program cannot access
+// the whole buffer, the system call raises a SIGSEGV exception before
+// transferring any character.
+
+// exitError is the error returned by SyscallExit.
+type exitError struct {
+	status int
+}
+
+// Error implements error.Error.
+func (err exitError) Error() string {
+	return fmt.Sprintf("vm: exit with status %d", err.status)
+}
+
+// registerSyscalls registers the default system calls.
+func registerSyscalls(machine *vm.VM, console *vm.Console) {
+	machine.RegisterSyscall(SyscallExit, func(machine *vm.VM) error {
+		return exitError{status: int(int16(machine.GPR[1]))}
+	})
+	machine.RegisterSyscall(SyscallPutchar, func(machine *vm.VM) error {
+		console.Write(vm.ConsoleData, machine.GPR[1])
+		return nil
+	})
+	machine.RegisterSyscall(SyscallGetchar, func(machine *vm.VM) error {
+		machine.GPR[1] = console.Read(vm.ConsoleData)
+		return nil
+	})
+	machine.RegisterSyscall(SyscallWrite, func(machine *vm.VM) error {
+		buffer, ok := translateBuffer(machine, vm.TLBRead)
+		if !ok {
+			return machine.RaiseException(vm.ExceptionTypeEXCEPTION | vm.ExceptionValueSIGSEGV)
+		}
+		for _, addr := range buffer {
+			console.Write(vm.ConsoleData, machine.Load(addr))
+		}
+		machine.GPR[1] = uint16(len(buffer))
+		return nil
+	})
+	machine.RegisterSyscall(SyscallRead, func(machine *vm.VM) error {
+		buffer, ok := translateBuffer(machine, vm.TLBWrite)
+		if !ok {
+			return machine.RaiseException(vm.ExceptionTypeEXCEPTION | vm.ExceptionValueSIGSEGV)
+		}
+		var idx uint16
+		for int(idx) < len(buffer) {
+			ch := console.Read(vm.ConsoleData)
+			if ch == vm.ConsoleEOF {
+				break
+			}
+			machine.Store(buffer[idx], ch)
+			idx++
+			if ch == '\n' {
+				break
+			}
+		}
+		machine.GPR[1] = idx
+		return nil
+	})
+}
+
+// translateBuffer translates the r2 words starting at the virtual address
+// r1 for an access of the given kind (i.e., vm.TLBRead or vm.TLBWrite) and
+// returns their physical addresses, or false if any translation fails.
+func translateBuffer(machine *vm.VM, kind uint16) ([]uint16, bool) {
+	vaddr, count := machine.GPR[1], machine.GPR[2]
+	buffer := make([]uint16, count)
+	for idx := range buffer {
+		addr, fault := machine.Translate(vaddr+uint16(idx), kind)
+		if fault != 0 {
+			return nil, false
+		}
+		buffer[idx] = addr
+	}
+	return buffer, true
+}
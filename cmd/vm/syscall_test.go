@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// newSyscallMachine returns a machine executing a system call at address
+// zero in user mode, where paging maps the virtual pages 0x03 (read and
+// write) and 0x04 (read only) to the physical pages 0x05 and 0x06, along
+// with the console and its output.
+func newSyscallMachine(num uint16, input string) (*vm.VM, *vm.Console, *bytes.Buffer) {
+	var out bytes.Buffer
+	console := vm.NewConsole(vm.ConsoleBase, strings.NewReader(input), &out)
+	machine := new(vm.VM)
+	registerSyscalls(machine, console)
+	machine.Paging = true
+	machine.SPR[vm.SPRStatus] = vm.StatusUser
+	machine.TLB[0] = vm.TLBEntry{Hi: 0x000, Lo: 0x100 | vm.TLBValid | vm.TLBExec}
+	machine.TLB[1] = vm.TLBEntry{Hi: 0x300, Lo: 0x500 | vm.TLBValid | vm.TLBRead | vm.TLBWrite}
+	machine.TLB[2] = vm.TLBEntry{Hi: 0x400, Lo: 0x600 | vm.TLBValid | vm.TLBRead}
+	machine.M[0x100] = vm.OpcodeJALR<<13 | vm.ExceptionTypeSYSCALL | num
+	return machine, console, &out
+}
+
+// expectSIGSEGV executes the system call and checks that it raises SIGSEGV.
+func expectSIGSEGV(t *testing.T, machine *vm.VM) {
+	machine.Fetch()
+	var exc *vm.ExceptionError
+	if err := machine.Execute(); !errors.As(err, &exc) ||
+		exc.Cause != vm.ExceptionTypeEXCEPTION|vm.ExceptionValueSIGSEGV || exc.PC != 0 {
+		t.Fatalf("expected SIGSEGV, got %v", err)
+	}
+}
+
+func TestSyscallWritePaging(t *testing.T) {
+	machine, console, out := newSyscallMachine(SyscallWrite, "")
+	machine.M[0x3fe], machine.M[0x4fe] = 'x', 'x' // physical, thus not printed
+	machine.M[0x5fe], machine.M[0x5ff], machine.M[0x600] = 'h', 'i', '!'
+	machine.GPR[1], machine.GPR[2] = 0x3fe, 3
+	machine.Fetch()
+	if err := machine.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if err := console.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hi!" || machine.GPR[1] != 3 {
+		t.Fatalf("unexpected output %q or result %d", out.String(), machine.GPR[1])
+	}
+	// the buffer crosses into an unmapped page
+	machine.PC, machine.GPR[1], machine.GPR[2] = 0, 0x4fe, 3
+	expectSIGSEGV(t, machine)
+	if err := console.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hi!" || machine.SPR[vm.SPRBadVAddr] != 0x500 {
+		t.Fatalf("unexpected output %q or bad address %#04x", out.String(), machine.SPR[vm.SPRBadVAddr])
+	}
+}
+
+func TestSyscallReadPaging(t *testing.T) {
+	machine, _, _ := newSyscallMachine(SyscallRead, "ok\nmore")
+	machine.GPR[1], machine.GPR[2] = 0x310, 10
+	machine.Fetch()
+	if err := machine.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[1] != 3 || machine.M[0x510] != 'o' || machine.M[0x512] != '\n' || machine.M[0x310] != 0 {
+		t.Fatalf("unexpected result %d or memory %#04x", machine.GPR[1], machine.M[0x510])
+	}
+	// the page is read only, thus the input is not consumed
+	machine.PC, machine.GPR[1], machine.GPR[2] = 0, 0x410, 10
+	expectSIGSEGV(t, machine)
+	if machine.M[0x610] != 0 || machine.M[0x410] != 0 {
+		t.Fatal("the system call wrote the memory")
+	}
+	machine.PC, machine.GPR[1], machine.GPR[2] = 0, 0x310, 10
+	machine.Fetch()
+	if err := machine.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[1] != 4 || machine.M[0x510] != 'm' {
+		t.Fatalf("unexpected result %d or memory %#04x", machine.GPR[1], machine.M[0x510])
+	}
+}
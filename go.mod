@@ -1,3 +1,3 @@
 module github.com/bassosimone/risc16
 
-go 1.14
+go 1.18
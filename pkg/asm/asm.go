@@ -9,19 +9,37 @@
 // 1. it is possible to put a comma between the instruction name
 // and the first register name, thus resulting in a language that
 // would be rejected by the original parser written in C.
+//
+// 2. the `syscall N` pseudo-instruction invokes the system call N, the
+// `mfspr SPR` and `mtspr SPR` pseudo-instructions copy the special
+// purpose register SPR (a name or a number) into r1 and vice versa, and
+// the `rfe` pseudo-instruction returns from an exception handler, and the
+// `tas` and `cas` pseudo-instructions perform the atomic test-and-set and
+// compare-and-swap operations on the word at the address in r2. All
+// of them are encoded as `jalr r0 r0 imm` with a suitable immediate.
+//
+// 3. the `.org ADDR` pseudo-instruction places the next instruction at
+// the address ADDR, which must not be lower than the address of the
+// previous instruction. The addresses in between are left unassigned.
 package asm
 
 import (
+	"fmt"
 	"io"
 	"math"
 )
 
 // InstructionOrError contains either an assembled instruction
-// or an error that occurred during the assemblation.
+// or an error that occurred during the assemblation. Data is true
+// when the instruction has been generated by .fill or .space. Address
+// is the address of the instruction, which increases by one for each
+// instruction, except after .org.
 type InstructionOrError struct {
 	Instruction uint16
 	Error       error
 	Lineno      int
+	Data        bool
+	Address     uint16
 }
 
 // StartAssembler starts the assembler in a background goroutine an
@@ -36,30 +54,103 @@ func StartAssembler(r io.Reader) <-chan InstructionOrError {
 // and it writes InstructionOrError on the output channel.
 func AssemblerAsync(r io.Reader, out chan<- InstructionOrError) {
 	defer close(out)
+	p, failure := layoutProgram(r)
+	if failure != nil {
+		out <- *failure
+		return
+	}
+	p.encode(func(instr InstructionOrError) {
+		out <- instr
+	})
+}
+
+// program is a parsed program whose instructions and labels
+// have been assigned their addresses.
+type program struct {
+	instructions []Instruction
+	addrs        []int64
+	labels       map[string]int64
+}
+
+// layoutProgram parses the assembly code read from r and assigns an
+// address to each instruction and label. It always drains the channel
+// returned by the parser, so that the background goroutines terminate.
+func layoutProgram(r io.Reader) (*program, *InstructionOrError) {
+	p := &program{labels: make(map[string]int64)}
+	var failure *InstructionOrError
 	var idx int64
-	labels := make(map[string]int64)
-	var instructions []Instruction
 	for instr := range StartParsing(StartLexing(r)) {
+		if failure != nil {
+			continue // drain the channel
+		}
 		if instr.Err() != nil {
-			out <- InstructionOrError{Error: instr.Err(), Lineno: instr.Line()}
-			return
+			failure = &InstructionOrError{Error: instr.Err(), Lineno: instr.Line()}
+			continue
+		}
+		var err error
+		if idx, err = placeInstruction(instr, idx); err != nil {
+			failure = &InstructionOrError{Error: err, Lineno: instr.Line()}
+			continue
 		}
 		if instr.Label() != nil {
-			labels[*instr.Label()] = idx
+			p.labels[*instr.Label()] = idx
 		}
-		instructions = append(instructions, instr)
+		if _, org := instr.(InstructionORG); org {
+			continue
+		}
+		p.instructions = append(p.instructions, instr)
+		p.addrs = append(p.addrs, idx)
 		idx++
 	}
-	for pc, instr := range instructions {
+	if failure != nil {
+		return nil, failure
+	}
+	return p, nil
+}
+
+// encode encodes the instructions of the program and passes
+// each of them, or the errors that occurred, to emit.
+func (p *program) encode(emit func(instr InstructionOrError)) {
+	for i, instr := range p.instructions {
+		pc := p.addrs[i]
 		if pc > math.MaxUint16 {
-			out <- InstructionOrError{Error: ErrTooManyInstructions, Lineno: instr.Line()}
+			emit(InstructionOrError{Error: ErrTooManyInstructions, Lineno: instr.Line()})
 			return
 		}
-		encoded, err := instr.Encode(labels, uint16(pc))
+		encoded, err := instr.Encode(p.labels, uint16(pc))
 		if err != nil {
-			out <- InstructionOrError{Error: err, Lineno: instr.Line()}
+			emit(InstructionOrError{Error: err, Lineno: instr.Line()})
 			continue
 		}
-		out <- InstructionOrError{Instruction: encoded, Lineno: instr.Line()}
+		_, data := instr.(InstructionDATA)
+		emit(InstructionOrError{
+			Instruction: encoded,
+			Lineno:      instr.Line(),
+			Data:        data,
+			Address:     uint16(pc),
+		})
+	}
+}
+
+// placeInstruction returns the address of instr given the address idx
+// following the previous instruction, which differs from idx for .org.
+func placeInstruction(instr Instruction, idx int64) (int64, error) {
+	org, ok := instr.(InstructionORG)
+	if !ok {
+		return idx, nil
+	}
+	if int64(org.Addr) < idx {
+		return 0, fmt.Errorf("%w on line %d", ErrOrgBackwards, org.Lineno)
+	}
+	return int64(org.Addr), nil
+}
+
+// CollectLabels parses the assembly code read from r and returns the
+// table that maps each label to the corresponding offset in memory.
+func CollectLabels(r io.Reader) (map[string]int64, error) {
+	p, failure := layoutProgram(r)
+	if failure != nil {
+		return nil, failure.Error
 	}
+	return p.labels, nil
 }
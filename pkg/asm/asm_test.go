@@ -0,0 +1,85 @@
+package asm
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// assemble assembles source and returns the instructions, failing
+// the test if the assembler returns an error.
+func assemble(t *testing.T, source string) []InstructionOrError {
+	var out []InstructionOrError
+	for instr := range StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		out = append(out, instr)
+	}
+	return out
+}
+
+func TestAssemble(t *testing.T) {
+	out := assemble(t, `
+start:	addi r1, r0, 3
+loop:	beq r1, r0, done
+	addi r1, r1, -1
+	beq r0, r0, loop
+done:	halt
+data:	.fill 7
+`)
+	expected := []uint16{0x2403, 0xc402, 0x24ff, 0xc07d, 0xe071, 0x0007}
+	if len(out) != len(expected) {
+		t.Fatalf("expected %d words, got %d", len(expected), len(out))
+	}
+	for idx, instr := range out {
+		if instr.Instruction != expected[idx] || instr.Address != uint16(idx) {
+			t.Fatalf("word %d: expected %04x at %d, got %04x at %d", idx,
+				expected[idx], idx, instr.Instruction, instr.Address)
+		}
+		if instr.Data != (idx == 5) {
+			t.Fatalf("word %d: unexpected Data=%v", idx, instr.Data)
+		}
+	}
+}
+
+func TestCollectLabels(t *testing.T) {
+	labels, err := CollectLabels(strings.NewReader("a: nop\nb: nop\n.space 3\nc: .org 10\nd: halt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"a": 0, "b": 1, "c": 10, "d": 10}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("expected %v, got %v", expected, labels)
+	}
+}
+
+func TestCollectLabelsError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	sources := []string{
+		"nop\nbogus r1\nnop\nnop\n",       // parse error
+		".org 5\nnop\n.org 2\nnop\nnop\n", // layout error
+	}
+	for _, source := range sources {
+		for idx := 0; idx < 100; idx++ {
+			if _, err := CollectLabels(strings.NewReader(source)); err == nil {
+				t.Fatalf("expected an error for %q", source)
+			}
+		}
+	}
+	_, err := CollectLabels(strings.NewReader(sources[1]))
+	if !errors.Is(err, ErrOrgBackwards) {
+		t.Fatalf("expected ErrOrgBackwards, got %v", err)
+	}
+	// the background goroutines should all terminate
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked %d goroutines", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
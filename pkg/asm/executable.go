@@ -0,0 +1,71 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bassosimone/risc16/pkg/executable"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// The following errors may occur when creating an executable.
+var (
+	ErrNoEntryLabel    = errors.New("asm: entry label not found")
+	ErrEmptyExecutable = errors.New("asm: empty executable")
+)
+
+// NewExecutable assembles the source read from r and returns the
+// corresponding executable. The .org pseudo-instruction starts a new
+// segment. The entry point is the address of the entry label or, if
+// entry is empty, the address of the first instruction. Use
+// executable.Write to write the result into a file.
+func NewExecutable(r io.Reader, entry string) (*executable.Executable, error) {
+	p, failure := layoutProgram(r)
+	if failure != nil {
+		return nil, failure.Error
+	}
+	exe := &executable.Executable{
+		Symbols: make(map[string]uint16),
+		Lines:   make(map[uint16]int),
+	}
+	for name, addr := range p.labels {
+		exe.Symbols[name] = uint16(addr)
+	}
+	var (
+		err  error
+		next uint32
+	)
+	p.encode(func(instr InstructionOrError) {
+		if instr.Error != nil {
+			if err == nil {
+				err = instr.Error
+			}
+			return
+		}
+		if len(exe.Segments) == 0 || uint32(instr.Address) != next {
+			exe.Segments = append(exe.Segments, vm.Segment{Addr: instr.Address})
+		}
+		seg := &exe.Segments[len(exe.Segments)-1]
+		seg.Words = append(seg.Words, instr.Instruction)
+		if !instr.Data {
+			exe.Lines[instr.Address] = instr.Lineno
+		}
+		next = uint32(instr.Address) + 1
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(exe.Segments) == 0 {
+		return nil, ErrEmptyExecutable
+	}
+	exe.Entry = exe.Segments[0].Addr
+	if entry != "" {
+		addr, found := exe.Symbols[entry]
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrNoEntryLabel, entry)
+		}
+		exe.Entry = addr
+	}
+	return exe, nil
+}
@@ -0,0 +1,84 @@
+package asm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/executable"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// gaps is a program with three segments whose entry point is main.
+const gaps = `	beq r0, r0, main
+	.fill 7
+	.org 10
+main:	lw r1, r0, value
+	halt
+	.org 20
+value:	.fill 42
+`
+
+func TestNewExecutable(t *testing.T) {
+	exe, err := NewExecutable(strings.NewReader(gaps), "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	halt := uint16(vm.OpcodeJALR<<13 | vm.ExceptionTypeEXCEPTION | vm.ExceptionValueHALT)
+	expected := &executable.Executable{
+		Entry: 10,
+		Segments: []vm.Segment{
+			{Addr: 0, Words: []uint16{vm.OpcodeBEQ<<13 | 9, 7}},
+			{Addr: 10, Words: []uint16{vm.OpcodeLW<<13 | 1<<10 | 20, halt}},
+			{Addr: 20, Words: []uint16{42}},
+		},
+		Symbols: map[string]uint16{"main": 10, "value": 20},
+		Lines:   map[uint16]int{0: 1, 10: 4, 11: 5},
+	}
+	if !reflect.DeepEqual(exe, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, exe)
+	}
+	// the executable survives a write and read round trip
+	var buf bytes.Buffer
+	if err := executable.Write(&buf, exe); err != nil {
+		t.Fatal(err)
+	}
+	exe, err = executable.Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exe, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, exe)
+	}
+	// and runs starting from the entry point
+	machine := new(vm.VM)
+	if err := machine.LoadSegments(exe.Entry, exe.Segments); err != nil {
+		t.Fatal(err)
+	}
+	result := machine.Run(context.Background(), vm.RunOptions{MaxInstructions: 10})
+	if result.Reason != vm.StopHalted || result.Instructions != 2 || machine.GPR[1] != 42 {
+		t.Fatalf("unexpected result %+v with r1 = %d", result, machine.GPR[1])
+	}
+}
+
+func TestNewExecutableEntry(t *testing.T) {
+	exe, err := NewExecutable(strings.NewReader("\t.org 5\n\thalt\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe.Entry != 5 {
+		t.Fatalf("expected 5, got %d", exe.Entry)
+	}
+	if _, err := NewExecutable(strings.NewReader(gaps), "start"); !errors.Is(err, ErrNoEntryLabel) {
+		t.Fatalf("expected ErrNoEntryLabel, got %v", err)
+	}
+	if _, err := NewExecutable(strings.NewReader("\t.org 5\n"), ""); !errors.Is(err, ErrEmptyExecutable) {
+		t.Fatalf("expected ErrEmptyExecutable, got %v", err)
+	}
+	if _, err := NewExecutable(strings.NewReader("\tbeq r0, r0, missing\n"), ""); err == nil {
+		t.Fatal("expected an error")
+	}
+}
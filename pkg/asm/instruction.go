@@ -29,6 +29,15 @@ const (
 	ExceptionTypeEXCEPTION
 )
 
+// ExceptionTypeATOMIC is the exception type of the atomic operations.
+const ExceptionTypeATOMIC = ExceptionTypeRFU1
+
+// The following constants define the atomic operations.
+const (
+	AtomicTAS = iota
+	AtomicCAS
+)
+
 // The following constants define exception values.
 const (
 	ExceptionValueNONE = iota
@@ -36,6 +45,8 @@ const (
 	ExceptionValueTLBMISS
 	ExceptionValueSIGSEGV
 	ExceptionValueINVALID
+	ExceptionValueRFE
+	ExceptionValueINTERRUPT
 )
 
 // Instruction is a parsed instruction.
@@ -469,6 +480,36 @@ func (ia InstructionDATA) Encode(labels map[string]int64, pc uint16) (uint16, er
 
 var _ Instruction = InstructionDATA{}
 
+// InstructionORG is the .ORG pseudo-instruction, which sets the
+// address of the next instruction without occupying memory
+type InstructionORG struct {
+	Lineno     int
+	MaybeLabel *string
+	Addr       uint16
+}
+
+// Err implements Instruction.Err
+func (ia InstructionORG) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionORG) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionORG) Line() int {
+	return ia.Lineno
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionORG) Encode(labels map[string]int64, pc uint16) (uint16, error) {
+	return 0, fmt.Errorf("%w because .org does not occupy memory", ErrCannotEncode)
+}
+
+var _ Instruction = InstructionORG{}
+
 // ResolveImmediate resolves the value of an immediate
 func ResolveImmediate(
 	labels map[string]int64, name string, bits, lineno int) (uint16, error) {
@@ -13,20 +13,27 @@ type ParseSpecificInstruction func(
 
 // InstructionParsers maps an instruction to its parser.
 var InstructionParsers = map[string]ParseSpecificInstruction{
-	"add":    ParseADD,
-	"addi":   ParseADDI,
-	"nand":   ParseNAND,
-	"lui":    ParseLUI,
-	"sw":     ParseSW,
-	"lw":     ParseLW,
-	"beq":    ParseBEQ,
-	"jalr":   ParseJALR,
-	"nop":    ParseNOP,
-	"halt":   ParseHALT,
-	"lli":    ParseLLI,
-	"movi":   ParseMOVI,
-	".fill":  ParseFILL,
-	".space": ParseSPACE,
+	"add":     ParseADD,
+	"addi":    ParseADDI,
+	"nand":    ParseNAND,
+	"lui":     ParseLUI,
+	"sw":      ParseSW,
+	"lw":      ParseLW,
+	"beq":     ParseBEQ,
+	"jalr":    ParseJALR,
+	"nop":     ParseNOP,
+	"halt":    ParseHALT,
+	"rfe":     ParseRFE,
+	"syscall": ParseSYSCALL,
+	"mfspr":   ParseMFSPR,
+	"mtspr":   ParseMTSPR,
+	"tas":     ParseTAS,
+	"cas":     ParseCAS,
+	"lli":     ParseLLI,
+	"movi":    ParseMOVI,
+	".fill":   ParseFILL,
+	".space":  ParseSPACE,
+	".org":    ParseORG,
 }
 
 // The following errors may occur when assembling.
@@ -39,6 +46,8 @@ var (
 	ErrOutOfRange           = errors.New("asm: immediate value out of range")
 	ErrCannotEncode         = errors.New("asm: can't encode instruction")
 	ErrTooManyInstructions  = errors.New("asm: too many instructions")
+	ErrInvalidSPRName       = errors.New("asm: invalid special-purpose register name")
+	ErrOrgBackwards         = errors.New("asm: .org moves backwards")
 )
 
 // StartParsing starts parsing in a backend goroutine.
@@ -323,6 +332,123 @@ func ParseHALT(in <-chan LexerToken, label *string, lineno int) []Instruction {
 	}}
 }
 
+// ParseRFE parses the RFE pseudo-instruction
+func ParseRFE(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// RFE is mapped to JALR r0 r0 <special-value>.
+	return []Instruction{InstructionJALR{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Imm:        ExceptionTypeEXCEPTION | ExceptionValueRFE,
+	}}
+}
+
+// ParseSYSCALL parses the SYSCALL pseudo-instruction
+func ParseSYSCALL(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := MaybeSkipCommaThenParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	num, err := strconv.ParseUint(imm, 0, 4)
+	if err != nil {
+		return NewParseError(fmt.Errorf("%w for syscall number on line %d",
+			ErrOutOfRange, lineno))
+	}
+	// SYSCALL is mapped to JALR r0 r0 <syscall-type-and-number>.
+	return []Instruction{InstructionJALR{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Imm:        ExceptionTypeSYSCALL | uint16(num),
+	}}
+}
+
+// ParseTAS parses the TAS (test-and-set) pseudo-instruction
+func ParseTAS(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return parseAtomicInstruction(in, label, lineno, AtomicTAS)
+}
+
+// ParseCAS parses the CAS (compare-and-swap) pseudo-instruction
+func ParseCAS(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return parseAtomicInstruction(in, label, lineno, AtomicCAS)
+}
+
+// parseAtomicInstruction parses TAS and CAS, which take no operands
+// because they implicitly use r1, r2, and r3.
+func parseAtomicInstruction(
+	in <-chan LexerToken, label *string, lineno int, op uint16) []Instruction {
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// TAS and CAS are mapped to JALR r0 r0 <atomic-type-and-operation>.
+	return []Instruction{InstructionJALR{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Imm:        ExceptionTypeATOMIC | op,
+	}}
+}
+
+// SPRNumbers maps the name of each special-purpose register to its number.
+var SPRNumbers = map[string]uint16{
+	"cycles":   0,
+	"cause":    1,
+	"epc":      2,
+	"ie":       3,
+	"status":   4,
+	"scratch":  5,
+	"evec":     6,
+	"timer":    7,
+	"reload":   8,
+	"pending":  9,
+	"tlbindex": 10,
+	"tlbhi":    11,
+	"tlblo":    12,
+	"badvaddr": 13,
+	"coreid":   14,
+}
+
+// ParseMFSPR parses the MFSPR pseudo-instruction
+func ParseMFSPR(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return parseSPRInstruction(in, label, lineno, ExceptionTypeMFSPR)
+}
+
+// ParseMTSPR parses the MTSPR pseudo-instruction
+func ParseMTSPR(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return parseSPRInstruction(in, label, lineno, ExceptionTypeMTSPR)
+}
+
+// parseSPRInstruction parses MFSPR and MTSPR, which both take the
+// special-purpose register name or number as their sole operand.
+func parseSPRInstruction(
+	in <-chan LexerToken, label *string, lineno int, etype uint16) []Instruction {
+	imm, err := MaybeSkipCommaThenParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	num, found := SPRNumbers[imm]
+	if !found {
+		value, err := strconv.ParseUint(imm, 0, 4)
+		if err != nil {
+			return NewParseError(fmt.Errorf("%w while parsing '%s' on line %d",
+				ErrInvalidSPRName, imm, lineno))
+		}
+		num = uint16(value)
+	}
+	// MFSPR and MTSPR are mapped to JALR r0 r0 <type-and-register>.
+	return []Instruction{InstructionJALR{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Imm:        etype | num,
+	}}
+}
+
 // ParseLLI parses the LLI pseudo-instruction
 func ParseLLI(in <-chan LexerToken, label *string, lineno int) []Instruction {
 	ra, err := MaybeSkipCommaThenParseRegister(in)
@@ -415,6 +541,26 @@ func ParseSPACE(in <-chan LexerToken, label *string, lineno int) (out []Instruct
 	return
 }
 
+// ParseORG parses the .ORG pseudo-instruction
+func ParseORG(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := MaybeSkipCommaThenParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	addr, err := strconv.ParseUint(imm, 0, 16)
+	if err != nil {
+		return NewParseError(fmt.Errorf("%w for address", ErrOutOfRange))
+	}
+	return []Instruction{InstructionORG{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Addr:       uint16(addr),
+	}}
+}
+
 // MaybeSkipCommaThenParseRegister parses a register ignoring a comma
 // that may or may not appear before the register.
 func MaybeSkipCommaThenParseRegister(in <-chan LexerToken) (uint16, error) {
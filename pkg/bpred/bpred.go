@@ -0,0 +1,371 @@
+// Package bpred contains branch predictor models for the RiSC-16.
+//
+// A Predictor predicts the direction of BEQ instructions. A Tracker
+// combines a Predictor with a branch target buffer for JALR, whose target
+// is not known until the instruction executes, and collects statistics.
+// The functional VM uses a Tracker by attaching it, so that it calls
+// Observe after each executed instruction, while timing models (e.g., the
+// pipeline model) call Predict when fetching and Resolve when the branch
+// executes.
+package bpred
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// Predictor predicts the direction of conditional branches.
+type Predictor interface {
+	// Name returns the predictor name.
+	Name() string
+
+	// Predict returns whether the branch at pc, whose target is
+	// target, is predicted as taken. Predict has no side effects.
+	Predict(pc, target uint16) bool
+
+	// Update updates the predictor with the outcome of the branch.
+	Update(pc, target uint16, taken bool)
+}
+
+// StaticNotTaken always predicts that the branch is not taken.
+type StaticNotTaken struct{}
+
+// Name implements Predictor.Name.
+func (StaticNotTaken) Name() string {
+	return "static"
+}
+
+// Predict implements Predictor.Predict.
+func (StaticNotTaken) Predict(pc, target uint16) bool {
+	return false
+}
+
+// Update implements Predictor.Update.
+func (StaticNotTaken) Update(pc, target uint16, taken bool) {}
+
+var _ Predictor = StaticNotTaken{}
+
+// BTFN predicts that backward branches are taken (i.e., loops) and
+// forward branches are not taken.
+type BTFN struct{}
+
+// Name implements Predictor.Name.
+func (BTFN) Name() string {
+	return "btfn"
+}
+
+// Predict implements Predictor.Predict.
+func (BTFN) Predict(pc, target uint16) bool {
+	return target <= pc
+}
+
+// Update implements Predictor.Update.
+func (BTFN) Update(pc, target uint16, taken bool) {}
+
+var _ Predictor = BTFN{}
+
+// Counters is a table of saturating counters indexed using the least
+// significant bits of the branch address. Using 1-bit counters yields a
+// predictor remembering the last outcome, while using 2-bit counters
+// yields the classic bimodal predictor.
+type Counters struct {
+	bits     uint
+	counters []uint8
+	max      uint8
+}
+
+// NewCounters creates a table of 2^indexBits counters of the given
+// width (in bits), initialized to the weakly not-taken state.
+func NewCounters(indexBits, width uint) *Counters {
+	max := uint8(1<<width - 1)
+	c := &Counters{
+		bits:     indexBits,
+		counters: make([]uint8, 1<<indexBits),
+		max:      max,
+	}
+	for idx := range c.counters {
+		c.counters[idx] = max / 2
+	}
+	return c
+}
+
+// Name implements Predictor.Name.
+func (c *Counters) Name() string {
+	if c.max == 1 {
+		return fmt.Sprintf("1bit:%d", c.bits)
+	}
+	return fmt.Sprintf("2bit:%d", c.bits)
+}
+
+// index returns the index of the counter for the given key.
+func (c *Counters) index(key uint16) uint16 {
+	return key & uint16(len(c.counters)-1)
+}
+
+// predict predicts the outcome using the counter for key.
+func (c *Counters) predict(key uint16) bool {
+	return c.counters[c.index(key)] > c.max/2
+}
+
+// update updates the counter for key.
+func (c *Counters) update(key uint16, taken bool) {
+	idx := c.index(key)
+	switch {
+	case taken && c.counters[idx] < c.max:
+		c.counters[idx]++
+	case !taken && c.counters[idx] > 0:
+		c.counters[idx]--
+	}
+}
+
+// Predict implements Predictor.Predict.
+func (c *Counters) Predict(pc, target uint16) bool {
+	return c.predict(pc)
+}
+
+// Update implements Predictor.Update.
+func (c *Counters) Update(pc, target uint16, taken bool) {
+	c.update(pc, taken)
+}
+
+var _ Predictor = &Counters{}
+
+// GShare indexes a table of 2-bit counters using the XOR of the branch
+// address and of the global history of branch outcomes.
+type GShare struct {
+	counters *Counters
+	history  uint16
+}
+
+// NewGShare creates a new gshare predictor with 2^indexBits counters
+// and a global history of indexBits outcomes.
+func NewGShare(indexBits uint) *GShare {
+	return &GShare{counters: NewCounters(indexBits, 2)}
+}
+
+// Name implements Predictor.Name.
+func (g *GShare) Name() string {
+	return fmt.Sprintf("gshare:%d", g.counters.bits)
+}
+
+// Predict implements Predictor.Predict.
+func (g *GShare) Predict(pc, target uint16) bool {
+	return g.counters.predict(pc ^ g.history)
+}
+
+// Update implements Predictor.Update.
+func (g *GShare) Update(pc, target uint16, taken bool) {
+	g.counters.update(pc^g.history, taken)
+	g.history <<= 1
+	if taken {
+		g.history |= 1
+	}
+	g.history &= uint16(len(g.counters.counters) - 1)
+}
+
+var _ Predictor = &GShare{}
+
+// ErrUnknownPredictor indicates that the predictor name is unknown.
+var ErrUnknownPredictor = errors.New("bpred: unknown predictor")
+
+// DefaultIndexBits is the default number of bits used to index
+// the tables of counters of the dynamic predictors.
+const DefaultIndexBits = 10
+
+// New creates a predictor given its name, which is one of `static`,
+// `btfn`, `1bit`, `2bit`, and `gshare`. The dynamic predictors accept
+// an optional `:N` suffix specifying the number of index bits (e.g.,
+// `gshare:12`), which otherwise defaults to DefaultIndexBits.
+func New(name string) (Predictor, error) {
+	v := strings.SplitN(name, ":", 2)
+	bits := uint(DefaultIndexBits)
+	if len(v) == 2 {
+		value, err := strconv.ParseUint(v[1], 10, 8)
+		if err != nil || value < 1 || value > 16 {
+			return nil, fmt.Errorf("%w: invalid index bits in '%s'", ErrUnknownPredictor, name)
+		}
+		bits = uint(value)
+	}
+	switch {
+	case v[0] == "static" && len(v) == 1:
+		return StaticNotTaken{}, nil
+	case v[0] == "btfn" && len(v) == 1:
+		return BTFN{}, nil
+	case v[0] == "1bit":
+		return NewCounters(bits, 1), nil
+	case v[0] == "2bit":
+		return NewCounters(bits, 2), nil
+	case v[0] == "gshare":
+		return NewGShare(bits), nil
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownPredictor, name)
+	}
+}
+
+// BranchStats contains the statistics of a single branch.
+type BranchStats struct {
+	PC           uint16 // address of the branch
+	Instr        uint16 // branch instruction
+	Executed     uint64 // number of times the branch executed
+	Taken        uint64 // number of times the branch was taken
+	Mispredicted uint64 // number of mispredictions
+}
+
+// MispredictionRate returns the ratio of mispredicted executions.
+func (s BranchStats) MispredictionRate() float64 {
+	if s.Executed == 0 {
+		return 0
+	}
+	return float64(s.Mispredicted) / float64(s.Executed)
+}
+
+// String generates a string representation of the statistics.
+func (s BranchStats) String() string {
+	return fmt.Sprintf("{Executed:%d Taken:%d Mispredicted:%d MispredictionRate:%.4f}",
+		s.Executed, s.Taken, s.Mispredicted, s.MispredictionRate())
+}
+
+// Tracker tracks the branches using a predictor for BEQ and a branch
+// target buffer, remembering the last target, for JALR. A Tracker is not
+// goroutine safe; a single goroutine should manage it.
+type Tracker struct {
+	Predictor Predictor
+
+	branches map[uint16]*BranchStats
+	btb      map[uint16]uint16
+}
+
+// NewTracker creates a new Tracker using the given predictor.
+func NewTracker(predictor Predictor) *Tracker {
+	return &Tracker{
+		Predictor: predictor,
+		branches:  make(map[uint16]*BranchStats),
+		btb:       make(map[uint16]uint16),
+	}
+}
+
+// isJump returns true if instr is a JALR that is not special (e.g., HALT).
+func isJump(instr uint16) bool {
+	ra := (instr >> 10) & 0b0111
+	rb := (instr >> 7) & 0b0111
+	return instr>>13 == vm.OpcodeJALR && (ra != 0 || rb != 0)
+}
+
+// IsBranch returns true if instr is a BEQ or a JALR that is not special.
+func IsBranch(instr uint16) bool {
+	return instr>>13 == vm.OpcodeBEQ || isJump(instr)
+}
+
+// Predict returns the predicted address of the instruction following
+// the instruction instr located at pc. Predict has no side effects.
+func (t *Tracker) Predict(pc, instr uint16) uint16 {
+	switch {
+	case instr>>13 == vm.OpcodeBEQ:
+		target := pc + 1 + vm.SignExtend7(instr&0b111_1111)
+		if t.Predictor.Predict(pc, target) {
+			return target
+		}
+	case isJump(instr):
+		if target, found := t.btb[pc]; found {
+			return target
+		}
+	}
+	return pc + 1
+}
+
+// Resolve updates the predictor and the statistics given the address
+// of the instruction following the instruction instr located at pc that
+// was predicted, when fetching, and the actual one. For BEQ, taken is
+// whether the registers were equal, which we cannot infer from next when
+// the offset is zero, while we always consider JALR taken. Resolve ignores
+// instructions that are not branches.
+func (t *Tracker) Resolve(pc, instr, predicted, next uint16, taken bool) {
+	if !IsBranch(instr) {
+		return
+	}
+	correct := predicted == next
+	taken = taken || isJump(instr)
+	if instr>>13 == vm.OpcodeBEQ {
+		t.Predictor.Update(pc, pc+1+vm.SignExtend7(instr&0b111_1111), taken)
+	} else {
+		t.btb[pc] = next
+	}
+	stats := t.branches[pc]
+	if stats == nil {
+		stats = &BranchStats{PC: pc}
+		t.branches[pc] = stats
+	}
+	stats.Instr = instr
+	stats.Executed++
+	if taken {
+		stats.Taken++
+	}
+	if !correct {
+		stats.Mispredicted++
+	}
+}
+
+// Attach registers an observer on machine that calls Observe for each
+// instruction that machine executes without errors.
+func (t *Tracker) Attach(machine *vm.VM) {
+	machine.AddObserver(&observer{machine: machine, tracker: t})
+}
+
+// observer is the vm.Observer registered by Attach.
+type observer struct {
+	vm.NopObserver
+	machine *vm.VM
+	tracker *Tracker
+}
+
+// AfterInstruction implements vm.Observer.AfterInstruction.
+func (o *observer) AfterInstruction(pc, instr uint16, err error) {
+	if err == nil {
+		o.tracker.Observe(pc, instr, o.machine.PC, Taken(instr, &o.machine.GPR))
+	}
+}
+
+// Taken returns whether the instruction instr is a taken BEQ given the
+// registers. Since BEQ does not write registers, the registers may be
+// either the ones before or the ones after executing instr.
+func Taken(instr uint16, gpr *[vm.NumRegisters]uint16) bool {
+	ra := (instr >> 10) & 0b0111
+	rb := (instr >> 7) & 0b0111
+	return instr>>13 == vm.OpcodeBEQ && gpr[ra] == gpr[rb]
+}
+
+// Observe predicts and immediately resolves the instruction instr located
+// at pc given the address of the next instruction and, for BEQ, whether
+// it was taken. Use this function with the functional VM after executing
+// each instruction.
+func (t *Tracker) Observe(pc, instr, next uint16, taken bool) {
+	t.Resolve(pc, instr, t.Predict(pc, instr), next, taken)
+}
+
+// Branches returns the statistics of each branch sorted by address.
+func (t *Tracker) Branches() []BranchStats {
+	var out []BranchStats
+	for _, stats := range t.branches {
+		out = append(out, *stats)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].PC < out[j].PC
+	})
+	return out
+}
+
+// Total returns the statistics aggregated over all the branches.
+func (t *Tracker) Total() BranchStats {
+	var total BranchStats
+	for _, stats := range t.branches {
+		total.Executed += stats.Executed
+		total.Taken += stats.Taken
+		total.Mispredicted += stats.Mispredicted
+	}
+	return total
+}
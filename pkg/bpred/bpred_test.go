@@ -0,0 +1,205 @@
+package bpred
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// beq returns the encoding of `beq ra rb offset`.
+func beq(ra, rb, offset uint16) uint16 {
+	return vm.OpcodeBEQ<<13 | ra<<10 | rb<<7 | offset&0b111_1111
+}
+
+// jalr returns the encoding of `jalr ra rb`.
+func jalr(ra, rb uint16) uint16 {
+	return vm.OpcodeJALR<<13 | ra<<10 | rb<<7
+}
+
+// outcome is the outcome of a branch along with the expected
+// prediction after updating the predictor with it.
+type outcome struct {
+	taken    bool
+	expected bool
+}
+
+// checkOutcomes updates the predictor for the branch at pc with each
+// outcome and checks the following prediction.
+func checkOutcomes(t *testing.T, p Predictor, pc uint16, outcomes []outcome) {
+	for idx, o := range outcomes {
+		p.Update(pc, pc+10, o.taken)
+		if got := p.Predict(pc, pc+10); got != o.expected {
+			t.Fatalf("%s: after outcome %d: expected %v, got %v", p.Name(), idx, o.expected, got)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	c := NewCounters(4, 2)
+	if c.Predict(0, 10) {
+		t.Fatal("the initial state should be weakly not taken")
+	}
+	checkOutcomes(t, c, 0, []outcome{
+		{true, true},   // 1 -> 2 (weakly taken)
+		{true, true},   // 2 -> 3 (strongly taken)
+		{true, true},   // 3 -> 3 (saturated)
+		{false, true},  // 3 -> 2
+		{false, false}, // 2 -> 1
+		{false, false}, // 1 -> 0
+		{false, false}, // 0 -> 0 (saturated)
+		{true, false},  // 0 -> 1
+		{true, true},   // 1 -> 2
+	})
+	one := NewCounters(4, 1)
+	if one.Predict(0, 10) {
+		t.Fatal("the initial state should be not taken")
+	}
+	checkOutcomes(t, one, 0, []outcome{
+		{true, true},
+		{true, true},
+		{false, false},
+		{true, true},
+	})
+}
+
+func TestCountersAliasing(t *testing.T) {
+	c := NewCounters(2, 1)
+	c.Update(1, 0, true)
+	if !c.Predict(5, 0) {
+		t.Fatal("branches 1 and 5 should share the counter")
+	}
+	if c.Predict(2, 0) {
+		t.Fatal("branches 1 and 2 should not share the counter")
+	}
+}
+
+func TestGShare(t *testing.T) {
+	g := NewGShare(2)
+	g.Update(0, 10, true) // counter 0 -> 2, history 01
+	if g.history != 0b01 {
+		t.Fatalf("expected history 01, got %02b", g.history)
+	}
+	if g.Predict(0, 10) {
+		t.Fatal("pc 0 with history 01 should use counter 1")
+	}
+	if !g.Predict(1, 10) {
+		t.Fatal("pc 1 with history 01 should use counter 0")
+	}
+	g.Update(0, 10, true)  // counter 1 -> 2, history 11
+	g.Update(0, 10, false) // counter 3 -> 0, history 10
+	if g.history != 0b10 {
+		t.Fatalf("expected history 10, got %02b", g.history)
+	}
+	expected := []uint8{2, 2, 1, 0}
+	for idx, value := range expected {
+		if g.counters.counters[idx] != value {
+			t.Fatalf("expected counters %v, got %v", expected, g.counters.counters)
+		}
+	}
+	if !g.Predict(3, 10) {
+		t.Fatal("pc 3 with history 10 should use counter 1")
+	}
+}
+
+func TestStatic(t *testing.T) {
+	if (StaticNotTaken{}).Predict(10, 5) {
+		t.Fatal("static should predict not taken")
+	}
+	if !(BTFN{}).Predict(10, 5) || !(BTFN{}).Predict(10, 10) || (BTFN{}).Predict(10, 11) {
+		t.Fatal("btfn should predict backward branches as taken")
+	}
+}
+
+func TestNew(t *testing.T) {
+	for name, expected := range map[string]string{
+		"static":    "static",
+		"btfn":      "btfn",
+		"1bit":      "1bit:10",
+		"2bit:4":    "2bit:4",
+		"gshare:12": "gshare:12",
+	} {
+		p, err := New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name() != expected {
+			t.Fatalf("%s: expected %s, got %s", name, expected, p.Name())
+		}
+	}
+	for _, name := range []string{"", "bogus", "static:4", "2bit:0", "2bit:17", "gshare:x"} {
+		if _, err := New(name); !errors.Is(err, ErrUnknownPredictor) {
+			t.Fatalf("%q: expected ErrUnknownPredictor, got %v", name, err)
+		}
+	}
+}
+
+func TestTrackerBTB(t *testing.T) {
+	tracker := NewTracker(StaticNotTaken{})
+	instr := jalr(7, 1)
+	if next := tracker.Predict(5, instr); next != 6 {
+		t.Fatalf("expected 6 before the first execution, got %d", next)
+	}
+	tracker.Observe(5, instr, 20, false)
+	if next := tracker.Predict(5, instr); next != 20 {
+		t.Fatalf("expected the last target, got %d", next)
+	}
+	tracker.Observe(5, instr, 20, false)
+	tracker.Observe(5, instr, 30, false)
+	if next := tracker.Predict(5, instr); next != 30 {
+		t.Fatalf("expected the last target, got %d", next)
+	}
+	expected := BranchStats{PC: 5, Instr: instr, Executed: 3, Taken: 3, Mispredicted: 2}
+	if stats := tracker.Branches(); len(stats) != 1 || stats[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	// HALT is not a branch
+	tracker.Observe(6, vm.OpcodeJALR<<13|vm.ExceptionTypeEXCEPTION|vm.ExceptionValueHALT, 7, false)
+	if len(tracker.Branches()) != 1 {
+		t.Fatal("the tracker should ignore HALT")
+	}
+}
+
+func TestTrackerBEQ(t *testing.T) {
+	tracker := NewTracker(NewCounters(4, 2))
+	loop := beq(1, 2, 0x7e) // beq r1 r2 -2
+	tracker.Observe(3, loop, 2, true)
+	if next := tracker.Predict(3, loop); next != 2 {
+		t.Fatalf("expected the target, got %d", next)
+	}
+	tracker.Observe(3, loop, 4, false)
+	zero := beq(1, 1, 0) // taken, but the target is the next instruction
+	tracker.Observe(8, zero, 9, true)
+	tracker.Observe(8, zero, 9, true)
+	expected := []BranchStats{
+		{PC: 3, Instr: loop, Executed: 2, Taken: 1, Mispredicted: 2},
+		{PC: 8, Instr: zero, Executed: 2, Taken: 2},
+	}
+	stats := tracker.Branches()
+	if len(stats) != len(expected) || stats[0] != expected[0] || stats[1] != expected[1] {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	total := BranchStats{Executed: 4, Taken: 3, Mispredicted: 2}
+	if tracker.Total() != total {
+		t.Fatalf("expected %+v, got %+v", total, tracker.Total())
+	}
+}
+
+func TestTrackerAttach(t *testing.T) {
+	machine := new(vm.VM)
+	machine.M[0] = beq(0, 0, 0) // always taken, offset zero
+	machine.M[1] = beq(0, 1, 0) // not taken, offset zero
+	machine.M[2] = beq(1, 1, 0) // taken, offset zero
+	machine.GPR[1] = 1
+	tracker := NewTracker(StaticNotTaken{})
+	tracker.Attach(machine)
+	for idx := 0; idx < 3; idx++ {
+		machine.Fetch()
+		if err := machine.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total := tracker.Total(); total.Executed != 3 || total.Taken != 2 || total.Mispredicted != 0 {
+		t.Fatalf("unexpected stats: %+v", total)
+	}
+}
@@ -0,0 +1,242 @@
+// Package cache simulates a configurable cache hierarchy for the RiSC-16 VM.
+//
+// A cache has a number of sets, each containing a number of ways, each
+// holding a block of words. A cache with a single way per set is direct
+// mapped, while a cache with a single set is fully associative.
+//
+// Write-back caches allocate a block on a write miss, while write-through
+// caches forward every write to the next level and do not allocate on a
+// write miss. The last level of the hierarchy is backed by the memory.
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Replacement is a replacement policy.
+type Replacement int
+
+// The following constants define the replacement policies.
+const (
+	ReplacementLRU = Replacement(iota)
+	ReplacementFIFO
+	ReplacementRandom
+)
+
+// WritePolicy is a write policy.
+type WritePolicy int
+
+// The following constants define the write policies.
+const (
+	WriteBack = WritePolicy(iota)
+	WriteThrough
+)
+
+// Config is the configuration of a cache.
+type Config struct {
+	Name        string      // name of the cache (e.g., "L1D")
+	Sets        int         // number of sets
+	Ways        int         // number of ways per set
+	BlockSize   int         // number of words per block
+	Replacement Replacement // replacement policy
+	Write       WritePolicy // write policy
+	Seed        int64       // seed for the random replacement policy
+}
+
+// Stats contains cache statistics.
+type Stats struct {
+	ReadHits    uint64 // reads that hit
+	ReadMisses  uint64 // reads that missed
+	WriteHits   uint64 // writes that hit
+	WriteMisses uint64 // writes that missed
+	Evictions   uint64 // valid blocks that were replaced
+	Writebacks  uint64 // dirty blocks written to the next level
+}
+
+// Accesses returns the total number of accesses.
+func (s Stats) Accesses() uint64 {
+	return s.ReadHits + s.ReadMisses + s.WriteHits + s.WriteMisses
+}
+
+// MissRate returns the ratio between misses and accesses.
+func (s Stats) MissRate() float64 {
+	if s.Accesses() == 0 {
+		return 0
+	}
+	return float64(s.ReadMisses+s.WriteMisses) / float64(s.Accesses())
+}
+
+// String generates a string representation of the statistics.
+func (s Stats) String() string {
+	return fmt.Sprintf(
+		"{Accesses:%d ReadHits:%d ReadMisses:%d WriteHits:%d WriteMisses:%d MissRate:%.4f Evictions:%d Writebacks:%d}",
+		s.Accesses(), s.ReadHits, s.ReadMisses, s.WriteHits, s.WriteMisses,
+		s.MissRate(), s.Evictions, s.Writebacks)
+}
+
+// Event describes a single cache access.
+type Event struct {
+	Cache   string // name of the cache
+	Write   bool   // whether this is a write
+	Addr    uint16 // accessed address
+	Hit     bool   // whether the access hit
+	Evicted bool   // whether a valid block was evicted
+	Victim  uint16 // first address of the evicted block
+}
+
+// String generates a string representation of the event.
+func (e Event) String() string {
+	kind := "read"
+	if e.Write {
+		kind = "write"
+	}
+	outcome := "miss"
+	if e.Hit {
+		outcome = "hit"
+	}
+	s := fmt.Sprintf("%s: %s %d %s", e.Cache, kind, e.Addr, outcome)
+	if e.Evicted {
+		s += fmt.Sprintf(" evict %d", e.Victim)
+	}
+	return s
+}
+
+// line is a cache line.
+type line struct {
+	valid bool
+	dirty bool
+	tag   uint32
+	stamp uint64 // time of last use (LRU) or of insertion (FIFO)
+}
+
+// Cache is a simulated cache. A cache is not goroutine safe.
+type Cache struct {
+	// Next is the next level of the hierarchy. When nil, the
+	// cache is backed directly by the memory.
+	Next *Cache
+
+	// Trace, if not nil, is called for each access.
+	Trace func(Event)
+
+	clock  uint64
+	config Config
+	rnd    *rand.Rand
+	sets   [][]line
+	stats  Stats
+}
+
+// ErrInvalidConfig indicates that a cache configuration is invalid.
+var ErrInvalidConfig = errors.New("cache: invalid configuration")
+
+// New creates a new cache with the given configuration.
+func New(config Config) (*Cache, error) {
+	if config.Sets < 1 || config.Ways < 1 || config.BlockSize < 1 ||
+		config.Sets*config.Ways*config.BlockSize > 1<<16 {
+		return nil, fmt.Errorf("%w: %s has %d sets, %d ways, and %d-word blocks",
+			ErrInvalidConfig, config.Name, config.Sets, config.Ways, config.BlockSize)
+	}
+	c := &Cache{
+		config: config,
+		rnd:    rand.New(rand.NewSource(config.Seed)),
+		sets:   make([][]line, config.Sets),
+	}
+	for idx := range c.sets {
+		c.sets[idx] = make([]line, config.Ways)
+	}
+	return c, nil
+}
+
+// Config returns the cache configuration.
+func (c *Cache) Config() Config {
+	return c.config
+}
+
+// Stats returns the statistics collected so far.
+func (c *Cache) Stats() Stats {
+	return c.stats
+}
+
+// Access simulates reading (or writing, if write is true) the given
+// address and returns whether the access hit.
+func (c *Cache) Access(write bool, addr uint16) bool {
+	c.clock++
+	block := uint32(addr) / uint32(c.config.BlockSize)
+	set := c.sets[block%uint32(c.config.Sets)]
+	tag := block / uint32(c.config.Sets)
+	event := Event{Cache: c.config.Name, Write: write, Addr: addr}
+	defer func() {
+		if c.Trace != nil {
+			c.Trace(event)
+		}
+	}()
+	for idx := range set {
+		if set[idx].valid && set[idx].tag == tag {
+			event.Hit = true
+			if c.config.Replacement == ReplacementLRU {
+				set[idx].stamp = c.clock
+			}
+			if !write {
+				c.stats.ReadHits++
+				return true
+			}
+			c.stats.WriteHits++
+			if c.config.Write == WriteThrough {
+				c.forward(true, addr)
+			} else {
+				set[idx].dirty = true
+			}
+			return true
+		}
+	}
+	if !write {
+		c.stats.ReadMisses++
+	} else {
+		c.stats.WriteMisses++
+		if c.config.Write == WriteThrough {
+			c.forward(true, addr) // no write allocate
+			return false
+		}
+	}
+	victim := &set[c.victim(set)]
+	if victim.valid {
+		c.stats.Evictions++
+		event.Evicted = true
+		victimBlock := victim.tag*uint32(c.config.Sets) + block%uint32(c.config.Sets)
+		event.Victim = uint16(victimBlock * uint32(c.config.BlockSize))
+		if victim.dirty {
+			c.stats.Writebacks++
+			c.forward(true, event.Victim)
+		}
+	}
+	c.forward(false, addr)
+	*victim = line{valid: true, dirty: write, tag: tag, stamp: c.clock}
+	return false
+}
+
+// forward forwards an access to the next level, if any.
+func (c *Cache) forward(write bool, addr uint16) {
+	if c.Next != nil {
+		c.Next.Access(write, addr)
+	}
+}
+
+// victim returns the index of the way to replace in the given set.
+func (c *Cache) victim(set []line) int {
+	for idx := range set {
+		if !set[idx].valid {
+			return idx
+		}
+	}
+	if c.config.Replacement == ReplacementRandom {
+		return c.rnd.Intn(len(set))
+	}
+	oldest := 0
+	for idx := range set {
+		if set[idx].stamp < set[oldest].stamp {
+			oldest = idx
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// access is a single access in a test sequence.
+type access struct {
+	write bool
+	addr  uint16
+}
+
+// newCache creates a new cache with the given configuration and
+// returns it along with the slice where we record its events.
+func newCache(t *testing.T, config Config) (*Cache, *[]Event) {
+	c, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &[]Event{}
+	c.Trace = func(ev Event) {
+		*events = append(*events, ev)
+	}
+	return c, events
+}
+
+// run performs the given accesses on c.
+func run(c *Cache, accesses []access) {
+	for _, a := range accesses {
+		c.Access(a.write, a.addr)
+	}
+}
+
+// reads returns read accesses to the given addresses.
+func reads(addrs ...uint16) (out []access) {
+	for _, addr := range addrs {
+		out = append(out, access{addr: addr})
+	}
+	return
+}
+
+func TestReplacement(t *testing.T) {
+	tests := []struct {
+		name        string
+		replacement Replacement
+		expected    []Event
+	}{{
+		name:        "LRU",
+		replacement: ReplacementLRU,
+		expected: []Event{
+			{Cache: "C", Addr: 0},
+			{Cache: "C", Addr: 1},
+			{Cache: "C", Addr: 0, Hit: true},
+			{Cache: "C", Addr: 2, Evicted: true, Victim: 1}, // 1 is least recently used
+			{Cache: "C", Addr: 0, Hit: true},
+			{Cache: "C", Addr: 1, Evicted: true, Victim: 2},
+		},
+	}, {
+		name:        "FIFO",
+		replacement: ReplacementFIFO,
+		expected: []Event{
+			{Cache: "C", Addr: 0},
+			{Cache: "C", Addr: 1},
+			{Cache: "C", Addr: 0, Hit: true},
+			{Cache: "C", Addr: 2, Evicted: true, Victim: 0}, // 0 is the oldest
+			{Cache: "C", Addr: 0, Evicted: true, Victim: 1},
+			{Cache: "C", Addr: 1, Evicted: true, Victim: 2},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, events := newCache(t, Config{Name: "C", Sets: 1, Ways: 2, BlockSize: 1,
+				Replacement: tt.replacement})
+			run(c, reads(0, 1, 0, 2, 0, 1))
+			if !reflect.DeepEqual(*events, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, *events)
+			}
+			hits := uint64(0)
+			for _, ev := range tt.expected {
+				if ev.Hit {
+					hits++
+				}
+			}
+			expected := Stats{ReadHits: hits, ReadMisses: 6 - hits, Evictions: 4 - hits}
+			if c.Stats() != expected {
+				t.Fatalf("expected %s, got %s", expected, c.Stats())
+			}
+		})
+	}
+}
+
+func TestReplacementRandom(t *testing.T) {
+	config := Config{Sets: 1, Ways: 4, BlockSize: 1, Replacement: ReplacementRandom, Seed: 7}
+	sequence := reads(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3)
+	c1, events1 := newCache(t, config)
+	run(c1, sequence)
+	c2, events2 := newCache(t, config)
+	run(c2, sequence)
+	if !reflect.DeepEqual(*events1, *events2) {
+		t.Fatal("the same seed produced different replacements")
+	}
+	for idx, ev := range *events1 {
+		if ev.Hit {
+			continue
+		}
+		if evicted := idx >= 4; ev.Evicted != evicted {
+			t.Fatalf("access %d: expected Evicted=%v, got %v", idx, evicted, ev.Evicted)
+		}
+	}
+	if stats := c1.Stats(); stats.Accesses() != 14 || stats.Evictions != stats.ReadMisses-4 {
+		t.Fatalf("unexpected stats: %s", stats)
+	}
+}
+
+func TestMapping(t *testing.T) {
+	// 2 sets of 2-word blocks: addresses 0-1 and 4-5 map to set 0,
+	// while addresses 2-3 and 6-7 map to set 1
+	c, events := newCache(t, Config{Name: "C", Sets: 2, Ways: 1, BlockSize: 2})
+	run(c, reads(0, 1, 2, 3, 5, 0, 7))
+	expected := []Event{
+		{Cache: "C", Addr: 0},
+		{Cache: "C", Addr: 1, Hit: true},
+		{Cache: "C", Addr: 2},
+		{Cache: "C", Addr: 3, Hit: true},
+		{Cache: "C", Addr: 5, Evicted: true, Victim: 0},
+		{Cache: "C", Addr: 0, Evicted: true, Victim: 4},
+		{Cache: "C", Addr: 7, Evicted: true, Victim: 2},
+	}
+	if !reflect.DeepEqual(*events, expected) {
+		t.Fatalf("expected %v, got %v", expected, *events)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	l1, _ := newCache(t, Config{Name: "L1", Sets: 1, Ways: 1, BlockSize: 2})
+	l2, events := newCache(t, Config{Name: "L2", Sets: 1, Ways: 4, BlockSize: 2})
+	l1.Next = l2
+	run(l1, []access{
+		{write: true, addr: 0}, // miss: allocate by reading from L2
+		{write: true, addr: 1}, // hit: just mark dirty
+		{addr: 2},              // miss: write back 0-1 and read from L2
+		{addr: 3},              // hit
+	})
+	expected := Stats{WriteHits: 1, WriteMisses: 1, ReadHits: 1, ReadMisses: 1,
+		Evictions: 1, Writebacks: 1}
+	if l1.Stats() != expected {
+		t.Fatalf("L1: expected %s, got %s", expected, l1.Stats())
+	}
+	expectedEvents := []Event{
+		{Cache: "L2", Addr: 0},
+		{Cache: "L2", Write: true, Addr: 0, Hit: true},
+		{Cache: "L2", Addr: 2},
+	}
+	if !reflect.DeepEqual(*events, expectedEvents) {
+		t.Fatalf("L2: expected %v, got %v", expectedEvents, *events)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	l1, _ := newCache(t, Config{Name: "L1", Sets: 1, Ways: 1, BlockSize: 2, Write: WriteThrough})
+	l2, events := newCache(t, Config{Name: "L2", Sets: 1, Ways: 4, BlockSize: 2})
+	l1.Next = l2
+	run(l1, []access{
+		{write: true, addr: 0}, // miss: forward without allocating
+		{addr: 0},              // miss: allocate
+		{write: true, addr: 1}, // hit: forward
+		{addr: 2},              // miss: evict the clean block
+	})
+	expected := Stats{WriteHits: 1, WriteMisses: 1, ReadMisses: 2, Evictions: 1}
+	if l1.Stats() != expected {
+		t.Fatalf("L1: expected %s, got %s", expected, l1.Stats())
+	}
+	expectedEvents := []Event{
+		{Cache: "L2", Write: true, Addr: 0},
+		{Cache: "L2", Addr: 0, Hit: true},
+		{Cache: "L2", Write: true, Addr: 1, Hit: true},
+		{Cache: "L2", Addr: 2},
+	}
+	if !reflect.DeepEqual(*events, expectedEvents) {
+		t.Fatalf("L2: expected %v, got %v", expectedEvents, *events)
+	}
+	expected = Stats{ReadHits: 1, ReadMisses: 1, WriteHits: 1, WriteMisses: 1}
+	if l2.Stats() != expected {
+		t.Fatalf("L2: expected %s, got %s", expected, l2.Stats())
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for _, config := range []Config{
+		{Sets: 0, Ways: 1, BlockSize: 1},
+		{Sets: 1, Ways: 0, BlockSize: 1},
+		{Sets: 1, Ways: 1, BlockSize: 0},
+		{Sets: 1 << 10, Ways: 1 << 4, BlockSize: 1 << 4},
+	} {
+		if _, err := New(config); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%+v: expected ErrInvalidConfig, got %v", config, err)
+		}
+	}
+}
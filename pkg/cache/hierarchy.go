@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// Hierarchy is a cache hierarchy that can be attached to a VM. The
+// first level may be split into instruction and data caches or may be
+// unified, in which case Instruction and Data are the same cache. A nil
+// first level cache means that the corresponding accesses are uncached.
+type Hierarchy struct {
+	Instruction *Cache   // first level cache for instruction fetches
+	Data        *Cache   // first level cache for loads and stores
+	All         []*Cache // all the caches, from the first to the last level
+}
+
+// Attach attaches the hierarchy to the given VM. If the VM already has
+// an AccessHook, the new hook calls it after simulating the access.
+func (h *Hierarchy) Attach(machine *vm.VM) {
+	next := machine.AccessHook
+	if next == nil {
+		machine.AccessHook = h.Access
+		return
+	}
+	machine.AccessHook = func(kind vm.AccessKind, addr uint16) {
+		h.Access(kind, addr)
+		next(kind, addr)
+	}
+}
+
+// Access routes a memory access to the proper first level cache.
+func (h *Hierarchy) Access(kind vm.AccessKind, addr uint16) {
+	switch kind {
+	case vm.AccessFetch:
+		if h.Instruction != nil {
+			h.Instruction.Access(false, addr)
+		}
+	default:
+		if h.Data != nil {
+			h.Data.Access(kind == vm.AccessWrite, addr)
+		}
+	}
+}
+
+// SetTrace sets the trace function of all the caches.
+func (h *Hierarchy) SetTrace(trace func(Event)) {
+	for _, c := range h.All {
+		c.Trace = trace
+	}
+}
+
+// ParseHierarchy parses the specification of a cache hierarchy. The
+// specification is a comma separated list of `level=config` entries
+// where level is one of `i` (first level instruction cache), `d` (first
+// level data cache), `u` (unified first level cache), `l2`, and `l3`,
+// and where config has the format accepted by ParseConfig.
+//
+// For example, `i=64x1x4,d=32x2x4:lru:wb,l2=128x4x8` configures split
+// direct-mapped and 2-way first level caches backed by a 4-way L2.
+func ParseHierarchy(spec string) (*Hierarchy, error) {
+	levels := make(map[string]*Cache)
+	for _, entry := range strings.Split(spec, ",") {
+		v := strings.SplitN(entry, "=", 2)
+		if len(v) != 2 {
+			return nil, fmt.Errorf("%w: expected level=config in '%s'", ErrInvalidConfig, entry)
+		}
+		name, found := levelNames[v[0]]
+		if !found {
+			return nil, fmt.Errorf("%w: unknown level '%s'", ErrInvalidConfig, v[0])
+		}
+		if levels[v[0]] != nil {
+			return nil, fmt.Errorf("%w: duplicate level '%s'", ErrInvalidConfig, v[0])
+		}
+		config, err := ParseConfig(v[1])
+		if err != nil {
+			return nil, err
+		}
+		config.Name = name
+		c, err := New(config)
+		if err != nil {
+			return nil, err
+		}
+		levels[v[0]] = c
+	}
+	h := &Hierarchy{Instruction: levels["i"], Data: levels["d"]}
+	if unified := levels["u"]; unified != nil {
+		if h.Instruction != nil || h.Data != nil {
+			return nil, fmt.Errorf("%w: cannot mix unified and split caches", ErrInvalidConfig)
+		}
+		h.Instruction, h.Data = unified, unified
+		h.All = append(h.All, unified)
+	} else {
+		for _, c := range []*Cache{h.Instruction, h.Data} {
+			if c != nil {
+				h.All = append(h.All, c)
+			}
+		}
+	}
+	if len(h.All) < 1 {
+		return nil, fmt.Errorf("%w: missing first level cache", ErrInvalidConfig)
+	}
+	upper := h.All
+	for _, level := range []string{"l2", "l3"} {
+		c := levels[level]
+		if c == nil {
+			continue
+		}
+		for _, u := range upper {
+			u.Next = c
+		}
+		h.All = append(h.All, c)
+		upper = []*Cache{c}
+	}
+	if levels["l3"] != nil && levels["l2"] == nil {
+		return nil, fmt.Errorf("%w: l3 without l2", ErrInvalidConfig)
+	}
+	return h, nil
+}
+
+// levelNames maps each level in a hierarchy specification to the name
+// of the corresponding cache.
+var levelNames = map[string]string{
+	"i":  "L1I",
+	"d":  "L1D",
+	"u":  "L1",
+	"l2": "L2",
+	"l3": "L3",
+}
+
+// ParseConfig parses a cache configuration with the format
+// `SETSxWAYSxBLOCK[:REPLACEMENT][:WRITE]`, where SETS, WAYS, and BLOCK
+// are the number of sets, the number of ways per set, and the number of
+// words per block, REPLACEMENT is one of `lru` (the default), `fifo`,
+// and `random`, and WRITE is either `wb` (the default) or `wt`.
+func ParseConfig(spec string) (Config, error) {
+	var config Config
+	v := strings.Split(spec, ":")
+	geometry := strings.Split(v[0], "x")
+	if len(geometry) != 3 {
+		return config, fmt.Errorf("%w: expected SETSxWAYSxBLOCK in '%s'", ErrInvalidConfig, v[0])
+	}
+	var values [3]int
+	for idx, s := range geometry {
+		value, err := strconv.Atoi(s)
+		if err != nil {
+			return config, fmt.Errorf("%w: invalid number '%s'", ErrInvalidConfig, s)
+		}
+		values[idx] = value
+	}
+	config.Sets, config.Ways, config.BlockSize = values[0], values[1], values[2]
+	for _, option := range v[1:] {
+		switch option {
+		case "lru":
+			config.Replacement = ReplacementLRU
+		case "fifo":
+			config.Replacement = ReplacementFIFO
+		case "random":
+			config.Replacement = ReplacementRandom
+		case "wb":
+			config.Write = WriteBack
+		case "wt":
+			config.Write = WriteThrough
+		default:
+			return config, fmt.Errorf("%w: unknown option '%s'", ErrInvalidConfig, option)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+func TestParseHierarchy(t *testing.T) {
+	h, err := ParseHierarchy("i=64x1x4,d=32x2x4:fifo:wt,l2=128x4x8:random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.All) != 3 || h.Instruction != h.All[0] || h.Data != h.All[1] {
+		t.Fatalf("unexpected hierarchy: %+v", h)
+	}
+	expected := Config{Name: "L1D", Sets: 32, Ways: 2, BlockSize: 4,
+		Replacement: ReplacementFIFO, Write: WriteThrough}
+	if h.Data.Config() != expected {
+		t.Fatalf("expected %+v, got %+v", expected, h.Data.Config())
+	}
+	if h.Instruction.Next != h.All[2] || h.Data.Next != h.All[2] || h.All[2].Next != nil {
+		t.Fatal("the first level caches are not backed by the L2")
+	}
+	for _, spec := range []string{
+		"", "x=1x1x1", "i=1x1x1,i=1x1x1", "u=1x1x1,d=1x1x1", "l2=1x1x1",
+		"u=1x1x1,l3=1x1x1", "u=1x1", "u=1x1x1:bogus", "u=0x1x1",
+	} {
+		if _, err := ParseHierarchy(spec); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%q: expected ErrInvalidConfig, got %v", spec, err)
+		}
+	}
+}
+
+func TestHierarchyAttach(t *testing.T) {
+	h, err := ParseHierarchy("i=4x1x1,d=4x1x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := new(vm.VM)
+	machine.M[0] = vm.OpcodeLW<<13 | 1<<10 | 10 // lw r1 r0 10
+	machine.M[1] = vm.OpcodeSW<<13 | 1<<10 | 11 // sw r1 r0 11
+	var previous []vm.AccessKind
+	machine.AccessHook = func(kind vm.AccessKind, addr uint16) {
+		previous = append(previous, kind)
+	}
+	h.Attach(machine)
+	for idx := 0; idx < 2; idx++ {
+		machine.Fetch()
+		if err := machine.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []vm.AccessKind{vm.AccessFetch, vm.AccessRead, vm.AccessFetch, vm.AccessWrite}
+	if len(previous) != len(expected) {
+		t.Fatalf("the previous hook saw %v, expected %v", previous, expected)
+	}
+	for idx := range expected {
+		if previous[idx] != expected[idx] {
+			t.Fatalf("the previous hook saw %v, expected %v", previous, expected)
+		}
+	}
+	if s := h.Instruction.Stats(); s.ReadMisses != 2 {
+		t.Fatalf("L1I: unexpected stats: %s", s)
+	}
+	if s := h.Data.Stats(); s.ReadMisses != 1 || s.WriteMisses != 1 {
+		t.Fatalf("L1D: unexpected stats: %s", s)
+	}
+}
@@ -0,0 +1,326 @@
+// Package coverage measures the code coverage of RiSC-16 assembly programs.
+//
+// A Source maps each address of an assembled program to the line of the
+// assembly source that generated it, using either the line numbers reported
+// by the assembler or the line table of an executable. A Coverage observes
+// a vm.VM and counts how many times the instruction at each address
+// executed and, for BEQ, how many times the branch was taken and not
+// taken. Combining the two, we produce line coverage and branch coverage,
+// as an annotated listing of the source or in the LCOV tracefile format.
+//
+// The addresses of a Source are the ones assigned by the assembler (e.g.,
+// using .org), hence a program in the machine code format must be loaded
+// at address zero, while an executable is loaded at the addresses of its
+// segments. A Source ignores the addresses generated by .fill and .space.
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/bpred"
+	"github.com/bassosimone/risc16/pkg/executable"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// Source is an assembly source along with its line table.
+type Source struct {
+	// Filename is the name of the source file.
+	Filename string
+
+	// Text contains the lines of the source.
+	Text []string
+
+	// Lines maps each address to the corresponding line number,
+	// starting from one, or zero for data and unassigned addresses.
+	Lines []int
+
+	// Code contains the assembled program.
+	Code []uint16
+}
+
+// ErrLineTable indicates that the line table of an executable
+// refers to lines that do not exist in the source.
+var ErrLineTable = errors.New("coverage: line table does not match the source")
+
+// readText reads the source from r and returns the corresponding Source
+// without the line table, along with the bytes of the source.
+func readText(filename string, r io.Reader) (*Source, []byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &Source{Filename: filename}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		s.Text = append(s.Text, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return s, data, nil
+}
+
+// NewSource assembles the source read from r and returns the
+// corresponding Source. The filename is only used for reporting.
+func NewSource(filename string, r io.Reader) (*Source, error) {
+	s, data, err := readText(filename, r)
+	if err != nil {
+		return nil, err
+	}
+	for instr := range asm.StartAssembler(bytes.NewReader(data)) {
+		if instr.Error != nil {
+			if err == nil {
+				err = fmt.Errorf("%s:%d: %w", filename, instr.Lineno, instr.Error)
+			}
+			continue // drain the channel
+		}
+		for len(s.Code) < int(instr.Address) {
+			s.Lines = append(s.Lines, 0) // gap left by .org
+			s.Code = append(s.Code, 0)
+		}
+		lineno := instr.Lineno
+		if instr.Data {
+			lineno = 0
+		}
+		s.Lines = append(s.Lines, lineno)
+		s.Code = append(s.Code, instr.Instruction)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewExecutableSource returns the Source of the executable exe, whose
+// source is read from r, using the line table of the executable rather
+// than assembling the source again. The filename is only used for reporting.
+func NewExecutableSource(filename string, r io.Reader, exe *executable.Executable) (*Source, error) {
+	s, _, err := readText(filename, r)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range exe.Segments {
+		end := int(seg.Addr) + len(seg.Words)
+		for len(s.Code) < end {
+			s.Lines = append(s.Lines, 0)
+			s.Code = append(s.Code, 0)
+		}
+		copy(s.Code[seg.Addr:], seg.Words)
+	}
+	for addr, lineno := range exe.Lines {
+		if lineno < 1 || lineno > len(s.Text) || int(addr) >= len(s.Lines) {
+			return nil, fmt.Errorf("%w: address %d, line %d", ErrLineTable, addr, lineno)
+		}
+		s.Lines[addr] = lineno
+	}
+	return s, nil
+}
+
+// Coverage is a vm.Observer collecting coverage information. A Coverage
+// is not goroutine safe; a single goroutine should manage it along with
+// the VM. Use New to create a Coverage.
+type Coverage struct {
+	// Source is the source of the program.
+	Source *Source
+
+	counts   [vm.MemorySize]uint64
+	machine  *vm.VM
+	notTaken [vm.MemorySize]uint64
+	taken    [vm.MemorySize]uint64
+}
+
+// New creates a new Coverage for machine and registers it as an observer.
+func New(machine *vm.VM, source *Source) *Coverage {
+	c := &Coverage{Source: source, machine: machine}
+	machine.AddObserver(c)
+	return c
+}
+
+// BeforeInstruction implements vm.Observer.BeforeInstruction.
+func (c *Coverage) BeforeInstruction(pc, instr uint16) {}
+
+// AfterInstruction implements vm.Observer.AfterInstruction.
+func (c *Coverage) AfterInstruction(pc, instr uint16, err error) {
+	c.counts[pc]++
+	if err == nil && instr>>13 == vm.OpcodeBEQ {
+		// we cannot use the PC because a BEQ with offset zero
+		// continues sequentially even when it is taken
+		if bpred.Taken(instr, &c.machine.GPR) {
+			c.taken[pc]++
+		} else {
+			c.notTaken[pc]++
+		}
+	}
+}
+
+// MemoryRead implements vm.Observer.MemoryRead.
+func (c *Coverage) MemoryRead(addr, value uint16) {}
+
+// MemoryWrite implements vm.Observer.MemoryWrite.
+func (c *Coverage) MemoryWrite(addr, old, value uint16) {}
+
+// RegisterWrite implements vm.Observer.RegisterWrite.
+func (c *Coverage) RegisterWrite(reg, old, value uint16) {}
+
+// Exception implements vm.Observer.Exception.
+func (c *Coverage) Exception(cause, epc uint16) {}
+
+var _ vm.Observer = &Coverage{}
+
+// Branch contains the coverage of a BEQ.
+type Branch struct {
+	Addr     uint16 // address of the BEQ
+	Taken    uint64 // number of times the branch was taken
+	NotTaken uint64 // number of times the branch was not taken
+}
+
+// Line contains the coverage of a source line generating code.
+type Line struct {
+	Lineno   int      // line number, starting from one
+	Count    uint64   // number of times the line executed
+	Branches []Branch // branches generated by the line
+}
+
+// Lines returns the coverage of the source lines generating code sorted
+// by line number. The count of a line is the maximum count of the
+// instructions it generated (e.g., `movi` generates two instructions).
+func (c *Coverage) Lines() []Line {
+	index := make(map[int]int)
+	var out []Line
+	for addr, lineno := range c.Source.Lines {
+		if lineno <= 0 {
+			continue
+		}
+		idx, found := index[lineno]
+		if !found {
+			idx = len(out)
+			index[lineno] = idx
+			out = append(out, Line{Lineno: lineno})
+		}
+		line := &out[idx]
+		if c.counts[addr] > line.Count {
+			line.Count = c.counts[addr]
+		}
+		if c.Source.Code[addr]>>13 == vm.OpcodeBEQ {
+			line.Branches = append(line.Branches, Branch{
+				Addr:     uint16(addr),
+				Taken:    c.taken[addr],
+				NotTaken: c.notTaken[addr],
+			})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { // executables may reorder the lines
+		return out[i].Lineno < out[j].Lineno
+	})
+	return out
+}
+
+// Stats contains coverage statistics.
+type Stats struct {
+	Lines       int // number of lines generating code
+	LinesHit    int // number of lines that executed
+	Branches    int // number of branch outcomes (two per BEQ)
+	BranchesHit int // number of branch outcomes that occurred
+}
+
+// String generates a string representation of the stats.
+func (s Stats) String() string {
+	return fmt.Sprintf("lines=%d/%d (%.1f%%) branches=%d/%d (%.1f%%)",
+		s.LinesHit, s.Lines, percent(s.LinesHit, s.Lines),
+		s.BranchesHit, s.Branches, percent(s.BranchesHit, s.Branches))
+}
+
+// percent returns the percentage of hit over total.
+func percent(hit, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(hit) / float64(total)
+}
+
+// Stats returns the coverage statistics.
+func (c *Coverage) Stats() Stats {
+	var stats Stats
+	for _, line := range c.Lines() {
+		stats.Lines++
+		if line.Count > 0 {
+			stats.LinesHit++
+		}
+		for _, branch := range line.Branches {
+			stats.Branches += 2
+			if branch.Taken > 0 {
+				stats.BranchesHit++
+			}
+			if branch.NotTaken > 0 {
+				stats.BranchesHit++
+			}
+		}
+	}
+	return stats
+}
+
+// WriteListing writes into w the source annotated with the number of
+// times each line executed, using `#####` for lines that never executed,
+// and with the number of times each branch was taken and not taken.
+func (c *Coverage) WriteListing(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	lines := make(map[int]Line)
+	for _, line := range c.Lines() {
+		lines[line.Lineno] = line
+	}
+	for idx, text := range c.Source.Text {
+		line, found := lines[idx+1]
+		switch {
+		case !found:
+			fmt.Fprintf(bw, "%9s:%5d: %s\n", "-", idx+1, text)
+		case line.Count == 0:
+			fmt.Fprintf(bw, "%9s:%5d: %s\n", "#####", idx+1, text)
+		default:
+			fmt.Fprintf(bw, "%9d:%5d: %s\n", line.Count, idx+1, text)
+		}
+		for _, branch := range line.Branches {
+			fmt.Fprintf(bw, "%9s %5s  branch at %d: taken %d, not taken %d\n", "", "",
+				branch.Addr, branch.Taken, branch.NotTaken)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteLCOV writes the coverage into w using the LCOV tracefile format.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "TN:\nSF:%s\n", c.Source.Filename)
+	var stats Stats
+	for _, line := range c.Lines() {
+		for idx, branch := range line.Branches {
+			for outcome, count := range []uint64{branch.Taken, branch.NotTaken} {
+				stats.Branches++
+				taken := "-" // the line never executed
+				if line.Count > 0 {
+					taken = fmt.Sprintf("%d", count)
+				}
+				if count > 0 {
+					stats.BranchesHit++
+				}
+				fmt.Fprintf(bw, "BRDA:%d,%d,%d,%s\n", line.Lineno, idx, outcome, taken)
+			}
+		}
+	}
+	fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", stats.Branches, stats.BranchesHit)
+	for _, line := range c.Lines() {
+		stats.Lines++
+		if line.Count > 0 {
+			stats.LinesHit++
+		}
+		fmt.Fprintf(bw, "DA:%d,%d\n", line.Lineno, line.Count)
+	}
+	fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", stats.Lines, stats.LinesHit)
+	return bw.Flush()
+}
@@ -0,0 +1,159 @@
+package coverage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/executable"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// branches is a program whose branches with offset zero continue
+// sequentially both when they are taken and when they are not.
+const branches = `	addi r1, r0, 1
+	beq r1, r0, l2
+l2:	beq r1, r1, l3
+l3:	beq r1, r0, end
+	addi r2, r0, 2
+end:	halt
+data:	.fill 7
+`
+
+// run loads s into a new VM, measures the coverage of its execution
+// until it halts, and returns the coverage.
+func run(t *testing.T, s *Source, load func(*vm.VM)) *Coverage {
+	machine := new(vm.VM)
+	load(machine)
+	c := New(machine, s)
+	result := machine.Run(context.Background(), vm.RunOptions{MaxInstructions: 1000})
+	if result.Reason != vm.StopHalted {
+		t.Fatalf("expected StopHalted, got %s", result.Reason)
+	}
+	return c
+}
+
+// newSource assembles source into a new Source.
+func newSource(t *testing.T, source string) *Source {
+	s, err := NewSource("branches.s", strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWriteLCOV(t *testing.T) {
+	s := newSource(t, branches)
+	c := run(t, s, func(machine *vm.VM) {
+		copy(machine.M[:], s.Code)
+	})
+	var buf strings.Builder
+	if err := c.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `TN:
+SF:branches.s
+BRDA:2,0,0,0
+BRDA:2,0,1,1
+BRDA:3,0,0,1
+BRDA:3,0,1,0
+BRDA:4,0,0,0
+BRDA:4,0,1,1
+BRF:6
+BRH:3
+DA:1,1
+DA:2,1
+DA:3,1
+DA:4,1
+DA:5,1
+DA:6,1
+LF:6
+LH:6
+end_of_record
+`
+	if buf.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+	stats := Stats{Lines: 6, LinesHit: 6, Branches: 6, BranchesHit: 3}
+	if c.Stats() != stats {
+		t.Fatalf("expected %+v, got %+v", stats, c.Stats())
+	}
+}
+
+func TestWriteLCOVNotExecuted(t *testing.T) {
+	s := newSource(t, `	halt
+	beq r0, r0, 2
+`)
+	c := run(t, s, func(machine *vm.VM) {
+		copy(machine.M[:], s.Code)
+	})
+	var buf strings.Builder
+	if err := c.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"BRDA:2,0,0,-\n", "BRDA:2,0,1,-\n", "DA:2,0\n", "LH:1\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	s := newSource(t, `	beq r0, r0, end
+	halt
+end:	halt
+`)
+	c := run(t, s, func(machine *vm.VM) {
+		copy(machine.M[:], s.Code)
+	})
+	var buf strings.Builder
+	if err := c.WriteListing(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "        1:    1: \tbeq r0, r0, end\n" +
+		"                 branch at 0: taken 1, not taken 0\n" +
+		"    #####:    2: \thalt\n" +
+		"        1:    3: end:\thalt\n"
+	if buf.String() != expected {
+		t.Fatalf("expected\n%q\ngot\n%q", expected, buf.String())
+	}
+}
+
+func TestNewExecutableSource(t *testing.T) {
+	source := `	halt
+	.fill 1
+	beq r0, r0, 0
+`
+	// the executable loads the second line at 10 and the third at 20
+	exe := &executable.Executable{
+		Entry: 20,
+		Segments: []vm.Segment{
+			{Addr: 10, Words: []uint16{1}},
+			{Addr: 20, Words: []uint16{vm.OpcodeBEQ << 13, vm.OpcodeJALR<<13 |
+				vm.ExceptionTypeEXCEPTION | vm.ExceptionValueHALT}},
+		},
+		Lines: map[uint16]int{20: 3, 21: 1},
+	}
+	s, err := NewExecutableSource("exe.s", strings.NewReader(source), exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Lines) != 22 || s.Lines[10] != 0 || s.Lines[20] != 3 || s.Lines[21] != 1 {
+		t.Fatalf("unexpected line table: %v", s.Lines)
+	}
+	c := run(t, s, func(machine *vm.VM) {
+		if err := machine.LoadSegments(exe.Entry, exe.Segments); err != nil {
+			t.Fatal(err)
+		}
+	})
+	lines := c.Lines()
+	if len(lines) != 2 || lines[0].Lineno != 1 || lines[0].Count != 1 || lines[1].Lineno != 3 ||
+		lines[1].Count != 1 || len(lines[1].Branches) != 1 || lines[1].Branches[0].Taken != 1 {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+	exe.Lines[21] = 4
+	if _, err := NewExecutableSource("exe.s", strings.NewReader(source), exe); !errors.Is(err, ErrLineTable) {
+		t.Fatalf("expected ErrLineTable, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package difftest implements differential testing of the RiSC-16 VM.
+//
+// We generate random valid programs (see Generate), run them both on a
+// vm.VM and on an independently written reference interpreter (see
+// Reference), and compare the two machine states after each instruction.
+// When the states differ, we report the first diverging step along with
+// both states. The FuzzCompare test allows fuzzing the VM using
+// `go test -fuzz FuzzCompare ./pkg/difftest`.
+package difftest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// State is the architectural state compared after each step.
+type State struct {
+	PC  uint16                  // program counter
+	GPR [vm.NumRegisters]uint16 // general purpose registers
+	Err error                   // error returned by the step, if any
+}
+
+// String generates a string representation of the state.
+func (s State) String() string {
+	out := fmt.Sprintf("PC=%d GPR=%v", s.PC, s.GPR)
+	if s.Err != nil {
+		out += fmt.Sprintf(" err=%q", s.Err.Error())
+	}
+	return out
+}
+
+// Divergence describes the first step where the VM and the
+// reference interpreter produced different states.
+type Divergence struct {
+	Step      uint64 // step number, starting from one
+	PC        uint16 // address of the instruction
+	Instr     uint16 // the instruction
+	VM        State  // state of the VM after the step
+	Reference State  // state of the reference interpreter after the step
+	Memory    string // description of the first memory difference, if any
+}
+
+// String generates a string representation of the divergence.
+func (d *Divergence) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "step %d: %d: %s\n", d.Step, d.PC, vm.Disassemble(d.Instr))
+	fmt.Fprintf(&builder, "  vm:        %s\n", d.VM)
+	fmt.Fprintf(&builder, "  reference: %s\n", d.Reference)
+	if d.Memory != "" {
+		fmt.Fprintf(&builder, "  memory:    %s\n", d.Memory)
+	}
+	return builder.String()
+}
+
+// Options contains options for Compare.
+type Options struct {
+	// MaxSteps is the maximum number of steps. Zero means DefaultMaxSteps.
+	MaxSteps uint64
+
+	// Step, if not nil, executes an instruction on the VM in place of
+	// calling Fetch and Execute (e.g., to test vm.VM.Step).
+	Step func(machine *vm.VM) error
+}
+
+// DefaultMaxSteps is the default maximum number of steps.
+const DefaultMaxSteps = 100000
+
+// Compare loads program at address zero of a vm.VM and of a Reference and
+// runs them until HALT, comparing their states after each step. It returns
+// the first divergence, or nil if the states never differed. Compare stops
+// without reporting a divergence when the reference interpreter executes
+// an instruction it does not support or after opts.MaxSteps steps.
+func Compare(program []uint16, opts Options) *Divergence {
+	maxSteps := opts.MaxSteps
+	if maxSteps == 0 {
+		maxSteps = DefaultMaxSteps
+	}
+	step := opts.Step
+	if step == nil {
+		step = func(machine *vm.VM) error {
+			machine.Fetch()
+			return machine.Execute()
+		}
+	}
+	machine, ref := new(vm.VM), new(Reference)
+	copy(machine.M[:], program)
+	copy(ref.M[:], program)
+	for count := uint64(1); count <= maxSteps; count++ {
+		pc, instr := ref.PC, ref.M[ref.PC]
+		refErr := ref.Step()
+		if errors.Is(refErr, ErrUnsupported) {
+			return nil
+		}
+		vmErr := step(machine)
+		d := &Divergence{
+			Step:      count,
+			PC:        pc,
+			Instr:     instr,
+			VM:        State{PC: machine.PC, GPR: machine.GPR, Err: vmErr},
+			Reference: State{PC: ref.PC, GPR: ref.R, Err: refErr},
+		}
+		if instr>>13 == vm.OpcodeSW || refErr != nil || count == maxSteps {
+			d.Memory = compareMemory(machine, ref)
+		}
+		halted := errors.Is(vmErr, vm.ErrHalted)
+		if d.VM.PC != d.Reference.PC || d.VM.GPR != d.Reference.GPR || d.Memory != "" ||
+			halted != (refErr != nil) || (vmErr != nil && !halted) {
+			return d
+		}
+		if halted {
+			break
+		}
+	}
+	return nil
+}
+
+// compareMemory returns a description of the first memory
+// difference, or an empty string if the memories are equal.
+func compareMemory(machine *vm.VM, ref *Reference) string {
+	if machine.M == ref.M {
+		return ""
+	}
+	for addr := range machine.M {
+		if machine.M[addr] != ref.M[addr] {
+			return fmt.Sprintf("M[%d]: vm=%d reference=%d", addr, machine.M[addr], ref.M[addr])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package difftest
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// steps contains the ways of executing an instruction on the VM.
+var steps = map[string]func(machine *vm.VM) error{
+	"Execute": nil, // the default of Compare
+	"Step":    (*vm.VM).Step,
+}
+
+func TestCompareRandomPrograms(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for idx := 0; idx < 200; idx++ {
+		program := Generate(rng, 64)
+		for name, step := range steps {
+			if d := Compare(program, Options{Step: step}); d != nil {
+				t.Fatalf("%s: program %d:\n%s", name, idx, d)
+			}
+		}
+	}
+}
+
+func TestCompareReportsDivergence(t *testing.T) {
+	program := Generate(rand.New(rand.NewSource(1)), 64)
+	broken := func(machine *vm.VM) error {
+		machine.Fetch()
+		err := machine.Execute()
+		machine.GPR[5]++ // simulate a bug
+		return err
+	}
+	d := Compare(program, Options{Step: broken})
+	if d == nil {
+		t.Fatal("expected a divergence")
+	}
+	if d.Step != 1 || d.VM.GPR[5] != d.Reference.GPR[5]+1 {
+		t.Fatalf("unexpected divergence:\n%s", d)
+	}
+}
+
+func TestReferenceHalt(t *testing.T) {
+	ref := new(Reference)
+	ref.M[0] = 7<<13 | haltCode
+	if err := ref.Step(); !errors.Is(err, ErrHalted) {
+		t.Fatalf("expected ErrHalted, got %v", err)
+	}
+	ref = new(Reference)
+	ref.M[0] = 7<<13 | 0x10 // syscall 0
+	if err := ref.Step(); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+	if ref.PC != 0 {
+		t.Fatal("an unsupported instruction changed the PC")
+	}
+}
+
+// FuzzCompare fuzzes the VM against the reference interpreter. When the
+// first byte of data is even, we use the remaining bytes as the seed of
+// Generate; otherwise, we use them as the program (little endian words).
+func FuzzCompare(f *testing.F) {
+	f.Add([]byte{0, 1})
+	f.Add([]byte{64, 0x12, 0x34, 0x56})
+	f.Add([]byte{200, 0xde, 0xad, 0xbe, 0xef})
+	// jalr r1 r1 after loading r1 with 3, followed by halt
+	f.Add([]byte{1, 0x83, 0x24, 0x80, 0xe4, 0x00, 0x00, 0x71, 0xe0})
+	// self-modifying code: store r0 over the next instruction
+	f.Add([]byte{1, 0x02, 0x80, 0x03, 0x24, 0x71, 0xe0, 0x71, 0xe0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 1 {
+			return
+		}
+		var program []uint16
+		if data[0]%2 == 0 {
+			var seed int64
+			for _, b := range data[1:] {
+				seed = seed<<8 | int64(b)
+			}
+			program = Generate(rand.New(rand.NewSource(seed)), 16+int(data[0]))
+		} else {
+			for idx := 1; idx+1 < len(data); idx += 2 {
+				program = append(program, uint16(data[idx])|uint16(data[idx+1])<<8)
+			}
+		}
+		for name, step := range steps {
+			if d := Compare(program, Options{MaxSteps: 10000, Step: step}); d != nil {
+				t.Fatalf("%s:\n%s", name, d)
+			}
+		}
+	})
+}
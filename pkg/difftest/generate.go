@@ -0,0 +1,154 @@
+package difftest
+
+import "math/rand"
+
+// The following constants define the layout of the generated programs.
+const (
+	// DataSize is the number of data words following the code.
+	DataSize = 64
+
+	// MaxLoopIterations is the maximum number of iterations of a loop.
+	MaxLoopIterations = 8
+)
+
+// The generated programs use the registers as follows: r1 through r5 hold
+// random values and are the destination of the random instructions, r6
+// always points to the data area, and r7 is the loop counter. Random
+// instructions may also write into r0, which must not change.
+const (
+	regData = 6
+	regLoop = 7
+)
+
+// generator generates a random program.
+type generator struct {
+	code []uint16
+	rng  *rand.Rand
+}
+
+// Generate generates a random valid program containing about size
+// instructions followed by DataSize random data words. The program uses
+// all the eight opcodes, including loops with at most MaxLoopIterations
+// iterations, forward branches, jumps, and loads and stores into the
+// data area, and always terminates by executing HALT.
+func Generate(rng *rand.Rand, size int) []uint16 {
+	g := &generator{rng: rng}
+	for reg := 1; reg <= 5; reg++ {
+		g.movi(reg, uint16(rng.Intn(1<<16)))
+	}
+	dataAddr := len(g.code)
+	g.movi(regData, 0) // patched below
+	for len(g.code) < size {
+		switch rng.Intn(8) {
+		case 0:
+			g.loop()
+		case 1:
+			g.forwardBranch()
+		case 2:
+			g.jump()
+		default:
+			g.random()
+		}
+	}
+	g.emit(7, 0, 0, haltCode)
+	base := uint16(len(g.code))
+	g.code[dataAddr] = encodeLUI(regData, base>>6)
+	g.code[dataAddr+1] = encode(1, regData, regData, base&0x3f)
+	for idx := 0; idx < DataSize; idx++ {
+		g.code = append(g.code, uint16(rng.Intn(1<<16)))
+	}
+	return g.code
+}
+
+// encode encodes an instruction using the RRR or RRI formats.
+func encode(opcode, ra, rb int, low uint16) uint16 {
+	return uint16(opcode)<<13 | uint16(ra)<<10 | uint16(rb)<<7 | low&0x7f
+}
+
+// encodeLUI encodes LUI, which uses the RI format.
+func encodeLUI(ra int, imm uint16) uint16 {
+	return 3<<13 | uint16(ra)<<10 | imm&0x3ff
+}
+
+// emit appends an instruction using the RRR or RRI formats.
+func (g *generator) emit(opcode, ra, rb int, low uint16) {
+	g.code = append(g.code, encode(opcode, ra, rb, low))
+}
+
+// movi loads value into the register reg using LUI and ADDI.
+func (g *generator) movi(reg int, value uint16) {
+	g.code = append(g.code, encodeLUI(reg, value>>6))
+	g.emit(1, reg, reg, value&0x3f)
+}
+
+// dest returns a random destination register.
+func (g *generator) dest() int {
+	return g.rng.Intn(6) // r0 through r5
+}
+
+// source returns a random source register.
+func (g *generator) source() int {
+	return g.rng.Intn(8)
+}
+
+// random appends a random instruction that does not change the PC.
+func (g *generator) random() {
+	switch g.rng.Intn(6) {
+	case 0:
+		g.emit(0, g.dest(), g.source(), uint16(g.source())) // add
+	case 1:
+		g.emit(1, g.dest(), g.source(), uint16(g.rng.Intn(128))) // addi
+	case 2:
+		g.emit(2, g.dest(), g.source(), uint16(g.source())) // nand
+	case 3:
+		g.code = append(g.code, encodeLUI(g.dest(), uint16(g.rng.Intn(1024))))
+	case 4:
+		g.emit(4, g.source(), regData, uint16(g.rng.Intn(DataSize))) // sw
+	case 5:
+		g.emit(5, g.dest(), regData, uint16(g.rng.Intn(DataSize))) // lw
+	}
+}
+
+// forwardBranch appends a BEQ skipping up to three random instructions.
+func (g *generator) forwardBranch() {
+	skip := g.rng.Intn(4)
+	g.emit(6, g.source(), g.source(), uint16(skip))
+	for idx := 0; idx < skip; idx++ {
+		g.random()
+	}
+}
+
+// jump appends a JALR skipping up to three random instructions. The
+// link register may coincide with the register containing the target.
+func (g *generator) jump() {
+	skip := g.rng.Intn(4)
+	target := 1 + g.rng.Intn(5)
+	addr := uint16(len(g.code) + 3 + skip)
+	g.movi(target, addr)
+	link := target
+	if g.rng.Intn(2) == 0 {
+		link = g.dest()
+	}
+	g.emit(7, link, target, 0)
+	for idx := 0; idx < skip; idx++ {
+		g.random()
+	}
+}
+
+// loop appends a loop containing random instructions and forward branches
+// that executes between one and MaxLoopIterations iterations.
+func (g *generator) loop() {
+	g.movi(regLoop, uint16(1+g.rng.Intn(MaxLoopIterations)))
+	start := len(g.code)
+	for count := 1 + g.rng.Intn(6); count > 0; count-- {
+		if g.rng.Intn(4) == 0 {
+			g.forwardBranch()
+		} else {
+			g.random()
+		}
+	}
+	g.emit(1, regLoop, regLoop, 0x7f) // addi r7 r7 -1
+	g.emit(6, regLoop, 0, 1)          // beq r7 r0 1
+	offset := start - (len(g.code) + 1)
+	g.emit(6, 0, 0, uint16(offset)) // beq r0 r0 start
+}
@@ -0,0 +1,79 @@
+package difftest
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupported indicates that the reference interpreter does not
+// implement an instruction (i.e., an exception other than HALT).
+var ErrUnsupported = errors.New("difftest: unsupported instruction")
+
+// ErrHalted indicates that the reference interpreter executed HALT.
+var ErrHalted = errors.New("difftest: halted")
+
+// haltCode is the immediate of `jalr r0 r0 imm` implementing HALT.
+const haltCode = 0x71
+
+// Reference is a reference interpreter written after the RiSC-16 ISA
+// specification rather than after pkg/vm. It only implements the eight
+// base instructions plus HALT, and it uses a flat memory. Like the VM,
+// it treats a JALR whose registers both contain zero as an exception.
+type Reference struct {
+	PC uint16          // program counter
+	R  [8]uint16       // registers, where R[0] is always zero
+	M  [1 << 16]uint16 // memory
+}
+
+// setReg writes into a register, discarding writes into r0.
+func (ref *Reference) setReg(num int, value int) {
+	if num != 0 {
+		ref.R[num] = uint16(value)
+	}
+}
+
+// Step executes the instruction at PC. It returns ErrHalted after
+// executing HALT and ErrUnsupported, without changing the state,
+// for the instructions it does not implement.
+func (ref *Reference) Step() error {
+	word := int(ref.M[ref.PC])
+	opcode := word >> 13
+	a, b, c := (word>>10)&7, (word>>7)&7, word&7
+	simm := word & 0x7f
+	if simm >= 0x40 {
+		simm -= 0x80 // signed 7-bit immediate
+	}
+	uimm := word & 0x3ff
+	next := int(ref.PC) + 1
+	ra, rb, rc := int(ref.R[a]), int(ref.R[b]), int(ref.R[c])
+	switch opcode {
+	case 0: // add: R[a] = R[b] + R[c]
+		ref.setReg(a, rb+rc)
+	case 1: // addi: R[a] = R[b] + simm
+		ref.setReg(a, rb+simm)
+	case 2: // nand: R[a] = ~(R[b] & R[c])
+		ref.setReg(a, ^(rb & rc))
+	case 3: // lui: R[a] = uimm << 6
+		ref.setReg(a, uimm*64)
+	case 4: // sw: M[R[b] + simm] = R[a]
+		ref.M[uint16(rb+simm)] = uint16(ra)
+	case 5: // lw: R[a] = M[R[b] + simm]
+		ref.setReg(a, int(ref.M[uint16(rb+simm)]))
+	case 6: // beq: if R[a] == R[b] then PC = PC + 1 + simm
+		if ra == rb {
+			next += simm
+		}
+	case 7: // jalr: PC = R[b], R[a] = PC + 1
+		if ra == 0 && rb == 0 { // `jalr r0 r0 imm` where imm is an exception code
+			if word&0x7f != haltCode {
+				return fmt.Errorf("%w: %#04x at %d", ErrUnsupported, word, ref.PC)
+			}
+			ref.PC = uint16(next)
+			return ErrHalted
+		}
+		ref.setReg(a, next)
+		next = rb
+	}
+	ref.PC = uint16(next)
+	return nil
+}
@@ -0,0 +1,221 @@
+// Package executable implements the RiSC-16 executable format.
+//
+// An executable contains the segments of an assembled program, each with
+// its own load address, along with the entry point, the symbol table, and
+// the line table. The pkg/asm package creates executables from assembly
+// source, and the Boot method of vm.VM boots them through the boot ROM.
+package executable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// Magic is the magic string at the beginning of an executable.
+const Magic = "R16X"
+
+// Version is the version of the executable format. An executable
+// starts with Magic and with the version byte, followed by, in
+// little endian order:
+//
+//  1. the entry point (uint16);
+//  2. the number of segments (uint16) followed by, for each segment, its
+//     load address (uint16), the number of words (uint32), and the words;
+//  3. the number of symbols (uint16) followed by, for each symbol, its
+//     address (uint16), the length of its name (uint8), and the name;
+//  4. the number of line table entries (uint32) followed by, for each
+//     entry, the address (uint16) and the source line number (uint32);
+//  5. the CRC-32 (IEEE) checksum of all the preceding bytes (uint32).
+//
+// The segments must be nonempty, must not overlap, and must not extend
+// beyond the end of the memory. The symbol and line tables may be empty.
+const Version = 1
+
+// The following errors may occur when reading or writing an executable.
+var (
+	ErrInvalid        = errors.New("executable: invalid executable")
+	ErrSymbolTooLong  = errors.New("executable: symbol name too long")
+	ErrTooManySymbols = errors.New("executable: too many symbols")
+)
+
+// Executable is a program along with its entry point,
+// its symbol table, and its line table.
+type Executable struct {
+	// Entry is the address of the first instruction to execute.
+	Entry uint16
+
+	// Segments contains the segments to load into the memory.
+	Segments []vm.Segment
+
+	// Symbols maps each label to its address.
+	Symbols map[string]uint16
+
+	// Lines maps the address of each instruction to its source
+	// line. Data generated by .fill and .space has no line.
+	Lines map[uint16]int
+}
+
+// Write writes exe into w using the format described by Version.
+func Write(w io.Writer, exe *Executable) error {
+	if len(exe.Symbols) > 0xffff {
+		return ErrTooManySymbols
+	}
+	var names []string
+	for name := range exe.Symbols {
+		if len(name) > 0xff {
+			return fmt.Errorf("%w: %s", ErrSymbolTooLong, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	bw.WriteString(Magic)
+	bw.WriteByte(Version)
+	binary.Write(bw, binary.LittleEndian, exe.Entry)
+	binary.Write(bw, binary.LittleEndian, uint16(len(exe.Segments)))
+	for _, seg := range exe.Segments {
+		binary.Write(bw, binary.LittleEndian, seg.Addr)
+		binary.Write(bw, binary.LittleEndian, uint32(len(seg.Words)))
+		binary.Write(bw, binary.LittleEndian, seg.Words)
+	}
+	binary.Write(bw, binary.LittleEndian, uint16(len(names)))
+	for _, name := range names {
+		binary.Write(bw, binary.LittleEndian, exe.Symbols[name])
+		bw.WriteByte(byte(len(name)))
+		bw.WriteString(name)
+	}
+	var addrs []int
+	for addr := range exe.Lines {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	binary.Write(bw, binary.LittleEndian, uint32(len(addrs)))
+	for _, addr := range addrs {
+		binary.Write(bw, binary.LittleEndian, uint16(addr))
+		binary.Write(bw, binary.LittleEndian, uint32(exe.Lines[uint16(addr)]))
+	}
+	if err := bw.Flush(); err != nil { // returns the first write error
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// Read reads an executable in the format described by Version from r.
+// On failure, it returns an error wrapping ErrInvalid or the error
+// returned by r.
+func Read(r io.Reader) (*Executable, error) {
+	crc := crc32.NewIEEE()
+	exe, err := read(io.TeeReader(r, crc))
+	if err != nil {
+		return nil, err
+	}
+	var checksum uint32
+	if err := binary.Read(r, binary.LittleEndian, &checksum); err != nil {
+		return nil, readError(err)
+	}
+	if checksum != crc.Sum32() {
+		return nil, fmt.Errorf("%w: bad checksum", ErrInvalid)
+	}
+	return exe, nil
+}
+
+// readError converts an error returned by the reader
+// into an error describing a malformed executable.
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated", ErrInvalid)
+	}
+	return err
+}
+
+// read reads an executable but not its checksum.
+func read(r io.Reader) (*Executable, error) {
+	var header [len(Magic) + 1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, readError(err)
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalid)
+	}
+	if header[len(Magic)] != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalid, header[len(Magic)])
+	}
+	exe := &Executable{Symbols: make(map[string]uint16), Lines: make(map[uint16]int)}
+	var counts struct {
+		Entry    uint16
+		Segments uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &counts); err != nil {
+		return nil, readError(err)
+	}
+	exe.Entry = counts.Entry
+	var used [vm.MemorySize]bool
+	for idx := 0; idx < int(counts.Segments); idx++ {
+		var seg struct {
+			Addr   uint16
+			Length uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &seg); err != nil {
+			return nil, readError(err)
+		}
+		if seg.Length < 1 || uint32(seg.Addr)+seg.Length > vm.MemorySize {
+			return nil, fmt.Errorf("%w: segment at %#04x with %d words", ErrInvalid,
+				seg.Addr, seg.Length)
+		}
+		for addr := uint32(seg.Addr); addr < uint32(seg.Addr)+seg.Length; addr++ {
+			if used[addr] {
+				return nil, fmt.Errorf("%w: overlapping segments at %#04x", ErrInvalid, addr)
+			}
+			used[addr] = true
+		}
+		words := make([]uint16, seg.Length)
+		if err := binary.Read(r, binary.LittleEndian, words); err != nil {
+			return nil, readError(err)
+		}
+		exe.Segments = append(exe.Segments, vm.Segment{Addr: seg.Addr, Words: words})
+	}
+	var numSymbols uint16
+	if err := binary.Read(r, binary.LittleEndian, &numSymbols); err != nil {
+		return nil, readError(err)
+	}
+	for idx := 0; idx < int(numSymbols); idx++ {
+		var sym struct {
+			Addr   uint16
+			Length uint8
+		}
+		if err := binary.Read(r, binary.LittleEndian, &sym); err != nil {
+			return nil, readError(err)
+		}
+		name := make([]byte, sym.Length)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, readError(err)
+		}
+		exe.Symbols[string(name)] = sym.Addr
+	}
+	var numLines uint32
+	if err := binary.Read(r, binary.LittleEndian, &numLines); err != nil {
+		return nil, readError(err)
+	}
+	if numLines > vm.MemorySize {
+		return nil, fmt.Errorf("%w: %d line table entries", ErrInvalid, numLines)
+	}
+	for idx := uint32(0); idx < numLines; idx++ {
+		var line struct {
+			Addr   uint16
+			Lineno uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &line); err != nil {
+			return nil, readError(err)
+		}
+		exe.Lines[line.Addr] = int(line.Lineno)
+	}
+	return exe, nil
+}
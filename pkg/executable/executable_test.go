@@ -0,0 +1,144 @@
+package executable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// sample returns an executable with two segments.
+func sample() *Executable {
+	return &Executable{
+		Entry: 0x100,
+		Segments: []vm.Segment{
+			{Addr: 0x100, Words: []uint16{1, 2, 3}},
+			{Addr: 0xfffe, Words: []uint16{4, 5}},
+		},
+		Symbols: map[string]uint16{"start": 0x100, "end": 0xffff},
+		Lines:   map[uint16]int{0x100: 1, 0x101: 2, 0x102: 70000},
+	}
+}
+
+// encode writes exe, failing the test on error.
+func encode(t *testing.T, exe *Executable) []byte {
+	var buf bytes.Buffer
+	if err := Write(&buf, exe); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// resum replaces the checksum at the end of data.
+func resum(data []byte) []byte {
+	out := append([]byte{}, data...)
+	body := out[:len(out)-4]
+	binary.LittleEndian.PutUint32(out[len(body):], crc32.ChecksumIEEE(body))
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := encode(t, sample())
+	if !bytes.HasPrefix(data, []byte(Magic+"\x01")) {
+		t.Fatalf("unexpected header %q", data[:5])
+	}
+	exe, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exe, sample()) {
+		t.Fatalf("expected %+v, got %+v", sample(), exe)
+	}
+	exe, err = Read(bytes.NewReader(encode(t, &Executable{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exe.Segments) != 0 || len(exe.Symbols) != 0 || len(exe.Lines) != 0 {
+		t.Fatalf("expected an empty executable, got %+v", exe)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	data := encode(t, sample())
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		reason string
+	}{{
+		name:   "magic",
+		data:   resum(append([]byte("R16Y"), data[4:]...)),
+		reason: "bad magic",
+	}, {
+		name:   "version",
+		data:   resum(append([]byte(Magic+"\x02"), data[5:]...)),
+		reason: "unsupported version 2",
+	}, {
+		name:   "checksum",
+		data:   append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^1),
+		reason: "bad checksum",
+	}, {
+		name:   "truncated",
+		data:   data[:len(data)-1],
+		reason: "truncated",
+	}, {
+		name: "overlap",
+		data: encode(t, &Executable{Segments: []vm.Segment{
+			{Addr: 10, Words: []uint16{1, 2}},
+			{Addr: 11, Words: []uint16{3}},
+		}}),
+		reason: "overlapping segments at 0x000b",
+	}, {
+		name:   "empty segment",
+		data:   encode(t, &Executable{Segments: []vm.Segment{{Addr: 10}}}),
+		reason: "segment at 0x000a with 0 words",
+	}, {
+		name:   "beyond the memory",
+		data:   encode(t, &Executable{Segments: []vm.Segment{{Addr: 0xffff, Words: []uint16{1, 2}}}}),
+		reason: "segment at 0xffff with 2 words",
+	}} {
+		_, err := Read(bytes.NewReader(tc.data))
+		if !errors.Is(err, ErrInvalid) || !strings.HasSuffix(err.Error(), tc.reason) {
+			t.Fatalf("%s: expected %q, got %v", tc.name, tc.reason, err)
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	exe := &Executable{Symbols: map[string]uint16{strings.Repeat("x", 256): 0}}
+	if err := Write(&bytes.Buffer{}, exe); !errors.Is(err, ErrSymbolTooLong) {
+		t.Fatalf("expected ErrSymbolTooLong, got %v", err)
+	}
+	exe.Symbols = make(map[string]uint16)
+	for idx := 0; idx <= 0xffff; idx++ {
+		exe.Symbols[string(rune(idx+0x10000))] = 0
+	}
+	if err := Write(&bytes.Buffer{}, exe); !errors.Is(err, ErrTooManySymbols) {
+		t.Fatalf("expected ErrTooManySymbols, got %v", err)
+	}
+}
+
+func TestBoot(t *testing.T) {
+	exe := sample()
+	machine := new(vm.VM)
+	if err := machine.Boot(exe.Entry, exe.Segments); err != nil {
+		t.Fatal(err)
+	}
+	for steps := 0; machine.PC != exe.Entry; steps++ {
+		if steps > 100 {
+			t.Fatal("the boot ROM did not jump to the entry point")
+		}
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem := machine.Memory()
+	if mem[0x100] != 1 || mem[0x102] != 3 || mem[0xfffe] != 4 || mem[0xffff] != 5 ||
+		mem[0x103] != 0 || machine.GPR != [vm.NumRegisters]uint16{} {
+		t.Fatal("unexpected machine state after booting")
+	}
+}
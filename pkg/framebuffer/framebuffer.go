@@ -0,0 +1,179 @@
+// Package framebuffer implements a memory-mapped 16-color framebuffer.
+//
+// The framebuffer contains Width x Height pixels. Each pixel is an index
+// into Palette, which contains the 16 CGA colors, where zero is black and
+// 15 is white (so a monochrome program only uses these two colors). Each
+// word contains PixelsPerWord pixels, with the leftmost pixel in the least
+// significant bits, and the words are ordered by row, from top to bottom.
+//
+// Storing any value into the Present register presents the current frame,
+// which calls the function passed to New. When the program stops, call
+// Flush to present the last frame, in case the program did not present
+// it before stopping. Use a FrameWriter to write the
+// presented frames into PNG or PPM files (e.g., for comparing them with
+// golden images), so that no display is needed.
+package framebuffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// The following constants define the geometry of the framebuffer.
+const (
+	// Width is the number of pixels of each row.
+	Width = 64
+
+	// Height is the number of rows.
+	Height = 64
+
+	// BitsPerPixel is the number of bits of each pixel.
+	BitsPerPixel = 4
+
+	// PixelsPerWord is the number of pixels of each word.
+	PixelsPerWord = 16 / BitsPerPixel
+
+	// PixelWords is the number of words containing the pixels.
+	PixelWords = Width * Height / PixelsPerWord
+)
+
+// DefaultBase is the conventional address of the framebuffer.
+const DefaultBase = 0xe000
+
+// The following constants define the framebuffer registers, expressed
+// as offsets relative to the framebuffer base address. The pixels start
+// at offset zero and are followed by the control registers.
+const (
+	// Present is the present register. Storing any value presents
+	// the current frame. Loading returns zero.
+	Present = PixelWords + iota
+
+	// Size is the number of words mapped by the framebuffer.
+	Size
+)
+
+// Palette contains the 16 colors of the framebuffer.
+var Palette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xff}, // black
+	color.RGBA{0x00, 0x00, 0xaa, 0xff}, // blue
+	color.RGBA{0x00, 0xaa, 0x00, 0xff}, // green
+	color.RGBA{0x00, 0xaa, 0xaa, 0xff}, // cyan
+	color.RGBA{0xaa, 0x00, 0x00, 0xff}, // red
+	color.RGBA{0xaa, 0x00, 0xaa, 0xff}, // magenta
+	color.RGBA{0xaa, 0x55, 0x00, 0xff}, // brown
+	color.RGBA{0xaa, 0xaa, 0xaa, 0xff}, // light gray
+	color.RGBA{0x55, 0x55, 0x55, 0xff}, // dark gray
+	color.RGBA{0x55, 0x55, 0xff, 0xff}, // light blue
+	color.RGBA{0x55, 0xff, 0x55, 0xff}, // light green
+	color.RGBA{0x55, 0xff, 0xff, 0xff}, // light cyan
+	color.RGBA{0xff, 0x55, 0x55, 0xff}, // light red
+	color.RGBA{0xff, 0x55, 0xff, 0xff}, // light magenta
+	color.RGBA{0xff, 0xff, 0x55, 0xff}, // yellow
+	color.RGBA{0xff, 0xff, 0xff, 0xff}, // white
+}
+
+// Framebuffer is a memory-mapped framebuffer.
+type Framebuffer struct {
+	base      uint16
+	dirty     bool
+	onPresent func(img *image.Paletted)
+	pixels    [PixelWords]uint16
+	presented bool
+}
+
+// New creates a new framebuffer mapped at base that calls onPresent,
+// if not nil, with the current frame when the program presents it.
+func New(base uint16, onPresent func(img *image.Paletted)) *Framebuffer {
+	return &Framebuffer{base: base, onPresent: onPresent}
+}
+
+// Base implements vm.Device.Base.
+func (fb *Framebuffer) Base() uint16 {
+	return fb.base
+}
+
+// Size implements vm.Device.Size.
+func (fb *Framebuffer) Size() uint16 {
+	return Size
+}
+
+// Read implements vm.Device.Read.
+func (fb *Framebuffer) Read(offset uint16) uint16 {
+	if offset < PixelWords {
+		return fb.pixels[offset]
+	}
+	return 0
+}
+
+// Write implements vm.Device.Write.
+func (fb *Framebuffer) Write(offset uint16, value uint16) {
+	switch {
+	case offset < PixelWords:
+		fb.pixels[offset] = value
+		fb.dirty = true
+	case offset == Present:
+		fb.Present()
+	}
+}
+
+// Present presents the current frame, like storing into the
+// Present register does.
+func (fb *Framebuffer) Present() {
+	fb.dirty, fb.presented = false, true
+	if fb.onPresent != nil {
+		fb.onPresent(fb.Image())
+	}
+}
+
+// Flush presents the current frame if the pixels changed since the last
+// time the current frame was presented, or if no frame has been presented
+// yet, so that the output always contains the final frame.
+func (fb *Framebuffer) Flush() {
+	if fb.dirty || !fb.presented {
+		fb.Present()
+	}
+}
+
+// Dirty returns whether the pixels changed since the last
+// time the current frame was presented.
+func (fb *Framebuffer) Dirty() bool {
+	return fb.dirty
+}
+
+// Image returns a copy of the current frame.
+func (fb *Framebuffer) Image() *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, Width, Height), Palette)
+	for idx := range img.Pix {
+		word := fb.pixels[idx/PixelsPerWord]
+		shift := uint(idx%PixelsPerWord) * BitsPerPixel
+		img.Pix[idx] = uint8(word>>shift) & (1<<BitsPerPixel - 1)
+	}
+	return img
+}
+
+// SaveState implements vm.StatefulDevice.SaveState.
+func (fb *Framebuffer) SaveState() ([]byte, error) {
+	state := make([]byte, 2*PixelWords)
+	for idx, word := range fb.pixels {
+		binary.LittleEndian.PutUint16(state[2*idx:], word)
+	}
+	return state, nil
+}
+
+// RestoreState implements vm.StatefulDevice.RestoreState.
+func (fb *Framebuffer) RestoreState(state []byte) error {
+	if len(state) != 2*PixelWords {
+		return fmt.Errorf("framebuffer state has size %d", len(state))
+	}
+	for idx := range fb.pixels {
+		fb.pixels[idx] = binary.LittleEndian.Uint16(state[2*idx:])
+	}
+	fb.dirty = true
+	return nil
+}
+
+var _ vm.StatefulDevice = &Framebuffer{}
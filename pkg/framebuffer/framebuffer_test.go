@@ -0,0 +1,189 @@
+package framebuffer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+var update = flag.Bool("update", false, "update the golden images")
+
+func TestImage(t *testing.T) {
+	fb := New(DefaultBase, nil)
+	fb.Write(0, 0x4321)
+	fb.Write(PixelWords-1, 0xf000)
+	img := fb.Image()
+	for _, p := range []struct {
+		x, y  int
+		index uint8
+	}{
+		{0, 0, 1}, // the leftmost pixel is in the least significant bits
+		{1, 0, 2},
+		{2, 0, 3},
+		{3, 0, 4},
+		{4, 0, 0},
+		{Width - 2, Height - 1, 0},
+		{Width - 1, Height - 1, 15},
+	} {
+		if index := img.ColorIndexAt(p.x, p.y); index != p.index {
+			t.Fatalf("(%d, %d): expected %d, got %d", p.x, p.y, p.index, index)
+		}
+	}
+	if img.At(Width-1, Height-1) != Palette[15] {
+		t.Fatal("the last pixel should be white")
+	}
+	if fb.Read(0) != 0x4321 || fb.Read(Present) != 0 {
+		t.Fatal("unexpected register values")
+	}
+	// the image is a copy of the current frame
+	img.Pix[0] = 7
+	if fb.Image().Pix[0] != 1 {
+		t.Fatal("the image shares the pixels with the framebuffer")
+	}
+}
+
+func TestPresentAndFlush(t *testing.T) {
+	var frames []*image.Paletted
+	fb := New(DefaultBase, func(img *image.Paletted) {
+		frames = append(frames, img)
+	})
+	fb.Flush() // presents the first frame even if it is not dirty
+	fb.Flush()
+	if len(frames) != 1 || fb.Dirty() {
+		t.Fatalf("expected one frame, got %d", len(frames))
+	}
+	fb.Write(0, 1)
+	if !fb.Dirty() {
+		t.Fatal("writing the pixels should make the frame dirty")
+	}
+	fb.Write(Present, 0)
+	fb.Flush()
+	if len(frames) != 2 || fb.Dirty() {
+		t.Fatalf("expected two frames, got %d", len(frames))
+	}
+	fb.Write(1, 2) // as if the program halted without presenting
+	fb.Flush()
+	if len(frames) != 3 || frames[2].Pix[4] != 2 {
+		t.Fatalf("expected the final frame, got %d frames", len(frames))
+	}
+}
+
+func TestWritePPM(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), Palette)
+	img.Pix[0], img.Pix[1] = 4, 14
+	var buf bytes.Buffer
+	if err := WritePPM(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	expected := "P6\n2 1\n255\n\xaa\x00\x00\xff\xff\x55"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	if _, err := NewFrameWriter("out.gif"); !errors.Is(err, ErrFormat) {
+		t.Fatalf("expected ErrFormat, got %v", err)
+	}
+	dir := t.TempDir()
+	fw, err := NewFrameWriter(filepath.Join(dir, "out%03d.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := New(DefaultBase, nil)
+	fb.Write(0, 0x0009)
+	for idx := 0; idx < 2; idx++ {
+		if err := fw.WriteFrame(fb.Image()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fw.Count() != 2 {
+		t.Fatalf("expected 2 frames, got %d", fw.Count())
+	}
+	fp, err := os.Open(filepath.Join(dir, "out001.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	img, err := png.Decode(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 0x55 || g>>8 != 0x55 || b>>8 != 0xff {
+		t.Fatalf("unexpected color %v", img.At(0, 0))
+	}
+	fw, err = NewFrameWriter(filepath.Join(dir, "missing", "out.ppm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.WriteFrame(fb.Image()); err == nil || fw.Count() != 0 {
+		t.Fatal("expected an error")
+	}
+}
+
+// bars draws 16 vertical bars, one for each color, and halts without
+// presenting the frame, so that Flush has to present it.
+const bars = `	movi r1, -8192
+	movi r2, 1024
+	addi r3, r0, 0
+	movi r4, 4369
+loop:	sw r3, r1, 0
+	addi r1, r1, 1
+	add r3, r3, r4
+	addi r2, r2, -1
+	beq r2, r0, done
+	beq r0, r0, loop
+done:	halt
+`
+
+func TestGolden(t *testing.T) {
+	machine := new(vm.VM)
+	for instr := range asm.StartAssembler(strings.NewReader(bars)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		machine.M[instr.Address] = instr.Instruction
+	}
+	var frames []*image.Paletted
+	fb := New(DefaultBase, func(img *image.Paletted) {
+		frames = append(frames, img)
+	})
+	if err := machine.Attach(fb); err != nil {
+		t.Fatal(err)
+	}
+	result := machine.Run(context.Background(), vm.RunOptions{MaxInstructions: 100000})
+	if result.Reason != vm.StopHalted {
+		t.Fatalf("expected StopHalted, got %s", result.Reason)
+	}
+	fb.Flush()
+	if len(frames) != 1 {
+		t.Fatalf("expected one frame, got %d", len(frames))
+	}
+	var buf bytes.Buffer
+	if err := WritePPM(&buf, frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "bars.ppm")
+	if *update {
+		if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("the frame differs from %s (use -update to regenerate it)", golden)
+	}
+}
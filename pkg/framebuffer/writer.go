@@ -0,0 +1,91 @@
+package framebuffer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrFormat indicates that a file name does not end with .png or .ppm.
+var ErrFormat = errors.New("framebuffer: unsupported image format")
+
+// FrameWriter writes frames into numbered files.
+type FrameWriter struct {
+	count   int
+	encode  func(w io.Writer, img image.Image) error
+	pattern string
+}
+
+// NewFrameWriter creates a FrameWriter that writes the N-th frame, starting
+// from zero, into the file named fmt.Sprintf(pattern, N) (e.g., pattern may
+// be "out%03d.png"). The extension of pattern, which must be .png or .ppm,
+// selects the image format.
+func NewFrameWriter(pattern string) (*FrameWriter, error) {
+	fw := &FrameWriter{pattern: pattern}
+	switch strings.ToLower(filepath.Ext(pattern)) {
+	case ".png":
+		fw.encode = png.Encode
+	case ".ppm":
+		fw.encode = WritePPM
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFormat, pattern)
+	}
+	return fw, nil
+}
+
+// Count returns the number of frames written so far.
+func (fw *FrameWriter) Count() int {
+	return fw.count
+}
+
+// WriteFrame writes img into the file of the next frame.
+func (fw *FrameWriter) WriteFrame(img image.Image) error {
+	filename := fw.pattern
+	if strings.Contains(fw.pattern, "%") {
+		filename = fmt.Sprintf(fw.pattern, fw.count)
+	}
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fp)
+	if err := fw.encode(bw, img); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	fw.count++
+	return nil
+}
+
+// WritePPM writes img into w using the binary PPM (P6) format.
+func WritePPM(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	if _, err := fmt.Fprintf(w, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy()); err != nil {
+		return err
+	}
+	row := make([]byte, 0, 3*bounds.Dx())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			row = append(row, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,680 @@
+// Package gdbstub exposes a RiSC-16 VM over the GDB remote serial protocol.
+//
+// See https://sourceware.org/gdb/onlinedocs/gdb/Remote-Protocol.html.
+//
+// # Registers
+//
+// The stub exposes nine 16-bit registers: r0 through r7, with numbers
+// zero through seven, and the program counter, with number eight. Each
+// register is transferred as four hex digits in little endian order.
+//
+// # Memory
+//
+// Memory addresses are word addresses, like in the VM, while lengths
+// are expressed in bytes. Each word is transferred as two bytes in
+// little endian order. With an odd length, we read or write only the
+// low byte of the last word. Writes go through the devices mapped at
+// the written addresses (e.g., writing the console data register prints
+// a character). Since reading a device register may have side effects,
+// writing only the low byte of a device register clears the high byte.
+//
+// # Target description
+//
+// The stub serves a target description, describing the registers above,
+// to clients that request it using qXfer:features:read.
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// NumRegisters is the number of registers exposed by the stub.
+const NumRegisters = vm.NumRegisters + 1
+
+// RegisterPC is the number of the program counter register.
+const RegisterPC = vm.NumRegisters
+
+// The following constants define the signals used in stop replies.
+const (
+	SignalINT  = 2
+	SignalILL  = 4
+	SignalTRAP = 5
+)
+
+// interruptCheckInterval is the number of instructions that we execute
+// when continuing before checking whether the client has interrupted us.
+const interruptCheckInterval = 1024
+
+// Stub is a GDB remote serial protocol stub. The stub is not goroutine
+// safe; a single goroutine should call its Serve method.
+type Stub struct {
+	// Machine is the virtual machine to debug.
+	Machine *vm.VM
+
+	// Step executes a single instruction. NewStub initializes it
+	// to Machine.Step.
+	Step func() error
+
+	// StepBack, if not nil, undoes the last executed instruction and
+	// returns false if there is no instruction to undo. Setting it enables
+	// the reverse step and reverse continue commands (e.g., reverse-stepi).
+	StepBack func() bool
+
+	// Modify, if not nil, applies the changes that the client makes to
+	// the registers and the memory by calling change. Set it to record
+	// the changes into an undo log, so that reverse execution restores
+	// the state before them. By default, the stub calls change directly.
+	Modify func(change func())
+
+	breaks  map[uint16]bool
+	exited  bool
+	noAck   bool
+	stopped string
+	w       *bufio.Writer
+}
+
+// NewStub creates a new stub for the given virtual machine.
+func NewStub(machine *vm.VM) *Stub {
+	return &Stub{
+		Machine: machine,
+		Step:    machine.Step,
+		breaks:  make(map[uint16]bool),
+		stopped: fmt.Sprintf("S%02x", SignalTRAP),
+	}
+}
+
+// ErrKilled indicates that the client has killed the program.
+var ErrKilled = errors.New("gdbstub: killed by client")
+
+// errDetached indicates that the client has detached.
+var errDetached = errors.New("gdbstub: detached")
+
+// ListenAndServe listens on the given TCP address, accepts a single
+// connection and serves the GDB remote serial protocol over it.
+func (s *Stub) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// event is an event emitted by the reader goroutine.
+type event struct {
+	err       error
+	interrupt bool
+	packet    string
+	valid     bool
+}
+
+// readEvents reads packets and interrupts from r and emits them on out
+// until an error occurs or the done channel is closed.
+func readEvents(r io.Reader, out chan<- event, done <-chan struct{}) {
+	reader := bufio.NewReader(r)
+	emit := func(ev event) bool {
+		select {
+		case out <- ev:
+			return ev.err == nil
+		case <-done:
+			return false
+		}
+	}
+	for {
+		ch, err := reader.ReadByte()
+		if err != nil {
+			emit(event{err: err})
+			return
+		}
+		switch ch {
+		case 0x03:
+			if !emit(event{interrupt: true}) {
+				return
+			}
+		case '$':
+			data, err := reader.ReadString('#')
+			if err != nil {
+				emit(event{err: err})
+				return
+			}
+			var checksum [2]byte
+			if _, err := io.ReadFull(reader, checksum[:]); err != nil {
+				emit(event{err: err})
+				return
+			}
+			data = strings.TrimSuffix(data, "#")
+			expected, err := strconv.ParseUint(string(checksum[:]), 16, 8)
+			ev := event{
+				packet: data,
+				valid:  err == nil && uint8(expected) == computeChecksum(data),
+			}
+			if !emit(ev) {
+				return
+			}
+		default:
+			// ignore acks and garbage between packets
+		}
+	}
+}
+
+// computeChecksum computes the checksum of a packet.
+func computeChecksum(data string) (sum uint8) {
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return
+}
+
+// Serve serves the GDB remote serial protocol over conn until the client
+// detaches or kills the program, or an I/O error occurs. Serve returns nil
+// when the client detaches and ErrKilled when the client kills the program.
+// Serve may leave behind a goroutine blocked reading from conn, which
+// exits once the caller closes conn.
+func (s *Stub) Serve(conn io.ReadWriter) error {
+	events := make(chan event)
+	done := make(chan struct{})
+	defer close(done)
+	go readEvents(conn, events, done)
+	s.w = bufio.NewWriter(conn)
+	for ev := range events {
+		if ev.err != nil {
+			return ev.err
+		}
+		if ev.interrupt {
+			// we're already stopped, most likely because we stopped
+			// while the client was sending the interrupt
+			if err := s.writePacket(s.stopped); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.ack(ev); err != nil {
+			return err
+		}
+		if !ev.valid && !s.noAck {
+			continue
+		}
+		out, err := s.handle(ev.packet, events)
+		if out != nil {
+			if err := s.writePacket(*out); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, errDetached) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil // not reached
+}
+
+// ack acknowledges the packet contained by ev, unless we're in
+// no acknowledgment mode, and flushes the writer.
+func (s *Stub) ack(ev event) error {
+	if s.noAck {
+		return nil
+	}
+	ack := "+"
+	if !ev.valid {
+		ack = "-"
+	}
+	if _, err := s.w.WriteString(ack); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// writePacket writes a packet and flushes the writer.
+func (s *Stub) writePacket(data string) error {
+	fmt.Fprintf(s.w, "$%s#%02x", data, computeChecksum(data))
+	return s.w.Flush()
+}
+
+// reply is a convenience function to construct a reply.
+func reply(data string) *string {
+	return &data
+}
+
+// errorReply constructs an error reply.
+func errorReply() *string {
+	return reply("E01")
+}
+
+// handle handles a single packet and returns the reply to send, if any,
+// and an error, if the stub should stop serving the client.
+func (s *Stub) handle(packet string, events <-chan event) (*string, error) {
+	if packet == "" {
+		return reply(""), nil
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return reply(s.stopped), nil
+	case 'g':
+		return reply(s.readRegisters()), nil
+	case 'G':
+		return s.writeRegisters(args), nil
+	case 'p':
+		return s.readRegister(args), nil
+	case 'P':
+		return s.writeRegister(args), nil
+	case 'm':
+		return s.readMemory(args), nil
+	case 'M':
+		return s.writeMemory(args), nil
+	case 's':
+		return s.resume(args, events, 1)
+	case 'c':
+		return s.resume(args, events, -1)
+	case 'b':
+		switch {
+		case s.StepBack == nil:
+			return reply(""), nil // unsupported
+		case args == "s":
+			return s.reverse(events, 1)
+		case args == "c":
+			return s.reverse(events, -1)
+		default:
+			return reply(""), nil
+		}
+	case 'Z', 'z':
+		return s.breakpoint(packet[0] == 'Z', args), nil
+	case 'H':
+		return reply("OK"), nil
+	case 'D':
+		return reply("OK"), errDetached
+	case 'k':
+		return nil, ErrKilled
+	case 'q', 'Q':
+		return s.query(packet), nil
+	default:
+		return reply(""), nil // unsupported
+	}
+}
+
+// query handles general query packets.
+func (s *Stub) query(packet string) *string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		features := "PacketSize=4000;QStartNoAckMode+;swbreak+;qXfer:features:read+"
+		if s.StepBack != nil {
+			features += ";ReverseStep+;ReverseContinue+"
+		}
+		return reply(features)
+	case strings.HasPrefix(packet, "qXfer:features:read:"):
+		return readFeatures(strings.TrimPrefix(packet, "qXfer:features:read:"))
+	case packet == "QStartNoAckMode":
+		s.noAck = true
+		return reply("OK")
+	case packet == "qAttached":
+		return reply("1")
+	case packet == "qC":
+		return reply("QC1")
+	case packet == "qfThreadInfo":
+		return reply("m1")
+	case packet == "qsThreadInfo":
+		return reply("l")
+	default:
+		return reply("")
+	}
+}
+
+// targetDescription returns the target description.
+func targetDescription() string {
+	var builder strings.Builder
+	builder.WriteString(`<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<feature name="org.gnu.gdb.risc16.core">
+`)
+	for idx := 0; idx < vm.NumRegisters; idx++ {
+		fmt.Fprintf(&builder, "<reg name=\"r%d\" bitsize=\"16\" type=\"int\" regnum=\"%d\"/>\n", idx, idx)
+	}
+	fmt.Fprintf(&builder, "<reg name=\"pc\" bitsize=\"16\" type=\"code_ptr\" regnum=\"%d\"/>\n", RegisterPC)
+	builder.WriteString("</feature>\n</target>\n")
+	return builder.String()
+}
+
+// readFeatures handles the `annex:offset,length` arguments of the
+// qXfer:features:read query, where the only valid annex is target.xml.
+func readFeatures(args string) *string {
+	v := strings.SplitN(args, ":", 2)
+	if len(v) != 2 {
+		return errorReply()
+	}
+	if v[0] != "target.xml" {
+		return reply("E00") // no such annex
+	}
+	w := strings.SplitN(v[1], ",", 2)
+	if len(w) != 2 {
+		return errorReply()
+	}
+	offset, err := strconv.ParseUint(w[0], 16, 32)
+	if err != nil {
+		return errorReply()
+	}
+	length, err := strconv.ParseUint(w[1], 16, 32)
+	if err != nil {
+		return errorReply()
+	}
+	data := targetDescription()
+	if offset >= uint64(len(data)) {
+		return reply("l")
+	}
+	data = data[offset:]
+	if uint64(len(data)) > length {
+		return reply("m" + data[:length])
+	}
+	return reply("l" + data)
+}
+
+// encodeWord encodes a word as four hex digits in little endian order.
+func encodeWord(value uint16) string {
+	return hex.EncodeToString([]byte{byte(value), byte(value >> 8)})
+}
+
+// decodeWord decodes a word encoded by encodeWord.
+func decodeWord(s string) (uint16, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 2 {
+		return 0, errors.New("gdbstub: invalid word length")
+	}
+	return uint16(data[0]) | uint16(data[1])<<8, nil
+}
+
+// registerValue returns the value of the given register.
+func (s *Stub) registerValue(idx int) uint16 {
+	if idx == RegisterPC {
+		return s.Machine.PC
+	}
+	return s.Machine.GPR[idx]
+}
+
+// setRegisterValue sets the value of the given register.
+func (s *Stub) setRegisterValue(idx int, value uint16) {
+	switch idx {
+	case RegisterPC:
+		s.Machine.PC = value
+	case 0:
+		// r0 is always zero
+	default:
+		s.Machine.GPR[idx] = value
+	}
+}
+
+// modify calls change, which modifies the machine state, using Modify.
+func (s *Stub) modify(change func()) {
+	if s.Modify == nil {
+		change()
+		return
+	}
+	s.Modify(change)
+}
+
+func (s *Stub) readRegisters() string {
+	var builder strings.Builder
+	for idx := 0; idx < NumRegisters; idx++ {
+		builder.WriteString(encodeWord(s.registerValue(idx)))
+	}
+	return builder.String()
+}
+
+func (s *Stub) writeRegisters(args string) *string {
+	if len(args) != NumRegisters*4 {
+		return errorReply()
+	}
+	var values [NumRegisters]uint16
+	for idx := 0; idx < NumRegisters; idx++ {
+		value, err := decodeWord(args[idx*4 : (idx+1)*4])
+		if err != nil {
+			return errorReply()
+		}
+		values[idx] = value
+	}
+	s.modify(func() {
+		for idx, value := range values {
+			s.setRegisterValue(idx, value)
+		}
+	})
+	return reply("OK")
+}
+
+// parseRegisterNumber parses a register number.
+func parseRegisterNumber(s string) (int, error) {
+	idx, err := strconv.ParseUint(s, 16, 8)
+	if err != nil {
+		return 0, err
+	}
+	if idx >= NumRegisters {
+		return 0, errors.New("gdbstub: invalid register number")
+	}
+	return int(idx), nil
+}
+
+func (s *Stub) readRegister(args string) *string {
+	idx, err := parseRegisterNumber(args)
+	if err != nil {
+		return errorReply()
+	}
+	return reply(encodeWord(s.registerValue(idx)))
+}
+
+func (s *Stub) writeRegister(args string) *string {
+	v := strings.SplitN(args, "=", 2)
+	if len(v) != 2 {
+		return errorReply()
+	}
+	idx, err := parseRegisterNumber(v[0])
+	if err != nil {
+		return errorReply()
+	}
+	value, err := decodeWord(v[1])
+	if err != nil {
+		return errorReply()
+	}
+	s.modify(func() {
+		s.setRegisterValue(idx, value)
+	})
+	return reply("OK")
+}
+
+// parseAddressAndLength parses the `addr,length` memory arguments and
+// returns the word address and the number of bytes.
+func parseAddressAndLength(args string) (uint16, int, error) {
+	v := strings.SplitN(args, ",", 2)
+	if len(v) != 2 {
+		return 0, 0, errors.New("gdbstub: expected comma")
+	}
+	addr, err := strconv.ParseUint(v[0], 16, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := strconv.ParseUint(v[1], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if length > 2*vm.MemorySize {
+		return 0, 0, errors.New("gdbstub: length too large")
+	}
+	return uint16(addr), int(length), nil
+}
+
+func (s *Stub) readMemory(args string) *string {
+	addr, length, err := parseAddressAndLength(args)
+	if err != nil {
+		return errorReply()
+	}
+	data := make([]byte, length)
+	for idx := range data {
+		data[idx] = byte(s.Machine.Memory()[addr+uint16(idx/2)] >> (8 * (idx % 2)))
+	}
+	return reply(hex.EncodeToString(data))
+}
+
+func (s *Stub) writeMemory(args string) *string {
+	v := strings.SplitN(args, ":", 2)
+	if len(v) != 2 {
+		return errorReply()
+	}
+	addr, length, err := parseAddressAndLength(v[0])
+	if err != nil {
+		return errorReply()
+	}
+	data, err := hex.DecodeString(v[1])
+	if err != nil || len(data) != length {
+		return errorReply()
+	}
+	s.modify(func() {
+		for idx := 0; idx < len(data); idx += 2 {
+			waddr, value := addr+uint16(idx/2), uint16(data[idx])
+			switch {
+			case idx+1 < len(data):
+				value |= uint16(data[idx+1]) << 8
+			case s.Machine.DeviceAt(waddr) == nil:
+				value |= s.Machine.Memory()[waddr] &^ 0xff
+			}
+			s.Machine.Store(waddr, value)
+		}
+	})
+	return reply("OK")
+}
+
+func (s *Stub) breakpoint(insert bool, args string) *string {
+	v := strings.Split(args, ",")
+	if len(v) != 3 {
+		return errorReply()
+	}
+	switch v[0] {
+	case "0", "1": // software and hardware breakpoints
+	default:
+		return reply("") // unsupported
+	}
+	addr, err := strconv.ParseUint(v[1], 16, 16)
+	if err != nil {
+		return errorReply()
+	}
+	if insert {
+		s.breaks[uint16(addr)] = true
+	} else {
+		delete(s.breaks, uint16(addr))
+	}
+	return reply("OK")
+}
+
+// resume implements the step and continue commands. When count is
+// negative we continue until a breakpoint, an interrupt, or the program
+// terminates. Otherwise, we execute count instructions.
+func (s *Stub) resume(args string, events <-chan event, count int) (*string, error) {
+	if args != "" {
+		addr, err := strconv.ParseUint(args, 16, 16)
+		if err != nil {
+			return errorReply(), nil
+		}
+		s.Machine.PC = uint16(addr)
+	}
+	if s.exited {
+		return reply(s.stopped), nil
+	}
+	for steps := 0; count < 0 || steps < count; steps++ {
+		if err := s.Step(); err != nil {
+			s.exited = true
+			if errors.Is(err, vm.ErrHalted) {
+				s.stopped = "W00"
+			} else {
+				s.stopped = fmt.Sprintf("X%02x", SignalILL)
+			}
+			return reply(s.stopped), nil
+		}
+		if count >= 0 {
+			continue
+		}
+		if s.breaks[s.Machine.PC] {
+			s.stopped = fmt.Sprintf("T%02xswbreak:;", SignalTRAP)
+			return reply(s.stopped), nil
+		}
+		if steps%interruptCheckInterval != 0 {
+			continue
+		}
+		stop, err := s.interrupted(events)
+		if err != nil {
+			return nil, err
+		}
+		if stop {
+			return reply(s.stopped), nil
+		}
+	}
+	s.stopped = fmt.Sprintf("S%02x", SignalTRAP)
+	return reply(s.stopped), nil
+}
+
+// reverse implements the reverse step and continue commands. When count
+// is negative we go backwards until a breakpoint, an interrupt, or the
+// beginning of the history. Otherwise, we undo count instructions.
+func (s *Stub) reverse(events <-chan event, count int) (*string, error) {
+	for steps := 0; count < 0 || steps < count; steps++ {
+		if !s.StepBack() {
+			s.stopped = fmt.Sprintf("T%02xreplaylog:begin;", SignalTRAP)
+			return reply(s.stopped), nil
+		}
+		s.exited = false
+		if count >= 0 {
+			continue
+		}
+		if s.breaks[s.Machine.PC] {
+			s.stopped = fmt.Sprintf("T%02xswbreak:;", SignalTRAP)
+			return reply(s.stopped), nil
+		}
+		if steps%interruptCheckInterval != 0 {
+			continue
+		}
+		stop, err := s.interrupted(events)
+		if err != nil {
+			return nil, err
+		}
+		if stop {
+			return reply(s.stopped), nil
+		}
+	}
+	s.stopped = fmt.Sprintf("S%02x", SignalTRAP)
+	return reply(s.stopped), nil
+}
+
+// interrupted returns true if the client has interrupted us while
+// running, in which case it also updates the stop reason, or an
+// error if reading from or writing to the client failed. We
+// acknowledge packets sent while running, so that the client does
+// not retransmit them, but we otherwise ignore them.
+func (s *Stub) interrupted(events <-chan event) (bool, error) {
+	select {
+	case ev := <-events:
+		if ev.err != nil {
+			return false, ev.err
+		}
+		if ev.interrupt {
+			s.stopped = fmt.Sprintf("S%02x", SignalINT)
+			return true, nil
+		}
+		return false, s.ack(ev)
+	default:
+	}
+	return false, nil
+}
@@ -0,0 +1,272 @@
+package gdbstub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/risc16/pkg/reverse"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// client is a scripted GDB remote serial protocol client.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startStub serves the stub over a pipe and returns the client side
+// of the pipe along with the channel where Serve posts its result.
+func startStub(t *testing.T, stub *Stub) (*client, <-chan error) {
+	stubConn, clientConn := net.Pipe()
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() {
+		clientConn.Close()
+		stubConn.Close()
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- stub.Serve(stubConn)
+	}()
+	return &client{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}, done
+}
+
+// send sends a packet.
+func (c *client) send(data string) {
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", data, computeChecksum(data)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// interrupt sends an interrupt.
+func (c *client) interrupt() {
+	if _, err := c.conn.Write([]byte{0x03}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expectAck reads the acknowledgment of a packet.
+func (c *client) expectAck() {
+	ch, err := c.r.ReadByte()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if ch != '+' {
+		c.t.Fatalf("expected an ack, got %q", ch)
+	}
+}
+
+// receive reads a packet, checks its checksum, and acknowledges it.
+func (c *client) receive() string {
+	if ch, err := c.r.ReadByte(); err != nil || ch != '$' {
+		c.t.Fatalf("expected a packet, got %q (%v)", ch, err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = strings.TrimSuffix(data, "#")
+	var checksum [2]byte
+	if _, err := io.ReadFull(c.r, checksum[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if string(checksum[:]) != fmt.Sprintf("%02x", computeChecksum(data)) {
+		c.t.Fatalf("invalid checksum for %q", data)
+	}
+	if _, err := c.conn.Write([]byte("+")); err != nil {
+		c.t.Fatal(err)
+	}
+	return data
+}
+
+// call sends a packet and returns the reply.
+func (c *client) call(data string) string {
+	c.send(data)
+	c.expectAck()
+	return c.receive()
+}
+
+// expect sends a packet and checks the reply.
+func (c *client) expect(data, expected string) {
+	if got := c.call(data); got != expected {
+		c.t.Fatalf("%s: expected %q, got %q", data, expected, got)
+	}
+}
+
+// kill kills the program and checks the result of Serve.
+func (c *client) kill(done <-chan error) {
+	c.send("k")
+	c.expectAck()
+	if err := <-done; !errors.Is(err, ErrKilled) {
+		c.t.Fatalf("expected ErrKilled, got %v", err)
+	}
+}
+
+func TestStub(t *testing.T) {
+	machine := new(vm.VM) // executes NOPs
+	machine.GPR[1] = 0x1234
+	machine.M[5] = 0x1234
+	machine.M[6] = 0xabcd
+	c, done := startStub(t, NewStub(machine))
+	if features := c.call("qSupported:swbreak+"); !strings.Contains(features, "qXfer:features:read+") {
+		t.Fatalf("qSupported: %q", features)
+	}
+	c.expect("?", "S05")
+	c.expect("g", "00003412"+strings.Repeat("0000", NumRegisters-2))
+	c.expect("p1", "3412")
+	c.expect("P2=cdab", "OK")
+	if machine.GPR[2] != 0xabcd {
+		t.Fatalf("P: r2=%04x", machine.GPR[2])
+	}
+	c.expect("m5,4", "3412cdab")
+	c.expect("m5,3", "3412cd")
+	c.expect("M6,1:ef", "OK")
+	if machine.M[6] != 0xabef {
+		t.Fatalf("odd M: %04x", machine.M[6])
+	}
+	c.expect("M7,3:010203", "OK")
+	if machine.M[7] != 0x0201 || machine.M[8] != 0x0003 {
+		t.Fatalf("odd M: %04x %04x", machine.M[7], machine.M[8])
+	}
+	c.expect("M7,1:0102", "E01")
+	c.expect("Z0,3,2", "OK")
+	c.expect("c", "T05swbreak:;")
+	if machine.PC != 3 {
+		t.Fatalf("c: PC=%d", machine.PC)
+	}
+	c.expect("s", "S05")
+	if machine.PC != 4 {
+		t.Fatalf("s: PC=%d", machine.PC)
+	}
+	c.interrupt() // while stopped
+	if stop := c.receive(); stop != "S05" {
+		t.Fatalf("interrupt while stopped: %q", stop)
+	}
+	c.kill(done)
+}
+
+func TestStubModify(t *testing.T) {
+	// the changes made by the client go through the devices and
+	// the undo log, thus stepping back undoes them in order
+	var out bytes.Buffer
+	console := vm.NewConsole(vm.ConsoleBase, strings.NewReader(""), &out)
+	machine := new(vm.VM) // executes NOPs
+	if err := machine.Attach(console); err != nil {
+		t.Fatal(err)
+	}
+	l := reverse.New(machine, 10)
+	stub := NewStub(machine)
+	stub.Step = l.Step
+	stub.StepBack = func() bool {
+		return l.StepBack(1) == 1
+	}
+	stub.Modify = func(change func()) {
+		l.Record(func() error {
+			change()
+			return nil
+		})
+	}
+	c, done := startStub(t, stub)
+	c.expect("s", "S05")
+	c.expect("P1=3412", "OK")
+	c.expect("G"+strings.Repeat("0000", 2)+"cdab"+strings.Repeat("0000", 5)+"0a00", "OK")
+	c.expect("M5,3:cdab01", "OK")
+	c.expect("Mfff0,2:4100", "OK")
+	c.expect("Mfff0,1:42", "OK")
+	if err := console.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "AB" || machine.Memory()[vm.ConsoleBase] != 0 {
+		t.Fatalf("the console printed %q", out.String())
+	}
+	if machine.GPR[1] != 0 || machine.GPR[2] != 0xabcd || machine.PC != 10 {
+		t.Fatalf("G: r1=%04x r2=%04x PC=%d", machine.GPR[1], machine.GPR[2], machine.PC)
+	}
+	if machine.M[5] != 0xabcd || machine.M[6] != 0x0001 {
+		t.Fatalf("M: %04x %04x", machine.M[5], machine.M[6])
+	}
+	c.expect("bs", "S05") // the console writes
+	c.expect("bs", "S05")
+	c.expect("bs", "S05") // the memory write
+	if machine.M[5] != 0 || machine.M[6] != 0 || machine.PC != 10 {
+		t.Fatalf("bs: %04x %04x PC=%d", machine.M[5], machine.M[6], machine.PC)
+	}
+	c.expect("bs", "S05") // the registers write
+	if machine.GPR[1] != 0x1234 || machine.GPR[2] != 0 || machine.PC != 1 {
+		t.Fatalf("bs: r1=%04x r2=%04x PC=%d", machine.GPR[1], machine.GPR[2], machine.PC)
+	}
+	c.expect("bs", "S05") // the register write
+	c.expect("bs", "S05") // the instruction
+	if machine.GPR[1] != 0 || machine.PC != 0 {
+		t.Fatalf("bs: r1=%04x PC=%d", machine.GPR[1], machine.PC)
+	}
+	c.expect("bs", "T05replaylog:begin;")
+	c.kill(done)
+}
+
+func TestStubTargetDescription(t *testing.T) {
+	c, done := startStub(t, NewStub(new(vm.VM)))
+	var xml string
+	for {
+		chunk := c.call(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", len(xml)))
+		if chunk == "" || (chunk[0] != 'm' && chunk[0] != 'l') {
+			t.Fatalf("unexpected reply: %q", chunk)
+		}
+		if chunk[0] == 'm' && len(chunk) != 0x41 {
+			t.Fatalf("unexpected chunk length: %d", len(chunk))
+		}
+		xml += chunk[1:]
+		if chunk[0] == 'l' {
+			break
+		}
+	}
+	if xml != targetDescription() {
+		t.Fatalf("unexpected target description:\n%s", xml)
+	}
+	for _, reg := range []string{`name="r0"`, `name="r7"`, `name="pc"`, `bitsize="16"`} {
+		if !strings.Contains(xml, reg) {
+			t.Fatalf("target description lacks %s:\n%s", reg, xml)
+		}
+	}
+	c.expect("qXfer:features:read:other.xml:0,40", "E00")
+	c.kill(done)
+}
+
+func TestStubWhileRunning(t *testing.T) {
+	machine := new(vm.VM)
+	machine.M[0] = vm.OpcodeBEQ<<13 | 0x7f // beq r0 r0 -1
+	c, done := startStub(t, NewStub(machine))
+	c.send("c")
+	c.expectAck()
+	c.send("qC")
+	c.expectAck() // acknowledged while running
+	c.interrupt()
+	if stop := c.receive(); stop != "S02" {
+		t.Fatalf("interrupt while running: %q", stop)
+	}
+	c.expect("?", "S02")
+	c.kill(done)
+}
+
+func TestStubHalt(t *testing.T) {
+	machine := new(vm.VM)
+	machine.M[1] = vm.OpcodeJALR<<13 | vm.ExceptionTypeEXCEPTION | vm.ExceptionValueHALT
+	c, done := startStub(t, NewStub(machine))
+	c.expect("c", "W00")
+	c.expect("s", "W00")
+	c.send("D")
+	c.expectAck()
+	if reply := c.receive(); reply != "OK" {
+		t.Fatalf("D: %q", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
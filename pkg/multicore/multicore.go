@@ -0,0 +1,168 @@
+// Package multicore simulates a RiSC-16 system with several cores
+// sharing the same memory.
+//
+// Each core is a vm.VM whose vm.SPRCoreID special-purpose register
+// contains the index of the core. The cores share the same physical
+// memory (see vm.VM.ShareMemory), so that any store into the memory,
+// including the ones performed by devices using DMA, by system calls, or
+// by a debugger, is immediately visible to all the cores (i.e., the memory
+// is sequentially consistent). Memory-mapped devices are not shared by the
+// cores, unless the same device is attached to all of them.
+//
+// The scheduler is deterministic: Run executes System.Quantum instructions
+// on each core in round-robin order. Because the cores only switch at
+// instruction boundaries, the TAS and CAS atomic instructions (see
+// vm.ExceptionTypeATOMIC) are atomic with respect to the other cores, which
+// allows writing spinlocks and lock-free code. To explore other interleavings
+// reproducibly, set System.Rand to shuffle the order of the cores in each
+// round using a seeded random number generator.
+package multicore
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// DefaultQuantum is the default number of instructions that
+// each core executes before switching to the next core.
+const DefaultQuantum = 1
+
+// System is a multi-core system. Do not modify Cores after New
+// returns, except for configuring each core (e.g., attaching devices
+// or registering system calls). Like vm.VM, a System is not goroutine
+// safe; a single goroutine should manage it.
+type System struct {
+	// Cores contains the cores.
+	Cores []*vm.VM
+
+	// Quantum is the number of instructions that each core executes
+	// before switching to the next core. Zero means DefaultQuantum.
+	Quantum int
+
+	// Rand, if not nil, shuffles the order in which the cores
+	// execute in each round of the round-robin scheduler.
+	Rand *rand.Rand
+
+	halted []bool
+	memory [vm.MemorySize]uint16
+}
+
+// New creates a System with n cores, where n must be positive.
+func New(n int) *System {
+	s := &System{halted: make([]bool, n)}
+	for idx := 0; idx < n; idx++ {
+		core := new(vm.VM)
+		core.SPR[vm.SPRCoreID] = uint16(idx)
+		core.ShareMemory(&s.memory)
+		s.Cores = append(s.Cores, core)
+	}
+	return s
+}
+
+// Load copies program into the shared memory starting at addr.
+func (s *System) Load(addr uint16, program []uint16) {
+	copy(s.memory[addr:], program)
+}
+
+// Memory returns the shared memory.
+func (s *System) Memory() *[vm.MemorySize]uint16 {
+	return &s.memory
+}
+
+// Halted returns whether the given core has executed HALT.
+func (s *System) Halted(core int) bool {
+	return s.halted[core]
+}
+
+// RunResult is the result of Run. The embedded vm.RunResult describes
+// why the system stopped, except that Instructions is the number of
+// instructions executed by all the cores during Run.
+type RunResult struct {
+	vm.RunResult
+
+	// Core is the index of the core that stopped the system (e.g.,
+	// because of an exception), or -1 when no core is responsible
+	// (e.g., because all the cores halted or a limit was reached).
+	Core int
+}
+
+// Run runs the cores until all of them halt, a core stops because of
+// an error, ctx is done, or a limit in opts is reached. A core that
+// halts does not stop the other cores. The opts.MaxInstructions limit
+// applies to the sum of the instructions executed by the cores, and
+// opts.Step is ignored. After Run returns, you can call Run again to
+// resume the execution. The cores that halted remain halted.
+func (s *System) Run(ctx context.Context, opts vm.RunOptions) RunResult {
+	quantum := uint64(DefaultQuantum)
+	if s.Quantum > 0 {
+		quantum = uint64(s.Quantum)
+	}
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+	result := RunResult{Core: -1}
+	order := make([]int, len(s.Cores))
+	for idx := range order {
+		order[idx] = idx
+	}
+	for {
+		if s.allHalted() {
+			result.Reason, result.Err = vm.StopHalted, vm.ErrHalted
+			return result
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			result.Reason, result.Err = vm.StopTimeLimit, vm.ErrTimeLimit
+			return result
+		}
+		if s.Rand != nil {
+			s.Rand.Shuffle(len(order), func(i, j int) {
+				order[i], order[j] = order[j], order[i]
+			})
+		}
+		for _, idx := range order {
+			if s.halted[idx] {
+				continue
+			}
+			limit := quantum
+			if opts.MaxInstructions > 0 {
+				if result.Instructions >= opts.MaxInstructions {
+					result.Reason, result.Err = vm.StopInstructionLimit, vm.ErrInstructionLimit
+					return result
+				}
+				if opts.MaxInstructions-result.Instructions < limit {
+					limit = opts.MaxInstructions - result.Instructions
+				}
+			}
+			core := s.Cores[idx]
+			cr := core.Run(ctx, vm.RunOptions{MaxInstructions: limit})
+			result.Instructions += cr.Instructions
+			switch cr.Reason {
+			case vm.StopInstructionLimit:
+				// end of the quantum
+			case vm.StopHalted:
+				s.halted[idx] = true
+			default:
+				result.Reason, result.Err = cr.Reason, cr.Err
+				result.PC, result.Cause = cr.PC, cr.Cause
+				if cr.Reason != vm.StopCanceled {
+					result.Core = idx
+				}
+				return result
+			}
+		}
+	}
+}
+
+// allHalted returns whether all the cores have halted.
+func (s *System) allHalted() bool {
+	for _, halted := range s.halted {
+		if !halted {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package multicore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// load assembles source into the shared memory of a new system with
+// n cores and returns the system along with the labels.
+func load(t *testing.T, n int, source string) (*System, map[string]int64) {
+	s := New(n)
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		s.Load(instr.Address, []uint16{instr.Instruction})
+	}
+	labels, err := asm.CollectLabels(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, labels
+}
+
+// spinlock increments the counter 20 times on each core holding the lock.
+const spinlock = `	movi r2, lock
+	addi r6, r0, 20
+loop:	tas
+	beq r1, r0, locked
+	beq r0, r0, loop
+locked:	lw r4, r0, counter
+	addi r4, r4, 1
+	sw r4, r0, counter
+	sw r0, r0, lock
+	addi r6, r6, -1
+	beq r6, r0, done
+	beq r0, r0, loop
+done:	halt
+lock:	.fill 0
+counter:	.fill 0
+`
+
+func TestSpinlock(t *testing.T) {
+	for quantum := 1; quantum <= 3; quantum++ {
+		for seed := int64(0); seed < 4; seed++ {
+			s, labels := load(t, 3, spinlock)
+			s.Quantum = quantum
+			if seed > 0 {
+				s.Rand = rand.New(rand.NewSource(seed))
+			}
+			result := s.Run(context.Background(), vm.RunOptions{MaxInstructions: 100000})
+			if result.Reason != vm.StopHalted || result.Core != -1 {
+				t.Fatalf("quantum %d, seed %d: unexpected result: %+v", quantum, seed, result)
+			}
+			if value := s.Memory()[labels["counter"]]; value != 60 {
+				t.Fatalf("quantum %d, seed %d: expected 60, got %d", quantum, seed, value)
+			}
+			for idx := range s.Cores {
+				if !s.Halted(idx) || s.Cores[idx].SPR[vm.SPRCoreID] != uint16(idx) {
+					t.Fatalf("unexpected state of core %d", idx)
+				}
+			}
+		}
+	}
+}
+
+// memoryDisk is a vm.DiskFile keeping the data in memory.
+type memoryDisk []byte
+
+// ReadAt implements io.ReaderAt.
+func (d memoryDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, io.EOF
+	}
+	count := copy(p, d[off:])
+	if count < len(p) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (d memoryDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(d[off:], p), nil
+}
+
+func TestDiskDMA(t *testing.T) {
+	// core zero reads the first sector into buffer using the disk, which
+	// is only attached to core zero, while core one waits for the data
+	s, labels := load(t, 2, `	mfspr coreid
+	beq r1, r0, reader
+wait:	lw r3, r0, buffer
+	beq r3, r0, wait
+	halt
+reader:	movi r4, buffer
+	sw r4, r0, -31
+	addi r4, r0, 1
+	sw r4, r0, -30
+	sw r4, r0, -29
+	halt
+buffer:	.fill 0
+`)
+	disk := make(memoryDisk, 2*vm.DiskSectorSize)
+	disk[0], disk[1] = 0x34, 0x12
+	if err := s.Cores[0].Attach(vm.NewDisk(s.Cores[0], vm.DiskBase, disk, int64(len(disk)))); err != nil {
+		t.Fatal(err)
+	}
+	result := s.Run(context.Background(), vm.RunOptions{MaxInstructions: 10000})
+	if result.Reason != vm.StopHalted {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if value := s.Cores[1].GPR[3]; value != 0x1234 {
+		t.Fatalf("expected 0x1234, got %#04x", value)
+	}
+	if value := s.Memory()[labels["buffer"]]; value != 0x1234 {
+		t.Fatalf("expected 0x1234, got %#04x", value)
+	}
+}
+
+func TestStore(t *testing.T) {
+	// stores made outside of the cores (e.g., by system call
+	// handlers or by a debugger) are visible to all the cores
+	s := New(2)
+	s.Cores[1].Store(100, 7)
+	if value := s.Cores[0].Load(100); value != 7 {
+		t.Fatalf("expected 7, got %d", value)
+	}
+	s.Cores[0].Memory()[101] = 8
+	if value := s.Cores[1].Memory()[101]; value != 8 {
+		t.Fatalf("expected 8, got %d", value)
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	// core one raises an exception while core zero loops forever
+	s, _ := load(t, 2, `	mfspr coreid
+	beq r1, r0, loop
+	syscall 15
+loop:	beq r0, r0, loop
+`)
+	result := s.Run(context.Background(), vm.RunOptions{MaxInstructions: 1000})
+	if result.Reason != vm.StopException || result.Core != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	var exc *vm.ExceptionError
+	if !errors.As(result.Err, &exc) {
+		t.Fatalf("expected an ExceptionError, got %v", result.Err)
+	}
+	s, _ = load(t, 2, `loop:	beq r0, r0, loop
+`)
+	result = s.Run(context.Background(), vm.RunOptions{MaxInstructions: 101})
+	if result.Reason != vm.StopInstructionLimit || result.Instructions != 101 || result.Core != -1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if s.Cores[0].SPR[vm.SPRCycles] != 51 || s.Cores[1].SPR[vm.SPRCycles] != 50 {
+		t.Fatalf("unexpected cycles: %d %d", s.Cores[0].SPR[vm.SPRCycles], s.Cores[1].SPR[vm.SPRCycles])
+	}
+}
@@ -0,0 +1,486 @@
+// Package pipeline contains a cycle-accurate model of the five-stage
+// RiSC-16 pipeline (IF, ID, EX, MEM, WB).
+//
+// See https://user.eng.umd.edu/~blj/RiSC/.
+//
+// # Model
+//
+// By default, the pipeline predicts that branches are not taken. When
+// the Branches field is set, the pipeline instead fetches from the address
+// predicted by the bpred.Tracker. The pipeline resolves BEQ and JALR in EX,
+// flushing the two younger instructions when the prediction is wrong, and
+// updates the predictor at that time, so that predictions made while older
+// branches are in flight use stale predictor state. The EX stage receives
+// operands forwarded from the EX/MEM latch, while the register file is
+// written in the first half of the cycle, so that WB-to-EX forwarding is
+// implicit. An instruction using the result of the immediately preceding
+// LW stalls in ID for one cycle.
+//
+// # Limitations
+//
+// The model implements the base instruction set, plus HALT, using
+// the flat memory of a vm.VM. Every other exception code (e.g., system
+// calls) stops the model with ErrUnsupported, and devices attached to
+// the VM are ignored. Stores to instructions already in flight flush
+// the pipeline so that the program observes its own writes. The model
+// reports fetches, loads, and stores to the machine's AccessHook.
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/bpred"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// The following constants define the pipeline stages.
+const (
+	StageIF = iota
+	StageID
+	StageEX
+	StageMEM
+	StageWB
+	NumStages
+)
+
+// StageNames contains the name of each stage.
+var StageNames = [NumStages]string{"IF", "ID", "EX", "MEM", "WB"}
+
+// Slot describes the instruction occupying a stage.
+type Slot struct {
+	Valid bool   // false if the stage contains a bubble
+	PC    uint16 // address of the instruction
+	Instr uint16 // instruction
+}
+
+// String returns the disassembly of the slot's instruction.
+func (s Slot) String() string {
+	if !s.Valid {
+		return "-"
+	}
+	return fmt.Sprintf("%d: %s", s.PC, vm.Disassemble(s.Instr))
+}
+
+// Occupancy describes the instructions in each stage during a cycle.
+type Occupancy struct {
+	Cycle  uint64          // cycle number, starting from one
+	Stages [NumStages]Slot // content of each stage
+	Stall  bool            // true if there has been a load-use stall
+	Flush  bool            // true if younger instructions were flushed
+}
+
+// String generates a string representation of the occupancy.
+func (o Occupancy) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%6d", o.Cycle)
+	for idx, slot := range o.Stages {
+		fmt.Fprintf(&builder, " | %s %-18s", StageNames[idx], slot.String())
+	}
+	if o.Stall {
+		builder.WriteString(" | stall")
+	}
+	if o.Flush {
+		builder.WriteString(" | flush")
+	}
+	return builder.String()
+}
+
+// Stats contains pipeline statistics.
+type Stats struct {
+	Cycles       uint64 // number of simulated cycles
+	Instructions uint64 // number of retired instructions
+	Stalls       uint64 // number of load-use stall cycles
+	Flushes      uint64 // number of times the pipeline was flushed
+	Flushed      uint64 // number of flushed instructions
+}
+
+// CPI returns the average number of cycles per retired instruction.
+func (s Stats) CPI() float64 {
+	if s.Instructions == 0 {
+		return 0
+	}
+	return float64(s.Cycles) / float64(s.Instructions)
+}
+
+// String generates a string representation of the statistics.
+func (s Stats) String() string {
+	return fmt.Sprintf("{Cycles:%d Instructions:%d CPI:%.3f Stalls:%d Flushes:%d Flushed:%d}",
+		s.Cycles, s.Instructions, s.CPI(), s.Stalls, s.Flushes, s.Flushed)
+}
+
+// ErrUnsupported indicates that the pipeline encountered an exception
+// code that is not supported by the model.
+var ErrUnsupported = errors.New("pipeline: unsupported instruction")
+
+// latch is a pipeline latch. The fields other than valid, pc, and
+// instr are filled by the stages as the instruction moves forward.
+type latch struct {
+	valid  bool
+	pc     uint16
+	instr  uint16
+	next   uint16 // predicted address of the next instruction
+	dest   uint16 // register written by the instruction, zero if none
+	result uint16 // value to write into dest
+	addr   uint16 // memory address for LW and SW
+	data   uint16 // data to store for SW
+	taken  bool   // whether this is a taken BEQ
+	halt   bool   // whether this is HALT
+	err    error  // error to report when the instruction retires
+}
+
+// opcode returns the opcode of the latched instruction.
+func (l *latch) opcode() uint16 {
+	return l.instr >> 13
+}
+
+// slot returns the slot describing the latched instruction.
+func (l *latch) slot() Slot {
+	return Slot{Valid: l.valid, PC: l.pc, Instr: l.instr}
+}
+
+// Pipeline is the pipeline model. It uses the registers, memory, and
+// program counter of a vm.VM as its architectural state. The model is
+// not goroutine safe; a single goroutine should manage it.
+type Pipeline struct {
+	Machine *vm.VM
+
+	// Branches, if not nil, predicts branches and collects
+	// statistics about them. When nil, we predict not taken.
+	Branches *bpred.Tracker
+
+	done     bool
+	draining bool
+	err      error
+	ifid     latch
+	idex     latch
+	exmem    latch
+	memwb    latch
+	stats    Stats
+}
+
+// New creates a new pipeline that starts fetching at machine.PC.
+func New(machine *vm.VM) *Pipeline {
+	return &Pipeline{Machine: machine}
+}
+
+// Stats returns the statistics collected so far.
+func (p *Pipeline) Stats() Stats {
+	return p.stats
+}
+
+// sources returns the registers read by the given instruction. We
+// also consider ra for JALR because the VM checks whether both ra
+// and rb are zero to recognize HALT and the other exceptions.
+func sources(instr uint16) []uint16 {
+	ra := (instr >> 10) & 0b0111
+	rb := (instr >> 7) & 0b0111
+	rc := instr & 0b0111
+	switch instr >> 13 {
+	case vm.OpcodeADD, vm.OpcodeNAND:
+		return []uint16{rb, rc}
+	case vm.OpcodeADDI, vm.OpcodeLW:
+		return []uint16{rb}
+	case vm.OpcodeSW, vm.OpcodeBEQ, vm.OpcodeJALR:
+		return []uint16{ra, rb}
+	default:
+		return nil
+	}
+}
+
+// Cycle simulates a single clock cycle and returns the occupancy of the
+// stages during such cycle. When the HALT instruction retires, this function
+// returns vm.ErrHalted and sets Machine.PC to the address following HALT,
+// like the vm.VM does. Once it has returned an error, Cycle keeps returning
+// the same error without simulating additional cycles.
+func (p *Pipeline) Cycle() (Occupancy, error) {
+	if p.done {
+		return Occupancy{}, p.err
+	}
+	p.stats.Cycles++
+	occupancy := Occupancy{Cycle: p.stats.Cycles}
+	occupancy.Stages[StageID] = p.ifid.slot()
+	occupancy.Stages[StageEX] = p.idex.slot()
+	occupancy.Stages[StageMEM] = p.exmem.slot()
+	occupancy.Stages[StageWB] = p.memwb.slot()
+	// WB (first half of the cycle)
+	if err := p.writeBack(); err != nil {
+		return occupancy, err
+	}
+	// MEM
+	memwb, stored, hasStored := p.memory()
+	// EX
+	exmem, redirect, target := p.execute()
+	// ID
+	stall := p.idex.valid && p.idex.opcode() == vm.OpcodeLW && p.idex.dest != 0
+	if stall {
+		stall = false
+		for _, reg := range sources(p.ifid.instr) {
+			if p.ifid.valid && reg == p.idex.dest {
+				stall = true
+			}
+		}
+	}
+	idex := p.decode()
+	ifid := p.ifid
+	// IF
+	switch {
+	case stall:
+		idex = latch{} // insert a bubble into EX
+		p.stats.Stalls++
+		occupancy.Stall = true
+	case !p.draining:
+		p.accessed(vm.AccessFetch, p.Machine.PC)
+		ifid = latch{valid: true, pc: p.Machine.PC, instr: p.Machine.Memory()[p.Machine.PC]}
+		ifid.next = ifid.pc + 1
+		if p.Branches != nil {
+			ifid.next = p.Branches.Predict(ifid.pc, ifid.instr)
+		}
+		occupancy.Stages[StageIF] = ifid.slot()
+		p.Machine.PC = ifid.next
+	}
+	if exmem.halt || exmem.err != nil {
+		// stop fetching and wait for the instruction to retire
+		ifid, idex, p.draining = latch{}, latch{}, true
+	}
+	if redirect {
+		p.flush(&ifid, &idex)
+		p.Machine.PC = target
+		occupancy.Flush = true
+	}
+	if hasStored {
+		// In the functional model, the store happens before fetching
+		// the younger instructions, so we must refetch stale ones.
+		younger := []*latch{&exmem, &idex, &ifid}
+		for idx, l := range younger {
+			if l.valid && l.pc == stored {
+				p.Machine.PC = l.pc
+				p.flush(younger[idx:]...)
+				occupancy.Flush = true
+				break
+			}
+		}
+	}
+	p.ifid, p.idex, p.exmem, p.memwb = ifid, idex, exmem, memwb
+	return occupancy, nil
+}
+
+// flush turns the given latches into bubbles.
+func (p *Pipeline) flush(latches ...*latch) {
+	p.stats.Flushes++
+	for _, l := range latches {
+		if l.valid {
+			p.stats.Flushed++
+		}
+		*l = latch{}
+	}
+}
+
+// writeBack implements the WB stage.
+func (p *Pipeline) writeBack() error {
+	if !p.memwb.valid {
+		return nil
+	}
+	if p.memwb.err != nil || p.memwb.halt {
+		p.Machine.PC = p.memwb.pc + 1
+		p.done, p.err = true, p.memwb.err
+		if p.memwb.halt {
+			p.err = vm.ErrHalted
+			p.retire()
+		}
+		return p.err
+	}
+	if p.memwb.dest != 0 {
+		p.Machine.GPR[p.memwb.dest] = p.memwb.result
+	}
+	p.retire()
+	return nil
+}
+
+// accessed invokes the machine's access hook, if any.
+func (p *Pipeline) accessed(kind vm.AccessKind, addr uint16) {
+	if p.Machine.AccessHook != nil {
+		p.Machine.AccessHook(kind, addr)
+	}
+}
+
+// retire accounts for a retired instruction. Like the vm.VM, we count
+// the retired instructions using the SPRCycles register.
+func (p *Pipeline) retire() {
+	p.stats.Instructions++
+	p.Machine.SPR[vm.SPRCycles]++
+}
+
+// memory implements the MEM stage. It returns the new MEM/WB latch
+// and, in case of SW, the address that has been written.
+func (p *Pipeline) memory() (latch, uint16, bool) {
+	out := p.exmem
+	if !out.valid || out.err != nil || out.halt {
+		return out, 0, false
+	}
+	switch out.opcode() {
+	case vm.OpcodeLW:
+		p.accessed(vm.AccessRead, out.addr)
+		out.result = p.Machine.Memory()[out.addr]
+	case vm.OpcodeSW:
+		p.accessed(vm.AccessWrite, out.addr)
+		p.Machine.Memory()[out.addr] = out.data
+		return out, out.addr, true
+	}
+	return out, 0, false
+}
+
+// operand reads the given register forwarding from EX/MEM if needed.
+func (p *Pipeline) operand(reg uint16) uint16 {
+	if reg != 0 && p.exmem.valid && p.exmem.dest == reg {
+		return p.exmem.result // never a LW because of the load-use stall
+	}
+	return p.Machine.GPR[reg]
+}
+
+// execute implements the EX stage. It returns the new EX/MEM latch
+// and whether the next instruction was mispredicted along with the
+// address of the correct next instruction.
+func (p *Pipeline) execute() (latch, bool, uint16) {
+	out := p.idex
+	if !out.valid {
+		return out, false, 0
+	}
+	next, special := p.compute(&out)
+	if special {
+		return out, false, 0
+	}
+	if p.Branches != nil {
+		p.Branches.Resolve(out.pc, out.instr, out.next, next, out.taken)
+	}
+	return out, next != out.next, next
+}
+
+// compute computes the result of the instruction in EX and returns the
+// address of the next instruction. It also returns whether the instruction
+// is a special JALR (e.g., HALT) that stops fetching.
+func (p *Pipeline) compute(out *latch) (uint16, bool) {
+	ra := (out.instr >> 10) & 0b0111
+	rb := (out.instr >> 7) & 0b0111
+	rc := out.instr & 0b0111
+	imm7 := vm.SignExtend7(out.instr & 0b111_1111)
+	imm10 := out.instr & 0b11_1111_1111
+	switch out.opcode() {
+	case vm.OpcodeADD:
+		out.result = p.operand(rb) + p.operand(rc)
+	case vm.OpcodeADDI:
+		out.result = p.operand(rb) + imm7
+	case vm.OpcodeNAND:
+		out.result = ^(p.operand(rb) & p.operand(rc))
+	case vm.OpcodeLUI:
+		out.result = imm10 << 6
+	case vm.OpcodeSW:
+		out.addr = p.operand(rb) + imm7
+		out.data = p.operand(ra)
+	case vm.OpcodeLW:
+		out.addr = p.operand(rb) + imm7
+	case vm.OpcodeBEQ:
+		if p.operand(ra) == p.operand(rb) {
+			out.taken = true
+			return out.pc + 1 + imm7, false
+		}
+	case vm.OpcodeJALR:
+		if p.operand(ra) == 0 && p.operand(rb) == 0 {
+			out.dest = 0
+			code := imm7 & 0b111_1111
+			if code == vm.ExceptionTypeEXCEPTION|vm.ExceptionValueHALT {
+				out.halt = true
+			} else {
+				out.err = fmt.Errorf("%w with ID %d at %d", ErrUnsupported, code, out.pc)
+			}
+			return 0, true
+		}
+		out.result = out.pc + 1
+		return p.operand(rb), false
+	}
+	return out.pc + 1, false
+}
+
+// decode implements the ID stage and returns the new ID/EX latch.
+func (p *Pipeline) decode() latch {
+	out := p.ifid
+	if !out.valid {
+		return out
+	}
+	switch out.opcode() {
+	case vm.OpcodeADD, vm.OpcodeADDI, vm.OpcodeNAND, vm.OpcodeLUI,
+		vm.OpcodeLW, vm.OpcodeJALR:
+		out.dest = (out.instr >> 10) & 0b0111
+	}
+	return out
+}
+
+// The following errors may be returned by Verify.
+var (
+	ErrMismatch      = errors.New("pipeline: mismatch with the functional model")
+	ErrTooManyCycles = errors.New("pipeline: too many cycles")
+)
+
+// Verify runs the program loaded into p.Machine on the pipeline model, for
+// at most maxCycles cycles, and on a copy of p.Machine using the functional
+// VM. Call Verify on a new pipeline, before calling Cycle. If trace is not
+// nil, Verify calls it after each cycle. Verify returns the pipeline statistics
+// and an error if the program did not halt or if the architectural states
+// of the two models differ at the end of the run.
+func (p *Pipeline) Verify(maxCycles uint64, trace func(Occupancy)) (Stats, error) {
+	machine := p.Machine
+	reference := &vm.VM{GPR: machine.GPR, M: *machine.Memory(), PC: machine.PC, SPR: machine.SPR}
+	var err error
+	for err == nil {
+		if p.stats.Cycles >= maxCycles {
+			return p.stats, ErrTooManyCycles
+		}
+		var occupancy Occupancy
+		occupancy, err = p.Cycle()
+		if trace != nil {
+			trace(occupancy)
+		}
+	}
+	if !errors.Is(err, vm.ErrHalted) {
+		return p.stats, err
+	}
+	for steps := uint64(0); ; steps++ {
+		if steps >= p.stats.Instructions {
+			return p.stats, fmt.Errorf("%w: the functional model did not halt", ErrMismatch)
+		}
+		reference.Fetch()
+		if err := reference.Execute(); err != nil {
+			if !errors.Is(err, vm.ErrHalted) {
+				return p.stats, fmt.Errorf("%w: %s", ErrMismatch, err.Error())
+			}
+			break
+		}
+	}
+	return p.stats, compare(machine, reference)
+}
+
+// compare compares the architectural state of two machines.
+func compare(got, expected *vm.VM) error {
+	if got.PC != expected.PC {
+		return fmt.Errorf("%w: PC is %d, expected %d", ErrMismatch, got.PC, expected.PC)
+	}
+	for idx := range got.GPR {
+		if got.GPR[idx] != expected.GPR[idx] {
+			return fmt.Errorf("%w: r%d is %d, expected %d", ErrMismatch, idx,
+				got.GPR[idx], expected.GPR[idx])
+		}
+	}
+	gotM, expectedM := got.Memory(), expected.Memory()
+	for addr := range gotM {
+		if gotM[addr] != expectedM[addr] {
+			return fmt.Errorf("%w: M[%d] is %d, expected %d", ErrMismatch, addr,
+				gotM[addr], expectedM[addr])
+		}
+	}
+	if got.SPR[vm.SPRCycles] != expected.SPR[vm.SPRCycles] {
+		return fmt.Errorf("%w: retired %d instructions, expected %d", ErrMismatch,
+			got.SPR[vm.SPRCycles], expected.SPR[vm.SPRCycles])
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/bpred"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// load assembles source into a new VM.
+func load(t *testing.T, source string) *vm.VM {
+	machine := new(vm.VM)
+	var addr uint16
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		machine.M[addr] = instr.Instruction
+		addr++
+	}
+	return machine
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		reg    uint16 // register to check
+		value  uint16 // expected value of reg
+		stats  Stats
+	}{{
+		name: "load-use stall",
+		source: `	lw r1, r0, data
+	add r2, r1, r1
+	halt
+data:	.fill 21
+`,
+		reg:   2,
+		value: 42,
+		stats: Stats{Cycles: 8, Instructions: 3, Stalls: 1},
+	}, {
+		name: "EX/MEM forwarding",
+		source: `	addi r1, r0, 5
+	add r2, r1, r1
+	add r3, r2, r1
+	halt
+`,
+		reg:   3,
+		value: 15,
+		stats: Stats{Cycles: 8, Instructions: 4},
+	}, {
+		name: "BEQ taken",
+		source: `	addi r1, r0, 1
+	beq r1, r1, skip
+	addi r2, r0, 7
+	addi r2, r0, 8
+skip:	halt
+`,
+		reg:   2,
+		value: 0,
+		stats: Stats{Cycles: 9, Instructions: 3, Flushes: 1, Flushed: 2},
+	}, {
+		name: "BEQ not taken",
+		source: `	addi r1, r0, 1
+	beq r0, r1, skip
+	addi r2, r0, 7
+skip:	halt
+`,
+		reg:   2,
+		value: 7,
+		stats: Stats{Cycles: 8, Instructions: 4},
+	}, {
+		name: "JALR",
+		source: `	addi r1, r0, target
+	jalr r7, r1
+	addi r2, r0, 7
+	addi r2, r0, 8
+target:	halt
+`,
+		reg:   7,
+		value: 2,
+		stats: Stats{Cycles: 9, Instructions: 3, Flushes: 1, Flushed: 2},
+	}, {
+		name: "store into the instruction stream",
+		source: `	lw r1, r0, patch
+	sw r1, r0, target
+target:	addi r2, r0, 1
+	halt
+patch:	addi r2, r0, 9
+`,
+		reg:   2,
+		value: 9,
+		stats: Stats{Cycles: 12, Instructions: 4, Stalls: 1, Flushes: 1, Flushed: 3},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			machine := load(t, tt.source)
+			p := New(machine)
+			stats, err := p.Verify(1000, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if machine.GPR[tt.reg] != tt.value {
+				t.Fatalf("expected r%d=%d, got %d", tt.reg, tt.value, machine.GPR[tt.reg])
+			}
+			if stats != tt.stats {
+				t.Fatalf("expected %s, got %s", tt.stats, stats)
+			}
+		})
+	}
+}
+
+func TestVerifyTooManyCycles(t *testing.T) {
+	machine := load(t, "loop:	beq r0, r0, loop\n")
+	if _, err := New(machine).Verify(100, nil); !errors.Is(err, ErrTooManyCycles) {
+		t.Fatalf("expected ErrTooManyCycles, got %v", err)
+	}
+}
+
+func TestVerifyUnsupported(t *testing.T) {
+	machine := load(t, "	syscall 1\n	halt\n")
+	if _, err := New(machine).Verify(100, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestCycleOccupancy(t *testing.T) {
+	machine := load(t, `	lw r1, r0, data
+	add r2, r1, r1
+	halt
+data:	.fill 21
+`)
+	p := New(machine)
+	var trace []Occupancy
+	if _, err := p.Verify(1000, func(o Occupancy) { trace = append(trace, o) }); err != nil {
+		t.Fatal(err)
+	}
+	// cycle 3: the add stalls in ID while the lw is in EX
+	o := trace[2]
+	if !o.Stall || o.Stages[StageID].PC != 1 || o.Stages[StageEX].PC != 0 {
+		t.Fatalf("unexpected occupancy:\n%s", o)
+	}
+	// cycle 4: the bubble is in EX and the lw is in MEM
+	o = trace[3]
+	if o.Stall || o.Stages[StageEX].Valid || o.Stages[StageMEM].PC != 0 {
+		t.Fatalf("unexpected occupancy:\n%s", o)
+	}
+}
+
+func TestVerifyBranchPredictor(t *testing.T) {
+	machine := load(t, `	addi r1, r0, 3
+loop:	beq r0, r0, next
+next:	addi r1, r1, -1
+	beq r1, r0, done
+	beq r0, r0, loop
+done:	halt
+`)
+	p := New(machine)
+	p.Branches = bpred.NewTracker(bpred.NewCounters(4, 2))
+	if _, err := p.Verify(1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []bpred.BranchStats{
+		{PC: 1, Executed: 3, Taken: 3},                  // offset zero, so never mispredicted
+		{PC: 3, Executed: 3, Taken: 1, Mispredicted: 1}, // exits the loop
+		{PC: 4, Executed: 2, Taken: 2, Mispredicted: 1}, // learns the loop
+	}
+	stats := p.Branches.Branches()
+	if len(stats) != len(expected) {
+		t.Fatalf("expected %d branches, got %+v", len(expected), stats)
+	}
+	for idx := range expected {
+		stats[idx].Instr = 0
+		if stats[idx] != expected[idx] {
+			t.Fatalf("expected %+v, got %+v", expected[idx], stats[idx])
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package profile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// protobuf encodes protocol buffers messages. We only implement the
+// subset of the encoding required by the pprof profile.proto schema.
+type protobuf struct {
+	buf []byte
+}
+
+// varint appends x using the varint encoding.
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf = append(b.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	b.buf = append(b.buf, byte(x))
+}
+
+// key appends the key of the field tag with the given wire type.
+func (b *protobuf) key(tag int, wireType uint64) {
+	b.varint(uint64(tag)<<3 | wireType)
+}
+
+// uint64 appends a varint field, unless x is zero.
+func (b *protobuf) uint64(tag int, x uint64) {
+	if x != 0 {
+		b.key(tag, 0)
+		b.varint(x)
+	}
+}
+
+// bool appends a bool field, unless x is false.
+func (b *protobuf) bool(tag int, x bool) {
+	if x {
+		b.uint64(tag, 1)
+	}
+}
+
+// packed appends a packed repeated varint field.
+func (b *protobuf) packed(tag int, xs []uint64) {
+	var body protobuf
+	for _, x := range xs {
+		body.varint(x)
+	}
+	b.message(tag, &body)
+}
+
+// string appends a string field, even if s is empty.
+func (b *protobuf) string(tag int, s string) {
+	b.key(tag, 2)
+	b.varint(uint64(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+// message appends an embedded message field.
+func (b *protobuf) message(tag int, body *protobuf) {
+	b.key(tag, 2)
+	b.varint(uint64(len(body.buf)))
+	b.buf = append(b.buf, body.buf...)
+}
+
+// The following constants define the tags of the profile.proto fields.
+const (
+	profileSampleType   = 1
+	profileSample       = 2
+	profileMapping      = 3
+	profileLocation     = 4
+	profileFunction     = 5
+	profileStringTable  = 6
+	profilePeriodType   = 11
+	profilePeriod       = 12
+	valueTypeType       = 1
+	valueTypeUnit       = 2
+	sampleLocationID    = 1
+	sampleValues        = 2
+	mappingID           = 1
+	mappingMemoryLimit  = 3
+	mappingFilename     = 5
+	mappingHasFunctions = 7
+	locationID          = 1
+	locationMappingID   = 2
+	locationAddress     = 3
+	locationLine        = 4
+	lineFunctionID      = 1
+	functionID          = 1
+	functionName        = 2
+	functionSystemName  = 3
+	functionFilename    = 4
+)
+
+// pprofWriter builds a pprof profile.
+type pprofWriter struct {
+	functions map[string]uint64
+	locations map[uint16]uint64
+	profile   protobuf
+	strings   map[string]uint64
+	table     []string
+}
+
+// str returns the index of s into the string table.
+func (w *pprofWriter) str(s string) uint64 {
+	idx, found := w.strings[s]
+	if !found {
+		idx = uint64(len(w.table))
+		w.strings[s] = idx
+		w.table = append(w.table, s)
+	}
+	return idx
+}
+
+// valueType appends a ValueType field.
+func (w *pprofWriter) valueType(tag int, typ, unit string) {
+	var body protobuf
+	body.uint64(valueTypeType, w.str(typ))
+	body.uint64(valueTypeUnit, w.str(unit))
+	w.profile.message(tag, &body)
+}
+
+// location returns the ID of the location of addr, appending
+// the location and its function when needed.
+func (w *pprofWriter) location(addr uint16, symbols *Symbols, filename string) uint64 {
+	if id, found := w.locations[addr]; found {
+		return id
+	}
+	name := symbols.Label(addr)
+	if name == "" {
+		name = fmt.Sprintf("addr_%d", addr)
+	}
+	fid, found := w.functions[name]
+	if !found {
+		fid = uint64(len(w.functions) + 1)
+		w.functions[name] = fid
+		var body protobuf
+		body.uint64(functionID, fid)
+		body.uint64(functionName, w.str(name))
+		body.uint64(functionSystemName, w.str(name))
+		body.uint64(functionFilename, w.str(filename))
+		w.profile.message(profileFunction, &body)
+	}
+	id := uint64(len(w.locations) + 1)
+	w.locations[addr] = id
+	var line protobuf
+	line.uint64(lineFunctionID, fid)
+	var body protobuf
+	body.uint64(locationID, id)
+	body.uint64(locationMappingID, 1)
+	body.uint64(locationAddress, uint64(addr))
+	body.message(locationLine, &line)
+	w.profile.message(profileLocation, &body)
+	return id
+}
+
+// WritePprof writes the profile into w using the gzip-compressed
+// protocol buffers format read by `go tool pprof`. The profile contains
+// two sample types, the instructions and the estimated cycles, and the
+// stack of each sample contains the address of the instruction followed
+// by the addresses of the active calls. Each label becomes a function
+// and the filename (e.g., the assembly source) is used as the name of
+// the mapping and as the file of each function.
+func (p *Profiler) WritePprof(w io.Writer, filename string) error {
+	pw := &pprofWriter{
+		functions: make(map[string]uint64),
+		locations: make(map[uint16]uint64),
+		strings:   make(map[string]uint64),
+	}
+	pw.str("") // the first string must be empty
+	pw.valueType(profileSampleType, "instructions", "count")
+	pw.valueType(profileSampleType, "cycles", "count")
+	var keys []sampleKey
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	depth := func(f *frame) (n int) {
+		for ; f != p.root; f = f.parent {
+			n++
+		}
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { // for a deterministic output
+		di, dj := depth(keys[i].frame), depth(keys[j].frame)
+		if di != dj {
+			return di < dj
+		}
+		fi, fj := keys[i].frame, keys[j].frame
+		for fi != fj && fi.parent != fj.parent {
+			fi, fj = fi.parent, fj.parent
+		}
+		if fi != fj {
+			if fi.site != fj.site {
+				return fi.site < fj.site
+			}
+			return fi.target < fj.target
+		}
+		return keys[i].pc < keys[j].pc
+	})
+	for _, key := range keys {
+		value := p.samples[key]
+		locations := []uint64{pw.location(key.pc, p.Symbols, filename)}
+		for f := key.frame; f != p.root; f = f.parent {
+			locations = append(locations, pw.location(f.site, p.Symbols, filename))
+		}
+		var body protobuf
+		body.packed(sampleLocationID, locations)
+		body.packed(sampleValues, []uint64{value.instructions, value.cycles})
+		pw.profile.message(profileSample, &body)
+	}
+	var mapping protobuf
+	mapping.uint64(mappingID, 1)
+	mapping.uint64(mappingMemoryLimit, vm.MemorySize)
+	mapping.uint64(mappingFilename, pw.str(filename))
+	mapping.bool(mappingHasFunctions, true)
+	pw.profile.message(profileMapping, &mapping)
+	pw.valueType(profilePeriodType, "instructions", "count")
+	pw.profile.uint64(profilePeriod, 1)
+	for _, s := range pw.table {
+		pw.profile.string(profileStringTable, s)
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(pw.profile.buf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,142 @@
+package profile
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rawProfile is a profile parsed from the output of `go tool pprof -raw`.
+type rawProfile struct {
+	sampleTypes string
+	samples     []rawSample
+	functions   map[uint64]string
+	addrs       map[uint64]uint64
+}
+
+// rawSample is a sample of a rawProfile.
+type rawSample struct {
+	values    []uint64
+	locations []uint64 // the innermost first
+}
+
+// readPprof reads the profile at filename using `go tool pprof -raw`,
+// which uses the same parser as the pprof tool.
+func readPprof(t *testing.T, filename string) *rawProfile {
+	gobin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(gobin); err != nil {
+		t.Skip("cannot find the go tool")
+	}
+	out, err := exec.Command(gobin, "tool", "pprof", "-raw", filename).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool pprof: %s\n%s", err, out)
+	}
+	raw := &rawProfile{functions: make(map[uint64]string), addrs: make(map[uint64]uint64)}
+	section := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case line == "Samples:" || line == "Locations" || line == "Mappings":
+			section = line
+			continue
+		}
+		switch section {
+		case "Samples:":
+			if raw.sampleTypes == "" {
+				raw.sampleTypes = line
+				continue
+			}
+			// e.g., `10  20: 3 2 1` with the values before the colon
+			values, locations, found := strings.Cut(line, ":")
+			if !found {
+				t.Fatalf("invalid sample: %s", line)
+			}
+			raw.samples = append(raw.samples, rawSample{
+				values:    parseUints(t, strings.Fields(values)),
+				locations: parseUints(t, strings.Fields(locations)),
+			})
+		case "Locations":
+			// e.g., `7: 0x6 M=1 loop prof.s:0:0 s=0`
+			if len(fields) < 4 {
+				t.Fatalf("invalid location: %s", line)
+			}
+			id := parseUints(t, []string{strings.TrimSuffix(fields[0], ":")})[0]
+			addr, err := strconv.ParseUint(fields[1], 0, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw.addrs[id] = addr
+			raw.functions[id] = fields[3]
+		}
+	}
+	return raw
+}
+
+// parseUints parses the given decimal numbers.
+func parseUints(t *testing.T, fields []string) []uint64 {
+	var out []uint64
+	for _, field := range fields {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, value)
+	}
+	return out
+}
+
+func TestWritePprof(t *testing.T) {
+	p := run(t, calls)
+	filename := filepath.Join(t.TempDir(), "prof.pb.gz")
+	fp, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WritePprof(fp, "calls.s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw := readPprof(t, filename)
+	if raw.sampleTypes != "instructions/count cycles/count" {
+		t.Fatalf("unexpected sample types: %s", raw.sampleTypes)
+	}
+	for id, addr := range raw.addrs {
+		expected := p.Symbols.Label(uint16(addr))
+		if expected == "" {
+			expected = "addr_" + strconv.FormatUint(addr, 10)
+		}
+		if raw.functions[id] != expected {
+			t.Fatalf("%d: expected %s, got %s", addr, expected, raw.functions[id])
+		}
+	}
+	var total Stats
+	stacks := make(map[string]bool)
+	for _, sample := range raw.samples {
+		if len(sample.values) != 2 || len(sample.locations) < 1 {
+			t.Fatalf("invalid sample: %+v", sample)
+		}
+		total.Instructions += sample.values[0]
+		total.Cycles += sample.values[1]
+		var names []string
+		for _, id := range sample.locations {
+			names = append(names, raw.functions[id])
+		}
+		stacks[strings.Join(names, " ")] = true
+	}
+	if total != p.Total() {
+		t.Fatalf("expected %+v, got %+v", p.Total(), total)
+	}
+	for _, stack := range []string{"loop", "outer loop", "inner outer loop"} {
+		if !stacks[stack] {
+			t.Fatalf("missing stack %q in %v", stack, stacks)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+// Package profile implements an instruction-level profiler for the
+// RiSC-16 VM.
+//
+// A Profiler observes a vm.VM and counts, for each address, how many
+// times the instruction at such address executed and how many cycles
+// it took according to a simple timing model. Using the labels of the
+// assembly source, the profiler also aggregates the counts by label,
+// identifies the hottest basic blocks, and counts the calls to the
+// subroutines invoked using JALR. The profile is available as a text
+// report and in the pprof format (see WritePprof).
+//
+// # Timing model
+//
+// We estimate the cycles using the model of a five-stage pipeline that
+// predicts branches as not taken (see the pipeline package). Each
+// instruction takes one cycle, plus BranchPenalty cycles when it does not
+// continue with the following instruction (i.e., taken branches, jumps,
+// and exceptions), plus LoadUsePenalty cycles when it reads the register
+// loaded by the immediately preceding LW.
+//
+// # Calls
+//
+// We consider a call any JALR that saves the return address into a
+// register other than r0, and a return any JALR r0 that jumps to the
+// return address of an active call. The profiler uses such calls and
+// returns to maintain a shadow call stack, which it uses for computing
+// the inclusive cycles of each subroutine and for the pprof stacks.
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// The following constants define the timing model.
+const (
+	// BranchPenalty is the number of additional cycles taken
+	// by instructions that do not continue sequentially.
+	BranchPenalty = 2
+
+	// LoadUsePenalty is the number of additional cycles taken by an
+	// instruction using the result of the immediately preceding LW.
+	LoadUsePenalty = 1
+)
+
+// Symbols maps addresses to labels.
+type Symbols struct {
+	addrs []uint16
+	names []string
+}
+
+// NewSymbols creates the symbols from the labels returned by the
+// assembler (e.g., by asm.CollectLabels).
+func NewSymbols(labels map[string]int64) *Symbols {
+	s := &Symbols{}
+	for name := range labels {
+		s.names = append(s.names, name)
+	}
+	sort.Slice(s.names, func(i, j int) bool {
+		ai, aj := labels[s.names[i]], labels[s.names[j]]
+		return ai < aj || (ai == aj && s.names[i] < s.names[j])
+	})
+	for _, name := range s.names {
+		s.addrs = append(s.addrs, uint16(labels[name]))
+	}
+	return s
+}
+
+// Lookup returns the label preceding or at addr and the offset
+// of addr from such label. If there is no such label, Lookup
+// returns false.
+func (s *Symbols) Lookup(addr uint16) (string, uint16, bool) {
+	if s == nil {
+		return "", 0, false
+	}
+	idx := sort.Search(len(s.addrs), func(i int) bool {
+		return s.addrs[i] > addr
+	})
+	if idx == 0 {
+		return "", 0, false
+	}
+	return s.names[idx-1], addr - s.addrs[idx-1], true
+}
+
+// Label returns the label preceding or at addr, or an empty string.
+func (s *Symbols) Label(addr uint16) string {
+	name, _, _ := s.Lookup(addr)
+	return name
+}
+
+// Format formats addr as `label+offset`, `label`, or the plain address
+// when there is no label preceding addr.
+func (s *Symbols) Format(addr uint16) string {
+	name, offset, found := s.Lookup(addr)
+	switch {
+	case !found:
+		return fmt.Sprintf("%d", addr)
+	case offset == 0:
+		return name
+	default:
+		return fmt.Sprintf("%s+%d", name, offset)
+	}
+}
+
+// frame is a node of the tree of the call stacks.
+type frame struct {
+	children map[[2]uint16]*frame
+	parent   *frame
+	site     uint16 // address of the JALR performing the call
+	target   uint16 // address of the subroutine
+}
+
+// child returns the frame for calling target from site.
+func (f *frame) child(site, target uint16) *frame {
+	key := [2]uint16{site, target}
+	c := f.children[key]
+	if c == nil {
+		c = &frame{children: make(map[[2]uint16]*frame), parent: f, site: site, target: target}
+		f.children[key] = c
+	}
+	return c
+}
+
+// sampleKey identifies the samples of a pprof profile.
+type sampleKey struct {
+	frame *frame
+	pc    uint16
+}
+
+// sampleValue contains the values of a sample.
+type sampleValue struct {
+	instructions uint64
+	cycles       uint64
+}
+
+// Profiler is a vm.Observer profiling the executed instructions. A
+// Profiler is not goroutine safe; a single goroutine should manage
+// it along with the VM. Use New to create a Profiler.
+type Profiler struct {
+	// Symbols contains the labels. It may be nil.
+	Symbols *Symbols
+
+	calls    map[[2]uint16]uint64
+	counts   [vm.MemorySize]uint64
+	cycles   [vm.MemorySize]uint64
+	frame    *frame
+	instrs   [vm.MemorySize]uint16
+	leaders  [vm.MemorySize]bool
+	loaded   uint16 // register loaded by the previous instruction or zero
+	machine  *vm.VM
+	next     uint16 // address of the next instruction
+	root     *frame
+	samples  map[sampleKey]*sampleValue
+	started  bool
+	total    uint64
+	totalCyc uint64
+}
+
+// New creates a new Profiler for machine and registers it as an observer.
+func New(machine *vm.VM, symbols *Symbols) *Profiler {
+	p := &Profiler{
+		Symbols: symbols,
+		calls:   make(map[[2]uint16]uint64),
+		machine: machine,
+		root:    &frame{children: make(map[[2]uint16]*frame)},
+		samples: make(map[sampleKey]*sampleValue),
+	}
+	p.frame = p.root
+	machine.AddObserver(p)
+	return p
+}
+
+// BeforeInstruction implements vm.Observer.BeforeInstruction.
+func (p *Profiler) BeforeInstruction(pc, instr uint16) {}
+
+// AfterInstruction implements vm.Observer.AfterInstruction.
+func (p *Profiler) AfterInstruction(pc, instr uint16, err error) {
+	next := p.machine.PC
+	if !p.started || pc != p.next {
+		p.leaders[pc] = true // entered from a non sequential instruction
+	}
+	p.started = true
+	if next != pc+1 {
+		p.leaders[next] = true
+	}
+	p.next = next
+	cycles := uint64(1)
+	if next != pc+1 && err == nil {
+		cycles += BranchPenalty
+	}
+	if p.loaded != 0 && reads(instr, p.loaded) {
+		cycles += LoadUsePenalty
+	}
+	p.loaded = 0
+	ra := (instr >> 10) & 0b0111
+	rb := (instr >> 7) & 0b0111
+	if instr>>13 == vm.OpcodeLW {
+		p.loaded = ra
+	}
+	p.counts[pc]++
+	p.cycles[pc] += cycles
+	p.instrs[pc] = instr
+	p.total++
+	p.totalCyc += cycles
+	value := p.samples[sampleKey{frame: p.frame, pc: pc}]
+	if value == nil {
+		value = &sampleValue{}
+		p.samples[sampleKey{frame: p.frame, pc: pc}] = value
+	}
+	value.instructions++
+	value.cycles += cycles
+	if err != nil || instr>>13 != vm.OpcodeJALR || (ra == 0 && rb == 0) {
+		return
+	}
+	if ra != 0 {
+		p.calls[[2]uint16{pc, next}]++
+		p.frame = p.frame.child(pc, next)
+		return
+	}
+	for f := p.frame; f != p.root; f = f.parent {
+		if f.site+1 == next {
+			p.frame = f.parent // return, possibly unwinding several frames
+			return
+		}
+	}
+}
+
+// reads returns true if instr reads the register reg.
+func reads(instr, reg uint16) bool {
+	ra := (instr >> 10) & 0b0111
+	rb := (instr >> 7) & 0b0111
+	rc := instr & 0b0111
+	switch instr >> 13 {
+	case vm.OpcodeADD, vm.OpcodeNAND:
+		return rb == reg || rc == reg
+	case vm.OpcodeADDI, vm.OpcodeLW:
+		return rb == reg
+	case vm.OpcodeSW, vm.OpcodeBEQ, vm.OpcodeJALR:
+		return ra == reg || rb == reg
+	default:
+		return false
+	}
+}
+
+// MemoryRead implements vm.Observer.MemoryRead.
+func (p *Profiler) MemoryRead(addr, value uint16) {}
+
+// MemoryWrite implements vm.Observer.MemoryWrite.
+func (p *Profiler) MemoryWrite(addr, old, value uint16) {}
+
+// RegisterWrite implements vm.Observer.RegisterWrite.
+func (p *Profiler) RegisterWrite(reg, old, value uint16) {}
+
+// Exception implements vm.Observer.Exception.
+func (p *Profiler) Exception(cause, epc uint16) {}
+
+var _ vm.Observer = &Profiler{}
+
+// Stats contains the counts of an address, a label, or a basic block.
+type Stats struct {
+	Instructions uint64 // number of executed instructions
+	Cycles       uint64 // estimated number of cycles
+}
+
+// CPI returns the estimated cycles per instruction.
+func (s Stats) CPI() float64 {
+	if s.Instructions == 0 {
+		return 0
+	}
+	return float64(s.Cycles) / float64(s.Instructions)
+}
+
+// String generates a string representation of the stats.
+func (s Stats) String() string {
+	return fmt.Sprintf("instructions=%d cycles=%d cpi=%.2f", s.Instructions, s.Cycles, s.CPI())
+}
+
+// Total returns the overall stats.
+func (p *Profiler) Total() Stats {
+	return Stats{Instructions: p.total, Cycles: p.totalCyc}
+}
+
+// AddressStats contains the stats of an address.
+type AddressStats struct {
+	Stats
+	Addr  uint16 // the address
+	Instr uint16 // the last instruction executed at Addr
+}
+
+// Addresses returns the stats of each executed address sorted by address.
+func (p *Profiler) Addresses() []AddressStats {
+	var out []AddressStats
+	for addr := 0; addr < vm.MemorySize; addr++ {
+		if p.counts[addr] > 0 {
+			out = append(out, AddressStats{
+				Stats: Stats{Instructions: p.counts[addr], Cycles: p.cycles[addr]},
+				Addr:  uint16(addr),
+				Instr: p.instrs[addr],
+			})
+		}
+	}
+	return out
+}
+
+// LabelStats contains the stats of the addresses following a label
+// up to the next label.
+type LabelStats struct {
+	Stats
+	Label string // the label or an empty string for the addresses before the first label
+}
+
+// Labels returns the stats of each label sorted by decreasing cycles.
+func (p *Profiler) Labels() []LabelStats {
+	index := make(map[string]int)
+	var out []LabelStats
+	for _, stats := range p.Addresses() {
+		label := p.Symbols.Label(stats.Addr)
+		idx, found := index[label]
+		if !found {
+			idx = len(out)
+			index[label] = idx
+			out = append(out, LabelStats{Label: label})
+		}
+		out[idx].Instructions += stats.Instructions
+		out[idx].Cycles += stats.Cycles
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Cycles > out[j].Cycles
+	})
+	return out
+}
+
+// BlockStats contains the stats of a basic block.
+type BlockStats struct {
+	Stats
+	Start uint16 // address of the first instruction
+	End   uint16 // address of the last instruction
+	Count uint64 // number of times the block executed
+}
+
+// Blocks returns the stats of the executed basic blocks sorted by
+// decreasing cycles. A basic block starts at an instruction reached by
+// a non sequential instruction, or following a BEQ or a JALR, and ends
+// before the following block or an address that never executed.
+func (p *Profiler) Blocks() []BlockStats {
+	var out []BlockStats
+	var current *BlockStats
+	for addr := 0; addr < vm.MemorySize; addr++ {
+		if p.counts[addr] == 0 {
+			current = nil
+			continue
+		}
+		if current == nil || p.leaders[addr] || endsBlock(p.instrs[addr-1]) {
+			out = append(out, BlockStats{Start: uint16(addr), Count: p.counts[addr]})
+			current = &out[len(out)-1]
+		}
+		current.End = uint16(addr)
+		current.Instructions += p.counts[addr]
+		current.Cycles += p.cycles[addr]
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Cycles > out[j].Cycles
+	})
+	return out
+}
+
+// endsBlock returns true if instr ends a basic block.
+func endsBlock(instr uint16) bool {
+	return instr>>13 == vm.OpcodeBEQ || instr>>13 == vm.OpcodeJALR
+}
+
+// CallStats contains the stats of a subroutine.
+type CallStats struct {
+	Target    uint16            // address of the subroutine
+	Calls     uint64            // number of calls
+	Callers   map[uint16]uint64 // number of calls by address of the JALR
+	Inclusive Stats             // stats of the subroutine and of its callees
+}
+
+// Calls returns the stats of each called subroutine sorted by
+// decreasing number of calls.
+func (p *Profiler) Calls() []CallStats {
+	index := make(map[uint16]int)
+	var out []CallStats
+	for key, count := range p.calls {
+		idx, found := index[key[1]]
+		if !found {
+			idx = len(out)
+			index[key[1]] = idx
+			out = append(out, CallStats{Target: key[1], Callers: make(map[uint16]uint64)})
+		}
+		out[idx].Calls += count
+		out[idx].Callers[key[0]] += count
+	}
+	for key, value := range p.samples {
+		seen := make(map[uint16]bool)
+		for f := key.frame; f != p.root; f = f.parent {
+			if seen[f.target] {
+				continue // recursion
+			}
+			seen[f.target] = true
+			inclusive := &out[index[f.target]].Inclusive
+			inclusive.Instructions += value.instructions
+			inclusive.Cycles += value.cycles
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Calls != out[j].Calls {
+			return out[i].Calls > out[j].Calls
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+// MaxReportBlocks is the maximum number of basic blocks in the report.
+const MaxReportBlocks = 10
+
+// WriteReport writes a text report into w.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	total := p.Total()
+	percent := func(cycles uint64) float64 {
+		if total.Cycles == 0 {
+			return 0
+		}
+		return 100 * float64(cycles) / float64(total.Cycles)
+	}
+	fmt.Fprintf(tw, "profile: %s\n", total)
+	if p.Symbols != nil {
+		fmt.Fprintf(tw, "\nlabels:\n")
+		fmt.Fprintf(tw, "instructions\tcycles\t%%cycles\t\tlabel\t\n")
+		for _, stats := range p.Labels() {
+			label := stats.Label
+			if label == "" {
+				label = "?"
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%.2f\t\t%s\t\n", stats.Instructions, stats.Cycles,
+				percent(stats.Cycles), label)
+		}
+	}
+	fmt.Fprintf(tw, "\nhottest basic blocks:\n")
+	fmt.Fprintf(tw, "start\tend\tcount\tinstructions\tcycles\t%%cycles\t\tlocation\t\n")
+	for idx, stats := range p.Blocks() {
+		if idx >= MaxReportBlocks {
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%.2f\t\t%s\t\n", stats.Start, stats.End, stats.Count,
+			stats.Instructions, stats.Cycles, percent(stats.Cycles), p.Symbols.Format(stats.Start))
+	}
+	if calls := p.Calls(); len(calls) > 0 {
+		fmt.Fprintf(tw, "\nsubroutines:\n")
+		fmt.Fprintf(tw, "target\tcalls\tinstructions\tcycles\t%%cycles\t\tlocation\t\n")
+		for _, stats := range calls {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.2f\t\t%s\t\n", stats.Target, stats.Calls,
+				stats.Inclusive.Instructions, stats.Inclusive.Cycles,
+				percent(stats.Inclusive.Cycles), p.Symbols.Format(stats.Target))
+		}
+	}
+	fmt.Fprintf(tw, "\naddresses:\n")
+	fmt.Fprintf(tw, "addr\tinstructions\tcycles\t%%cycles\t\tinstruction\tlocation\t\n")
+	for _, stats := range p.Addresses() {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%.2f\t\t%s\t%s\t\n", stats.Addr, stats.Instructions,
+			stats.Cycles, percent(stats.Cycles), vm.Disassemble(stats.Instr),
+			p.Symbols.Format(stats.Addr))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,155 @@
+package profile
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// calls is a program with nested subroutine calls.
+const calls = `	movi r1, 10
+	movi r2, 0
+	movi r7, outer
+loop:	beq r1, r0, done
+	jalr r6, r7
+	addi r1, r1, -1
+	beq r0, r0, loop
+done:	sw r2, r0, result
+	halt
+outer:	addi r5, r6, 0
+	movi r4, inner
+	jalr r6, r4
+	lw r3, r0, result
+	add r3, r3, r2
+	jalr r0, r5
+inner:	add r2, r2, r1
+	jalr r0, r6
+result:	.fill 0
+`
+
+// run assembles source into a new VM, profiles its execution until it
+// halts, and returns the profiler.
+func run(t *testing.T, source string) *Profiler {
+	machine := new(vm.VM)
+	var addr uint16
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		machine.M[addr] = instr.Instruction
+		addr++
+	}
+	labels, err := asm.CollectLabels(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(machine, NewSymbols(labels))
+	result := machine.Run(context.Background(), vm.RunOptions{MaxInstructions: 10000})
+	if result.Reason != vm.StopHalted {
+		t.Fatalf("expected StopHalted, got %s", result.Reason)
+	}
+	return p
+}
+
+func TestSymbols(t *testing.T) {
+	s := NewSymbols(map[string]int64{"main": 2, "loop": 5, "alias": 5})
+	for addr, expected := range map[uint16]string{
+		0: "0",
+		2: "main",
+		4: "main+2",
+		5: "loop", // the last label in alphabetical order
+		9: "loop+4",
+	} {
+		if got := s.Format(addr); got != expected {
+			t.Fatalf("%d: expected %s, got %s", addr, expected, got)
+		}
+	}
+	var none *Symbols
+	if got := none.Format(7); got != "7" {
+		t.Fatalf("expected 7, got %s", got)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	p := run(t, `	lw r1, r0, data
+	add r2, r1, r1
+	beq r0, r0, skip
+	add r2, r2, r2
+skip:	halt
+data:	.fill 21
+`)
+	// lw: 1, add: 1+LoadUsePenalty, beq: 1+BranchPenalty, halt: 1
+	expected := Stats{Instructions: 4, Cycles: 4 + LoadUsePenalty + BranchPenalty}
+	if p.Total() != expected {
+		t.Fatalf("expected %+v, got %+v", expected, p.Total())
+	}
+}
+
+func TestCalls(t *testing.T) {
+	p := run(t, calls)
+	stats := p.Calls()
+	if len(stats) != 2 {
+		t.Fatalf("expected two subroutines, got %+v", stats)
+	}
+	// outer is at 12 and called from 7, while inner is at 19 and called from 15
+	expected := []struct {
+		target       uint16
+		site         uint16
+		instructions uint64
+	}{
+		{12, 7, 10 * (7 + 2)},
+		{19, 15, 10 * 2},
+	}
+	for idx, e := range expected {
+		s := stats[idx]
+		if s.Target != e.target || s.Calls != 10 || s.Callers[e.site] != 10 || len(s.Callers) != 1 {
+			t.Fatalf("unexpected stats for %d: %+v", e.target, s)
+		}
+		if s.Inclusive.Instructions != e.instructions {
+			t.Fatalf("%d: expected %d instructions, got %d", e.target, e.instructions,
+				s.Inclusive.Instructions)
+		}
+	}
+	var sum uint64
+	for _, s := range p.Labels() {
+		sum += s.Instructions
+		if s.Label == "inner" && s.Instructions != 20 {
+			t.Fatalf("expected 20 instructions for inner, got %d", s.Instructions)
+		}
+	}
+	if sum != p.Total().Instructions {
+		t.Fatalf("expected %d instructions, got %d", p.Total().Instructions, sum)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	p := run(t, calls)
+	blocks := make(map[uint16]BlockStats)
+	for _, b := range p.Blocks() {
+		blocks[b.Start] = b
+	}
+	// the BEQ at loop ends its own block
+	if b := blocks[6]; b.End != 6 || b.Count != 11 {
+		t.Fatalf("unexpected loop block: %+v", b)
+	}
+	// the body of inner
+	if b := blocks[19]; b.End != 20 || b.Count != 10 || b.Instructions != 20 {
+		t.Fatalf("unexpected inner block: %+v", b)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	p := run(t, calls)
+	var buf strings.Builder
+	if err := p.WriteReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"labels:", "hottest basic blocks:", "subroutines:", "addresses:", "inner"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("the report does not contain %q:\n%s", s, buf.String())
+		}
+	}
+}
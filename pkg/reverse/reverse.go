@@ -0,0 +1,147 @@
+// Package reverse implements reverse execution for the RiSC-16 VM.
+//
+// A Log executes instructions on a vm.VM and records, for each of them,
+// the registers and the memory words it modifies, so that it is possible
+// to undo instructions and step backwards. The log keeps a bounded number
+// of instructions, discarding the oldest ones.
+//
+// # Limitations
+//
+// The log only records changes made while executing instructions using
+// the Step method, or made by the functions passed to Record. Other changes
+// and side effects on devices (e.g., console output) are not undone.
+package reverse
+
+import "github.com/bassosimone/risc16/pkg/vm"
+
+// write is a memory write recorded into the log.
+type write struct {
+	addr uint16 // written address
+	old  uint16 // value before the write
+}
+
+// entry is the state before executing an instruction.
+type entry struct {
+	pc     uint16
+	gpr    [vm.NumRegisters]uint16
+	spr    [vm.NumSPRs]uint16
+	tlb    [vm.NumTLBEntries]vm.TLBEntry
+	writes []write
+}
+
+// Log is an undo log. A Log is not goroutine safe; a single goroutine
+// should manage it along with the underlying vm.VM.
+type Log struct {
+	Machine *vm.VM
+
+	count     int
+	entries   []entry // ring buffer
+	first     int
+	recording bool
+}
+
+// New creates a new Log for machine keeping at most limit instructions,
+// which must be positive. This function registers an observer on machine.
+func New(machine *vm.VM, limit int) *Log {
+	if limit < 1 {
+		panic("limit must be positive")
+	}
+	l := &Log{Machine: machine, entries: make([]entry, limit)}
+	machine.AddObserver(&observer{log: l})
+	return l
+}
+
+// Len returns the number of instructions that can be undone.
+func (l *Log) Len() int {
+	return l.count
+}
+
+// Step executes a single instruction (i.e., Fetch and Execute) recording
+// the state needed to undo it and returns the error returned by Execute.
+func (l *Log) Step() error {
+	return l.Record(func() error {
+		l.Machine.Fetch()
+		return l.Machine.Execute()
+	})
+}
+
+// Record calls change, which should modify the machine state using the
+// vm.VM methods that notify observers (e.g., vm.VM.Store), and records the
+// state needed to undo the change as if it were an instruction. Use Record
+// to make changes made by a debugger undoable. Record returns the error
+// returned by change.
+func (l *Log) Record(change func() error) error {
+	idx := (l.first + l.count) % len(l.entries)
+	if l.count < len(l.entries) {
+		l.count++
+	} else {
+		l.first = (l.first + 1) % len(l.entries) // discard the oldest
+	}
+	e := &l.entries[idx]
+	e.pc, e.gpr, e.spr, e.tlb = l.Machine.PC, l.Machine.GPR, l.Machine.SPR, l.Machine.TLB
+	e.writes = e.writes[:0]
+	l.recording = true
+	err := change()
+	l.recording = false
+	return err
+}
+
+// StepBack undoes the last n instructions, or fewer if the log does
+// not contain enough instructions, and returns how many it undid.
+func (l *Log) StepBack(n int) int {
+	var undone int
+	for ; undone < n && l.count > 0; undone++ {
+		l.undo()
+	}
+	return undone
+}
+
+// ReverseContinue undoes instructions until stop returns true, in which
+// case it returns true, or the log is empty, in which case it returns
+// false. ReverseContinue calls stop after undoing each instruction, and
+// also returns the number of undone instructions.
+func (l *Log) ReverseContinue(stop func() bool) (int, bool) {
+	var undone int
+	for l.count > 0 {
+		l.undo()
+		undone++
+		if stop() {
+			return undone, true
+		}
+	}
+	return undone, false
+}
+
+// undo undoes the last instruction.
+func (l *Log) undo() {
+	l.count--
+	e := &l.entries[(l.first+l.count)%len(l.entries)]
+	for idx := len(e.writes) - 1; idx >= 0; idx-- {
+		l.Machine.Memory()[e.writes[idx].addr] = e.writes[idx].old
+	}
+	l.Machine.PC, l.Machine.GPR, l.Machine.SPR, l.Machine.TLB = e.pc, e.gpr, e.spr, e.tlb
+	l.Machine.CI = 0
+}
+
+// observer records the memory writes. It implements vm.DeviceObserver
+// to ignore the writes to device registers, which are not undone, while
+// recording the writes that devices make to the memory using DMA.
+type observer struct {
+	vm.NopObserver
+	log *Log
+}
+
+var _ vm.DeviceObserver = &observer{}
+
+// DeviceWrite implements vm.DeviceObserver.DeviceWrite.
+func (o *observer) DeviceWrite(addr, value uint16) {}
+
+// MemoryWrite implements vm.Observer.MemoryWrite.
+func (o *observer) MemoryWrite(addr, old, value uint16) {
+	l := o.log
+	if !l.recording {
+		return
+	}
+	e := &l.entries[(l.first+l.count-1)%len(l.entries)]
+	e.writes = append(e.writes, write{addr: addr, old: old})
+}
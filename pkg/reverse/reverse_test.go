@@ -0,0 +1,213 @@
+package reverse
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// load returns a machine containing the assembled source.
+func load(t *testing.T, source string) *vm.VM {
+	machine := new(vm.VM)
+	var addr uint16
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		machine.M[addr] = instr.Instruction
+		addr++
+	}
+	return machine
+}
+
+// state is the machine state restored by the log.
+type state struct {
+	PC  uint16
+	GPR [vm.NumRegisters]uint16
+	SPR [vm.NumSPRs]uint16
+	M   [vm.MemorySize]uint16
+}
+
+// capture returns the current state of machine.
+func capture(machine *vm.VM) *state {
+	return &state{PC: machine.PC, GPR: machine.GPR, SPR: machine.SPR, M: *machine.Memory()}
+}
+
+// run executes the program until it halts using the log and returns
+// the state before executing each instruction and after halting.
+func run(t *testing.T, l *Log) []*state {
+	states := []*state{capture(l.Machine)}
+	for {
+		err := l.Step()
+		states = append(states, capture(l.Machine))
+		if errors.Is(err, vm.ErrHalted) {
+			return states
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sum sums the numbers from 1 to 5 into the memory.
+const sum = `	addi r1, r0, 5
+loop:	lw r2, r0, sum
+	add r2, r2, r1
+	sw r2, r0, sum
+	addi r1, r1, -1
+	beq r1, r0, done
+	beq r0, r0, loop
+done:	halt
+sum:	.fill 100
+`
+
+func TestStepBack(t *testing.T) {
+	l := New(load(t, sum), 1000)
+	states := run(t, l)
+	if l.Machine.M[8] != 115 || l.Len() != len(states)-1 {
+		t.Fatalf("unexpected sum %d or length %d", l.Machine.M[8], l.Len())
+	}
+	for idx := len(states) - 2; idx >= 0; idx-- {
+		if l.StepBack(1) != 1 {
+			t.Fatal("expected to undo one instruction")
+		}
+		if *capture(l.Machine) != *states[idx] {
+			t.Fatalf("the state after undoing to %d differs", idx)
+		}
+	}
+	if l.StepBack(1) != 0 || l.Len() != 0 {
+		t.Fatal("expected an empty log")
+	}
+	// executing again after undoing produces the same states
+	if again := run(t, l); len(again) != len(states) || *again[len(again)-1] != *states[len(states)-1] {
+		t.Fatal("the second run differs")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	l := New(load(t, sum), 3)
+	states := run(t, l)
+	if l.Len() != 3 {
+		t.Fatalf("expected 3, got %d", l.Len())
+	}
+	if undone := l.StepBack(10); undone != 3 {
+		t.Fatalf("expected 3, got %d", undone)
+	}
+	if *capture(l.Machine) != *states[len(states)-4] {
+		t.Fatal("unexpected state")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	New(new(vm.VM), 0)
+}
+
+func TestReverseContinue(t *testing.T) {
+	l := New(load(t, sum), 1000)
+	states := run(t, l)
+	// go back to the last state in which the sum is 100 + 5, that
+	// is, just before the second iteration of the loop stores 109
+	undone, found := l.ReverseContinue(func() bool {
+		return l.Machine.M[8] == 105
+	})
+	if !found || *capture(l.Machine) != *states[len(states)-1-undone] || l.Machine.PC != 3 {
+		t.Fatalf("unexpected state after undoing %d instructions", undone)
+	}
+	undone, found = l.ReverseContinue(func() bool { return false })
+	if found || l.Len() != 0 || *capture(l.Machine) != *states[0] {
+		t.Fatalf("unexpected state after undoing %d instructions", undone)
+	}
+}
+
+// memoryDisk is a vm.DiskFile keeping the data in memory.
+type memoryDisk []byte
+
+// ReadAt implements io.ReaderAt.
+func (d memoryDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, io.EOF
+	}
+	count := copy(p, d[off:])
+	if count < len(p) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (d memoryDisk) WriteAt(p []byte, off int64) (int, error) {
+	return copy(d[off:], p), nil
+}
+
+func TestUndoDMA(t *testing.T) {
+	// the program reads the first sector into buffer, whose first
+	// word the undo must restore along with the following ones
+	machine := load(t, `	movi r1, buffer
+	sw r1, r0, -31
+	addi r1, r0, 1
+	sw r1, r0, -30
+	sw r1, r0, -29
+	halt
+buffer:	.fill 7
+`)
+	disk := make(memoryDisk, 2*vm.DiskSectorSize)
+	for idx := range disk {
+		disk[idx] = 0xaa
+	}
+	if err := machine.Attach(vm.NewDisk(machine, vm.DiskBase, disk, int64(len(disk)))); err != nil {
+		t.Fatal(err)
+	}
+	l := New(machine, 100)
+	states := run(t, l)
+	buffer := machine.PC // the word following the halt
+	if machine.M[buffer] != 0xaaaa || machine.M[buffer+vm.DiskSectorSize-1] != 0xaaaa {
+		t.Fatal("the disk did not read the sector")
+	}
+	l.StepBack(2)
+	if *capture(machine) != *states[len(states)-3] || machine.M[buffer] != 7 ||
+		machine.M[buffer+1] != 0 {
+		t.Fatal("the undo did not restore the memory written by the disk")
+	}
+}
+
+func TestUndoDMADeviceWindow(t *testing.T) {
+	// the program reads the first sector into the last 256 words of
+	// the memory, which include the RAM under the disk and the console
+	machine := load(t, `	movi r1, -256
+	sw r1, r0, -31
+	addi r1, r0, 1
+	sw r1, r0, -30
+	sw r1, r0, -29
+	halt
+`)
+	disk := make(memoryDisk, 2*vm.DiskSectorSize)
+	for idx := range disk {
+		disk[idx] = 0xaa
+	}
+	if err := machine.Attach(vm.NewDisk(machine, vm.DiskBase, disk, int64(len(disk)))); err != nil {
+		t.Fatal(err)
+	}
+	console := vm.NewConsole(vm.ConsoleBase, strings.NewReader(""), ioutil.Discard)
+	if err := machine.Attach(console); err != nil {
+		t.Fatal(err)
+	}
+	mem := machine.Memory()
+	mem[vm.ConsoleBase] = 7
+	l := New(machine, 100)
+	states := run(t, l)
+	if mem[0xff00] != 0xaaaa || mem[vm.DiskBase] != 0xaaaa || mem[vm.ConsoleBase] != 0xaaaa {
+		t.Fatal("the disk did not read the sector")
+	}
+	l.StepBack(2)
+	if *capture(machine) != *states[len(states)-3] || mem[0xff00] != 0 ||
+		mem[vm.DiskBase] != 0 || mem[vm.ConsoleBase] != 7 {
+		t.Fatal("the undo did not restore the memory under the devices")
+	}
+}
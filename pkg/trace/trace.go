@@ -0,0 +1,385 @@
+// Package trace records and reads execution traces of the RiSC-16 VM.
+//
+// A trace contains a record for each executed instruction and a record
+// for each interrupt, which the VM takes between instructions. We support
+// two formats: JSON Lines, where each line is the JSON encoding of a
+// Record, and a compact binary format.
+//
+// # Binary format
+//
+// The binary format starts with the four bytes "R16T" followed by a
+// version byte, which is currently 1. Each record then contains:
+//
+//  1. the step number (uvarint);
+//  2. the PC and the CI (two little endian uint16);
+//  3. a flags byte, where bit 0 indicates an exception and bit 1
+//     indicates an interrupt record;
+//  4. the exception cause (one byte, only if bit 0 of flags is set);
+//  5. the number of register writes (uvarint) followed by, for each
+//     write, the register number (one byte) and the new value (little
+//     endian uint16);
+//  6. the number of memory accesses (uvarint) followed by, for each
+//     access, the kind (one byte, 0 for reads and 1 for writes), the
+//     address, and the value (two little endian uint16).
+//
+// The binary format does not contain the disassembly, which the
+// reader reconstructs from the CI.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// RegisterWrite describes a write into a general purpose register.
+type RegisterWrite struct {
+	Reg   uint16 `json:"reg"`
+	Value uint16 `json:"value"`
+}
+
+// MemoryAccess describes a data memory access.
+type MemoryAccess struct {
+	Write bool   `json:"write,omitempty"`
+	Addr  uint16 `json:"addr"`
+	Value uint16 `json:"value"`
+}
+
+// Record describes a single executed instruction or, when Interrupt
+// is true, an interrupt taken before executing the instruction at PC. An
+// interrupt record has the Step of the previous instruction, a zero CI,
+// an empty Disasm, and Exception set to true.
+type Record struct {
+	Step      uint64          `json:"step"`                // step number, starting from one
+	PC        uint16          `json:"pc"`                  // address of the instruction
+	CI        uint16          `json:"ci"`                  // the instruction
+	Disasm    string          `json:"disasm"`              // disassembly of the instruction
+	Interrupt bool            `json:"interrupt,omitempty"` // whether this is an interrupt record
+	Exception bool            `json:"exception,omitempty"` // whether an exception occurred
+	Cause     uint16          `json:"cause,omitempty"`     // cause of the exception
+	Registers []RegisterWrite `json:"regs,omitempty"`      // registers written
+	Memory    []MemoryAccess  `json:"mem,omitempty"`       // memory accesses
+}
+
+// Writer writes trace records.
+type Writer interface {
+	// Write writes a record.
+	Write(rec *Record) error
+
+	// Flush flushes buffered records, if any.
+	Flush() error
+}
+
+// JSONWriter writes records using the JSON Lines format.
+type JSONWriter struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewJSONWriter creates a new JSONWriter writing into w.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	bw := bufio.NewWriter(w)
+	return &JSONWriter{bw: bw, enc: json.NewEncoder(bw)}
+}
+
+// Write implements Writer.Write.
+func (w *JSONWriter) Write(rec *Record) error {
+	return w.enc.Encode(rec)
+}
+
+// Flush implements Writer.Flush.
+func (w *JSONWriter) Flush() error {
+	return w.bw.Flush()
+}
+
+var _ Writer = &JSONWriter{}
+
+// Magic is the magic string at the beginning of a binary trace.
+const Magic = "R16T"
+
+// Version is the version of the binary format.
+const Version = 1
+
+// BinaryWriter writes records using the binary format.
+type BinaryWriter struct {
+	bw     *bufio.Writer
+	buf    []byte
+	header bool
+}
+
+// NewBinaryWriter creates a new BinaryWriter writing into w.
+func NewBinaryWriter(w io.Writer) *BinaryWriter {
+	return &BinaryWriter{bw: bufio.NewWriter(w)}
+}
+
+// Write implements Writer.Write.
+func (w *BinaryWriter) Write(rec *Record) error {
+	buf := w.buf[:0]
+	if !w.header {
+		buf = append(buf, Magic...)
+		buf = append(buf, Version)
+		w.header = true
+	}
+	buf = appendUvarint(buf, rec.Step)
+	buf = appendUint16(buf, rec.PC)
+	buf = appendUint16(buf, rec.CI)
+	var flags byte
+	if rec.Exception {
+		flags |= 1
+	}
+	if rec.Interrupt {
+		flags |= 2
+	}
+	buf = append(buf, flags)
+	if rec.Exception {
+		buf = append(buf, byte(rec.Cause))
+	}
+	buf = appendUvarint(buf, uint64(len(rec.Registers)))
+	for _, reg := range rec.Registers {
+		buf = append(buf, byte(reg.Reg))
+		buf = appendUint16(buf, reg.Value)
+	}
+	buf = appendUvarint(buf, uint64(len(rec.Memory)))
+	for _, access := range rec.Memory {
+		var kind byte
+		if access.Write {
+			kind = 1
+		}
+		buf = append(buf, kind)
+		buf = appendUint16(buf, access.Addr)
+		buf = appendUint16(buf, access.Value)
+	}
+	w.buf = buf
+	_, err := w.bw.Write(buf)
+	return err
+}
+
+// appendUvarint appends the uvarint encoding of value to buf.
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], value)]...)
+}
+
+// appendUint16 appends the little endian encoding of value to buf.
+func appendUint16(buf []byte, value uint16) []byte {
+	return append(buf, byte(value), byte(value>>8))
+}
+
+// Flush implements Writer.Flush.
+func (w *BinaryWriter) Flush() error {
+	return w.bw.Flush()
+}
+
+var _ Writer = &BinaryWriter{}
+
+// ErrUnknownFormat indicates that the trace format name is unknown.
+var ErrUnknownFormat = errors.New("trace: unknown format")
+
+// NewWriter creates a writer for the given format, which
+// is either `jsonl` or `bin`, writing into w.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case "jsonl":
+		return NewJSONWriter(w), nil
+	case "bin":
+		return NewBinaryWriter(w), nil
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownFormat, format)
+	}
+}
+
+// Recorder is a vm.Observer that writes a record for each instruction
+// executed by the VM and for each interrupt. Register it using vm.AddObserver.
+type Recorder struct {
+	err       error
+	executing bool
+	record    Record
+	step      uint64
+	writer    Writer
+}
+
+// NewRecorder creates a new Recorder writing into the given writer.
+func NewRecorder(writer Writer) *Recorder {
+	return &Recorder{writer: writer}
+}
+
+// Err returns the first error that occurred when writing, if any. After
+// an error has occurred, the recorder stops writing records.
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+// BeforeInstruction implements vm.Observer.BeforeInstruction.
+func (r *Recorder) BeforeInstruction(pc, instr uint16) {
+	r.executing = true
+	r.step++
+	r.record = Record{
+		Step:      r.step,
+		PC:        pc,
+		CI:        instr,
+		Registers: r.record.Registers[:0],
+		Memory:    r.record.Memory[:0],
+	}
+}
+
+// AfterInstruction implements vm.Observer.AfterInstruction.
+func (r *Recorder) AfterInstruction(pc, instr uint16, err error) {
+	r.executing = false
+	if r.err == nil {
+		r.record.Disasm = vm.Disassemble(instr)
+		r.err = r.writer.Write(&r.record)
+	}
+}
+
+// MemoryRead implements vm.Observer.MemoryRead.
+func (r *Recorder) MemoryRead(addr, value uint16) {
+	r.record.Memory = append(r.record.Memory, MemoryAccess{Addr: addr, Value: value})
+}
+
+// MemoryWrite implements vm.Observer.MemoryWrite.
+func (r *Recorder) MemoryWrite(addr, old, value uint16) {
+	r.record.Memory = append(r.record.Memory, MemoryAccess{Write: true, Addr: addr, Value: value})
+}
+
+// RegisterWrite implements vm.Observer.RegisterWrite.
+func (r *Recorder) RegisterWrite(reg, old, value uint16) {
+	r.record.Registers = append(r.record.Registers, RegisterWrite{Reg: reg, Value: value})
+}
+
+// Exception implements vm.Observer.Exception. The VM takes interrupts
+// when fetching, before notifying BeforeInstruction, so an exception that
+// occurs between instructions gets its own interrupt record.
+func (r *Recorder) Exception(cause, epc uint16) {
+	if r.executing {
+		r.record.Exception, r.record.Cause = true, cause
+		return
+	}
+	if r.err == nil {
+		r.err = r.writer.Write(&Record{
+			Step:      r.step,
+			PC:        epc,
+			Interrupt: true,
+			Exception: true,
+			Cause:     cause,
+		})
+	}
+}
+
+var _ vm.Observer = &Recorder{}
+
+// ErrInvalidTrace indicates that a binary trace is malformed.
+var ErrInvalidTrace = errors.New("trace: invalid trace")
+
+// Reader reads records from a trace.
+type Reader struct {
+	br     *bufio.Reader
+	binary bool
+	dec    *json.Decoder
+}
+
+// NewReader creates a new Reader reading from r. The reader detects
+// the format by checking whether the trace starts with Magic.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(Magic) + 1)
+	if err == nil && string(magic[:len(Magic)]) == Magic {
+		if magic[len(Magic)] != Version {
+			return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidTrace, magic[len(Magic)])
+		}
+		br.Discard(len(magic))
+		return &Reader{br: br, binary: true}, nil
+	}
+	return &Reader{br: br, dec: json.NewDecoder(br)}, nil
+}
+
+// Next returns the next record or io.EOF at the end of the trace.
+func (r *Reader) Next() (*Record, error) {
+	if !r.binary {
+		rec := &Record{}
+		if err := r.dec.Decode(rec); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+	rec, err := r.readBinary()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: truncated record", ErrInvalidTrace)
+	}
+	return rec, err
+}
+
+// readBinary reads a record using the binary format.
+func (r *Reader) readBinary() (*Record, error) {
+	step, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return nil, err // io.EOF at the end of the trace
+	}
+	var fixed [5]byte
+	if _, err := io.ReadFull(r.br, fixed[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	rec := &Record{
+		Step: step,
+		PC:   binary.LittleEndian.Uint16(fixed[0:2]),
+		CI:   binary.LittleEndian.Uint16(fixed[2:4]),
+	}
+	rec.Interrupt = fixed[4]&2 != 0
+	if !rec.Interrupt {
+		rec.Disasm = vm.Disassemble(rec.CI)
+	}
+	if fixed[4]&1 != 0 {
+		cause, err := r.br.ReadByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		rec.Exception, rec.Cause = true, uint16(cause)
+	}
+	count, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if count > vm.NumRegisters {
+		return nil, fmt.Errorf("%w: too many register writes", ErrInvalidTrace)
+	}
+	for idx := uint64(0); idx < count; idx++ {
+		var buf [3]byte
+		if _, err := io.ReadFull(r.br, buf[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		rec.Registers = append(rec.Registers, RegisterWrite{
+			Reg:   uint16(buf[0]),
+			Value: binary.LittleEndian.Uint16(buf[1:3]),
+		})
+	}
+	if count, err = binary.ReadUvarint(r.br); err != nil {
+		return nil, unexpected(err)
+	}
+	if count > vm.MemorySize {
+		return nil, fmt.Errorf("%w: too many memory accesses", ErrInvalidTrace)
+	}
+	for idx := uint64(0); idx < count; idx++ {
+		var buf [5]byte
+		if _, err := io.ReadFull(r.br, buf[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		rec.Memory = append(rec.Memory, MemoryAccess{
+			Write: buf[0] == 1,
+			Addr:  binary.LittleEndian.Uint16(buf[1:3]),
+			Value: binary.LittleEndian.Uint16(buf[3:5]),
+		})
+	}
+	return rec, nil
+}
+
+// unexpected converts io.EOF to io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
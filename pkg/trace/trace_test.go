@@ -0,0 +1,165 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// memoryWriter is a Writer keeping the records in memory.
+type memoryWriter struct {
+	records []Record
+}
+
+// Write implements Writer.Write.
+func (w *memoryWriter) Write(rec *Record) error {
+	out := *rec
+	out.Registers = append([]RegisterWrite(nil), rec.Registers...)
+	out.Memory = append([]MemoryAccess(nil), rec.Memory...)
+	w.records = append(w.records, out)
+	return nil
+}
+
+// Flush implements Writer.Flush.
+func (w *memoryWriter) Flush() error {
+	return nil
+}
+
+// record runs n instructions of machine and returns the trace.
+func record(t *testing.T, machine *vm.VM, n int) []Record {
+	writer := &memoryWriter{}
+	recorder := NewRecorder(writer)
+	machine.AddObserver(recorder)
+	for idx := 0; idx < n; idx++ {
+		machine.Fetch()
+		if err := machine.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return writer.records
+}
+
+func TestRecorder(t *testing.T) {
+	machine := new(vm.VM)
+	machine.M[0] = vm.OpcodeADDI<<13 | 1<<10 | 5  // addi r1 r0 5
+	machine.M[1] = vm.OpcodeSW<<13 | 1<<10 | 20   // sw r1 r0 20
+	machine.M[2] = vm.OpcodeLW<<13 | 2<<10 | 20   // lw r2 r0 20
+	machine.M[3] = vm.OpcodeJALR<<13 | 0b101_0000 // undefined exception code
+	machine.M[10] = 0                             // handler
+	machine.SPR[vm.SPREVEC] = 10
+	records := record(t, machine, 5)
+	expected := []Record{
+		{Step: 1, PC: 0, CI: machine.M[0], Registers: []RegisterWrite{{Reg: 1, Value: 5}}},
+		{Step: 2, PC: 1, CI: machine.M[1], Memory: []MemoryAccess{{Write: true, Addr: 20, Value: 5}}},
+		{Step: 3, PC: 2, CI: machine.M[2], Registers: []RegisterWrite{{Reg: 2, Value: 5}},
+			Memory: []MemoryAccess{{Addr: 20, Value: 5}}},
+		{Step: 4, PC: 3, CI: machine.M[3], Exception: true, Cause: 0b101_0000},
+		{Step: 5, PC: 10, CI: 0},
+	}
+	for idx := range expected {
+		expected[idx].Disasm = vm.Disassemble(expected[idx].CI)
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected\n%+v\ngot\n%+v", expected, records)
+	}
+}
+
+func TestRecorderInterrupt(t *testing.T) {
+	machine := new(vm.VM) // executes NOPs
+	machine.SPR[vm.SPREVEC] = 10
+	machine.SPR[vm.SPRIE] = 1
+	machine.Fetch()
+	if err := machine.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	machine.RaiseInterrupt(vm.InterruptTimer)
+	records := record(t, machine, 2)
+	cause := uint16(vm.ExceptionTypeEXCEPTION | vm.ExceptionValueINTERRUPT)
+	expected := []Record{
+		{Step: 0, PC: 1, Interrupt: true, Exception: true, Cause: cause},
+		{Step: 1, PC: 10, Disasm: vm.Disassemble(0)},
+		{Step: 2, PC: 11, Disasm: vm.Disassemble(0)},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected\n%+v\ngot\n%+v", expected, records)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	records := []Record{
+		{Step: 1, PC: 0, CI: 0x2485, Registers: []RegisterWrite{{Reg: 1, Value: 5}}},
+		{Step: 1, PC: 1, Interrupt: true, Exception: true, Cause: 0x76},
+		{Step: 2, PC: 10, CI: 0x8094, Memory: []MemoryAccess{{Write: true, Addr: 20, Value: 5}}},
+		{Step: 3, PC: 11, CI: 0xe050, Exception: true, Cause: 0x50},
+	}
+	for idx := range records {
+		if !records[idx].Interrupt {
+			records[idx].Disasm = vm.Disassemble(records[idx].CI)
+		}
+	}
+	for _, format := range []string{"jsonl", "bin"} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := NewWriter(format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for idx := range records {
+				if err := writer.Write(&records[idx]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if format == "bin" && !bytes.HasPrefix(buf.Bytes(), []byte(Magic)) {
+				t.Fatal("missing magic")
+			}
+			reader, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for idx := range records {
+				rec, err := reader.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(*rec, records[idx]) {
+					t.Fatalf("expected %+v, got %+v", records[idx], *rec)
+				}
+			}
+			if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewBinaryWriter(&buf)
+	rec := &Record{Step: 1, Registers: []RegisterWrite{{Reg: 1, Value: 5}}}
+	if err := writer.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Next(); !errors.Is(err, ErrInvalidTrace) {
+		t.Fatalf("expected ErrInvalidTrace, got %v", err)
+	}
+	if _, err := NewWriter("bogus", &buf); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("expected ErrUnknownFormat, got %v", err)
+	}
+}
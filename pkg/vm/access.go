@@ -0,0 +1,36 @@
+package vm
+
+// AccessKind is the kind of a memory access.
+type AccessKind int
+
+// The following constants define the kinds of memory access.
+const (
+	AccessFetch = AccessKind(iota)
+	AccessRead
+	AccessWrite
+)
+
+// String returns the name of the access kind.
+func (kind AccessKind) String() string {
+	switch kind {
+	case AccessFetch:
+		return "fetch"
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// AccessHook is a function called for each access to the memory. The
+// address is the physical address. Accesses to devices are not reported.
+type AccessHook func(kind AccessKind, addr uint16)
+
+// accessed invokes the access hook, if any.
+func (vm *VM) accessed(kind AccessKind, addr uint16) {
+	if vm.AccessHook != nil {
+		vm.AccessHook(kind, addr)
+	}
+}
@@ -0,0 +1,36 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAccessHook(t *testing.T) {
+	machine := new(VM)
+	if err := machine.Attach(NewConsole(ConsoleBase, strings.NewReader(""), ioutil.Discard)); err != nil {
+		t.Fatal(err)
+	}
+	machine.M[0] = OpcodeSW<<13 | 1<<10 | 10   // sw r1 r0 10
+	machine.M[1] = OpcodeLW<<13 | 3<<10 | 10   // lw r3 r0 10
+	machine.M[2] = OpcodeSW<<13 | 1<<10 | 0x70 // sw r1 r0 -16, the console
+	machine.M[3] = OpcodeLW<<13 | 3<<10 | 0x71 // lw r3 r0 -15, the console
+	machine.M[4] = encodeTrap(ExceptionTypeEXCEPTION | ExceptionValueHALT)
+	var accesses []string
+	machine.AccessHook = func(kind AccessKind, addr uint16) {
+		accesses = append(accesses, fmt.Sprintf("%s %d", kind, addr))
+	}
+	runUntilHalted(t, machine, 10)
+	// the accesses to devices are not reported
+	expected := []string{
+		"fetch 0", "write 10", "fetch 1", "read 10", "fetch 2", "fetch 3", "fetch 4",
+	}
+	if !reflect.DeepEqual(accesses, expected) {
+		t.Fatalf("expected %q, got %q", expected, accesses)
+	}
+	if s := AccessKind(7).String(); s != "unknown" {
+		t.Fatalf("expected unknown, got %s", s)
+	}
+}
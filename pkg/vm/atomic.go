@@ -0,0 +1,47 @@
+package vm
+
+// ExceptionTypeATOMIC is the exception type of the atomic operations. The
+// operation is encoded in the four least significant bits of the immediate
+// of a `jalr r0 r0 imm` instruction whose exception type is ATOMIC. Because
+// the VM executes each instruction atomically, the atomic operations are
+// atomic with respect to other VMs sharing the memory, provided that the
+// scheduler interleaves them at instruction boundaries (see pkg/multicore).
+const ExceptionTypeATOMIC = ExceptionTypeRFU1
+
+// The following constants define the atomic operations. Both operations
+// use the address in r2, which is translated like for LW and SW, and
+// return the previous value of the memory word in r1.
+const (
+	// AtomicTAS is test-and-set: it stores one into the word.
+	AtomicTAS = iota
+
+	// AtomicCAS is compare-and-swap: it stores r3 into the word if
+	// the word is equal to r1. The operation succeeds when r1 does
+	// not change, i.e., when the previous value was equal to r1.
+	AtomicCAS
+
+	// NumAtomics is the number of atomic operations.
+	NumAtomics
+)
+
+// atomic executes the given atomic operation.
+func (vm *VM) atomic(op uint16) error {
+	addr, fault := vm.translate(vm.GPR[2], TLBRead)
+	if fault == 0 {
+		addr, fault = vm.translate(vm.GPR[2], TLBWrite)
+	}
+	if fault != 0 {
+		return vm.trap(fault, vm.PC-1)
+	}
+	old := vm.load(addr)
+	switch op {
+	case AtomicTAS:
+		vm.store(addr, 1)
+	case AtomicCAS:
+		if old == vm.GPR[1] {
+			vm.store(addr, vm.GPR[3])
+		}
+	}
+	vm.GPR[1] = old
+	return nil
+}
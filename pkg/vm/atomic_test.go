@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAtomic(t *testing.T) {
+	machine := new(VM)
+	machine.GPR[2] = 50
+	machine.M[0] = encodeTrap(ExceptionTypeATOMIC | AtomicTAS)
+	machine.M[1] = encodeTrap(ExceptionTypeATOMIC | AtomicTAS)
+	machine.M[2] = encodeTrap(ExceptionTypeATOMIC | AtomicCAS)
+	machine.M[3] = encodeTrap(ExceptionTypeATOMIC | AtomicCAS)
+	machine.M[4] = encodeTrap(ExceptionTypeATOMIC | NumAtomics)
+	for _, expected := range []struct {
+		r1, mem uint16
+	}{
+		{0, 1}, // the lock was free
+		{1, 1}, // the lock was taken
+		{1, 7}, // r1 matches the word, so CAS swaps
+		{7, 7}, // r1 does not match the word anymore
+	} {
+		machine.GPR[1], machine.GPR[3] = 1, 7
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+		if machine.GPR[1] != expected.r1 || machine.M[50] != expected.mem {
+			t.Fatalf("expected %+v, got r1=%d and mem=%d", expected, machine.GPR[1], machine.M[50])
+		}
+	}
+	var exc *ExceptionError
+	if err := fetchExecute(machine); !errors.As(err, &exc) || exc.Cause != ExceptionTypeATOMIC|NumAtomics {
+		t.Fatalf("expected an exception, got %v", err)
+	}
+}
+
+func TestAtomicPaging(t *testing.T) {
+	// the atomic operations need both read and write permissions
+	machine := newPagedMachine()
+	machine.GPR[2] = machine.GPR[3]
+	machine.TLB[5].Lo &^= TLBWrite
+	machine.M[0x100] = encodeTrap(ExceptionTypeATOMIC | AtomicTAS)
+	var exc *ExceptionError
+	err := fetchExecute(machine)
+	if !errors.As(err, &exc) || exc.Cause != ExceptionTypeEXCEPTION|ExceptionValueSIGSEGV {
+		t.Fatalf("expected SIGSEGV, got %v", err)
+	}
+	if machine.M[0x500] != 0 || machine.SPR[SPRBadVAddr] != 0x300 {
+		t.Fatalf("unexpected memory %d or badvaddr %#04x", machine.M[0x500], machine.SPR[SPRBadVAddr])
+	}
+	machine.TLB[5].Lo |= TLBWrite
+	machine.PC = 0
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.M[0x500] != 1 || machine.GPR[1] != 0 {
+		t.Fatalf("unexpected memory %d or r1 %d", machine.M[0x500], machine.GPR[1])
+	}
+}
@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BootROMBase is the address of the boot ROM. After Boot, the PC points
+// to the boot ROM, which copies the segments of the program into the
+// memory and then jumps to the entry point of the program.
+const BootROMBase = 0xffa0
+
+// BootPortBase is the address of the boot port, a read-only device from
+// which the boot ROM reads the boot image. Because of sign extension,
+// the boot ROM accesses it using r0 as the base register (`lw r1 r0 -64`).
+// The boot image consists of the number of segments followed by, for
+// each segment, its load address, its number of words, and the words,
+// followed by the entry point. After the boot ROM reads the entry point,
+// the boot port detaches itself from the VM.
+const BootPortBase = 0xffc0
+
+// Segment is a contiguous sequence of words loaded at Addr.
+type Segment struct {
+	Addr  uint16
+	Words []uint16
+}
+
+// bootROM contains the boot ROM code. For each segment, the boot ROM reads
+// the load address into r2 and the number of words into r3, and copies the
+// words. Then, it stores the entry point into SPREPC, clears the registers
+// it used, and jumps to the entry point using rfe, which leaves the VM in
+// kernel mode with interrupts disabled, like at reset.
+var bootROM = [...]uint16{
+	OpcodeLW<<13 | 1<<10 | 0x40,                            //       lw r1 r0 -64
+	OpcodeBEQ<<13 | 1<<10 | 10,                             // next: beq r1 r0 done
+	OpcodeLW<<13 | 2<<10 | 0x40,                            //       lw r2 r0 -64
+	OpcodeLW<<13 | 3<<10 | 0x40,                            //       lw r3 r0 -64
+	OpcodeBEQ<<13 | 3<<10 | 5,                              // copy: beq r3 r0 end
+	OpcodeLW<<13 | 4<<10 | 0x40,                            //       lw r4 r0 -64
+	OpcodeSW<<13 | 4<<10 | 2<<7,                            //       sw r4 r2 0
+	OpcodeADDI<<13 | 2<<10 | 2<<7 | 1,                      //       addi r2 r2 1
+	OpcodeADDI<<13 | 3<<10 | 3<<7 | 0x7f,                   //       addi r3 r3 -1
+	OpcodeBEQ<<13 | 0x7a,                                   //       beq r0 r0 copy
+	OpcodeADDI<<13 | 1<<10 | 1<<7 | 0x7f,                   // end:  addi r1 r1 -1
+	OpcodeBEQ<<13 | 0x75,                                   //       beq r0 r0 next
+	OpcodeLW<<13 | 1<<10 | 0x40,                            // done: lw r1 r0 -64
+	encodeTrap(ExceptionTypeMTSPR | SPREPC),                //       mtspr epc
+	OpcodeADD<<13 | 1<<10,                                  //       add r1 r0 r0
+	OpcodeADD<<13 | 2<<10,                                  //       add r2 r0 r0
+	OpcodeADD<<13 | 3<<10,                                  //       add r3 r0 r0
+	OpcodeADD<<13 | 4<<10,                                  //       add r4 r0 r0
+	encodeTrap(ExceptionTypeEXCEPTION | ExceptionValueRFE), //       rfe
+}
+
+// ErrBootImage indicates that the segments passed to Boot or LoadSegments
+// extend beyond the end of the memory, overlap with the boot ROM or the
+// boot port, or are too many.
+var ErrBootImage = errors.New("vm: invalid boot image")
+
+// Boot prepares the VM to boot the program consisting of the given
+// segments and entry point. It copies the boot ROM at BootROMBase,
+// attaches the boot port at BootPortBase, and sets the PC to BootROMBase.
+// Running the VM then executes the boot ROM, which copies the segments
+// using SW, thus a segment overlapping with a device writes into the
+// device, and jumps to the entry point with SPREPC set to the entry
+// point. Like any other code, the boot ROM notifies the observers and
+// counts towards SPRCycles and the limits of Run. The segments must not
+// overlap with the boot ROM or the boot port.
+func (vm *VM) Boot(entry uint16, segments []Segment) error {
+	if len(segments) > 0xffff {
+		return fmt.Errorf("%w: %d segments", ErrBootImage, len(segments))
+	}
+	image := []uint16{uint16(len(segments))}
+	for _, seg := range segments {
+		if err := checkSegment(seg); err != nil {
+			return err
+		}
+		end := uint32(seg.Addr) + uint32(len(seg.Words))
+		if uint32(seg.Addr) <= BootPortBase && end > BootROMBase {
+			return fmt.Errorf("%w: segment at %#04x with size %d", ErrBootImage,
+				seg.Addr, len(seg.Words))
+		}
+		image = append(image, seg.Addr, uint16(len(seg.Words)))
+		image = append(image, seg.Words...)
+	}
+	image = append(image, entry)
+	if err := vm.Attach(&bootPort{image: image, vm: vm}); err != nil {
+		return err
+	}
+	copy(vm.Memory()[BootROMBase:], bootROM[:])
+	vm.PC = BootROMBase
+	return nil
+}
+
+// LoadSegments copies the given segments into the memory and sets the PC
+// to the entry point, without running the boot ROM (e.g., for models
+// that do not implement the exceptions or the devices used by the boot
+// ROM). Like writing the memory directly, it bypasses the devices and
+// the observers. It does not change the other registers.
+func (vm *VM) LoadSegments(entry uint16, segments []Segment) error {
+	for _, seg := range segments {
+		if err := checkSegment(seg); err != nil {
+			return err
+		}
+	}
+	for _, seg := range segments {
+		copy(vm.Memory()[seg.Addr:], seg.Words)
+	}
+	vm.PC = entry
+	return nil
+}
+
+// checkSegment returns an error if seg extends beyond the end of the memory.
+func checkSegment(seg Segment) error {
+	if uint32(seg.Addr)+uint32(len(seg.Words)) > MemorySize {
+		return fmt.Errorf("%w: segment at %#04x with size %d", ErrBootImage,
+			seg.Addr, len(seg.Words))
+	}
+	return nil
+}
+
+// bootPort is the boot port (see BootPortBase).
+type bootPort struct {
+	image []uint16
+	vm    *VM
+}
+
+var _ Device = &bootPort{}
+
+// Base implements Device.Base.
+func (p *bootPort) Base() uint16 {
+	return BootPortBase
+}
+
+// Size implements Device.Size.
+func (p *bootPort) Size() uint16 {
+	return 1
+}
+
+// Read implements Device.Read. It returns the next word of the boot image
+// and detaches the boot port after returning the last word.
+func (p *bootPort) Read(offset uint16) uint16 {
+	if len(p.image) <= 0 {
+		return 0
+	}
+	value := p.image[0]
+	p.image = p.image[1:]
+	if len(p.image) <= 0 {
+		p.vm.detach(p)
+	}
+	return value
+}
+
+// Write implements Device.Write. The boot port ignores writes.
+func (p *bootPort) Write(offset uint16, value uint16) {
+	// nothing
+}
+
+// detach detaches the given device from the VM.
+func (vm *VM) detach(dev Device) {
+	for idx, other := range vm.devices {
+		if other == dev {
+			vm.devices = append(vm.devices[:idx], vm.devices[idx+1:]...)
+			return
+		}
+	}
+}
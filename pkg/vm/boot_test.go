@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// bootSegments contains a program, placed at 0x8000, that stores the word
+// at 0x0010 into r1 and halts, along with the data segment at 0x0010.
+var bootSegments = []Segment{{
+	Addr:  0x0010,
+	Words: []uint16{42},
+}, {
+	Addr: 0x8000,
+	Words: []uint16{
+		OpcodeLW<<13 | 1<<10 | 0x10, // lw r1 r0 16
+		encodeTrap(ExceptionTypeEXCEPTION | ExceptionValueHALT),
+	},
+}}
+
+func TestBoot(t *testing.T) {
+	for _, observed := range []bool{false, true} {
+		machine := new(VM)
+		observer := &countingObserver{}
+		if observed {
+			machine.AddObserver(observer)
+		}
+		if err := machine.Boot(0x8000, bootSegments); err != nil {
+			t.Fatal(err)
+		}
+		if machine.PC != BootROMBase || machine.M[0x8000] != 0 {
+			t.Fatalf("expected PC %#04x and no program, got %#04x", BootROMBase, machine.PC)
+		}
+		result := machine.Run(context.Background(), RunOptions{MaxInstructions: 1000})
+		if result.Reason != StopHalted || result.PC != 0x8002 {
+			t.Fatalf("expected StopHalted at 0x8002, got %+v", result)
+		}
+		if machine.GPR != [NumRegisters]uint16{1: 42} {
+			t.Fatalf("expected r1=42 and the other registers zero, got %+v", machine.GPR)
+		}
+		if machine.SPR[SPREPC] != 0x8000 || machine.SPR[SPRStatus] != 0 || machine.SPR[SPRIE] != 0 {
+			t.Fatalf("unexpected SPRs %+v", machine.SPR)
+		}
+		if machine.DeviceAt(BootPortBase) != nil {
+			t.Fatal("expected the boot port to be detached")
+		}
+		if observed && (observer.writes != 3 || uint64(observer.instructions) != result.Instructions) {
+			t.Fatalf("expected 3 writes and %d instructions, got %d and %d",
+				result.Instructions, observer.writes, observer.instructions)
+		}
+	}
+}
+
+func TestBootDevices(t *testing.T) {
+	var out strings.Builder
+	machine := new(VM)
+	segments := []Segment{
+		{Addr: 0, Words: bootSegments[1].Words[1:]}, // halt
+		{Addr: ConsoleBase, Words: []uint16{'x'}},
+	}
+	if err := machine.Boot(0, segments); err != nil {
+		t.Fatal(err)
+	}
+	console := NewConsole(ConsoleBase, strings.NewReader(""), &out)
+	if err := machine.Attach(console); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Attach(NewConsole(BootPortBase, nil, ioutil.Discard)); !errors.Is(err, ErrDeviceOverlap) {
+		t.Fatalf("expected ErrDeviceOverlap, got %v", err)
+	}
+	if result := machine.Run(context.Background(), RunOptions{}); result.Reason != StopHalted {
+		t.Fatalf("expected StopHalted, got %+v", result)
+	}
+	if err := console.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "x" || machine.M[ConsoleBase] != 0 {
+		t.Fatalf("expected the segment to be written into the console, got %q", out.String())
+	}
+}
+
+func TestBootErrors(t *testing.T) {
+	for _, seg := range []Segment{
+		{Addr: 0xfffe, Words: make([]uint16, 3)},
+		{Addr: BootROMBase - 1, Words: make([]uint16, 2)},
+		{Addr: BootPortBase, Words: make([]uint16, 1)},
+	} {
+		machine := new(VM)
+		if err := machine.Boot(0, []Segment{seg}); !errors.Is(err, ErrBootImage) {
+			t.Fatalf("segment at %#04x: expected ErrBootImage, got %v", seg.Addr, err)
+		}
+		if machine.PC != 0 || machine.DeviceAt(BootPortBase) != nil {
+			t.Fatalf("segment at %#04x: Boot changed the machine", seg.Addr)
+		}
+	}
+	machine := new(VM)
+	if err := machine.Attach(NewConsole(BootPortBase, nil, ioutil.Discard)); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Boot(0, nil); !errors.Is(err, ErrDeviceOverlap) {
+		t.Fatalf("expected ErrDeviceOverlap, got %v", err)
+	}
+}
+
+func TestLoadSegments(t *testing.T) {
+	machine := new(VM)
+	machine.GPR[1] = 7
+	if err := machine.LoadSegments(0x8000, bootSegments); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC != 0x8000 || machine.M[0x10] != 42 || machine.M[0x8000] != bootSegments[1].Words[0] ||
+		machine.GPR[1] != 7 || machine.DeviceAt(BootPortBase) != nil {
+		t.Fatalf("unexpected machine %s", machine)
+	}
+	err := machine.LoadSegments(0, []Segment{{Addr: 0xffff, Words: make([]uint16, 2)}})
+	if !errors.Is(err, ErrBootImage) || machine.PC != 0x8000 {
+		t.Fatalf("expected ErrBootImage, got %v", err)
+	}
+}
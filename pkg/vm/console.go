@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"bufio"
+	"io"
+)
+
+// ConsoleBase is the conventional address of the console device. Because
+// of sign extension, a program may access the console registers using r0
+// as the base register (e.g., `sw r1 r0 -16` prints the byte in r1).
+const ConsoleBase = 0xfff0
+
+// The following constants define the console registers, expressed as
+// offsets relative to the console base address.
+const (
+	// ConsoleData is the data register. Storing a word prints its low
+	// byte. Loading returns the next input byte, blocking until input is
+	// available, or 0xffff when the input has ended.
+	ConsoleData = iota
+
+	// ConsoleStatus is the status register. Loading returns the
+	// bitwise OR of the ConsoleStatus* flags.
+	ConsoleStatus
+
+	// ConsoleSize is the number of words mapped by the console.
+	ConsoleSize
+)
+
+// The following constants define the flags of the status register.
+const (
+	// ConsoleStatusReady indicates that the console can accept output.
+	ConsoleStatusReady = 1 << iota
+
+	// ConsoleStatusEOF indicates that the input has ended.
+	ConsoleStatusEOF
+)
+
+// ConsoleEOF is the value of the data register when the input has ended.
+const ConsoleEOF = 0xffff
+
+// Console is a memory-mapped console UART.
+type Console struct {
+	base uint16
+	eof  bool
+	err  error
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// NewConsole creates a new console mapped at base that reads its
+// input from r and writes its output to w. Output is buffered; call
+// the Flush method to make sure it is written.
+func NewConsole(base uint16, r io.Reader, w io.Writer) *Console {
+	return &Console{base: base, r: bufio.NewReader(r), w: bufio.NewWriter(w)}
+}
+
+// Base implements Device.Base.
+func (c *Console) Base() uint16 {
+	return c.base
+}
+
+// Size implements Device.Size.
+func (c *Console) Size() uint16 {
+	return ConsoleSize
+}
+
+// Read implements Device.Read.
+func (c *Console) Read(offset uint16) uint16 {
+	switch offset {
+	case ConsoleData:
+		c.Flush() // make sure prompts are visible
+		if c.eof {
+			return ConsoleEOF
+		}
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			c.eof = true
+			if err != io.EOF && c.err == nil {
+				c.err = err
+			}
+			return ConsoleEOF
+		}
+		return uint16(ch)
+	case ConsoleStatus:
+		var status uint16 = ConsoleStatusReady
+		if c.eof {
+			status |= ConsoleStatusEOF
+		}
+		return status
+	default:
+		return 0
+	}
+}
+
+// Write implements Device.Write.
+func (c *Console) Write(offset uint16, value uint16) {
+	if offset != ConsoleData {
+		return
+	}
+	if err := c.w.WriteByte(byte(value)); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// Flush flushes the buffered output.
+func (c *Console) Flush() error {
+	if err := c.w.Flush(); err != nil && c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// Err returns the first I/O error that occurred, if any.
+func (c *Console) Err() error {
+	return c.err
+}
+
+var _ Device = &Console{}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// failingIO is an io.Reader and an io.Writer always failing with err.
+type failingIO struct {
+	err error
+}
+
+// Read implements io.Reader.
+func (f *failingIO) Read(p []byte) (int, error) {
+	return 0, f.err
+}
+
+// Write implements io.Writer.
+func (f *failingIO) Write(p []byte) (int, error) {
+	return 0, f.err
+}
+
+func TestConsole(t *testing.T) {
+	var out bytes.Buffer
+	console := NewConsole(ConsoleBase, strings.NewReader("hi"), &out)
+	if status := console.Read(ConsoleStatus); status != ConsoleStatusReady {
+		t.Fatalf("unexpected status %#x", status)
+	}
+	console.Write(ConsoleData, '>'|0x100) // only the low byte is printed
+	if out.Len() != 0 {
+		t.Fatal("the output is not buffered")
+	}
+	// reading flushes the output, so that prompts are visible
+	for _, expected := range []uint16{'h', 'i', ConsoleEOF, ConsoleEOF} {
+		if value := console.Read(ConsoleData); value != expected {
+			t.Fatalf("expected %#x, got %#x", expected, value)
+		}
+		if out.String() != ">" {
+			t.Fatalf("expected %q, got %q", ">", out.String())
+		}
+	}
+	if status := console.Read(ConsoleStatus); status != ConsoleStatusReady|ConsoleStatusEOF {
+		t.Fatalf("unexpected status %#x", status)
+	}
+}
+
+func TestConsoleErrors(t *testing.T) {
+	failure := errors.New("mocked error")
+	console := NewConsole(ConsoleBase, &failingIO{failure}, &failingIO{failure})
+	if value := console.Read(ConsoleData); value != ConsoleEOF {
+		t.Fatalf("expected ConsoleEOF, got %#x", value)
+	}
+	if !errors.Is(console.Err(), failure) {
+		t.Fatalf("expected the mocked error, got %v", console.Err())
+	}
+	console = NewConsole(ConsoleBase, strings.NewReader(""), &failingIO{failure})
+	console.Write(ConsoleData, 'x')
+	if err := console.Flush(); !errors.Is(err, failure) {
+		t.Fatalf("expected the mocked error, got %v", err)
+	}
+	// the end of the input is not an error
+	console = NewConsole(ConsoleBase, strings.NewReader(""), ioutil.Discard)
+	if console.Read(ConsoleData) != ConsoleEOF || console.Err() != nil {
+		t.Fatal("expected ConsoleEOF without errors")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	machine := new(VM)
+	if err := machine.Attach(NewConsole(ConsoleBase, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	for _, base := range []uint16{ConsoleBase - 1, ConsoleBase + 1, 0xffff} {
+		if err := machine.Attach(NewConsole(base, nil, nil)); !errors.Is(err, ErrDeviceOverlap) {
+			t.Fatalf("%#04x: expected ErrDeviceOverlap, got %v", base, err)
+		}
+	}
+	if err := machine.Attach(NewConsole(ConsoleBase-ConsoleSize, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsoleEcho(t *testing.T) {
+	// the program copies the input to the output until the end of the
+	// input, using r0 as the base register, while r2 contains ConsoleEOF
+	var out bytes.Buffer
+	console := NewConsole(ConsoleBase, strings.NewReader("echo\n"), &out)
+	machine := new(VM)
+	if err := machine.Attach(console); err != nil {
+		t.Fatal(err)
+	}
+	machine.GPR[2] = ConsoleEOF
+	machine.M[0] = OpcodeLW<<13 | 1<<10 | 0x70      // lw r1 r0 -16
+	machine.M[1] = OpcodeBEQ<<13 | 1<<10 | 2<<7 | 2 // beq r1 r2 2
+	machine.M[2] = OpcodeSW<<13 | 1<<10 | 0x70      // sw r1 r0 -16
+	machine.M[3] = OpcodeBEQ<<13 | 0x7c             // beq r0 r0 -4, back to 0
+	machine.M[4] = OpcodeJALR<<13 | ExceptionTypeEXCEPTION | ExceptionValueHALT
+	machine.M[ConsoleBase] = 7 // hidden by the console
+	runUntilHalted(t, machine, 100)
+	if err := console.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "echo\n" {
+		t.Fatalf("expected %q, got %q", "echo\n", out.String())
+	}
+	if machine.M[ConsoleBase] != 7 {
+		t.Fatal("the program wrote the memory under the console")
+	}
+}
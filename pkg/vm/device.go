@@ -0,0 +1,137 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Device is a memory-mapped device. When a device is attached to the
+// VM, the LW and SW instructions targeting the addresses in the range
+// [Base(), Base()+Size()) are routed to the device rather than to
+// the memory. Instruction fetches always read the memory.
+type Device interface {
+	// Base returns the first address mapped by the device.
+	Base() uint16
+
+	// Size returns the number of words mapped by the device.
+	Size() uint16
+
+	// Read is called when the VM loads from the given offset,
+	// which is relative to Base().
+	Read(offset uint16) uint16
+
+	// Write is called when the VM stores the given value at the
+	// given offset, which is relative to Base().
+	Write(offset uint16, value uint16)
+}
+
+// ErrDeviceOverlap indicates that a device overlaps with another device
+// or extends beyond the end of the memory.
+var ErrDeviceOverlap = errors.New("vm: device overlap")
+
+// Attach attaches a memory-mapped device to the VM.
+func (vm *VM) Attach(dev Device) error {
+	base, end := uint32(dev.Base()), uint32(dev.Base())+uint32(dev.Size())
+	if end > MemorySize || dev.Size() < 1 {
+		return fmt.Errorf("%w: device at %#04x with size %d", ErrDeviceOverlap,
+			dev.Base(), dev.Size())
+	}
+	for _, other := range vm.devices {
+		otherBase := uint32(other.Base())
+		otherEnd := otherBase + uint32(other.Size())
+		if base < otherEnd && otherBase < end {
+			return fmt.Errorf("%w: device at %#04x with size %d", ErrDeviceOverlap,
+				dev.Base(), dev.Size())
+		}
+	}
+	vm.devices = append(vm.devices, dev)
+	return nil
+}
+
+// findDevice returns the device mapping addr, if any.
+func (vm *VM) findDevice(addr uint16) Device {
+	for _, dev := range vm.devices {
+		if addr >= dev.Base() && addr-dev.Base() < dev.Size() {
+			return dev
+		}
+	}
+	return nil
+}
+
+// DeviceAt returns the device mapping the given physical address, if any.
+func (vm *VM) DeviceAt(addr uint16) Device {
+	return vm.findDevice(addr)
+}
+
+// Load loads a word from the given physical address, like LW does after
+// translating the address, notifying the observers. System call handlers
+// should use Load and Store so that observers see their memory accesses.
+func (vm *VM) Load(addr uint16) uint16 {
+	return vm.load(addr)
+}
+
+// Store stores a word at the given physical address, like SW does
+// after translating the address, notifying the observers.
+func (vm *VM) Store(addr uint16, value uint16) {
+	vm.store(addr, value)
+}
+
+// StoreMemory stores a word into the memory at the given physical address,
+// bypassing the devices and the AccessHook, and notifies the observers.
+// Devices performing DMA (e.g., Disk) should use StoreMemory so that
+// observers see the memory changes they cause.
+func (vm *VM) StoreMemory(addr uint16, value uint16) {
+	mem := vm.Memory()
+	old := mem[addr]
+	mem[addr] = value
+	if len(vm.observers) > 0 {
+		vm.notifyMemoryWrite(addr, old, value, false)
+	}
+}
+
+// load loads a word from the memory or from a device.
+func (vm *VM) load(addr uint16) uint16 {
+	value := vm.read(addr)
+	if len(vm.observers) > 0 {
+		vm.notifyMemoryRead(addr, value)
+	}
+	return value
+}
+
+// read reads a word from the memory or from a device.
+func (vm *VM) read(addr uint16) uint16 {
+	if len(vm.devices) > 0 {
+		if dev := vm.findDevice(addr); dev != nil {
+			return dev.Read(addr - dev.Base())
+		}
+	}
+	vm.accessed(AccessRead, addr)
+	return vm.Memory()[addr]
+}
+
+// store stores a word into the memory or into a device.
+func (vm *VM) store(addr uint16, value uint16) {
+	if len(vm.observers) == 0 {
+		vm.write(addr, value)
+		return
+	}
+	var old uint16
+	device := vm.findDevice(addr) != nil
+	if !device {
+		old = vm.Memory()[addr]
+	}
+	vm.write(addr, value)
+	vm.notifyMemoryWrite(addr, old, value, device)
+}
+
+// write writes a word into the memory or into a device.
+func (vm *VM) write(addr uint16, value uint16) {
+	if len(vm.devices) > 0 {
+		if dev := vm.findDevice(addr); dev != nil {
+			dev.Write(addr-dev.Base(), value)
+			return
+		}
+	}
+	vm.accessed(AccessWrite, addr)
+	vm.Memory()[addr] = value
+}
@@ -0,0 +1,240 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DiskBase is the conventional address of the disk device. Because
+// of sign extension, a program may access the disk registers using r0
+// as the base register (e.g., `sw r1 r0 -29` starts a command).
+const DiskBase = 0xffe0
+
+// The following constants define the disk registers, expressed as
+// offsets relative to the disk base address.
+const (
+	// DiskSector is the number of the first sector to transfer.
+	DiskSector = iota
+
+	// DiskAddress is the physical memory address of the first word
+	// to transfer. Addresses wrap around at the end of the memory.
+	DiskAddress
+
+	// DiskCount is the number of sectors to transfer.
+	DiskCount
+
+	// DiskCommand is the command register. Storing one of the
+	// DiskCommand* values starts the corresponding command.
+	DiskCommand
+
+	// DiskStatus is the status register. Loading returns the bitwise OR
+	// of the DiskStatus* flags. Storing any value clears the error flag.
+	DiskStatus
+
+	// DiskSectors is the read-only number of sectors of the disk.
+	DiskSectors
+
+	// DiskSize is the number of words mapped by the disk.
+	DiskSize
+)
+
+// The following constants define the commands of the disk.
+const (
+	// DiskCommandRead copies DiskCount sectors starting at DiskSector
+	// from the disk into the memory starting at DiskAddress.
+	DiskCommandRead = 1 + iota
+
+	// DiskCommandWrite copies DiskCount sectors from the memory starting
+	// at DiskAddress into the disk starting at DiskSector.
+	DiskCommandWrite
+)
+
+// DiskCommandInterrupt is a flag that, when ORed with a command,
+// raises InterruptDisk when the command completes.
+const DiskCommandInterrupt = 1 << 15
+
+// The following constants define the flags of the status register.
+const (
+	// DiskStatusReady indicates that the disk can accept a command.
+	DiskStatusReady = 1 << iota
+
+	// DiskStatusError indicates that a command failed, either because
+	// the command or the sectors were invalid, or because of an I/O
+	// error (see Disk.Err).
+	DiskStatusError
+)
+
+// DiskSectorSize is the number of words of a disk sector. The disk file
+// stores each word using two bytes in little endian order.
+const DiskSectorSize = 256
+
+// DiskFile is the file backing a Disk (e.g., an *os.File).
+type DiskFile interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Disk is a memory-mapped block storage device backed by a file. The
+// disk transfers data using DMA: the transfer happens while storing into
+// DiskCommand, so the command has completed when the next instruction
+// executes. DMA accesses the physical memory bypassing the AccessHook, and
+// the VM notifies the observers of the memory changes caused by
+// DiskCommandRead, which happen while executing the SW instruction.
+type Disk struct {
+	address uint16
+	base    uint16
+	count   uint16
+	err     error
+	failed  bool
+	file    DiskFile
+	machine *VM
+	sector  uint16
+	sectors uint16
+}
+
+// NewDisk creates a new disk mapped at base that performs DMA into the
+// memory of machine and is backed by file, whose size in bytes is size.
+// The number of sectors is size divided by the size of a sector in bytes,
+// rounded up, and at most 0xffff. When a sector extends beyond the end of
+// the file, its missing words read as zero.
+func NewDisk(machine *VM, base uint16, file DiskFile, size int64) *Disk {
+	const sectorBytes = 2 * DiskSectorSize
+	sectors := (size + sectorBytes - 1) / sectorBytes
+	if sectors > 0xffff {
+		sectors = 0xffff
+	}
+	return &Disk{base: base, file: file, machine: machine, sectors: uint16(sectors)}
+}
+
+// Base implements Device.Base.
+func (d *Disk) Base() uint16 {
+	return d.base
+}
+
+// Size implements Device.Size.
+func (d *Disk) Size() uint16 {
+	return DiskSize
+}
+
+// Read implements Device.Read.
+func (d *Disk) Read(offset uint16) uint16 {
+	switch offset {
+	case DiskSector:
+		return d.sector
+	case DiskAddress:
+		return d.address
+	case DiskCount:
+		return d.count
+	case DiskStatus:
+		var status uint16 = DiskStatusReady
+		if d.failed {
+			status |= DiskStatusError
+		}
+		return status
+	case DiskSectors:
+		return d.sectors
+	default:
+		return 0
+	}
+}
+
+// Write implements Device.Write.
+func (d *Disk) Write(offset uint16, value uint16) {
+	switch offset {
+	case DiskSector:
+		d.sector = value
+	case DiskAddress:
+		d.address = value
+	case DiskCount:
+		d.count = value
+	case DiskCommand:
+		d.failed = !d.execute(value &^ DiskCommandInterrupt)
+		if value&DiskCommandInterrupt != 0 {
+			d.machine.RaiseInterrupt(InterruptDisk)
+		}
+	case DiskStatus:
+		d.failed = false
+	}
+}
+
+// execute executes the given command and returns whether it succeeded.
+func (d *Disk) execute(command uint16) bool {
+	if command != DiskCommandRead && command != DiskCommandWrite {
+		return false
+	}
+	if uint32(d.sector)+uint32(d.count) > uint32(d.sectors) {
+		return false
+	}
+	buf := make([]byte, 2*DiskSectorSize)
+	addr, mem := d.address, d.machine.Memory()
+	for idx := uint16(0); idx < d.count; idx++ {
+		off := (int64(d.sector) + int64(idx)) * int64(len(buf))
+		if command == DiskCommandRead {
+			count, err := d.file.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				d.setErr(err)
+				return false
+			}
+			for pos := count; pos < len(buf); pos++ {
+				buf[pos] = 0 // beyond the end of the file
+			}
+			for pos := 0; pos < len(buf); pos += 2 {
+				d.machine.StoreMemory(addr, binary.LittleEndian.Uint16(buf[pos:]))
+				addr++
+			}
+			continue
+		}
+		for pos := 0; pos < len(buf); pos += 2 {
+			binary.LittleEndian.PutUint16(buf[pos:], mem[addr])
+			addr++
+		}
+		if _, err := d.file.WriteAt(buf, off); err != nil {
+			d.setErr(err)
+			return false
+		}
+	}
+	return true
+}
+
+// setErr records the first I/O error.
+func (d *Disk) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Err returns the first I/O error that occurred, if any.
+func (d *Disk) Err() error {
+	return d.err
+}
+
+// diskStateSize is the size of the state returned by SaveState.
+const diskStateSize = 7
+
+// SaveState implements StatefulDevice.SaveState. The state does not
+// include the disk content, which is stored in the file.
+func (d *Disk) SaveState() ([]byte, error) {
+	state := make([]byte, diskStateSize)
+	binary.LittleEndian.PutUint16(state[0:], d.sector)
+	binary.LittleEndian.PutUint16(state[2:], d.address)
+	binary.LittleEndian.PutUint16(state[4:], d.count)
+	if d.failed {
+		state[6] = 1
+	}
+	return state, nil
+}
+
+// RestoreState implements StatefulDevice.RestoreState.
+func (d *Disk) RestoreState(state []byte) error {
+	if len(state) != diskStateSize {
+		return fmt.Errorf("disk state has size %d", len(state))
+	}
+	d.sector = binary.LittleEndian.Uint16(state[0:])
+	d.address = binary.LittleEndian.Uint16(state[2:])
+	d.count = binary.LittleEndian.Uint16(state[4:])
+	d.failed = state[6] != 0
+	return nil
+}
+
+var _ StatefulDevice = &Disk{}
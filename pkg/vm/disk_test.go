@@ -0,0 +1,207 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// memoryDisk is a DiskFile keeping the data in memory.
+type memoryDisk struct {
+	data []byte
+	err  error // error returned by all the operations, if not nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *memoryDisk) ReadAt(p []byte, off int64) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	count := copy(p, d.data[off:])
+	if count < len(p) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (d *memoryDisk) WriteAt(p []byte, off int64) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	for int64(len(d.data)) < off+int64(len(p)) {
+		d.data = append(d.data, 0)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+// memoryWrite is a write notified to an observer.
+type memoryWrite struct {
+	addr, old, value uint16
+}
+
+// writesObserver records the memory writes.
+type writesObserver struct {
+	NopObserver
+	writes []memoryWrite
+}
+
+// MemoryWrite implements Observer.MemoryWrite.
+func (o *writesObserver) MemoryWrite(addr, old, value uint16) {
+	o.writes = append(o.writes, memoryWrite{addr, old, value})
+}
+
+// newDiskMachine returns a machine with a disk backed by file attached
+// at DiskBase, whose size is the size of the file data.
+func newDiskMachine(t *testing.T, file *memoryDisk) (*VM, *Disk) {
+	machine := new(VM)
+	disk := NewDisk(machine, DiskBase, file, int64(len(file.data)))
+	if err := machine.Attach(disk); err != nil {
+		t.Fatal(err)
+	}
+	return machine, disk
+}
+
+// command stores the registers and then the command into the disk.
+func command(machine *VM, sector, addr, count, cmd uint16) {
+	machine.Store(DiskBase+DiskSector, sector)
+	machine.Store(DiskBase+DiskAddress, addr)
+	machine.Store(DiskBase+DiskCount, count)
+	machine.Store(DiskBase+DiskCommand, cmd)
+}
+
+func TestDiskRead(t *testing.T) {
+	// two sectors and a half, with each word containing its index
+	file := &memoryDisk{data: make([]byte, 5*DiskSectorSize)}
+	for idx := 0; idx < len(file.data)/2; idx++ {
+		file.data[2*idx], file.data[2*idx+1] = byte(idx), byte(idx>>8)
+	}
+	machine, disk := newDiskMachine(t, file)
+	if sectors := machine.Load(DiskBase + DiskSectors); sectors != 3 {
+		t.Fatalf("expected 3 sectors, got %d", sectors)
+	}
+	machine.M[100] = 0xffff
+	observer := &writesObserver{}
+	machine.AddObserver(observer)
+	command(machine, 1, 100, 2, DiskCommandRead)
+	if status := machine.Load(DiskBase + DiskStatus); status != DiskStatusReady {
+		t.Fatalf("unexpected status %#x", status)
+	}
+	for idx := 0; idx < 2*DiskSectorSize; idx++ {
+		expected := uint16(DiskSectorSize + idx)
+		if idx >= DiskSectorSize+DiskSectorSize/2 {
+			expected = 0 // beyond the end of the file
+		}
+		if machine.M[100+idx] != expected {
+			t.Fatalf("M[%d]: expected %d, got %d", 100+idx, expected, machine.M[100+idx])
+		}
+	}
+	// three register writes, then the DMA writes, which happen while
+	// writing the command register, and then the command register
+	if len(observer.writes) != 3+2*DiskSectorSize+1 {
+		t.Fatalf("unexpected number of writes: %d", len(observer.writes))
+	}
+	dma := observer.writes[3 : 3+2*DiskSectorSize]
+	if dma[0] != (memoryWrite{100, 0xffff, DiskSectorSize}) ||
+		dma[1] != (memoryWrite{101, 0, DiskSectorSize + 1}) {
+		t.Fatalf("unexpected DMA writes: %+v", dma[:2])
+	}
+	if machine.SPR[SPRPending] != 0 || disk.Err() != nil {
+		t.Fatal("unexpected interrupt or error")
+	}
+}
+
+func TestDiskWrite(t *testing.T) {
+	file := &memoryDisk{data: make([]byte, 4*DiskSectorSize)}
+	machine, _ := newDiskMachine(t, file)
+	for idx := 0; idx < DiskSectorSize; idx++ {
+		machine.M[uint16(0xff80+idx)] = uint16(0x100 + idx) // wraps around
+	}
+	command(machine, 1, 0xff80, 1, DiskCommandWrite|DiskCommandInterrupt)
+	sector := file.data[2*DiskSectorSize : 4*DiskSectorSize]
+	for idx := 0; idx < DiskSectorSize; idx++ {
+		if value := uint16(sector[2*idx]) | uint16(sector[2*idx+1])<<8; value != uint16(0x100+idx) {
+			t.Fatalf("word %d: expected %#x, got %#x", idx, 0x100+idx, value)
+		}
+	}
+	if !bytes.Equal(file.data[:2*DiskSectorSize], make([]byte, 2*DiskSectorSize)) {
+		t.Fatal("the write changed the first sector")
+	}
+	if machine.SPR[SPRPending] != 1<<InterruptDisk {
+		t.Fatalf("expected the disk interrupt, got %#x", machine.SPR[SPRPending])
+	}
+}
+
+func TestDiskErrors(t *testing.T) {
+	file := &memoryDisk{data: make([]byte, 2*DiskSectorSize)}
+	machine, disk := newDiskMachine(t, file)
+	machine.M[10] = 7
+	for _, cmd := range []struct {
+		sector, count, cmd uint16
+	}{
+		{1, 2, DiskCommandRead},  // out of range
+		{2, 1, DiskCommandWrite}, // out of range
+		{0, 1, 3},                // invalid command
+	} {
+		command(machine, cmd.sector, 10, cmd.count, cmd.cmd|DiskCommandInterrupt)
+		if status := machine.Load(DiskBase + DiskStatus); status != DiskStatusReady|DiskStatusError {
+			t.Fatalf("%+v: unexpected status %#x", cmd, status)
+		}
+		machine.Store(DiskBase+DiskStatus, 0)
+		if status := machine.Load(DiskBase + DiskStatus); status != DiskStatusReady {
+			t.Fatalf("%+v: the error was not cleared", cmd)
+		}
+	}
+	if machine.M[10] != 7 || disk.Err() != nil {
+		t.Fatal("unexpected memory change or error")
+	}
+	// the interrupt signals the completion of failed commands too
+	if machine.SPR[SPRPending] != 1<<InterruptDisk {
+		t.Fatalf("expected the disk interrupt, got %#x", machine.SPR[SPRPending])
+	}
+	failure := errors.New("mocked error")
+	file.err = failure
+	command(machine, 0, 10, 1, DiskCommandRead)
+	if status := machine.Load(DiskBase + DiskStatus); status != DiskStatusReady|DiskStatusError {
+		t.Fatalf("unexpected status %#x", status)
+	}
+	if !errors.Is(disk.Err(), failure) {
+		t.Fatalf("expected the mocked error, got %v", disk.Err())
+	}
+}
+
+func TestDiskInterrupt(t *testing.T) {
+	// the program starts a read with the interrupt flag and loops,
+	// while the handler at 20 halts, and r1 points to the disk
+	file := &memoryDisk{data: make([]byte, 2*DiskSectorSize)}
+	file.data[0] = 42
+	machine, _ := newDiskMachine(t, file)
+	machine.GPR[1] = DiskBase
+	machine.GPR[2] = DiskCommandRead | DiskCommandInterrupt
+	machine.GPR[3] = 50
+	machine.M[0] = OpcodeSW<<13 | 3<<10 | 1<<7 | DiskAddress // sw r3 r1 DiskAddress
+	machine.M[1] = OpcodeADDI<<13 | 4<<10 | 1                // addi r4 r0 1
+	machine.M[2] = OpcodeSW<<13 | 4<<10 | 1<<7 | DiskCount   // sw r4 r1 DiskCount
+	machine.M[3] = OpcodeSW<<13 | 2<<10 | 1<<7 | DiskCommand // sw r2 r1 DiskCommand
+	machine.M[4] = OpcodeBEQ<<13 | 0x7f                      // beq r0 r0 -1
+	machine.M[20] = OpcodeJALR<<13 | ExceptionTypeEXCEPTION | ExceptionValueHALT
+	machine.SPR[SPREVEC] = 20
+	machine.SPR[SPRIE] = 1
+	for count := 0; ; count++ {
+		if count > 10 {
+			t.Fatal("the interrupt was not taken")
+		}
+		if err := machine.Step(); errors.Is(err, ErrHalted) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if machine.SPR[SPREPC] != 4 || machine.M[50] != 42 {
+		t.Fatalf("unexpected EPC %d or data %d", machine.SPR[SPREPC], machine.M[50])
+	}
+}
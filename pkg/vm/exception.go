@@ -0,0 +1,123 @@
+package vm
+
+import "fmt"
+
+// The following constants define the flags of the SPRStatus register.
+const (
+	// StatusUser indicates that the processor is in user mode.
+	StatusUser = 1 << iota
+
+	// StatusPrevUser is the value of StatusUser before the last exception.
+	StatusPrevUser
+
+	// StatusPrevIE is the value of SPRIE before the last exception.
+	StatusPrevIE
+)
+
+// isExceptionCode returns true when code is an exception code (i.e., the
+// seven bits immediate of `jalr r0 r0 imm`) for which the VM raises an
+// exception rather than executing it. An exception is raised for codes
+// that are not defined, for the TLBMISS, SIGSEGV, and INVALID exception
+// values, and for system calls without a Go handler.
+func (vm *VM) isExceptionCode(code uint16) bool {
+	switch code & 0b111_0000 {
+	case ExceptionTypeSYSCALL:
+		return vm.syscalls[code&0b1111] == nil
+	case ExceptionTypeMFSPR, ExceptionTypeMTSPR:
+		return false
+	case ExceptionTypeATOMIC:
+		return code&0b1111 >= NumAtomics
+	case ExceptionTypeEXCEPTION:
+		switch code & 0b1111 {
+		case ExceptionValueHALT, ExceptionValueRFE:
+			return false
+		}
+	}
+	return true
+}
+
+// isPrivileged returns true when code is an exception code that can only
+// be executed in kernel mode. Executing a privileged exception code in user
+// mode raises an ExceptionTypeEXCEPTION|ExceptionValueINVALID exception.
+func isPrivileged(code uint16) bool {
+	switch code & 0b111_0000 {
+	case ExceptionTypeMFSPR, ExceptionTypeMTSPR:
+		return true
+	case ExceptionTypeEXCEPTION:
+		switch code & 0b1111 {
+		case ExceptionValueHALT, ExceptionValueRFE:
+			return true
+		}
+	}
+	return false
+}
+
+// ExceptionError is the error returned by Execute when an exception
+// occurs and the exception vector SPREVEC is zero. It wraps ErrException.
+type ExceptionError struct {
+	Cause uint16 // exception code (e.g., ExceptionTypeEXCEPTION|ExceptionValueINVALID)
+	PC    uint16 // address of the instruction that raised the exception
+}
+
+// Error implements error.Error.
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("%s with ID %d at %d", ErrException.Error(), e.Cause, e.PC)
+}
+
+// Unwrap allows using errors.Is(err, ErrException).
+func (e *ExceptionError) Unwrap() error {
+	return ErrException
+}
+
+// trap raises an exception with the given cause for the instruction at
+// the given address. When the exception vector SPREVEC is zero, this
+// function returns an *ExceptionError. Otherwise, it saves the
+// address into SPREPC and the cause into SPRCause, disables interrupts,
+// switches to kernel mode, jumps to the exception vector, and returns nil.
+func (vm *VM) trap(cause, epc uint16) error {
+	if len(vm.observers) > 0 {
+		vm.notifyException(cause, epc)
+	}
+	if vm.SPR[SPREVEC] == 0 {
+		return &ExceptionError{Cause: cause, PC: epc}
+	}
+	status := vm.SPR[SPRStatus] &^ (StatusUser | StatusPrevUser | StatusPrevIE)
+	if vm.SPR[SPRStatus]&StatusUser != 0 {
+		status |= StatusPrevUser
+	}
+	if vm.SPR[SPRIE] != 0 {
+		status |= StatusPrevIE
+	}
+	vm.SPR[SPRStatus] = status
+	vm.SPR[SPRIE] = 0
+	vm.SPR[SPRCause] = cause
+	vm.SPR[SPREPC] = epc
+	vm.PC = vm.SPR[SPREVEC]
+	return nil
+}
+
+// RaiseException raises an exception with the given cause for the
+// instruction being executed. Like Execute, it returns an *ExceptionError
+// when SPREVEC is zero, and otherwise jumps to the exception handler and
+// returns nil. System call handlers use it to report faults to the program
+// (e.g., a buffer that the program cannot access) by returning its result.
+func (vm *VM) RaiseException(cause uint16) error {
+	return vm.trap(cause, vm.PC-1)
+}
+
+// rfe returns from an exception by jumping to the address saved in
+// SPREPC and by restoring the mode and the interrupt enable flag that
+// were active before the exception.
+func (vm *VM) rfe() {
+	status := vm.SPR[SPRStatus]
+	vm.SPR[SPRIE] = 0
+	if status&StatusPrevIE != 0 {
+		vm.SPR[SPRIE] = 1
+	}
+	status &^= StatusUser
+	if status&StatusPrevUser != 0 {
+		status |= StatusUser
+	}
+	vm.SPR[SPRStatus] = status
+	vm.PC = vm.SPR[SPREPC]
+}
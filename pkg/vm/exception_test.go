@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+// skipHandler is an exception handler at 100 that returns to the
+// instruction following the one that raised the exception.
+func skipHandler(machine *VM) {
+	machine.SPR[SPREVEC] = 100
+	machine.M[100] = OpcodeJALR<<13 | ExceptionTypeMFSPR | SPREPC
+	machine.M[101] = OpcodeADDI<<13 | 1<<10 | 1<<7 | 1 // addi r1 r1 1
+	machine.M[102] = OpcodeJALR<<13 | ExceptionTypeMTSPR | SPREPC
+	machine.M[103] = OpcodeJALR<<13 | ExceptionTypeEXCEPTION | ExceptionValueRFE
+}
+
+func TestExceptionVector(t *testing.T) {
+	machine := new(VM)
+	skipHandler(machine)
+	machine.M[0] = OpcodeJALR<<13 | ExceptionTypeRFU2 // undefined
+	machine.M[1] = OpcodeADDI<<13 | 2<<10 | 1         // addi r2 r0 1
+	machine.SPR[SPRStatus] = StatusUser
+	machine.SPR[SPRIE] = 1
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	// the handler runs in kernel mode with interrupts disabled
+	if machine.PC != 100 || machine.SPR[SPRCause] != ExceptionTypeRFU2 || machine.SPR[SPREPC] != 0 {
+		t.Fatalf("unexpected PC %d, cause %#x or EPC %d", machine.PC, machine.SPR[SPRCause],
+			machine.SPR[SPREPC])
+	}
+	if machine.SPR[SPRStatus] != StatusPrevUser|StatusPrevIE || machine.SPR[SPRIE] != 0 {
+		t.Fatalf("unexpected status %#x or IE %d", machine.SPR[SPRStatus], machine.SPR[SPRIE])
+	}
+	for idx := 0; idx < 5; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// RFE restores the mode and the interrupt enable flag
+	if machine.PC != 2 || machine.GPR[2] != 1 {
+		t.Fatalf("unexpected PC %d or r2 %d", machine.PC, machine.GPR[2])
+	}
+	if machine.SPR[SPRStatus]&StatusUser == 0 || machine.SPR[SPRIE] != 1 {
+		t.Fatalf("unexpected status %#x or IE %d", machine.SPR[SPRStatus], machine.SPR[SPRIE])
+	}
+}
+
+func TestExceptionError(t *testing.T) {
+	for _, code := range []uint16{
+		ExceptionTypeNONE | 3,
+		ExceptionTypeRFU3,
+		ExceptionTypeEXCEPTION | ExceptionValueTLBMISS,
+		ExceptionTypeEXCEPTION | ExceptionValueSIGSEGV,
+		ExceptionTypeEXCEPTION | ExceptionValueINVALID,
+		ExceptionTypeEXCEPTION | 15,
+	} {
+		machine := new(VM)
+		machine.PC = 7
+		machine.M[7] = OpcodeJALR<<13 | code
+		err := fetchExecute(machine)
+		var exc *ExceptionError
+		if !errors.As(err, &exc) || exc.Cause != code || exc.PC != 7 || !errors.Is(err, ErrException) {
+			t.Fatalf("%#x: unexpected error %v", code, err)
+		}
+		// without a vector, the VM does not change the registers
+		if machine.SPR[SPRCause] != 0 || machine.SPR[SPREPC] != 0 {
+			t.Fatalf("%#x: the exception was vectored", code)
+		}
+	}
+	err := &ExceptionError{Cause: 0x74, PC: 7}
+	if err.Error() != "vm: exception with ID 116 at 7" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+	machine := new(VM)
+	machine.M[0] = OpcodeJALR<<13 | ExceptionTypeEXCEPTION | ExceptionValueHALT
+	if err := fetchExecute(machine); err != ErrHalted {
+		t.Fatalf("expected ErrHalted, got %v", err)
+	}
+}
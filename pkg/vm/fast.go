@@ -0,0 +1,144 @@
+package vm
+
+// decoded is a pre-decoded instruction. The zero value is
+// the correct decoding of the zero word (`add r0 r0 r0`).
+type decoded struct {
+	word   uint16 // the instruction word, used as the cache tag
+	imm    uint16 // sign-extended imm7, or imm10 shifted for LUI
+	opcode uint8
+	ra     uint8
+	rb     uint8
+	rc     uint8
+}
+
+// icache caches the decoding of each memory word.
+type icache [MemorySize]decoded
+
+// decode decodes the given instruction word.
+func decode(word uint16) decoded {
+	d := decoded{
+		word:   word,
+		imm:    SignExtend7(word & 0b111_1111),
+		opcode: uint8(word >> 13),
+		ra:     uint8((word >> 10) & 0b0111),
+		rb:     uint8((word >> 7) & 0b0111),
+		rc:     uint8(word & 0b0111),
+	}
+	if d.opcode == OpcodeLUI {
+		d.imm = (word & 0b11_1111_1111) << 6
+	}
+	return d
+}
+
+// Step fetches and executes the next instruction, like calling Fetch and
+// then Execute, and returns the error returned by Execute. The resulting
+// machine state is the same, but Step is faster because it keeps an
+// instruction cache containing the decoding of the fetched memory words.
+// Each cache entry is tagged with the word it decodes, so that any memory
+// write (e.g., self-modifying code, a debugger, or Restore) implicitly
+// invalidates it. When observers are registered, Step falls back to
+// calling Fetch and Execute, so that they are notified.
+func (vm *VM) Step() error {
+	_, err := vm.steps(1)
+	return err
+}
+
+// steps executes up to n instructions like Step, stopping after an error
+// or a call to RequestStop, and returns the number of executed instructions
+// and the error. Run uses this function to avoid a function call per step.
+func (vm *VM) steps(n uint64) (uint64, error) {
+	if vm.icache == nil {
+		vm.icache = new(icache)
+	}
+	// when possible, we access the memory directly rather than
+	// using translate, load, and store, which are slower
+	mem := vm.Memory()
+	for count := uint64(1); ; count++ {
+		if len(vm.observers) > 0 {
+			vm.Fetch()
+			if err := vm.Execute(); err != nil || count >= n || vm.stopRequested {
+				return count, err
+			}
+			continue
+		}
+		if vm.SPR[SPRPending] != 0 {
+			vm.maybeInterrupt()
+		}
+		paging := vm.Paging && vm.SPR[SPRStatus]&StatusUser != 0
+		direct := vm.AccessHook == nil && len(vm.devices) == 0
+		addr, fault := vm.PC, uint16(0)
+		if paging {
+			addr, fault = vm.translate(addr, TLBExec)
+		}
+		if fault != 0 {
+			vm.CI = encodeTrap(fault)
+			vm.PC++
+			if err := vm.execute(); err != nil || count >= n || vm.stopRequested {
+				return count, err
+			}
+			continue
+		}
+		if vm.AccessHook != nil {
+			vm.AccessHook(AccessFetch, addr)
+		}
+		d := &vm.icache[addr]
+		if d.word != mem[addr] {
+			*d = decode(mem[addr])
+		}
+		vm.PC++
+		vm.SPR[SPRCycles]++
+		if vm.SPR[SPRTimer] != 0 {
+			vm.tick()
+		}
+		var err error
+		switch d.opcode {
+		case OpcodeADD:
+			vm.GPR[d.ra] = vm.GPR[d.rb] + vm.GPR[d.rc]
+		case OpcodeADDI:
+			vm.GPR[d.ra] = vm.GPR[d.rb] + d.imm
+		case OpcodeNAND:
+			vm.GPR[d.ra] = ^(vm.GPR[d.rb] & vm.GPR[d.rc])
+		case OpcodeLUI:
+			vm.GPR[d.ra] = d.imm
+		case OpcodeSW:
+			addr := vm.GPR[d.rb] + d.imm
+			if !paging && direct {
+				mem[addr] = vm.GPR[d.ra]
+				break
+			}
+			addr, fault := vm.translate(addr, TLBWrite)
+			if fault != 0 {
+				err = vm.trap(fault, vm.PC-1)
+				break
+			}
+			vm.store(addr, vm.GPR[d.ra])
+		case OpcodeLW:
+			addr := vm.GPR[d.rb] + d.imm
+			if !paging && direct {
+				vm.GPR[d.ra] = mem[addr]
+				break
+			}
+			addr, fault := vm.translate(addr, TLBRead)
+			if fault != 0 {
+				err = vm.trap(fault, vm.PC-1)
+				break
+			}
+			vm.GPR[d.ra] = vm.load(addr)
+		case OpcodeBEQ:
+			if vm.GPR[d.ra] == vm.GPR[d.rb] {
+				vm.PC += d.imm
+			}
+		case OpcodeJALR:
+			if vm.GPR[d.ra] == 0 && vm.GPR[d.rb] == 0 {
+				err = vm.exceptionCode(d.imm & 0b111_1111)
+				break
+			}
+			vm.PC, vm.GPR[d.ra] = vm.GPR[d.rb], vm.PC
+		}
+		vm.GPR[0] = 0
+		vm.CI = 0
+		if err != nil || count >= n || vm.stopRequested {
+			return count, err
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// compare compares the state of two VMs.
+func compare(got, expected *VM) error {
+	switch {
+	case got.PC != expected.PC:
+		return fmt.Errorf("PC: expected %d, got %d", expected.PC, got.PC)
+	case got.CI != expected.CI:
+		return fmt.Errorf("CI: expected %#04x, got %#04x", expected.CI, got.CI)
+	case got.GPR != expected.GPR:
+		return fmt.Errorf("GPR: expected %v, got %v", expected.GPR, got.GPR)
+	case got.SPR != expected.SPR:
+		return fmt.Errorf("SPR: expected %v, got %v", expected.SPR, got.SPR)
+	case got.TLB != expected.TLB:
+		return fmt.Errorf("TLB: expected %v, got %v", expected.TLB, got.TLB)
+	}
+	if got.M != expected.M {
+		for addr := range got.M {
+			if got.M[addr] != expected.M[addr] {
+				return fmt.Errorf("M[%d]: expected %d, got %d", addr, expected.M[addr], got.M[addr])
+			}
+		}
+	}
+	return nil
+}
+
+// verify runs a copy of machine using Fetch and Execute and another copy
+// using Step, comparing their states after each instruction, until an
+// error occurs or after n instructions, and returns the copy using Step
+// and the number of executed instructions.
+func verify(t *testing.T, machine *VM, n int) (*VM, int) {
+	reference, fast := new(VM), new(VM)
+	*reference, *fast = *machine, *machine
+	for count := 1; count <= n; count++ {
+		instr := reference.M[reference.PC] // without paging, for diagnostics only
+		expected := fetchExecute(reference)
+		got := fast.Step()
+		if (expected == nil) != (got == nil) || (got != nil && got.Error() != expected.Error()) {
+			t.Fatalf("after %d instructions (%s): expected error %v, got %v",
+				count, Disassemble(instr), expected, got)
+		}
+		if err := compare(fast, reference); err != nil {
+			t.Fatalf("after %d instructions (%s): %s", count, Disassemble(instr), err)
+		}
+		if expected != nil {
+			return fast, count
+		}
+	}
+	return fast, n
+}
+
+// randomMachine returns a machine with random memory and registers. We
+// randomize the special-purpose registers that affect the execution, so
+// that the programs may use paging, interrupts, and exception handlers.
+func randomMachine(rng *rand.Rand) *VM {
+	machine := new(VM)
+	for addr := 0; addr < 1024; addr++ {
+		machine.M[addr] = uint16(rng.Intn(1 << 16))
+	}
+	for reg := 1; reg < NumRegisters; reg++ {
+		machine.GPR[reg] = uint16(rng.Intn(1 << 16))
+	}
+	machine.PC = uint16(rng.Intn(1024))
+	if rng.Intn(2) == 0 {
+		machine.SPR[SPREVEC] = uint16(rng.Intn(1024))
+	}
+	if rng.Intn(2) == 0 {
+		machine.SPR[SPRIE] = 1
+		machine.SPR[SPRTimer] = uint16(rng.Intn(64))
+		machine.SPR[SPRReload] = uint16(rng.Intn(64))
+	}
+	if rng.Intn(4) == 0 {
+		machine.Paging = true
+		machine.SPR[SPRStatus] = StatusUser
+		for idx := range machine.TLB {
+			machine.TLB[idx] = TLBEntry{
+				Hi: uint16(rng.Intn(4)) << PageShift,
+				Lo: uint16(rng.Intn(4))<<PageShift | uint16(rng.Intn(16)),
+			}
+		}
+	}
+	return machine
+}
+
+func TestStepRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	total := 0
+	for idx := 0; idx < 200; idx++ {
+		t.Run(fmt.Sprintf("state #%d", idx), func(t *testing.T) {
+			_, count := verify(t, randomMachine(rng), 1000)
+			total += count
+		})
+	}
+	if total < 10000 {
+		t.Fatalf("only %d instructions executed", total)
+	}
+}
+
+func TestStepSelfModifying(t *testing.T) {
+	machine := new(VM)
+	machine.M[0] = OpcodeADDI<<13 | 3<<10 | 1 // addi r3 r0 1, replaced by the next pass
+	machine.M[1] = OpcodeLW<<13 | 2<<10 | 10  // lw r2 r0 10
+	machine.M[2] = OpcodeSW<<13 | 2<<10 | 0   // sw r2 r0 0
+	machine.M[3] = OpcodeBEQ<<13 | 5<<10 | 1  // beq r5 r0 1, skipping the HALT
+	machine.M[4] = OpcodeJALR<<13 | ExceptionTypeEXCEPTION | ExceptionValueHALT
+	machine.M[5] = OpcodeADDI<<13 | 5<<10 | 1  // addi r5 r0 1
+	machine.M[6] = OpcodeBEQ<<13 | 0x79        // beq r0 r0 -7, back to 0
+	machine.M[10] = OpcodeADDI<<13 | 3<<10 | 5 // addi r3 r0 5
+	fast, count := verify(t, machine, 100)
+	if count != 11 || fast.GPR[3] != 5 {
+		t.Fatalf("expected 11 instructions and r3=5, got %d and r3=%d", count, fast.GPR[3])
+	}
+	// a write made outside of the VM (e.g., by a debugger)
+	// also invalidates the cached decoding
+	machine = new(VM)
+	if err := machine.Step(); err != nil {
+		t.Fatal(err)
+	}
+	machine.PC = 0
+	machine.M[0] = OpcodeADDI<<13 | 1<<10 | 7 // addi r1 r0 7
+	if err := machine.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[1] != 7 {
+		t.Fatalf("expected 7, got %d", machine.GPR[1])
+	}
+}
+
+// countingObserver counts the executed instructions and the memory writes.
+type countingObserver struct {
+	NopObserver
+	instructions int
+	writes       int
+}
+
+// AfterInstruction implements Observer.AfterInstruction.
+func (o *countingObserver) AfterInstruction(pc, instr uint16, err error) {
+	o.instructions++
+}
+
+// MemoryWrite implements Observer.MemoryWrite.
+func (o *countingObserver) MemoryWrite(addr, old, value uint16) {
+	o.writes++
+}
+
+// registers is a Device storing the written values.
+type registers [4]uint16
+
+// Base implements Device.Base.
+func (r *registers) Base() uint16 {
+	return 100
+}
+
+// Size implements Device.Size.
+func (r *registers) Size() uint16 {
+	return uint16(len(r))
+}
+
+// Read implements Device.Read.
+func (r *registers) Read(offset uint16) uint16 {
+	return r[offset]
+}
+
+// Write implements Device.Write.
+func (r *registers) Write(offset uint16, value uint16) {
+	r[offset] = value + 1 // so that we can tell that the device wrote it
+}
+
+// storeLoad returns a machine storing r1 at 100+r2, loading it back into
+// r3, incrementing r2 and looping, until r2 wraps to 4, then halting.
+func storeLoad() *VM {
+	machine := new(VM)
+	machine.M[0] = OpcodeSW<<13 | 1<<10 | 4<<7       // sw r1 r4 0
+	machine.M[1] = OpcodeLW<<13 | 3<<10 | 4<<7       // lw r3 r4 0
+	machine.M[2] = OpcodeADDI<<13 | 4<<10 | 4<<7 | 1 // addi r4 r4 1
+	machine.M[3] = OpcodeADDI<<13 | 1<<10 | 1<<7 | 1 // addi r1 r1 1
+	machine.M[4] = OpcodeBEQ<<13 | 4<<10 | 5<<7 | 1  // beq r4 r5 1
+	machine.M[5] = OpcodeBEQ<<13 | 0x79              // beq r0 r0 -6, back to 0
+	machine.M[6] = OpcodeJALR<<13 | ExceptionTypeEXCEPTION | ExceptionValueHALT
+	machine.GPR[1] = 10
+	machine.GPR[4] = 100
+	machine.GPR[5] = 104
+	return machine
+}
+
+func TestStepFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(machine *VM, dev *registers, o *countingObserver) error
+	}{{
+		name: "observer",
+		setup: func(machine *VM, dev *registers, o *countingObserver) error {
+			machine.AddObserver(o)
+			return nil
+		},
+	}, {
+		name: "device",
+		setup: func(machine *VM, dev *registers, o *countingObserver) error {
+			return machine.Attach(dev)
+		},
+	}, {
+		name: "access hook",
+		setup: func(machine *VM, dev *registers, o *countingObserver) error {
+			machine.AccessHook = func(kind AccessKind, addr uint16) {
+				if kind == AccessWrite {
+					o.writes++
+				}
+			}
+			return nil
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var machines [2]*VM
+			var devs [2]registers
+			var observers [2]countingObserver
+			for idx, step := range []func(*VM) error{fetchExecute, (*VM).Step} {
+				machines[idx] = storeLoad()
+				if err := tt.setup(machines[idx], &devs[idx], &observers[idx]); err != nil {
+					t.Fatal(err)
+				}
+				for {
+					if err := step(machines[idx]); err == ErrHalted {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := compare(machines[1], machines[0]); err != nil {
+				t.Fatal(err)
+			}
+			if devs[1] != devs[0] || observers[1] != observers[0] {
+				t.Fatalf("expected %v %+v, got %v %+v", devs[0], observers[0], devs[1], observers[1])
+			}
+			if observers[0].writes+observers[0].instructions == 0 && devs[0][3] == 0 {
+				t.Fatal("the fallback was not exercised")
+			}
+		})
+	}
+}
+
+// sumProgram returns a machine running an endless loop summing
+// the words of the memory, which we use for benchmarking.
+func sumProgram() *VM {
+	machine := new(VM)
+	machine.M[0] = OpcodeLW<<13 | 2<<10 | 1<<7       // lw r2 r1 0
+	machine.M[1] = OpcodeADD<<13 | 3<<10 | 3<<7 | 2  // add r3 r3 r2
+	machine.M[2] = OpcodeADDI<<13 | 1<<10 | 1<<7 | 1 // addi r1 r1 1
+	machine.M[3] = OpcodeSW<<13 | 3<<10 | 4<<7       // sw r3 r4 0
+	machine.M[4] = OpcodeBEQ<<13 | 0x7b              // beq r0 r0 -5, back to 0
+	machine.GPR[4] = 1000
+	return machine
+}
+
+func BenchmarkExecute(b *testing.B) {
+	machine := sumProgram()
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStep(b *testing.B) {
+	machine := sumProgram()
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if err := machine.Step(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	machine := sumProgram()
+	b.ResetTimer()
+	result := machine.Run(context.Background(), RunOptions{MaxInstructions: uint64(b.N)})
+	if result.Reason != StopInstructionLimit {
+		b.Fatalf("expected StopInstructionLimit, got %s", result.Reason)
+	}
+}
@@ -0,0 +1,56 @@
+package vm
+
+// NumInterrupts is the number of interrupt lines. Each line corresponds
+// to a bit in the SPRPending register.
+const NumInterrupts = 16
+
+// The following constants define the interrupt lines used by the VM.
+const (
+	// InterruptTimer is the interrupt line raised by the timer.
+	InterruptTimer = iota
+
+	// InterruptDisk is the interrupt line raised by the Disk.
+	InterruptDisk
+)
+
+// RaiseInterrupt raises the given interrupt line by setting the
+// corresponding bit of SPRPending. The interrupt remains pending until the
+// program acknowledges it by writing the corresponding bit to SPRPending.
+// Devices should call this function from the goroutine managing the VM.
+// This function panics if line is out of range.
+func (vm *VM) RaiseInterrupt(line uint) {
+	if line >= NumInterrupts {
+		panic("interrupt line out of range")
+	}
+	vm.SPR[SPRPending] |= 1 << line
+}
+
+// ClearInterrupt clears the given interrupt line. This function panics
+// if line is out of range.
+func (vm *VM) ClearInterrupt(line uint) {
+	if line >= NumInterrupts {
+		panic("interrupt line out of range")
+	}
+	vm.SPR[SPRPending] &^= 1 << line
+}
+
+// tick advances the timer by one instruction. When the timer expires,
+// tick raises the timer interrupt and reloads the timer.
+func (vm *VM) tick() {
+	if vm.SPR[SPRTimer] == 0 {
+		return
+	}
+	vm.SPR[SPRTimer]--
+	if vm.SPR[SPRTimer] == 0 {
+		vm.SPR[SPRPending] |= 1 << InterruptTimer
+		vm.SPR[SPRTimer] = vm.SPR[SPRReload]
+	}
+}
+
+// maybeInterrupt vectors to the exception handler if interrupts are
+// enabled, an interrupt is pending, and the exception vector is set.
+func (vm *VM) maybeInterrupt() {
+	if vm.SPR[SPRPending] != 0 && vm.SPR[SPRIE] != 0 && vm.SPR[SPREVEC] != 0 {
+		vm.trap(ExceptionTypeEXCEPTION|ExceptionValueINTERRUPT, vm.PC)
+	}
+}
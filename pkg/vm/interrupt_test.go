@@ -0,0 +1,84 @@
+package vm
+
+import "testing"
+
+func TestTimer(t *testing.T) {
+	// memory contains zeros, which we execute as `add r0 r0 r0`
+	machine := new(VM)
+	machine.SPR[SPRTimer] = 3
+	machine.SPR[SPRReload] = 2
+	var pending []uint16
+	for idx := 0; idx < 7; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, machine.SPR[SPRPending])
+		machine.SPR[SPRPending] = 0
+	}
+	expected := []uint16{0, 0, 1, 0, 1, 0, 1}
+	for idx := range expected {
+		if pending[idx] != expected[idx] {
+			t.Fatalf("expected %v, got %v", expected, pending)
+		}
+	}
+	// a zero reload value configures a one-shot timer
+	machine.SPR[SPRTimer] = 1
+	machine.SPR[SPRReload] = 0
+	for idx := 0; idx < 3; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if machine.SPR[SPRPending] != 1<<InterruptTimer || machine.SPR[SPRTimer] != 0 {
+		t.Fatalf("unexpected pending %#x or timer %d", machine.SPR[SPRPending], machine.SPR[SPRTimer])
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	machine := new(VM)
+	machine.PC = 5
+	machine.M[100] = OpcodeADDI<<13 | 1<<10 | 1 // addi r1 r0 1
+	machine.RaiseInterrupt(3)
+	machine.SPR[SPRIE] = 1
+	// without an exception vector, the interrupt stays pending
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC != 6 || machine.SPR[SPRPending] != 1<<3 {
+		t.Fatalf("unexpected PC %d or pending %#x", machine.PC, machine.SPR[SPRPending])
+	}
+	machine.SPR[SPREVEC] = 100
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	// the VM vectors before fetching, so the handler's first
+	// instruction executes, and the interrupt is still pending
+	if machine.PC != 101 || machine.GPR[1] != 1 || machine.SPR[SPREPC] != 6 ||
+		machine.SPR[SPRCause] != ExceptionTypeEXCEPTION|ExceptionValueINTERRUPT {
+		t.Fatalf("unexpected PC %d, r1 %d, EPC %d or cause %#x", machine.PC, machine.GPR[1],
+			machine.SPR[SPREPC], machine.SPR[SPRCause])
+	}
+	if machine.SPR[SPRIE] != 0 || machine.SPR[SPRPending] != 1<<3 {
+		t.Fatalf("unexpected IE %d or pending %#x", machine.SPR[SPRIE], machine.SPR[SPRPending])
+	}
+	machine.ClearInterrupt(3)
+	if machine.SPR[SPRPending] != 0 {
+		t.Fatalf("unexpected pending %#x", machine.SPR[SPRPending])
+	}
+}
+
+func TestInterruptOutOfRange(t *testing.T) {
+	for name, fn := range map[string]func(vm *VM, line uint){
+		"RaiseInterrupt": (*VM).RaiseInterrupt,
+		"ClearInterrupt": (*VM).ClearInterrupt,
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: expected a panic", name)
+				}
+			}()
+			fn(new(VM), NumInterrupts)
+		}()
+	}
+}
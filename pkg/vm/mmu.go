@@ -0,0 +1,101 @@
+package vm
+
+// The following constants define the paged virtual memory. Paging only
+// applies in user mode (see StatusUser) when vm.Paging is true. In kernel
+// mode, the VM always uses physical addresses.
+const (
+	PageShift     = 8
+	PageSize      = 1 << PageShift
+	NumTLBEntries = 8
+)
+
+// The following constants define the flags of a TLB entry, which are
+// stored in the least significant bits of TLBEntry.Lo.
+const (
+	TLBValid = 1 << iota
+	TLBRead
+	TLBWrite
+	TLBExec
+)
+
+// TLBEntry is an entry of the software-managed TLB. The most significant
+// byte of Hi contains the virtual page number. The most significant byte
+// of Lo contains the physical page number, while its least significant
+// byte contains the TLB* flags.
+//
+// The kernel loads an entry by writing its index into SPRTLBIndex, the
+// virtual page number into SPRTLBHi, and finally the physical page number
+// and flags into SPRTLBLo, which stores the entry into the TLB. Writing
+// into SPRTLBIndex also loads the selected entry into SPRTLBHi and SPRTLBLo.
+//
+// When the translation fails, the VM raises an exception whose cause is
+// ExceptionTypeEXCEPTION|ExceptionValueTLBMISS, if there is no valid entry
+// for the page, or ExceptionTypeEXCEPTION|ExceptionValueSIGSEGV, if the
+// entry does not allow the access. In both cases, SPRBadVAddr contains the
+// faulting address and SPRTLBHi contains its virtual page number.
+type TLBEntry struct {
+	Hi uint16
+	Lo uint16
+}
+
+// translate translates the virtual address vaddr for an access of the given
+// kind (i.e., TLBRead, TLBWrite, or TLBExec) and returns the physical address.
+// On failure, it returns a nonzero exception code describing the fault.
+func (vm *VM) translate(vaddr uint16, kind uint16) (uint16, uint16) {
+	if !vm.Paging || vm.SPR[SPRStatus]&StatusUser == 0 {
+		return vaddr, 0
+	}
+	vpn := vaddr >> PageShift
+	for _, entry := range vm.TLB {
+		if entry.Lo&TLBValid == 0 || entry.Hi>>PageShift != vpn {
+			continue
+		}
+		if entry.Lo&kind == 0 {
+			return 0, vm.fault(vaddr, ExceptionValueSIGSEGV)
+		}
+		return entry.Lo&^(PageSize-1) | vaddr&(PageSize-1), 0
+	}
+	return 0, vm.fault(vaddr, ExceptionValueTLBMISS)
+}
+
+// Translate translates the virtual address vaddr for an access of the
+// given kind (i.e., TLBRead, TLBWrite, or TLBExec) like LW and SW do, and
+// returns the physical address. Addresses are only translated in user
+// mode when Paging is true. On failure, Translate returns a nonzero
+// exception code describing the fault and sets SPRBadVAddr and SPRTLBHi
+// (see TLBEntry). System call handlers should translate the addresses
+// they receive from the program, and use RaiseException on failure.
+func (vm *VM) Translate(vaddr, kind uint16) (uint16, uint16) {
+	return vm.translate(vaddr, kind)
+}
+
+// fault records the faulting address and returns the exception code
+// corresponding to the given exception value.
+func (vm *VM) fault(vaddr uint16, value uint16) uint16 {
+	vm.SPR[SPRBadVAddr] = vaddr
+	vm.SPR[SPRTLBHi] = vaddr &^ (PageSize - 1)
+	return ExceptionTypeEXCEPTION | value
+}
+
+// selectTLBEntry implements writing into SPRTLBIndex.
+func (vm *VM) selectTLBEntry(value uint16) {
+	vm.SPR[SPRTLBIndex] = value % NumTLBEntries
+	entry := vm.TLB[vm.SPR[SPRTLBIndex]]
+	vm.SPR[SPRTLBHi] = entry.Hi
+	vm.SPR[SPRTLBLo] = entry.Lo
+}
+
+// storeTLBEntry implements writing into SPRTLBLo.
+func (vm *VM) storeTLBEntry(value uint16) {
+	vm.SPR[SPRTLBLo] = value
+	vm.TLB[vm.SPR[SPRTLBIndex]%NumTLBEntries] = TLBEntry{
+		Hi: vm.SPR[SPRTLBHi],
+		Lo: value,
+	}
+}
+
+// encodeTrap returns the instruction raising the exception with the
+// given code (i.e., `jalr r0 r0 code`).
+func encodeTrap(code uint16) uint16 {
+	return OpcodeJALR<<13 | code&0b111_1111
+}
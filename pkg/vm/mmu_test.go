@@ -0,0 +1,170 @@
+package vm
+
+import "testing"
+
+func TestTLBRegisters(t *testing.T) {
+	machine := new(VM)
+	machine.M[0] = OpcodeADDI<<13 | 1<<10 | 10 // addi r1 r0 10, selecting entry 2
+	machine.M[1] = encodeTrap(ExceptionTypeMTSPR | SPRTLBIndex)
+	machine.M[2] = OpcodeLUI<<13 | 1<<10 | 12 // lui r1 12, i.e., 0x300
+	machine.M[3] = encodeTrap(ExceptionTypeMTSPR | SPRTLBHi)
+	machine.M[4] = OpcodeLUI<<13 | 1<<10 | 20        // lui r1 20, i.e., 0x500
+	machine.M[5] = OpcodeADDI<<13 | 1<<10 | 1<<7 | 7 // addi r1 r1 7
+	machine.M[6] = encodeTrap(ExceptionTypeMTSPR | SPRTLBLo)
+	machine.M[7] = OpcodeADDI<<13 | 1<<10 | 2 // addi r1 r0 2
+	machine.M[8] = encodeTrap(ExceptionTypeMTSPR | SPRTLBIndex)
+	for idx := 0; idx < 7; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := TLBEntry{Hi: 0x300, Lo: 0x500 | TLBValid | TLBRead | TLBWrite}
+	if machine.TLB[2] != expected || machine.SPR[SPRTLBIndex] != 2 {
+		t.Fatalf("expected %+v at 2, got %+v at %d", expected, machine.TLB[2], machine.SPR[SPRTLBIndex])
+	}
+	// selecting an entry loads it into the registers
+	machine.SPR[SPRTLBHi], machine.SPR[SPRTLBLo] = 0, 0
+	for idx := 0; idx < 2; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if machine.SPR[SPRTLBHi] != expected.Hi || machine.SPR[SPRTLBLo] != expected.Lo {
+		t.Fatalf("unexpected registers %#04x %#04x", machine.SPR[SPRTLBHi], machine.SPR[SPRTLBLo])
+	}
+}
+
+// newPagedMachine returns a machine in user mode mapping virtual page 0
+// to physical page 1 for execution and virtual page 3 to physical page 5
+// for reading and writing, with r3 pointing to virtual page 3.
+func newPagedMachine() *VM {
+	machine := new(VM)
+	machine.Paging = true
+	machine.SPR[SPRStatus] = StatusUser
+	machine.TLB[0] = TLBEntry{Hi: 0x000, Lo: 0x100 | TLBValid | TLBExec}
+	machine.TLB[5] = TLBEntry{Hi: 0x300, Lo: 0x500 | TLBValid | TLBRead | TLBWrite}
+	machine.GPR[3] = 0x300
+	return machine
+}
+
+func TestPaging(t *testing.T) {
+	machine := newPagedMachine()
+	machine.M[0x100] = OpcodeLW<<13 | 2<<10 | 3<<7 | 1 // lw r2 r3 1
+	machine.M[0x101] = OpcodeSW<<13 | 2<<10 | 3<<7 | 2 // sw r2 r3 2
+	machine.M[0x501] = 42
+	for idx := 0; idx < 2; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if machine.GPR[2] != 42 || machine.M[0x502] != 42 || machine.M[0x302] != 0 {
+		t.Fatalf("unexpected r2 %d or memory %d %d", machine.GPR[2], machine.M[0x502], machine.M[0x302])
+	}
+	// in kernel mode, the VM uses physical addresses
+	machine.SPR[SPRStatus] = 0
+	machine.PC = 0x100
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[2] != 0 || machine.PC != 0x101 {
+		t.Fatalf("unexpected r2 %d or PC %#04x", machine.GPR[2], machine.PC)
+	}
+}
+
+func TestPagingFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		instr    uint16
+		pc       uint16
+		cause    uint16
+		badVAddr uint16
+	}{{
+		name:     "write to an execute only page",
+		instr:    OpcodeSW<<13 | 2<<10 | 5, // sw r2 r0 5
+		cause:    ExceptionTypeEXCEPTION | ExceptionValueSIGSEGV,
+		badVAddr: 5,
+	}, {
+		name:     "read from an unmapped page",
+		instr:    OpcodeLW<<13 | 2<<10 | 3<<7 | 0x40, // lw r2 r3 -64
+		cause:    ExceptionTypeEXCEPTION | ExceptionValueTLBMISS,
+		badVAddr: 0x2c0,
+	}, {
+		name:     "fetch from a page without execute permission",
+		pc:       0x310,
+		cause:    ExceptionTypeEXCEPTION | ExceptionValueSIGSEGV,
+		badVAddr: 0x310,
+	}} {
+		machine := newPagedMachine()
+		machine.PC = tc.pc
+		machine.M[0x100] = tc.instr
+		machine.SPR[SPREVEC] = 200
+		if err := fetchExecute(machine); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if machine.PC != 200 || machine.SPR[SPRCause] != tc.cause || machine.SPR[SPREPC] != tc.pc {
+			t.Fatalf("%s: unexpected PC %d, cause %#x or EPC %d", tc.name, machine.PC,
+				machine.SPR[SPRCause], machine.SPR[SPREPC])
+		}
+		if machine.SPR[SPRBadVAddr] != tc.badVAddr || machine.SPR[SPRTLBHi] != tc.badVAddr&^0xff {
+			t.Fatalf("%s: unexpected badvaddr %#04x or tlbhi %#04x", tc.name,
+				machine.SPR[SPRBadVAddr], machine.SPR[SPRTLBHi])
+		}
+	}
+}
+
+func TestPrivileged(t *testing.T) {
+	for _, code := range []uint16{
+		ExceptionTypeMFSPR | SPRCycles,
+		ExceptionTypeMTSPR | SPRScratch,
+		ExceptionTypeEXCEPTION | ExceptionValueHALT,
+		ExceptionTypeEXCEPTION | ExceptionValueRFE,
+	} {
+		machine := new(VM)
+		machine.SPR[SPRStatus] = StatusUser
+		machine.SPR[SPREVEC] = 200
+		machine.GPR[1] = 7
+		machine.M[0] = encodeTrap(code)
+		if err := fetchExecute(machine); err != nil {
+			t.Fatalf("%#x: %s", code, err)
+		}
+		if machine.SPR[SPRCause] != ExceptionTypeEXCEPTION|ExceptionValueINVALID || machine.PC != 200 {
+			t.Fatalf("%#x: expected an INVALID exception, got %#x", code, machine.SPR[SPRCause])
+		}
+		if machine.GPR[1] != 7 || machine.SPR[SPRScratch] != 0 {
+			t.Fatalf("%#x: the instruction was executed", code)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	machine := newPagedMachine()
+	if addr, fault := machine.Translate(0x3ab, TLBWrite); fault != 0 || addr != 0x5ab {
+		t.Fatalf("unexpected address %#04x or fault %#x", addr, fault)
+	}
+	cause := uint16(ExceptionTypeEXCEPTION | ExceptionValueSIGSEGV)
+	if _, fault := machine.Translate(0x3ab, TLBExec); fault != cause || machine.SPR[SPRBadVAddr] != 0x3ab {
+		t.Fatalf("unexpected fault %#x or bad address %#04x", fault, machine.SPR[SPRBadVAddr])
+	}
+	// a system call handler reports faults by raising an exception
+	machine.RegisterSyscall(1, func(machine *VM) error {
+		if _, fault := machine.Translate(machine.GPR[1], TLBRead); fault != 0 {
+			return machine.RaiseException(cause)
+		}
+		machine.GPR[1] = 0
+		return nil
+	})
+	machine.M[0x100] = encodeTrap(ExceptionTypeSYSCALL | 1)
+	machine.GPR[1] = 0x7ff
+	machine.SPR[SPREVEC] = 200
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC != 200 || machine.SPR[SPRCause] != cause || machine.SPR[SPREPC] != 0 || machine.GPR[1] != 0x7ff {
+		t.Fatalf("unexpected PC %d, cause %#x, EPC %d or r1 %#04x", machine.PC,
+			machine.SPR[SPRCause], machine.SPR[SPREPC], machine.GPR[1])
+	}
+	// in kernel mode, the addresses are physical
+	if addr, fault := machine.Translate(0x7ff, TLBRead); fault != 0 || addr != 0x7ff {
+		t.Fatalf("unexpected address %#04x or fault %#x", addr, fault)
+	}
+}
@@ -0,0 +1,141 @@
+package vm
+
+// Observer observes the execution of a VM. Register an observer using
+// AddObserver. The VM calls the observer's methods synchronously, from
+// the goroutine executing the VM, so they should return quickly. An
+// observer may inspect the VM but should not modify it. Embed NopObserver
+// to implement only the methods you are interested in.
+type Observer interface {
+	// BeforeInstruction is called by Execute before executing
+	// the instruction instr located at pc.
+	BeforeInstruction(pc, instr uint16)
+
+	// AfterInstruction is called by Execute after executing the
+	// instruction instr located at pc, with the error returned
+	// by Execute, if any.
+	AfterInstruction(pc, instr uint16, err error)
+
+	// MemoryRead is called when LW reads value from the given
+	// physical address, which may belong to a device.
+	MemoryRead(addr, value uint16)
+
+	// MemoryWrite is called when SW writes value to the given
+	// physical address, or when a device writes the memory using
+	// DMA (see StoreMemory). Because reading a device register may
+	// have side effects, old is zero for devices. Implement the
+	// DeviceObserver interface to distinguish the writes to device
+	// registers from the writes to the memory.
+	MemoryWrite(addr, old, value uint16)
+
+	// RegisterWrite is called after an instruction (or a system
+	// call handler) has changed the value of a general purpose
+	// register. Writes not changing the value are not reported.
+	RegisterWrite(reg, old, value uint16)
+
+	// Exception is called when the VM raises an exception with the
+	// given cause for the instruction at epc, including interrupts
+	// and exceptions that stop the VM because SPREVEC is zero. Since
+	// Fetch takes interrupts, the VM notifies them between the
+	// AfterInstruction and BeforeInstruction calls.
+	Exception(cause, epc uint16)
+}
+
+// DeviceObserver is an Observer that distinguishes the writes to device
+// registers from the writes to the memory. For observers implementing this
+// interface, the VM calls DeviceWrite, rather than MemoryWrite, when SW
+// writes to a device register. The VM keeps calling MemoryWrite for the
+// writes to the memory, including the DMA writes made using StoreMemory,
+// which write the memory even at the addresses mapped by a device.
+type DeviceObserver interface {
+	Observer
+
+	// DeviceWrite is called when SW writes value to the register of
+	// the device mapped at the given physical address.
+	DeviceWrite(addr, value uint16)
+}
+
+// NopObserver is an Observer whose methods do nothing.
+type NopObserver struct{}
+
+// BeforeInstruction implements Observer.BeforeInstruction.
+func (NopObserver) BeforeInstruction(pc, instr uint16) {}
+
+// AfterInstruction implements Observer.AfterInstruction.
+func (NopObserver) AfterInstruction(pc, instr uint16, err error) {}
+
+// MemoryRead implements Observer.MemoryRead.
+func (NopObserver) MemoryRead(addr, value uint16) {}
+
+// MemoryWrite implements Observer.MemoryWrite.
+func (NopObserver) MemoryWrite(addr, old, value uint16) {}
+
+// RegisterWrite implements Observer.RegisterWrite.
+func (NopObserver) RegisterWrite(reg, old, value uint16) {}
+
+// Exception implements Observer.Exception.
+func (NopObserver) Exception(cause, epc uint16) {}
+
+var _ Observer = NopObserver{}
+
+// AddObserver registers an observer. Observers are called in the
+// order in which they have been registered.
+func (vm *VM) AddObserver(o Observer) {
+	vm.observers = append(vm.observers, o)
+}
+
+// RemoveObserver unregisters a previously registered observer, which
+// must be comparable using == (e.g., a pointer).
+func (vm *VM) RemoveObserver(o Observer) {
+	for idx, other := range vm.observers {
+		if other == o {
+			vm.observers = append(vm.observers[:idx:idx], vm.observers[idx+1:]...)
+			return
+		}
+	}
+}
+
+// executeObserved is like execute but notifies the observers.
+func (vm *VM) executeObserved() error {
+	pc, instr, gpr := vm.PC-1, vm.CI, vm.GPR
+	for _, o := range vm.observers {
+		o.BeforeInstruction(pc, instr)
+	}
+	err := vm.execute()
+	for reg := 1; reg < NumRegisters; reg++ {
+		if vm.GPR[reg] != gpr[reg] {
+			for _, o := range vm.observers {
+				o.RegisterWrite(uint16(reg), gpr[reg], vm.GPR[reg])
+			}
+		}
+	}
+	for _, o := range vm.observers {
+		o.AfterInstruction(pc, instr, err)
+	}
+	return err
+}
+
+// notifyMemoryRead notifies the observers about a memory read.
+func (vm *VM) notifyMemoryRead(addr, value uint16) {
+	for _, o := range vm.observers {
+		o.MemoryRead(addr, value)
+	}
+}
+
+// notifyMemoryWrite notifies the observers about a memory write, where
+// device indicates whether the write targets a device register.
+func (vm *VM) notifyMemoryWrite(addr, old, value uint16, device bool) {
+	for _, o := range vm.observers {
+		if do, ok := o.(DeviceObserver); ok && device {
+			do.DeviceWrite(addr, value)
+			continue
+		}
+		o.MemoryWrite(addr, old, value)
+	}
+}
+
+// notifyException notifies the observers about an exception.
+func (vm *VM) notifyException(cause, epc uint16) {
+	for _, o := range vm.observers {
+		o.Exception(cause, epc)
+	}
+}
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// eventsObserver records the notifications as strings.
+type eventsObserver struct {
+	events []string
+}
+
+// BeforeInstruction implements Observer.BeforeInstruction.
+func (o *eventsObserver) BeforeInstruction(pc, instr uint16) {
+	o.events = append(o.events, fmt.Sprintf("before %d", pc))
+}
+
+// AfterInstruction implements Observer.AfterInstruction.
+func (o *eventsObserver) AfterInstruction(pc, instr uint16, err error) {
+	o.events = append(o.events, fmt.Sprintf("after %d %v", pc, err))
+}
+
+// MemoryRead implements Observer.MemoryRead.
+func (o *eventsObserver) MemoryRead(addr, value uint16) {
+	o.events = append(o.events, fmt.Sprintf("read %d %d", addr, value))
+}
+
+// MemoryWrite implements Observer.MemoryWrite.
+func (o *eventsObserver) MemoryWrite(addr, old, value uint16) {
+	o.events = append(o.events, fmt.Sprintf("write %d %d %d", addr, old, value))
+}
+
+// RegisterWrite implements Observer.RegisterWrite.
+func (o *eventsObserver) RegisterWrite(reg, old, value uint16) {
+	o.events = append(o.events, fmt.Sprintf("r%d %d %d", reg, old, value))
+}
+
+// Exception implements Observer.Exception.
+func (o *eventsObserver) Exception(cause, epc uint16) {
+	o.events = append(o.events, fmt.Sprintf("exception %#x %d", cause, epc))
+}
+
+func TestObserver(t *testing.T) {
+	machine := new(VM)
+	machine.M[0] = OpcodeADDI<<13 | 1<<10 | 5        // addi r1 r0 5
+	machine.M[1] = OpcodeSW<<13 | 1<<10 | 10         // sw r1 r0 10
+	machine.M[2] = OpcodeLW<<13 | 2<<10 | 10         // lw r2 r0 10
+	machine.M[3] = OpcodeADDI<<13 | 2<<10 | 1<<7 | 0 // addi r2 r1 0, not changing r2
+	machine.M[4] = encodeTrap(ExceptionTypeRFU2)
+	machine.M[10] = 3
+	first, second := &eventsObserver{}, &eventsObserver{}
+	machine.AddObserver(first)
+	machine.AddObserver(second)
+	for idx := 0; idx < 5; idx++ {
+		fetchExecute(machine)
+	}
+	expected := []string{
+		"before 0", "r1 0 5", "after 0 <nil>",
+		"before 1", "write 10 3 5", "after 1 <nil>",
+		"before 2", "read 10 5", "r2 0 5", "after 2 <nil>",
+		"before 3", "after 3 <nil>",
+		"before 4", "exception 0x50 4", "after 4 vm: exception with ID 80 at 4",
+	}
+	if !reflect.DeepEqual(first.events, expected) || !reflect.DeepEqual(second.events, expected) {
+		t.Fatalf("expected %q, got %q and %q", expected, first.events, second.events)
+	}
+	machine.RemoveObserver(first)
+	machine.RemoveObserver(first) // not registered anymore
+	machine.PC = 0
+	fetchExecute(machine)
+	if len(first.events) != len(expected) || len(second.events) != len(expected)+2 {
+		t.Fatalf("unexpected events %q and %q", first.events, second.events)
+	}
+}
+
+func TestObserverInterrupt(t *testing.T) {
+	// the VM notifies interrupts between two instructions
+	machine := new(VM)
+	machine.SPR[SPREVEC] = 100
+	machine.SPR[SPRIE] = 1
+	observer := &eventsObserver{}
+	machine.AddObserver(observer)
+	fetchExecute(machine)
+	machine.RaiseInterrupt(InterruptTimer)
+	fetchExecute(machine)
+	expected := []string{
+		"before 0", "after 0 <nil>",
+		"exception 0x76 1", "before 100", "after 100 <nil>",
+	}
+	if !reflect.DeepEqual(observer.events, expected) {
+		t.Fatalf("expected %q, got %q", expected, observer.events)
+	}
+}
+
+// deviceObserver is an eventsObserver implementing DeviceObserver.
+type deviceObserver struct {
+	eventsObserver
+}
+
+// DeviceWrite implements DeviceObserver.DeviceWrite.
+func (o *deviceObserver) DeviceWrite(addr, value uint16) {
+	o.events = append(o.events, fmt.Sprintf("device %d %d", addr, value))
+}
+
+func TestDeviceObserver(t *testing.T) {
+	machine := new(VM)
+	if err := machine.Attach(&latch{base: 100}); err != nil {
+		t.Fatal(err)
+	}
+	machine.M[100] = 7
+	plain, device := &eventsObserver{}, &deviceObserver{}
+	machine.AddObserver(plain)
+	machine.AddObserver(device)
+	machine.Store(100, 1)
+	machine.StoreMemory(100, 2) // DMA writes the memory under the device
+	expected := []string{"write 100 0 1", "write 100 7 2"}
+	if !reflect.DeepEqual(plain.events, expected) {
+		t.Fatalf("expected %q, got %q", expected, plain.events)
+	}
+	expected = []string{"device 100 1", "write 100 7 2"}
+	if !reflect.DeepEqual(device.events, expected) {
+		t.Fatalf("expected %q, got %q", expected, device.events)
+	}
+}
@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StopReason explains why Run stopped.
+type StopReason int
+
+// The following constants define the reasons why Run stops.
+const (
+	// StopHalted indicates that the program executed HALT.
+	StopHalted = StopReason(iota)
+
+	// StopInstructionLimit indicates that the program executed
+	// RunOptions.MaxInstructions instructions without halting.
+	StopInstructionLimit
+
+	// StopTimeLimit indicates that RunOptions.Timeout expired.
+	StopTimeLimit
+
+	// StopCanceled indicates that the context was canceled.
+	StopCanceled
+
+	// StopException indicates that an exception occurred while the
+	// exception vector was not set. See ExceptionError.
+	StopException
+
+	// StopError indicates any other error (e.g., an error
+	// returned by a system call handler).
+	StopError
+
+	// StopRequested indicates that RequestStop was called.
+	StopRequested
+)
+
+// stopReasonNames contains the name of each StopReason.
+var stopReasonNames = []string{
+	"halted", "instruction limit", "time limit", "canceled", "exception", "error",
+	"requested",
+}
+
+// String returns the name of the reason.
+func (r StopReason) String() string {
+	if r < 0 || int(r) >= len(stopReasonNames) {
+		return fmt.Sprintf("StopReason(%d)", int(r))
+	}
+	return stopReasonNames[r]
+}
+
+// The following errors indicate that Run stopped before the program ended.
+var (
+	ErrInstructionLimit = errors.New("vm: instruction limit reached")
+	ErrTimeLimit        = errors.New("vm: time limit reached")
+	ErrStopRequested    = errors.New("vm: stop requested")
+)
+
+// RunOptions contains options for Run. The zero value means
+// running until the program halts or an error occurs.
+type RunOptions struct {
+	// MaxInstructions is the maximum number of instructions to
+	// execute. Zero means that there is no limit.
+	MaxInstructions uint64
+
+	// Timeout is the maximum wall-clock duration of the
+	// run. Zero means that there is no limit.
+	Timeout time.Duration
+
+	// Step, if not nil, executes a single instruction in place of
+	// calling the VM's Step method (e.g., to trace the execution). It
+	// should return the error returned by Execute.
+	Step func() error
+}
+
+// RunResult is the result of Run.
+type RunResult struct {
+	Reason       StopReason // why Run stopped
+	Err          error      // error describing the reason (e.g., ErrHalted)
+	Instructions uint64     // number of instructions executed by Run
+	PC           uint16     // address of the faulting instruction for StopException
+	Cause        uint16     // exception code for StopException
+}
+
+// runCheckInterval is the number of instructions after which Run checks
+// whether the context is done and whether the timeout has expired.
+const runCheckInterval = 1024
+
+// Run executes instructions until the program halts, an error occurs, ctx
+// is done, or a limit in opts is reached. We check ctx and the timeout every
+// few instructions, so Run may execute some more instructions after they
+// expire. After Run returns, you can call Run again to resume execution.
+func (vm *VM) Run(ctx context.Context, opts RunOptions) RunResult {
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+	var result RunResult
+	vm.stopRequested = false // ignore requests made outside of Run
+	for {
+		if result.Instructions%runCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				result.Reason, result.Err = StopCanceled, err
+				break
+			}
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				result.Reason, result.Err = StopTimeLimit, ErrTimeLimit
+				break
+			}
+		}
+		if opts.MaxInstructions > 0 && result.Instructions >= opts.MaxInstructions {
+			result.Reason, result.Err = StopInstructionLimit, ErrInstructionLimit
+			break
+		}
+		var err error
+		if opts.Step != nil {
+			err = opts.Step()
+			result.Instructions++
+		} else {
+			// run until the next check without returning to this loop
+			n := runCheckInterval - result.Instructions%runCheckInterval
+			if opts.MaxInstructions > 0 && opts.MaxInstructions-result.Instructions < n {
+				n = opts.MaxInstructions - result.Instructions
+			}
+			var count uint64
+			count, err = vm.steps(n)
+			result.Instructions += count
+		}
+		if err == nil && vm.stopRequested {
+			err = ErrStopRequested
+		}
+		vm.stopRequested = false
+		if err == nil {
+			continue
+		}
+		result.Err = err
+		var exception *ExceptionError
+		switch {
+		case errors.Is(err, ErrHalted):
+			result.Reason = StopHalted
+		case errors.As(err, &exception):
+			result.Reason = StopException
+			result.PC, result.Cause = exception.PC, exception.Cause
+		case err == ErrStopRequested:
+			result.Reason = StopRequested
+		default:
+			result.Reason = StopError
+		}
+		break
+	}
+	if result.Reason != StopException {
+		result.PC = vm.PC
+	}
+	return result
+}
+
+// RequestStop asks Run to stop after executing the current instruction
+// (e.g., from an Observer, when a watchpoint triggers).
+func (vm *VM) RequestStop() {
+	vm.stopRequested = true
+}
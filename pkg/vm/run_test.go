@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newLoopMachine returns a machine looping forever at address 0.
+func newLoopMachine() *VM {
+	machine := new(VM)
+	machine.M[0] = OpcodeBEQ<<13 | 0x7f // beq r0 r0 -1
+	return machine
+}
+
+func TestRunInstructionLimit(t *testing.T) {
+	machine := newLoopMachine()
+	for _, limit := range []uint64{1, runCheckInterval, 3*runCheckInterval + 7} {
+		result := machine.Run(context.Background(), RunOptions{MaxInstructions: limit})
+		if result.Reason != StopInstructionLimit || result.Err != ErrInstructionLimit ||
+			result.Instructions != limit || result.PC != 0 {
+			t.Fatalf("limit %d: unexpected result %+v", limit, result)
+		}
+	}
+	if cycles := machine.SPR[SPRCycles]; cycles != 4*runCheckInterval+8 {
+		t.Fatalf("expected %d cycles, got %d", 4*runCheckInterval+8, cycles)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	machine := newLoopMachine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result := machine.Run(ctx, RunOptions{})
+	if result.Reason != StopCanceled || !errors.Is(result.Err, context.Canceled) ||
+		result.Instructions != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	result = machine.Run(context.Background(), RunOptions{Timeout: time.Millisecond})
+	if result.Reason != StopTimeLimit || result.Err != ErrTimeLimit ||
+		result.Instructions%runCheckInterval != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	machine := new(VM)
+	failure := errors.New("mocked error")
+	machine.RegisterSyscall(1, func(vm *VM) error {
+		return failure
+	})
+	machine.M[0] = encodeTrap(ExceptionTypeSYSCALL | 1)
+	machine.M[1] = encodeTrap(ExceptionTypeEXCEPTION | ExceptionValueINVALID)
+	machine.M[2] = encodeTrap(ExceptionTypeEXCEPTION | ExceptionValueHALT)
+	for _, expected := range []RunResult{
+		{Reason: StopError, Err: failure, Instructions: 1, PC: 1},
+		{Reason: StopException, Instructions: 1, PC: 1,
+			Cause: ExceptionTypeEXCEPTION | ExceptionValueINVALID},
+		{Reason: StopHalted, Err: ErrHalted, Instructions: 1, PC: 3},
+	} {
+		result := machine.Run(context.Background(), RunOptions{})
+		if expected.Reason == StopException {
+			expected.Err = result.Err // checked below
+			if !errors.Is(result.Err, ErrException) {
+				t.Fatalf("expected an exception, got %v", result.Err)
+			}
+			machine.PC = 2 // skip the faulting instruction
+		}
+		if result != expected {
+			t.Fatalf("expected %+v, got %+v", expected, result)
+		}
+	}
+}
+
+func TestRunStep(t *testing.T) {
+	machine := newLoopMachine()
+	var count int
+	result := machine.Run(context.Background(), RunOptions{
+		MaxInstructions: 10,
+		Step: func() error {
+			count++
+			return fetchExecute(machine)
+		},
+	})
+	if result.Reason != StopInstructionLimit || result.Instructions != 10 || count != 10 {
+		t.Fatalf("unexpected result %+v after %d steps", result, count)
+	}
+}
+
+func TestStopReasonString(t *testing.T) {
+	if s := StopTimeLimit.String(); s != "time limit" {
+		t.Fatalf("expected time limit, got %s", s)
+	}
+	if s := StopReason(-1).String(); s != "StopReason(-1)" {
+		t.Fatalf("expected StopReason(-1), got %s", s)
+	}
+}
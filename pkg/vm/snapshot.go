@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// SnapshotMagic is the magic string at the beginning of a snapshot.
+const SnapshotMagic = "R16S"
+
+// SnapshotVersion is the version of the snapshot format. A snapshot
+// starts with SnapshotMagic and with the version byte, followed by a
+// gzip stream containing, in little endian order:
+//
+//  1. the PC, the CI, the GPR, the SPR, and the TLB (uint16 each);
+//  2. a flags byte, where bit 0 indicates that paging is enabled;
+//  3. the nonzero memory runs, each consisting of the start address
+//     (uint16), the number of words (uint32), and the words, terminated
+//     by a run with zero words;
+//  4. the number of device states (uint16) followed by, for each
+//     device, its base address (uint16), the length of its state
+//     (uint32), and the state.
+const SnapshotVersion = 1
+
+// StatefulDevice is a Device whose state is saved into snapshots. Devices
+// without state, or whose state is not meaningful across runs (e.g.,
+// the Console), do not need to implement this interface.
+type StatefulDevice interface {
+	Device
+
+	// SaveState returns the device state.
+	SaveState() ([]byte, error)
+
+	// RestoreState restores the state returned by SaveState.
+	RestoreState(state []byte) error
+}
+
+// ErrInvalidSnapshot indicates that a snapshot is malformed or that it
+// cannot be restored (e.g., because a device is not attached).
+var ErrInvalidSnapshot = errors.New("vm: invalid snapshot")
+
+// maxDeviceState is the maximum size of a device state in a snapshot.
+const maxDeviceState = 1 << 20
+
+// snapshotRegisters contains the fixed-size part of a snapshot.
+type snapshotRegisters struct {
+	PC    uint16
+	CI    uint16
+	GPR   [NumRegisters]uint16
+	SPR   [NumSPRs]uint16
+	TLB   [NumTLBEntries]TLBEntry
+	Flags uint8
+}
+
+// snapshotFlagPaging indicates that paging is enabled.
+const snapshotFlagPaging = 1
+
+// Save writes a snapshot of the complete machine state, including the
+// state of the attached devices implementing StatefulDevice, to w. Save
+// does not save the observers, the hooks, and the system call handlers.
+func (vm *VM) Save(w io.Writer) error {
+	if _, err := io.WriteString(w, SnapshotMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{SnapshotVersion}); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	regs := snapshotRegisters{PC: vm.PC, CI: vm.CI, GPR: vm.GPR, SPR: vm.SPR, TLB: vm.TLB}
+	if vm.Paging {
+		regs.Flags |= snapshotFlagPaging
+	}
+	binary.Write(bw, binary.LittleEndian, &regs)
+	mem := vm.Memory()
+	for addr := 0; addr < MemorySize; {
+		if mem[addr] == 0 {
+			addr++
+			continue
+		}
+		end := addr
+		for end < MemorySize && mem[end] != 0 {
+			end++
+		}
+		binary.Write(bw, binary.LittleEndian, uint16(addr))
+		binary.Write(bw, binary.LittleEndian, uint32(end-addr))
+		binary.Write(bw, binary.LittleEndian, mem[addr:end])
+		addr = end
+	}
+	binary.Write(bw, binary.LittleEndian, uint16(0))
+	binary.Write(bw, binary.LittleEndian, uint32(0))
+	var states [][]byte
+	var bases []uint16
+	for _, dev := range vm.devices {
+		if stateful, ok := dev.(StatefulDevice); ok {
+			state, err := stateful.SaveState()
+			if err != nil {
+				return err
+			}
+			states = append(states, state)
+			bases = append(bases, dev.Base())
+		}
+	}
+	binary.Write(bw, binary.LittleEndian, uint16(len(states)))
+	for idx, state := range states {
+		binary.Write(bw, binary.LittleEndian, bases[idx])
+		binary.Write(bw, binary.LittleEndian, uint32(len(state)))
+		bw.Write(state)
+	}
+	if err := bw.Flush(); err != nil { // returns the first write error
+		return err
+	}
+	return zw.Close()
+}
+
+// Restore restores the machine state from a snapshot written by Save. The
+// devices whose state has been saved must already be attached at the same
+// base addresses. On failure, the machine state is unspecified.
+func (vm *VM) Restore(r io.Reader) error {
+	var header [len(SnapshotMagic) + 1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	if string(header[:len(SnapshotMagic)]) != SnapshotMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidSnapshot)
+	}
+	if header[len(SnapshotMagic)] != SnapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot,
+			header[len(SnapshotMagic)])
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	br := bufio.NewReader(zr)
+	if err := vm.restore(br); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	// reading until the end verifies the checksum of the gzip stream
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	return nil
+}
+
+// restore restores the machine state from the uncompressed snapshot.
+func (vm *VM) restore(r io.Reader) error {
+	var regs snapshotRegisters
+	if err := binary.Read(r, binary.LittleEndian, &regs); err != nil {
+		return err
+	}
+	vm.PC, vm.CI, vm.GPR, vm.SPR, vm.TLB = regs.PC, regs.CI, regs.GPR, regs.SPR, regs.TLB
+	vm.Paging = regs.Flags&snapshotFlagPaging != 0
+	mem := vm.Memory()
+	*mem = [MemorySize]uint16{}
+	for {
+		var run struct {
+			Addr  uint16
+			Count uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &run); err != nil {
+			return err
+		}
+		if run.Count == 0 {
+			break
+		}
+		if uint32(run.Addr)+run.Count > MemorySize {
+			return errors.New("memory run out of range")
+		}
+		end := uint32(run.Addr) + run.Count
+		if err := binary.Read(r, binary.LittleEndian, mem[run.Addr:end]); err != nil {
+			return err
+		}
+	}
+	var count uint16
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	for idx := uint16(0); idx < count; idx++ {
+		var dev struct {
+			Base   uint16
+			Length uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &dev); err != nil {
+			return err
+		}
+		if dev.Length > maxDeviceState {
+			return fmt.Errorf("state of device at %#04x is too large", dev.Base)
+		}
+		stateful, ok := vm.findDevice(dev.Base).(StatefulDevice)
+		if !ok || stateful.Base() != dev.Base {
+			return fmt.Errorf("no device with state at %#04x", dev.Base)
+		}
+		state := make([]byte, dev.Length)
+		if _, err := io.ReadFull(r, state); err != nil {
+			return err
+		}
+		if err := stateful.RestoreState(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for idx := 0; idx < 20; idx++ {
+		machine := randomMachine(rng)
+		machine.M[MemorySize-1] = 1 // a run ending at the end of the memory
+		machine.CI = uint16(rng.Intn(1 << 16))
+		var buf bytes.Buffer
+		if err := machine.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		restored := randomMachine(rng)
+		if err := restored.Restore(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := compare(restored, machine); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Paging != machine.Paging {
+			t.Fatalf("expected paging %v, got %v", machine.Paging, restored.Paging)
+		}
+		// the restored machine continues like the original
+		_, expected := verify(t, machine, 100)
+		_, got := verify(t, restored, 100)
+		if got != expected {
+			t.Fatalf("expected %d instructions, got %d", expected, got)
+		}
+	}
+}
+
+// latch is a StatefulDevice storing the last written word.
+type latch struct {
+	base  uint16
+	value uint16
+}
+
+// Base implements Device.Base.
+func (l *latch) Base() uint16 {
+	return l.base
+}
+
+// Size implements Device.Size.
+func (l *latch) Size() uint16 {
+	return 1
+}
+
+// Read implements Device.Read.
+func (l *latch) Read(offset uint16) uint16 {
+	return l.value
+}
+
+// Write implements Device.Write.
+func (l *latch) Write(offset uint16, value uint16) {
+	l.value = value
+}
+
+// SaveState implements StatefulDevice.SaveState.
+func (l *latch) SaveState() ([]byte, error) {
+	state := make([]byte, 2)
+	binary.LittleEndian.PutUint16(state, l.value)
+	return state, nil
+}
+
+// RestoreState implements StatefulDevice.RestoreState.
+func (l *latch) RestoreState(state []byte) error {
+	if len(state) != 2 {
+		return fmt.Errorf("latch state has size %d", len(state))
+	}
+	l.value = binary.LittleEndian.Uint16(state)
+	return nil
+}
+
+func TestSnapshotDevices(t *testing.T) {
+	machine := new(VM)
+	if err := machine.Attach(&latch{base: 100, value: 42}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := machine.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+	restored, dev := new(VM), &latch{base: 100}
+	if err := restored.Attach(dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	if dev.value != 42 {
+		t.Fatalf("expected 42, got %d", dev.value)
+	}
+	// the device must be attached at the same address
+	other := new(VM)
+	if err := other.Attach(&latch{base: 101}); err != nil {
+		t.Fatal(err)
+	}
+	for _, machine := range []*VM{new(VM), other} {
+		if err := machine.Restore(bytes.NewReader(snapshot)); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+		}
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := new(VM).Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("R16X"), snapshot[4:]...),
+		"version":   append([]byte(SnapshotMagic+"\x02"), snapshot[5:]...),
+		"gzip":      []byte(SnapshotMagic + "\x01garbage"),
+		"truncated": snapshot[:len(snapshot)-10],
+	} {
+		if err := new(VM).Restore(bytes.NewReader(data)); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Fatalf("%s: expected ErrInvalidSnapshot, got %v", name, err)
+		}
+	}
+}
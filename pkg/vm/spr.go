@@ -0,0 +1,115 @@
+package vm
+
+import "fmt"
+
+// NumSPRs is the number of special-purpose registers. The register number
+// is encoded in the four least significant bits of the immediate of a
+// `jalr r0 r0 imm` instruction whose exception type is MFSPR or MTSPR.
+// MFSPR copies the special-purpose register into r1, while MTSPR copies
+// r1 into the special-purpose register.
+const NumSPRs = 16
+
+// The following constants define the special-purpose registers.
+const (
+	// SPRCycles counts the executed instructions, including the one
+	// being executed, and wraps around on overflow.
+	SPRCycles = iota
+
+	// SPRCause contains the cause of the last exception.
+	SPRCause
+
+	// SPREPC contains the PC of the last exception.
+	SPREPC
+
+	// SPRIE is the interrupt enable register. When it is nonzero, the
+	// VM vectors to the exception handler before fetching the next
+	// instruction if there is a pending interrupt. The exception cause
+	// is ExceptionTypeEXCEPTION|ExceptionValueINTERRUPT and SPREPC
+	// contains the address of the interrupted instruction.
+	SPRIE
+
+	// SPRStatus is the status and mode register.
+	SPRStatus
+
+	// SPRScratch is a scratch register for exception handlers.
+	SPRScratch
+
+	// SPREVEC is the address of the exception handler. When it is
+	// zero, exceptions stop the VM rather than being vectored.
+	SPREVEC
+
+	// SPRTimer is the timer, which decrements after each instruction
+	// when it is nonzero. When it reaches zero, the timer raises the
+	// InterruptTimer interrupt and reloads itself from SPRReload.
+	SPRTimer
+
+	// SPRReload is the value loaded into SPRTimer when it expires. A
+	// zero value configures a one-shot timer.
+	SPRReload
+
+	// SPRPending contains the pending interrupt lines. Writing into
+	// this register clears the lines corresponding to the bits set in
+	// the written value, thus acknowledging them.
+	SPRPending
+
+	// SPRTLBIndex selects the TLB entry (see TLBEntry).
+	SPRTLBIndex
+
+	// SPRTLBHi contains the virtual page number of a TLB entry.
+	SPRTLBHi
+
+	// SPRTLBLo contains the physical page number and flags of a TLB entry.
+	SPRTLBLo
+
+	// SPRBadVAddr contains the address that caused the last memory fault.
+	SPRBadVAddr
+
+	// SPRCoreID contains the ID of the core executing the program, which
+	// is zero for a single VM (see pkg/multicore). Writes are ignored.
+	SPRCoreID
+)
+
+// SPRNames maps each special-purpose register to its name. Registers
+// without a name are referred to using their number.
+var SPRNames = [NumSPRs]string{
+	SPRCycles:   "cycles",
+	SPRCause:    "cause",
+	SPREPC:      "epc",
+	SPRIE:       "ie",
+	SPRStatus:   "status",
+	SPRScratch:  "scratch",
+	SPREVEC:     "evec",
+	SPRTimer:    "timer",
+	SPRReload:   "reload",
+	SPRPending:  "pending",
+	SPRTLBIndex: "tlbindex",
+	SPRTLBHi:    "tlbhi",
+	SPRTLBLo:    "tlblo",
+	SPRBadVAddr: "badvaddr",
+	SPRCoreID:   "coreid",
+}
+
+// SPRName returns the name of the given special-purpose register.
+func SPRName(num uint16) string {
+	num &= NumSPRs - 1
+	if SPRNames[num] != "" {
+		return SPRNames[num]
+	}
+	return fmt.Sprintf("%d", num)
+}
+
+// mtspr implements writing value into the special-purpose register num.
+func (vm *VM) mtspr(num, value uint16) {
+	switch num {
+	case SPRPending:
+		vm.SPR[SPRPending] &^= value
+	case SPRTLBIndex:
+		vm.selectTLBEntry(value)
+	case SPRTLBLo:
+		vm.storeTLBEntry(value)
+	case SPRCoreID:
+		// read only
+	default:
+		vm.SPR[num] = value
+	}
+}
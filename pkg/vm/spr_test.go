@@ -0,0 +1,57 @@
+package vm
+
+import "testing"
+
+func TestSPR(t *testing.T) {
+	machine := new(VM)
+	machine.GPR[1] = 42
+	machine.M[0] = OpcodeJALR<<13 | ExceptionTypeMTSPR | SPRScratch
+	machine.M[1] = OpcodeJALR<<13 | ExceptionTypeMFSPR | SPRCycles
+	machine.M[2] = OpcodeJALR<<13 | ExceptionTypeMFSPR | SPRScratch
+	for idx := 0; idx < 2; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the cycles include the instruction reading them
+	if machine.SPR[SPRScratch] != 42 || machine.GPR[1] != 2 {
+		t.Fatalf("expected scratch=42 and r1=2, got %d and %d", machine.SPR[SPRScratch], machine.GPR[1])
+	}
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[1] != 42 || machine.SPR[SPRCycles] != 3 {
+		t.Fatalf("expected r1=42 and 3 cycles, got %d and %d", machine.GPR[1], machine.SPR[SPRCycles])
+	}
+}
+
+func TestSPRCoreID(t *testing.T) {
+	machine := new(VM)
+	machine.SPR[SPRCoreID] = 3
+	machine.GPR[1] = 7
+	machine.M[0] = encodeTrap(ExceptionTypeMTSPR | SPRCoreID)
+	machine.M[1] = encodeTrap(ExceptionTypeMFSPR | SPRCoreID)
+	for idx := 0; idx < 2; idx++ {
+		if err := fetchExecute(machine); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the core ID is read only
+	if machine.SPR[SPRCoreID] != 3 || machine.GPR[1] != 3 {
+		t.Fatalf("expected coreid=3 and r1=3, got %d and %d", machine.SPR[SPRCoreID], machine.GPR[1])
+	}
+}
+
+func TestSPRName(t *testing.T) {
+	for num, expected := range map[uint16]string{
+		SPRCycles:        "cycles",
+		SPRCoreID:        "coreid",
+		SPRScratch:       "scratch",
+		NumSPRs + SPREPC: "epc",
+		NumSPRs - 1:      "15", // without a name
+	} {
+		if name := SPRName(num); name != expected {
+			t.Fatalf("expected %s, got %s", expected, name)
+		}
+	}
+}
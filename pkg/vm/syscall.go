@@ -0,0 +1,30 @@
+package vm
+
+// NumSyscalls is the number of available system calls. The system call
+// number is encoded in the four least significant bits of the immediate
+// of a `jalr r0 r0 imm` instruction whose exception type is SYSCALL.
+const NumSyscalls = 16
+
+// SyscallHandler is a Go function handling a system call. The handler
+// may read and modify the registers and the memory of vm. By convention,
+// the arguments are passed in r1, r2, and r3, and the result is returned
+// in r1. Returning an error stops the execution and causes Execute to
+// return the same error to its caller.
+type SyscallHandler func(vm *VM) error
+
+// RegisterSyscall registers the handler for the given system call number,
+// replacing any existing handler. Passing a nil handler unregisters the
+// system call, so that invoking it raises an exception. This function
+// panics if num is out of range.
+func (vm *VM) RegisterSyscall(num uint16, handler SyscallHandler) {
+	if num >= NumSyscalls {
+		panic("syscall number out of range")
+	}
+	vm.syscalls[num] = handler
+}
+
+// syscall dispatches the given system call. The caller is responsible
+// for raising an exception when there is no handler for num.
+func (vm *VM) syscall(num uint16) error {
+	return vm.syscalls[num&(NumSyscalls-1)](vm)
+}
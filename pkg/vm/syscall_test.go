@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSyscall(t *testing.T) {
+	machine := new(VM)
+	machine.RegisterSyscall(3, func(vm *VM) error {
+		vm.GPR[1] = vm.GPR[2] + vm.GPR[3]
+		return nil
+	})
+	machine.GPR[2], machine.GPR[3] = 5, 6
+	machine.M[0] = OpcodeJALR<<13 | ExceptionTypeSYSCALL | 3
+	machine.M[1] = OpcodeJALR<<13 | ExceptionTypeSYSCALL | 4
+	if err := fetchExecute(machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[1] != 11 || machine.PC != 1 {
+		t.Fatalf("expected r1=11 and PC=1, got r1=%d and PC=%d", machine.GPR[1], machine.PC)
+	}
+	// a system call without a handler raises an exception
+	var exc *ExceptionError
+	expected := ExceptionError{Cause: ExceptionTypeSYSCALL | 4, PC: 1}
+	if err := fetchExecute(machine); !errors.As(err, &exc) || *exc != expected {
+		t.Fatalf("expected %v, got %v", &expected, err)
+	}
+	failure := errors.New("mocked error")
+	machine.RegisterSyscall(4, func(vm *VM) error {
+		return failure
+	})
+	machine.PC = 1
+	if err := fetchExecute(machine); !errors.Is(err, failure) {
+		t.Fatalf("expected the mocked error, got %v", err)
+	}
+	machine.RegisterSyscall(4, nil)
+	machine.PC = 1
+	if err := fetchExecute(machine); !errors.Is(err, ErrException) {
+		t.Fatalf("expected an exception, got %v", err)
+	}
+}
+
+func TestRegisterSyscallOutOfRange(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	new(VM).RegisterSyscall(NumSyscalls, nil)
+}
@@ -45,21 +45,68 @@ const (
 	ExceptionValueTLBMISS
 	ExceptionValueSIGSEGV
 	ExceptionValueINVALID
+	ExceptionValueRFE
+	ExceptionValueINTERRUPT
 )
 
 // VM is a RiSC-16 virtual machine. The virtual machine is not
 // goroutine safe; a single goroutine should manage it.
 type VM struct {
-	CI  uint16               // current instruction
-	GPR [NumRegisters]uint16 // general purpose registers
-	M   [MemorySize]uint16   // memory
-	PC  uint16               // program counter
+	CI  uint16                  // current instruction
+	GPR [NumRegisters]uint16    // general purpose registers
+	M   [MemorySize]uint16      // memory, unless the VM shares another memory
+	PC  uint16                  // program counter
+	SPR [NumSPRs]uint16         // special-purpose registers
+	TLB [NumTLBEntries]TLBEntry // translation lookaside buffer
+
+	// Paging enables paged virtual memory in user mode. By default,
+	// the VM uses a flat physical memory. See TLBEntry for details.
+	Paging bool
+
+	// AccessHook, if not nil, is called for each memory access,
+	// including instruction fetches, for example to simulate caches.
+	AccessHook AccessHook
+
+	devices       []Device
+	icache        *icache
+	memory        *[MemorySize]uint16
+	observers     []Observer
+	stopRequested bool
+	syscalls      [NumSyscalls]SyscallHandler
+}
+
+// ShareMemory makes the VM use mem as its physical memory instead of M,
+// so that several VMs (e.g., the cores of a multi-core system) execute
+// using the same memory. Code that may run with a shared memory should
+// access the memory using Memory rather than M.
+func (vm *VM) ShareMemory(mem *[MemorySize]uint16) {
+	vm.memory = mem
+}
+
+// Memory returns the physical memory of the VM, which is M unless the
+// VM shares another memory (see ShareMemory). Writing the memory directly
+// bypasses the devices and the observers; use Store to notify them.
+func (vm *VM) Memory() *[MemorySize]uint16 {
+	if vm.memory != nil {
+		return vm.memory
+	}
+	return &vm.M
 }
 
 // Fetch fetches the next instruction, stores it in vm.CI, and increments
-// the vm.PC program counter of the virtual machine.
+// the vm.PC program counter of the virtual machine. If there is a pending
+// interrupt and interrupts are enabled, Fetch first vectors to the exception
+// handler and then fetches the handler's first instruction.
 func (vm *VM) Fetch() {
-	vm.CI = vm.M[vm.PC]
+	vm.maybeInterrupt()
+	addr, fault := vm.translate(vm.PC, TLBExec)
+	if fault != 0 {
+		// Let Execute raise the exception for this instruction
+		vm.CI = encodeTrap(fault)
+	} else {
+		vm.accessed(AccessFetch, addr)
+		vm.CI = vm.Memory()[addr]
+	}
 	vm.PC++
 }
 
@@ -76,8 +123,20 @@ var (
 
 // Execute executes the current instruction vm.CI. This function will always
 // clear vm.CI so that calling Execute again will execute a NOP. This function
-// returns an error when the processor has halted or a fault has occurred.
+// returns ErrHalted when the processor has halted and an *ExceptionError when
+// an exception has occurred. When the SPREVEC exception vector is set,
+// exceptions do not cause an error but rather a jump to the exception
+// handler (see SPREVEC for more details). When observers are registered,
+// this function notifies them (see Observer for more details).
 func (vm *VM) Execute() error {
+	if len(vm.observers) > 0 {
+		return vm.executeObserved()
+	}
+	return vm.execute()
+}
+
+// execute implements Execute.
+func (vm *VM) execute() error {
 	// decode instruction
 	opcode := (vm.CI >> 13)
 	ra := (vm.CI >> 10) & 0b0111
@@ -90,6 +149,8 @@ func (vm *VM) Execute() error {
 		vm.GPR[0] = 0
 		vm.CI = 0
 	}()
+	vm.SPR[SPRCycles]++
+	vm.tick()
 	// execute instruction
 	switch opcode {
 	case OpcodeADD:
@@ -101,28 +162,57 @@ func (vm *VM) Execute() error {
 	case OpcodeLUI:
 		vm.GPR[ra] = imm10 << 6
 	case OpcodeSW:
-		vm.M[vm.GPR[rb]+imm7] = vm.GPR[ra]
+		addr, fault := vm.translate(vm.GPR[rb]+imm7, TLBWrite)
+		if fault != 0 {
+			return vm.trap(fault, vm.PC-1)
+		}
+		vm.store(addr, vm.GPR[ra])
 	case OpcodeLW:
-		vm.GPR[ra] = vm.M[vm.GPR[rb]+imm7]
+		addr, fault := vm.translate(vm.GPR[rb]+imm7, TLBRead)
+		if fault != 0 {
+			return vm.trap(fault, vm.PC-1)
+		}
+		vm.GPR[ra] = vm.load(addr)
 	case OpcodeBEQ:
 		if vm.GPR[ra] == vm.GPR[rb] {
 			vm.PC += imm7
 		}
 	case OpcodeJALR:
 		if vm.GPR[ra] == 0 && vm.GPR[rb] == 0 {
-			switch imm7 & 0b_0000_0000_0111_1111 {
-			case ExceptionTypeEXCEPTION | ExceptionValueHALT:
-				return ErrHalted
-			default:
-				return fmt.Errorf("%w with ID %d", ErrException, imm7)
-			}
+			return vm.exceptionCode(imm7 & 0b_0000_0000_0111_1111)
 		}
-		vm.GPR[ra] = vm.PC
-		vm.PC = vm.GPR[rb]
+		// read rb before writing ra, since they may be the same register
+		vm.PC, vm.GPR[ra] = vm.GPR[rb], vm.PC
 	}
 	return nil
 }
 
+// exceptionCode executes `jalr r0 r0 code`, which is either an exception
+// or one of the operations encoded as exceptions (e.g., HALT).
+func (vm *VM) exceptionCode(code uint16) error {
+	switch {
+	case vm.isExceptionCode(code):
+		return vm.trap(code, vm.PC-1)
+	case isPrivileged(code) && vm.SPR[SPRStatus]&StatusUser != 0:
+		return vm.trap(ExceptionTypeEXCEPTION|ExceptionValueINVALID, vm.PC-1)
+	case code == ExceptionTypeEXCEPTION|ExceptionValueHALT:
+		return ErrHalted
+	case code == ExceptionTypeEXCEPTION|ExceptionValueRFE:
+		vm.rfe()
+		return nil
+	case code&0b111_0000 == ExceptionTypeSYSCALL:
+		return vm.syscall(code & 0b1111)
+	case code&0b111_0000 == ExceptionTypeMFSPR:
+		vm.GPR[1] = vm.SPR[code&0b1111]
+		return nil
+	case code&0b111_0000 == ExceptionTypeATOMIC:
+		return vm.atomic(code & 0b1111)
+	default: // ExceptionTypeMTSPR
+		vm.mtspr(code&0b1111, vm.GPR[1])
+		return nil
+	}
+}
+
 // SignExtend7 extends the sign to negative values over 7 bit.
 func SignExtend7(v uint16) uint16 {
 	if (v & 0b0000_0000_0100_0000) != 0 {
@@ -158,6 +248,24 @@ func Disassemble(instr uint16) string {
 	case OpcodeBEQ:
 		return fmt.Sprintf("beq r%d r%d %d", ra, rb, int16(imm7))
 	case OpcodeJALR:
+		if ra == 0 && rb == 0 {
+			switch code := imm7 & 0b_0000_0000_0111_1111; {
+			case code == ExceptionTypeEXCEPTION|ExceptionValueHALT:
+				return "halt"
+			case code == ExceptionTypeEXCEPTION|ExceptionValueRFE:
+				return "rfe"
+			case code&0b111_0000 == ExceptionTypeSYSCALL:
+				return fmt.Sprintf("syscall %d", code&0b1111)
+			case code&0b111_0000 == ExceptionTypeMFSPR:
+				return fmt.Sprintf("mfspr %s", SPRName(code))
+			case code&0b111_0000 == ExceptionTypeMTSPR:
+				return fmt.Sprintf("mtspr %s", SPRName(code))
+			case code == ExceptionTypeATOMIC|AtomicTAS:
+				return "tas"
+			case code == ExceptionTypeATOMIC|AtomicCAS:
+				return "cas"
+			}
+		}
 		return fmt.Sprintf("jalr r%d r%d %d", ra, rb, int16(imm7))
 	default:
 		return fmt.Sprintf("# unknown instruction: %d", instr)
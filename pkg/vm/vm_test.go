@@ -0,0 +1,51 @@
+package vm
+
+import "testing"
+
+// fetchExecute executes a single instruction using Fetch and Execute.
+func fetchExecute(machine *VM) error {
+	machine.Fetch()
+	return machine.Execute()
+}
+
+// runUntilHalted executes instructions until the machine halts,
+// failing the test on error or after n instructions.
+func runUntilHalted(t *testing.T, machine *VM, n int) {
+	for count := 0; count < n; count++ {
+		if err := fetchExecute(machine); err == ErrHalted {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatalf("the machine did not halt after %d instructions", n)
+}
+
+// jalrR1R1 is `jalr r1 r1`, whose link and target registers coincide.
+const jalrR1R1 = OpcodeJALR<<13 | 1<<10 | 1<<7
+
+func TestJALRSameRegister(t *testing.T) {
+	steps := map[string]func(machine *VM) error{
+		"Execute": fetchExecute,
+		"Step":    (*VM).Step,
+	}
+	for name, step := range steps {
+		t.Run(name, func(t *testing.T) {
+			machine := new(VM)
+			machine.PC = 10
+			machine.M[10] = jalrR1R1
+			machine.GPR[1] = 100
+			if err := step(machine); err != nil {
+				t.Fatal(err)
+			}
+			// the jump uses the old value of r1, which then contains
+			// the address of the instruction following the JALR
+			if machine.PC != 100 {
+				t.Fatalf("PC: expected 100, got %d", machine.PC)
+			}
+			if machine.GPR[1] != 11 {
+				t.Fatalf("r1: expected 11, got %d", machine.GPR[1])
+			}
+		})
+	}
+}
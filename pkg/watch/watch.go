@@ -0,0 +1,290 @@
+// Package watch implements data watchpoints for the RiSC-16 VM.
+//
+// A watchpoint triggers when an instruction reads or writes a range of
+// memory words, or changes a general purpose register, optionally only
+// when the read or written value satisfies a condition. A Set observes a
+// vm.VM and invokes a callback for each triggered watchpoint; to stop
+// the execution, the callback may call the VM's RequestStop method.
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+// Access is a bitmask of the accesses that trigger a watchpoint.
+type Access int
+
+// The following constants define the accesses.
+const (
+	Read = Access(1 << iota)
+	Write
+	ReadWrite = Read | Write
+)
+
+// String returns the name of the access.
+func (a Access) String() string {
+	switch a {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case ReadWrite:
+		return "read/write"
+	default:
+		return "none"
+	}
+}
+
+// Watchpoint is a data watchpoint.
+type Watchpoint struct {
+	// Register indicates that we're watching the general purpose
+	// register numbered Addr rather than the memory.
+	Register bool
+
+	// Addr is the first watched physical address or the register number.
+	Addr uint16
+
+	// Len is the number of watched memory words. Zero means one word.
+	Len uint16
+
+	// Access contains the accesses that trigger the watchpoint. When
+	// watching a register, the watchpoint triggers when its value changes.
+	Access Access
+
+	// Cond, if not nil, restricts the watchpoint to the accesses for
+	// which Cond returns true when passed the read or written value.
+	Cond func(value uint16) bool
+
+	// Spec is the textual description used by String.
+	Spec string
+}
+
+// String returns the textual description of the watchpoint.
+func (w *Watchpoint) String() string {
+	if w.Spec != "" {
+		return w.Spec
+	}
+	if w.Register {
+		return fmt.Sprintf("r%d", w.Addr)
+	}
+	return fmt.Sprintf("%d:%d:%s", w.Addr, w.length(), w.Access)
+}
+
+// length returns the number of watched memory words.
+func (w *Watchpoint) length() uint32 {
+	if w.Len == 0 {
+		return 1
+	}
+	return uint32(w.Len)
+}
+
+// matches returns true if the given memory access triggers w.
+func (w *Watchpoint) matches(access Access, addr, value uint16) bool {
+	return !w.Register && w.Access&access != 0 &&
+		addr >= w.Addr && uint32(addr-w.Addr) < w.length() &&
+		(w.Cond == nil || w.Cond(value))
+}
+
+// Hit describes a triggered watchpoint.
+type Hit struct {
+	Watchpoint *Watchpoint // the watchpoint
+	PC         uint16      // address of the instruction
+	Instr      uint16      // the instruction
+	Access     Access      // either Read or Write
+	Addr       uint16      // accessed address or register number
+	Old        uint16      // value before a write
+	Value      uint16      // read or written value
+}
+
+// String generates a string representation of the hit.
+func (h Hit) String() string {
+	where := fmt.Sprintf("M[%d]", h.Addr)
+	if h.Watchpoint.Register {
+		where = fmt.Sprintf("r%d", h.Addr)
+	}
+	instr := fmt.Sprintf("at %d (%s)", h.PC, vm.Disassemble(h.Instr))
+	if h.Access == Read {
+		return fmt.Sprintf("%s read %s: %d", where, instr, h.Value)
+	}
+	return fmt.Sprintf("%s written %s: %d -> %d", where, instr, h.Old, h.Value)
+}
+
+// Set is a set of watchpoints observing a vm.VM. A Set is not goroutine
+// safe; a single goroutine should manage it along with the VM.
+type Set struct {
+	// OnHit, if not nil, is called for each triggered watchpoint.
+	OnHit func(Hit)
+
+	instr       uint16
+	machine     *vm.VM
+	observer    *observer
+	pc          uint16
+	triggered   bool
+	watchpoints []*Watchpoint
+}
+
+// New creates a new, empty set of watchpoints for machine. The set only
+// observes the machine while it contains watchpoints.
+func New(machine *vm.VM, onHit func(Hit)) *Set {
+	s := &Set{OnHit: onHit, machine: machine}
+	s.observer = &observer{set: s}
+	return s
+}
+
+// Add adds a watchpoint to the set.
+func (s *Set) Add(w *Watchpoint) {
+	if len(s.watchpoints) == 0 {
+		s.machine.AddObserver(s.observer)
+	}
+	s.watchpoints = append(s.watchpoints, w)
+}
+
+// Remove removes a watchpoint from the set.
+func (s *Set) Remove(w *Watchpoint) {
+	for idx, other := range s.watchpoints {
+		if other == w {
+			s.watchpoints = append(s.watchpoints[:idx:idx], s.watchpoints[idx+1:]...)
+			if len(s.watchpoints) == 0 {
+				s.machine.RemoveObserver(s.observer)
+				s.triggered = false
+			}
+			return
+		}
+	}
+}
+
+// Watchpoints returns the watchpoints in the set.
+func (s *Set) Watchpoints() []*Watchpoint {
+	return s.watchpoints
+}
+
+// Triggered returns whether any watchpoint triggered while
+// executing the last instruction.
+func (s *Set) Triggered() bool {
+	return s.triggered
+}
+
+// hit records a triggered watchpoint.
+func (s *Set) hit(h Hit) {
+	s.triggered = true
+	h.PC, h.Instr = s.pc, s.instr
+	if s.OnHit != nil {
+		s.OnHit(h)
+	}
+}
+
+// observer is the vm.Observer registered by a Set.
+type observer struct {
+	vm.NopObserver
+	set *Set
+}
+
+// BeforeInstruction implements vm.Observer.BeforeInstruction.
+func (o *observer) BeforeInstruction(pc, instr uint16) {
+	o.set.pc, o.set.instr, o.set.triggered = pc, instr, false
+}
+
+// MemoryRead implements vm.Observer.MemoryRead.
+func (o *observer) MemoryRead(addr, value uint16) {
+	for _, w := range o.set.watchpoints {
+		if w.matches(Read, addr, value) {
+			o.set.hit(Hit{Watchpoint: w, Access: Read, Addr: addr, Value: value})
+		}
+	}
+}
+
+// MemoryWrite implements vm.Observer.MemoryWrite.
+func (o *observer) MemoryWrite(addr, old, value uint16) {
+	for _, w := range o.set.watchpoints {
+		if w.matches(Write, addr, value) {
+			o.set.hit(Hit{Watchpoint: w, Access: Write, Addr: addr, Old: old, Value: value})
+		}
+	}
+}
+
+// RegisterWrite implements vm.Observer.RegisterWrite.
+func (o *observer) RegisterWrite(reg, old, value uint16) {
+	for _, w := range o.set.watchpoints {
+		if w.Register && w.Addr == reg && (w.Cond == nil || w.Cond(value)) {
+			o.set.hit(Hit{Watchpoint: w, Access: Write, Addr: reg, Old: old, Value: value})
+		}
+	}
+}
+
+// ErrInvalidSpec indicates that a watchpoint specification is invalid.
+var ErrInvalidSpec = errors.New("watch: invalid watchpoint")
+
+// Parse parses a watchpoint specification. For memory, the syntax is
+// `LOC[:LEN][:r|w|rw][=VALUE]`, where LOC is an address or a label, LEN
+// defaults to one, and the access defaults to `w`. For registers, the
+// syntax is `rN[=VALUE]`. When `=VALUE` is present, the watchpoint only
+// triggers when the read or written value is VALUE. The labels function,
+// which may be nil, resolves labels to addresses.
+func Parse(spec string, labels func(name string) (uint16, bool)) (*Watchpoint, error) {
+	w := &Watchpoint{Access: Write, Spec: spec}
+	target := spec
+	if idx := strings.LastIndex(spec, "="); idx >= 0 {
+		expected, err := parseValue(spec[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidSpec, spec)
+		}
+		w.Cond = func(value uint16) bool {
+			return value == expected
+		}
+		target = spec[:idx]
+	}
+	v := strings.Split(target, ":")
+	if len(v[0]) == 2 && v[0][0] == 'r' && v[0][1] >= '0' && v[0][1] <= '7' {
+		if len(v) != 1 {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidSpec, spec)
+		}
+		w.Register, w.Addr = true, uint16(v[0][1]-'0')
+		return w, nil
+	}
+	if len(v) > 3 {
+		return nil, fmt.Errorf("%w: '%s'", ErrInvalidSpec, spec)
+	}
+	addr, err := strconv.ParseUint(v[0], 0, 16)
+	if err != nil {
+		var found bool
+		if labels == nil {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidSpec, spec)
+		}
+		if w.Addr, found = labels(v[0]); !found {
+			return nil, fmt.Errorf("%w: no such label in '%s'", ErrInvalidSpec, spec)
+		}
+	} else {
+		w.Addr = uint16(addr)
+	}
+	for _, field := range v[1:] {
+		switch field {
+		case "r":
+			w.Access = Read
+		case "w":
+			w.Access = Write
+		case "rw", "wr":
+			w.Access = ReadWrite
+		default:
+			length, err := strconv.ParseUint(field, 0, 16)
+			if err != nil || length < 1 {
+				return nil, fmt.Errorf("%w: '%s'", ErrInvalidSpec, spec)
+			}
+			w.Len = uint16(length)
+		}
+	}
+	return w, nil
+}
+
+// parseValue parses a value that may be negative.
+func parseValue(s string) (uint16, error) {
+	value, err := strconv.ParseInt(s, 0, 32)
+	if err != nil || value < -(1<<15) || value > (1<<16)-1 {
+		return 0, errors.New("value out of range")
+	}
+	return uint16(value), nil
+}
@@ -0,0 +1,153 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc16/pkg/asm"
+	"github.com/bassosimone/risc16/pkg/vm"
+)
+
+func TestParse(t *testing.T) {
+	labels := func(name string) (uint16, bool) {
+		return 100, name == "buf"
+	}
+	for _, tc := range []struct {
+		spec     string
+		expected Watchpoint
+		value    uint16 // a value satisfying the condition
+	}{
+		{spec: "10", expected: Watchpoint{Addr: 10, Access: Write}},
+		{spec: "0x10:4", expected: Watchpoint{Addr: 16, Len: 4, Access: Write}},
+		{spec: "buf:r", expected: Watchpoint{Addr: 100, Access: Read}},
+		{spec: "buf:rw:2", expected: Watchpoint{Addr: 100, Len: 2, Access: ReadWrite}},
+		{spec: "buf:wr=-1", expected: Watchpoint{Addr: 100, Access: ReadWrite}, value: 0xffff},
+		{spec: "r3", expected: Watchpoint{Register: true, Addr: 3, Access: Write}},
+		{spec: "r7=65535", expected: Watchpoint{Register: true, Addr: 7, Access: Write}, value: 0xffff},
+	} {
+		w, err := Parse(tc.spec, labels)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.spec, err)
+		}
+		if (w.Cond != nil) != strings.Contains(tc.spec, "=") ||
+			(w.Cond != nil && (!w.Cond(tc.value) || w.Cond(tc.value+1))) {
+			t.Fatalf("%s: unexpected condition", tc.spec)
+		}
+		tc.expected.Spec, w.Cond = tc.spec, nil
+		if !reflect.DeepEqual(*w, tc.expected) {
+			t.Fatalf("%s: expected %+v, got %+v", tc.spec, tc.expected, *w)
+		}
+	}
+	for _, spec := range []string{
+		"", "buf", "r8:1", "r1:4", "10:0", "10:x", "10:1:r:2", "10=", "10=65536", "10=-32769",
+	} {
+		if _, err := Parse(spec, nil); !errors.Is(err, ErrInvalidSpec) {
+			t.Fatalf("%s: expected ErrInvalidSpec, got %v", spec, err)
+		}
+	}
+	if _, err := Parse("missing", labels); !errors.Is(err, ErrInvalidSpec) {
+		t.Fatalf("expected ErrInvalidSpec, got %v", err)
+	}
+}
+
+// program stores 3, 2, 1 into buf, reading each value back into r2.
+const program = `	addi r1, r0, 3
+loop:	sw r1, r0, buf
+	lw r2, r0, buf
+	addi r1, r1, -1
+	beq r1, r0, done
+	beq r0, r0, loop
+done:	halt
+buf:	.fill 0
+`
+
+// load returns a machine containing the assembled program.
+func load(t *testing.T) *vm.VM {
+	machine := new(vm.VM)
+	var addr uint16
+	for instr := range asm.StartAssembler(strings.NewReader(program)) {
+		if instr.Error != nil {
+			t.Fatalf("line %d: %s", instr.Lineno, instr.Error)
+		}
+		machine.M[addr] = instr.Instruction
+		addr++
+	}
+	return machine
+}
+
+func TestSet(t *testing.T) {
+	machine := load(t)
+	var hits []string
+	s := New(machine, func(h Hit) {
+		hits = append(hits, h.String())
+	})
+	for _, spec := range []string{"7:rw=2", "r1=1", "8:2"} {
+		w, err := Parse(spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Add(w)
+	}
+	result := machine.Run(context.Background(), vm.RunOptions{})
+	if result.Reason != vm.StopHalted {
+		t.Fatalf("expected StopHalted, got %s", result.Reason)
+	}
+	expected := []string{
+		"M[7] written at 1 (sw r1 r0 7): 3 -> 2",
+		"M[7] read at 2 (lw r2 r0 7): 2",
+		"r1 written at 3 (addi r1 r1 -1): 2 -> 1",
+	}
+	if !reflect.DeepEqual(hits, expected) {
+		t.Fatalf("expected %q, got %q", expected, hits)
+	}
+	if len(s.Watchpoints()) != 3 || s.Triggered() {
+		t.Fatal("unexpected state after the last instruction")
+	}
+}
+
+func TestStop(t *testing.T) {
+	machine := load(t)
+	var hits []Hit
+	s := New(machine, func(h Hit) {
+		hits = append(hits, h)
+		machine.RequestStop()
+	})
+	w := &Watchpoint{Addr: 7, Access: Write}
+	s.Add(w)
+	result := machine.Run(context.Background(), vm.RunOptions{})
+	if result.Reason != vm.StopRequested || result.PC != 2 || !s.Triggered() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(hits) != 1 || hits[0] != (Hit{Watchpoint: w, PC: 1, Instr: machine.M[1],
+		Access: Write, Addr: 7, Old: 0, Value: 3}) {
+		t.Fatalf("unexpected hits %+v", hits)
+	}
+	// without watchpoints, the set stops observing the machine
+	s.Remove(w)
+	result = machine.Run(context.Background(), vm.RunOptions{})
+	if result.Reason != vm.StopHalted || len(hits) != 1 || s.Triggered() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, tc := range []struct {
+		w        *Watchpoint
+		expected string
+	}{
+		{&Watchpoint{Addr: 10, Access: Read}, "10:1:read"},
+		{&Watchpoint{Addr: 10, Len: 3, Access: ReadWrite}, "10:3:read/write"},
+		{&Watchpoint{Register: true, Addr: 2}, "r2"},
+		{&Watchpoint{Addr: 10, Spec: "buf"}, "buf"},
+	} {
+		if s := tc.w.String(); s != tc.expected {
+			t.Fatalf("expected %s, got %s", tc.expected, s)
+		}
+	}
+	if s := Access(0).String(); s != "none" {
+		t.Fatalf("expected none, got %s", s)
+	}
+}